@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"github.com/gorilla/mux"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// ユーザの権限
+const (
+	userRoleUser  = "user"
+	userRoleAdmin = "admin"
+)
+
+// -H "x-token:yyy"のトークンからユーザIDを取り出し、そのユーザが管理者であることを確認する
+// 管理者でなければエラーを返す
+func (c *Config) requireAdmin(r *http.Request) (string, error) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		return "", newAPIError(http.StatusBadRequest, err.Error())
+	}
+	var user User
+	// SELECT * FROM `users` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	if err := c.DB.Where("user_id = ?", userId).Find(&user).Error; err != nil {
+		return "", err
+	}
+	if user.Role != userRoleAdmin {
+		return "", newAPIError(http.StatusForbidden, "admin only.")
+	}
+	return userId, nil
+}
+
+// リクエストボディのJSONをvに読み込む
+func readRequestBody(r *http.Request, v interface{}) error {
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, err.Error())
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return newAPIError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+// URLの{id}を整数として読み込む
+func pathIntId(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, newAPIError(http.StatusBadRequest, "id is error.")
+	}
+	return id, nil
+}
@@ -0,0 +1,311 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// 管理者用APIで作成、更新するカタログの項目
+type catalogItem interface {
+	// 項目単体で値が正しいことを確認する
+	validate() error
+}
+
+// レアリティ名が空でなく、重み、grade、最大レベルが1以上で、HPupとレベルごとのHP、素材の経験値、限界突破の設定、売値が0以上であることを確認する
+// 重複の扱いを省略したときは"keep"にし、"shards"、"refund"ならかけらの数、払い戻す量が1以上であることを確認する
+func (rarity *Rarity) validate() error {
+	if rarity.RarityName == "" {
+		return newAPIError(http.StatusBadRequest, "rarity_name is error.")
+	}
+	if rarity.Weight == 0 {
+		return newAPIError(http.StatusBadRequest, "weight must be greater than 0.")
+	}
+	if rarity.Grade <= 0 {
+		return newAPIError(http.StatusBadRequest, "grade must be greater than 0.")
+	}
+	if rarity.HPup < 0 {
+		return newAPIError(http.StatusBadRequest, "HPup is error.")
+	}
+	if rarity.MaxLevel <= 0 {
+		return newAPIError(http.StatusBadRequest, "max_level must be greater than 0.")
+	}
+	if rarity.HPPerLevel < 0 {
+		return newAPIError(http.StatusBadRequest, "hp_per_level is error.")
+	}
+	if rarity.EnhanceExp < 0 {
+		return newAPIError(http.StatusBadRequest, "enhance_exp is error.")
+	}
+	if rarity.MaxLimitBreak < 0 || rarity.LimitBreakLevels < 0 || rarity.LimitBreakHP < 0 {
+		return newAPIError(http.StatusBadRequest, "limit break settings are error.")
+	}
+	if rarity.SellPrice < 0 || rarity.SellPricePerLevel < 0 {
+		return newAPIError(http.StatusBadRequest, "sell price is error.")
+	}
+	if rarity.DuplicatePolicy == "" {
+		rarity.DuplicatePolicy = duplicatePolicyKeep
+	}
+	switch rarity.DuplicatePolicy {
+	case duplicatePolicyKeep:
+	case duplicatePolicyShards:
+		if rarity.DuplicateShards <= 0 {
+			return newAPIError(http.StatusBadRequest, "duplicate_shards must be greater than 0.")
+		}
+	case duplicatePolicyRefund:
+		if rarity.DuplicateRefund <= 0 {
+			return newAPIError(http.StatusBadRequest, "duplicate_refund must be greater than 0.")
+		}
+	default:
+		return newAPIError(http.StatusBadRequest, "duplicate_policy is error.")
+	}
+	return nil
+}
+
+// キャラクター名が空でなく、HPが0以上であることを確認する
+func (character *CatalogCharacter) validate() error {
+	if character.CharacterName == "" {
+		return newAPIError(http.StatusBadRequest, "character_name is error.")
+	}
+	if character.HP < 0 {
+		return newAPIError(http.StatusBadRequest, "HP is error.")
+	}
+	return nil
+}
+
+// ガチャ名が空でなく、種類、天井、開催期間が正しいことを確認する
+// 種類を省略したときは"normal"にする
+func (gacha *Gacha) validate() error {
+	if gacha.GachaName == "" {
+		return newAPIError(http.StatusBadRequest, "gacha_name is error.")
+	}
+	if gacha.GachaType == "" {
+		gacha.GachaType = gachaTypeNormal
+	}
+	if gacha.GachaType != gachaTypeNormal && gacha.GachaType != gachaTypeBox && gacha.GachaType != gachaTypeStepUp {
+		return newAPIError(http.StatusBadRequest, "gacha_type is error.")
+	}
+	if gacha.HardPity < 0 || gacha.SoftPity < 0 {
+		return newAPIError(http.StatusBadRequest, "pity is error.")
+	}
+	if gacha.HardPity > 0 && gacha.SoftPity >= gacha.HardPity {
+		return newAPIError(http.StatusBadRequest, "soft_pity must be less than hard_pity.")
+	}
+	if gacha.StartAt != nil && gacha.EndAt != nil && !gacha.StartAt.Before(*gacha.EndAt) {
+		return newAPIError(http.StatusBadRequest, "start_at must be before end_at.")
+	}
+	return nil
+}
+
+// ピックアップ倍率を省略したときは1にする
+// gacha_id、character_id、rarity_idが存在するかはカタログ全体の検証で確認する
+func (gachaCharacter *GachaCharacter) validate() error {
+	if gachaCharacter.RateUp == 0 {
+		gachaCharacter.RateUp = 1
+	}
+	return nil
+}
+
+// localhost:8080/admin/raritiesでレアリティを作成
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"rarity_name":"SSR", "weight":1, "HPup":2000, "grade":4, "duplicate_policy":"shards", "duplicate_auto":true, "duplicate_shards":20, "max_level":90, "hp_per_level":40, "enhance_exp":500, "max_limit_break":4, "limit_break_levels":5, "limit_break_hp":200, "sell_price":10, "sell_price_per_level":2}でレアリティの設定を受け取る
+func (c *Config) CreateRarity(w http.ResponseWriter, r *http.Request) {
+	var rarity Rarity
+	c.saveCatalogItem(w, r, &rarity, "id", func() (string, interface{}, error) {
+		rarity.ID = 0
+		return "create rarity " + rarity.RarityName, nil, nil
+	})
+	//	{"versionID":4,"item":{"id":4,"rarity_name":"SSR","weight":1,"HPup":2000,"grade":4,"duplicate_policy":"shards","duplicate_auto":true,"duplicate_shards":20,"duplicate_refund":0,"max_level":90,"hp_per_level":40,"enhance_exp":500,"max_limit_break":4,"limit_break_levels":5,"limit_break_hp":200,"sell_price":10,"sell_price_per_level":2,"retired":false}}
+	//	が返る
+}
+
+// localhost:8080/admin/rarities/{id}でレアリティを更新
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"rarity_name":"SR", "weight":2, "HPup":1000, "grade":3, "duplicate_policy":"shards", "duplicate_auto":true, "duplicate_shards":10, "duplicate_refund":0, "max_level":80, "hp_per_level":30, "enhance_exp":300, "max_limit_break":4, "limit_break_levels":5, "limit_break_hp":100, "sell_price":5, "sell_price_per_level":1, "retired":false}で更新後のレアリティの設定を全て受け取る
+func (c *Config) UpdateRarity(w http.ResponseWriter, r *http.Request) {
+	var rarity Rarity
+	c.saveCatalogItem(w, r, &rarity, "id", func() (string, interface{}, error) {
+		id, err := pathIntId(r)
+		rarity.ID = id
+		return "update rarity " + strconv.Itoa(id), id, err
+	})
+}
+
+// localhost:8080/admin/rarities/{id}でレアリティをretiredにする
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+func (c *Config) RetireRarity(w http.ResponseWriter, r *http.Request) {
+	c.retireCatalogItem(w, r, &Rarity{}, "id", "rarity")
+}
+
+// localhost:8080/admin/charactersでキャラクターを作成
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"character_name":"Moon", "HP":1000}でキャラクターの設定を受け取る
+func (c *Config) CreateCharacter(w http.ResponseWriter, r *http.Request) {
+	var character CatalogCharacter
+	c.saveCatalogItem(w, r, &character, "id", func() (string, interface{}, error) {
+		character.ID = 0
+		return "create character " + character.CharacterName, nil, nil
+	})
+	//	{"versionID":5,"item":{"id":11,"character_name":"Moon","HP":1000,"retired":false}}
+	//	が返る
+}
+
+// localhost:8080/admin/characters/{id}でキャラクターを更新
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"character_name":"Moon", "HP":1200, "retired":false}で更新後のキャラクターの設定を全て受け取る
+func (c *Config) UpdateCharacter(w http.ResponseWriter, r *http.Request) {
+	var character CatalogCharacter
+	c.saveCatalogItem(w, r, &character, "id", func() (string, interface{}, error) {
+		id, err := pathIntId(r)
+		character.ID = id
+		return "update character " + strconv.Itoa(id), id, err
+	})
+}
+
+// localhost:8080/admin/characters/{id}でキャラクターをretiredにする
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+func (c *Config) RetireCharacter(w http.ResponseWriter, r *http.Request) {
+	c.retireCatalogItem(w, r, &CatalogCharacter{}, "id", "character")
+}
+
+// localhost:8080/admin/gachasでガチャを作成
+// キャラクターのいないガチャは検証で弾かれるので、"retired":trueで作成してキャラクターを追加してから公開する
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"gacha_name":"Gacha_D", "gacha_type":"normal", "hard_pity":90, "soft_pity":74, "soft_pity_weight_up":6, "pity_rarity_id":1, "retired":true}でガチャの設定を受け取る
+func (c *Config) CreateGacha(w http.ResponseWriter, r *http.Request) {
+	var gacha Gacha
+	c.saveCatalogItem(w, r, &gacha, "id", func() (string, interface{}, error) {
+		gacha.ID = 0
+		return "create gacha " + gacha.GachaName, nil, nil
+	})
+	//	{"versionID":6,"item":{"id":6,"gacha_name":"Gacha_D","gacha_type":"normal",...,"retired":true}}
+	//	が返る
+}
+
+// localhost:8080/admin/gachas/{id}でガチャを更新
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"gacha_name":"Gacha_D", ..., "retired":false}で更新後のガチャの設定を全て受け取る
+func (c *Config) UpdateGacha(w http.ResponseWriter, r *http.Request) {
+	var gacha Gacha
+	c.saveCatalogItem(w, r, &gacha, "id", func() (string, interface{}, error) {
+		id, err := pathIntId(r)
+		gacha.ID = id
+		return "update gacha " + strconv.Itoa(id), id, err
+	})
+}
+
+// localhost:8080/admin/gachas/{id}でガチャをretiredにする
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+func (c *Config) RetireGacha(w http.ResponseWriter, r *http.Request) {
+	c.retireCatalogItem(w, r, &Gacha{}, "id", "gacha")
+}
+
+// localhost:8080/admin/gacha_charactersでガチャにキャラクターを追加
+// HPはキャラクターのHPとレアリティのHPupから計算する
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"gacha_id":6, "character_id":11, "rarity_id":1, "rate_up":1}でガチャのキャラクターの設定を受け取る
+func (c *Config) CreateGachaCharacter(w http.ResponseWriter, r *http.Request) {
+	var gachaCharacter GachaCharacter
+	c.saveCatalogItem(w, r, &gachaCharacter, "gacha_character_id", func() (string, interface{}, error) {
+		gachaCharacterId, err := createUUId()
+		gachaCharacter.GachaCharacterID = gachaCharacterId
+		return "create gacha character " + gachaCharacterId, nil, err
+	})
+	//	{"versionID":7,"item":{"gacha_character_id":"1f0e...","gacha_id":6,"character_id":11,"rarity_id":1,"HP":0,"rate_up":1,...}}
+	//	が返る
+}
+
+// localhost:8080/admin/gacha_characters/{id}でガチャのキャラクターを更新
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"gacha_id":6, "character_id":11, "rarity_id":2, "rate_up":3, "box_count":0, "is_prize":false, "retired":false}で更新後の設定を全て受け取る
+func (c *Config) UpdateGachaCharacter(w http.ResponseWriter, r *http.Request) {
+	var gachaCharacter GachaCharacter
+	c.saveCatalogItem(w, r, &gachaCharacter, "gacha_character_id", func() (string, interface{}, error) {
+		id := mux.Vars(r)["id"]
+		gachaCharacter.GachaCharacterID = id
+		return "update gacha character " + id, id, nil
+	})
+}
+
+// localhost:8080/admin/gacha_characters/{id}でガチャのキャラクターをretiredにする
+// 既にそのキャラクターを持っているユーザのキャラクターはそのまま残る
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+func (c *Config) RetireGachaCharacter(w http.ResponseWriter, r *http.Request) {
+	c.retireCatalogItem(w, r, &GachaCharacter{}, "gacha_character_id", "gacha character")
+}
+
+// リクエストボディをitemに読み込み、カタログに保存してレスポンスを返す
+// columnはitemの主キーの列名
+// prepareはitemの主キーを設定し、変更の説明と、更新なら主キーの値(作成ならnil)を返す
+func (c *Config) saveCatalogItem(w http.ResponseWriter, r *http.Request, item catalogItem, column string, prepare func() (string, interface{}, error)) {
+	adminId, err := c.requireAdmin(r)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	if err := readRequestBody(r, item); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	description, id, err := prepare()
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	if err := item.validate(); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	versionId, err := c.applyCatalogChange(adminId, description, func(tx *gorm.DB) error {
+		if id == nil {
+			// INSERT INTO `rarities` (`rarity_name`,`weight`,`HPup`,`grade`,`retired`) VALUES ('SSR',1,2000,4,false)
+			return tx.Create(item).Error
+		}
+		var count int64
+		// SELECT count(*) FROM `rarities` WHERE id = 1
+		if err := tx.Model(item).Where(column+" = ?", id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return newAPIError(http.StatusNotFound, "id is not found.")
+		}
+		// UPDATE `rarities` SET `id`=1,`rarity_name`='SR',`weight`=2,`HPup`=1000,`grade`=3,`retired`=false WHERE `id` = 1
+		return tx.Model(item).Select("*").Updates(item).Error
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &CatalogChangeResponse{
+		VersionID: versionId,
+		Item:      item,
+	})
+}
+
+// URLの{id}の項目をretiredにしてレスポンスを返す
+// modelは項目の種類を表す空の構造体、columnはその主キーの列名、nameは変更の説明に使う項目の種類の名前
+func (c *Config) retireCatalogItem(w http.ResponseWriter, r *http.Request, model catalogItem, column string, name string) {
+	adminId, err := c.requireAdmin(r)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	versionId, err := c.applyCatalogChange(adminId, "retire "+name+" "+id, func(tx *gorm.DB) error {
+		// SELECT * FROM `rarities` WHERE id = '1' LIMIT 1
+		if err := tx.Where(column+" = ?", id).Take(model).Error; err != nil {
+			return newAPIError(http.StatusNotFound, name+" is not found.")
+		}
+		// UPDATE `rarities` SET `retired`=true WHERE `id` = 1
+		return tx.Model(model).Update("retired", true).Error
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &CatalogChangeResponse{
+		VersionID: versionId,
+		Item:      model,
+	})
+}
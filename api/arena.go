@@ -0,0 +1,843 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// アリーナに参加したときのレーティング
+const arenaInitialRating = 1500
+
+// レーティングの変動の大きさ(EloのK)
+const arenaRatingK = 32
+
+// 対戦相手に選べるレーティングの幅(自分のレーティングから上下いくつまでか)
+const arenaRatingBand = 200
+
+// getArenaOpponents関数で返す対戦相手の最大の数
+const maxArenaOpponents = 5
+
+// 1日(UTC)に挑戦できる回数
+const arenaDailyChallenges = 5
+
+// 対戦の記録のページングで1度に返す最大件数
+const maxArenaMatchesLimit = 50
+
+// アリーナの戦闘のターン数の上限(決着がつかなければ挑戦した側の負け)
+const arenaMaxTurns = 20
+
+// アリーナのシーズン
+// StartAt以降EndAt未満の間、挑戦できる
+// PaidOut: シーズンの報酬を払い終えたか
+type ArenaSeason struct {
+	ID         int       `json:"id"`
+	SeasonName string    `json:"season_name"`
+	StartAt    time.Time `json:"start_at"`
+	EndAt      time.Time `json:"end_at"`
+	PaidOut    bool      `json:"paid_out"`
+}
+
+// シーズンの順位ごとの報酬
+// 最終順位がMaxRank以下のユーザのうち、MaxRankが一番小さい報酬を受け取る
+type ArenaSeasonReward struct {
+	SeasonID int `json:"season_id" gorm:"primaryKey"`
+	MaxRank  int `json:"max_rank" gorm:"primaryKey"`
+	Gmtoken  int `json:"gmtoken"`
+}
+
+// シーズンごとのユーザのアリーナの成績
+// DefenseTeamNo: 他のユーザに挑戦されたときに戦うチームの番号
+// RewardGmtoken、RewardTxHash: 払ったシーズンの報酬と、その鋳造のトランザクションのハッシュ
+// RewardTxHashはコミットしてから鋳造できたときに書き込むので、鋳造できるまでは空になる
+type ArenaPlayer struct {
+	SeasonID      int       `json:"season_id" gorm:"primaryKey"`
+	UserID        string    `json:"user_id" gorm:"primaryKey"`
+	Rating        int       `json:"rating"`
+	Wins          int       `json:"wins"`
+	Losses        int       `json:"losses"`
+	DefenseTeamNo int       `json:"defense_team_no"`
+	RewardGmtoken int       `json:"reward_gmtoken"`
+	RewardTxHash  string    `json:"reward_tx_hash"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// アリーナの1回の対戦の記録
+// Result: 挑戦した側から見た結果(battleResultWin、battleResultLose)
+// AttackerRating、DefenderRating: 対戦前のレーティング。RatingChangeは挑戦した側の変動で、挑戦された側は符号が逆になる
+// Seed、Units、Log: battlesと同じく、戦闘を再現するためのシードとユニット、行動の記録
+type ArenaMatch struct {
+	MatchID        string    `json:"match_id" gorm:"primaryKey"`
+	SeasonID       int       `json:"season_id"`
+	AttackerID     string    `json:"attacker_id"`
+	DefenderID     string    `json:"defender_id"`
+	AttackerTeamNo int       `json:"attacker_team_no"`
+	DefenderTeamNo int       `json:"defender_team_no"`
+	AttackerPower  int       `json:"attacker_power"`
+	DefenderPower  int       `json:"defender_power"`
+	AttackerRating int       `json:"attacker_rating"`
+	DefenderRating int       `json:"defender_rating"`
+	RatingChange   int       `json:"rating_change"`
+	Seed           int64     `json:"seed"`
+	Result         string    `json:"result"`
+	Turns          int       `json:"turns"`
+	Units          string    `json:"units"`
+	Log            string    `json:"log"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// 防衛チームを設定するときに受け取る
+type SettingArenaDefense struct {
+	TeamNo int `json:"team_no"`
+}
+
+// 挑戦するときに受け取る
+// OpponentID: 挑戦する相手のuser_id
+type ChallengingArena struct {
+	OpponentID string `json:"opponent_id"`
+	TeamNo     int    `json:"team_no"`
+}
+
+// シーズンを作成するときに受け取る
+type CreatingArenaSeason struct {
+	SeasonName string              `json:"season_name"`
+	StartAt    time.Time           `json:"start_at"`
+	EndAt      time.Time           `json:"end_at"`
+	Rewards    []ArenaSeasonReward `json:"rewards"`
+}
+
+// アリーナの成績
+type ArenaPlayerResponse struct {
+	SeasonID            int `json:"seasonID"`
+	Rating              int `json:"rating"`
+	Wins                int `json:"wins"`
+	Losses              int `json:"losses"`
+	DefenseTeamNo       int `json:"defenseTeamNo"`
+	RemainingChallenges int `json:"remainingChallenges"`
+}
+
+// getArenaOpponents関数で返される対戦相手
+// Powerは防衛チームのチーム戦力
+type ArenaOpponentResponse struct {
+	UserID  string               `json:"userID"`
+	Name    string               `json:"name"`
+	Rating  int                  `json:"rating"`
+	Wins    int                  `json:"wins"`
+	Losses  int                  `json:"losses"`
+	Power   int                  `json:"power"`
+	Members []TeamMemberResponse `json:"members"`
+}
+
+// getArenaOpponents関数で返される
+type ArenaOpponentsResponse struct {
+	Player    ArenaPlayerResponse     `json:"player"`
+	Opponents []ArenaOpponentResponse `json:"opponents"`
+}
+
+// challengeArena関数で返される
+type ArenaChallengeResponse struct {
+	Match  ArenaMatchResponse  `json:"match"`
+	Player ArenaPlayerResponse `json:"player"`
+}
+
+// アリーナの対戦の記録
+// Attackedは自分が挑戦した側か、RatingChangeは自分のレーティングの変動
+type ArenaMatchResponse struct {
+	MatchID        string           `json:"matchID"`
+	SeasonID       int              `json:"seasonID"`
+	Attacked       bool             `json:"attacked"`
+	AttackerID     string           `json:"attackerID"`
+	DefenderID     string           `json:"defenderID"`
+	AttackerPower  int              `json:"attackerPower"`
+	DefenderPower  int              `json:"defenderPower"`
+	AttackerRating int              `json:"attackerRating"`
+	DefenderRating int              `json:"defenderRating"`
+	RatingChange   int              `json:"ratingChange"`
+	Result         string           `json:"result"`
+	Turns          int              `json:"turns"`
+	Seed           int64            `json:"seed"`
+	Units          []battleUnit     `json:"units,omitempty"`
+	Log            []BattleLogEntry `json:"log,omitempty"`
+	CreatedAt      time.Time        `json:"createdAt"`
+}
+
+// getArenaMatches関数で返される
+type ArenaMatchesResponse struct {
+	Total   int64                `json:"total"`
+	Offset  int                  `json:"offset"`
+	Limit   int                  `json:"limit"`
+	Matches []ArenaMatchResponse `json:"matches"`
+}
+
+// payArenaSeason関数で返される、報酬を受け取ったユーザ1人分
+type ArenaPayoutResponse struct {
+	UserID  string `json:"userID"`
+	Rank    int    `json:"rank"`
+	Rating  int    `json:"rating"`
+	Gmtoken int    `json:"gmtoken"`
+	TxHash  string `json:"txHash"`
+}
+
+// payArenaSeason関数で返される
+type ArenaSeasonPayoutResponse struct {
+	SeasonID int                   `json:"seasonID"`
+	Paid     int                   `json:"paid"`
+	Gmtoken  int                   `json:"gmtoken"`
+	Payouts  []ArenaPayoutResponse `json:"payouts"`
+}
+
+// localhost:8080/arena/defenseで今のシーズンの防衛チームを設定する
+// まだ今のシーズンに参加していなければ、レーティングarenaInitialRatingで参加する
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"team_no":1}で防衛チームにするチームの番号を受け取る
+func (c *Config) SetArenaDefense(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var setting SettingArenaDefense
+	if err := readRequestBody(r, &setting); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	season, err := c.getCurrentArenaSeason(time.Now())
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	teams, err := c.getTeams(userId, setting.TeamNo)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if setting.TeamNo <= 0 || len(teams) == 0 || len(teams[0].Members) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "team_no is error.")
+		return
+	}
+	player := ArenaPlayer{SeasonID: season.ID, UserID: userId, Rating: arenaInitialRating, DefenseTeamNo: setting.TeamNo, UpdatedAt: time.Now()}
+	//	INSERT INTO `arena_players` (`season_id`,`user_id`,`rating`,`wins`,`losses`,`defense_team_no`,`reward_gmtoken`,`reward_tx_hash`,`updated_at`)
+	//	VALUES (1,'95daec2b-287c-4358-ba6f-5c29e1c3cbdf',1500,0,0,1,0,'','2021-09-10 12:00:00')
+	//	ON DUPLICATE KEY UPDATE `defense_team_no`=VALUES(`defense_team_no`),`updated_at`=VALUES(`updated_at`)
+	err = c.DB.Clauses(clause.OnConflict{DoUpdates: clause.AssignmentColumns([]string{"defense_team_no", "updated_at"})}).Create(&player).Error
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	response, err := c.arenaPlayerResponse(c.DB, season.ID, userId, time.Now())
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &response)
+	// {"seasonID":1,"rating":1500,"wins":0,"losses":0,"defenseTeamNo":1,"remainingChallenges":5}が返る
+}
+
+// localhost:8080/arena/opponentsで今のシーズンの自分の成績と、挑戦できる対戦相手を取得
+// 対戦相手はレーティングが自分から上下arenaRatingBand以内の、防衛チームを設定したユーザから、レーティングが近い順にmaxArenaOpponents人
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetArenaOpponents(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	season, err := c.getCurrentArenaSeason(now)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	player, err := c.arenaPlayerResponse(c.DB, season.ID, userId, now)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	var players []ArenaPlayer
+	//	SELECT * FROM `arena_players`
+	//	WHERE season_id = 1 AND user_id <> '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND rating BETWEEN 1300 AND 1700
+	//	ORDER BY ABS(rating - 1500), user_id LIMIT 5
+	err = c.DB.Where("season_id = ? AND user_id <> ? AND rating BETWEEN ? AND ?", season.ID, userId, player.Rating-arenaRatingBand, player.Rating+arenaRatingBand).
+		Order(clause.Expr{SQL: "ABS(rating - ?), user_id", Vars: []interface{}{player.Rating}}).
+		Limit(maxArenaOpponents).Find(&players).Error
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	opponents := make([]ArenaOpponentResponse, 0, len(players))
+	for _, v := range players {
+		opponent, err := c.arenaOpponentResponse(v)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// 防衛チームを空にしたユーザには挑戦できない
+		if len(opponent.Members) == 0 {
+			continue
+		}
+		opponents = append(opponents, opponent)
+	}
+	RespondWithJSON(w, http.StatusOK, &ArenaOpponentsResponse{
+		Player:    player,
+		Opponents: opponents,
+	})
+	//	{"player":{"seasonID":1,"rating":1500,"wins":3,"losses":1,"defenseTeamNo":1,"remainingChallenges":2},
+	//	"opponents":[
+	//		{"userID":"ba4bfb95-...","name":"bob","rating":1520,"wins":5,"losses":4,"power":9350,"members":[{"slot":1,"userCharacterID":"02091c4d-...","name":"Mercury",...},...]},
+	//		...
+	//	]}
+	//	が返る
+}
+
+// localhost:8080/arena/challengeで他のユーザの防衛チームに挑戦する
+// 戦闘はbattle/startと同じくサーバーで乱数のシードを決めて行い、結果に応じて両者のレーティングを変える
+// 挑戦は1日arenaDailyChallenges回まで
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"opponent_id":"ba4bfb95-...", "team_no":1}で挑戦する相手と、戦うチームを受け取る
+func (c *Config) ChallengeArena(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var challenging ChallengingArena
+	if err := readRequestBody(r, &challenging); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	if challenging.OpponentID == "" || challenging.OpponentID == userId {
+		RespondWithError(w, http.StatusBadRequest, "opponent_id is error.")
+		return
+	}
+	now := time.Now()
+	season, err := c.getCurrentArenaSeason(now)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	teams, err := c.getTeams(userId, challenging.TeamNo)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if challenging.TeamNo <= 0 || len(teams) == 0 || len(teams[0].Members) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "team_no is error.")
+		return
+	}
+	team := teams[0]
+	var response ArenaChallengeResponse
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		attacker, defender, err := lockArenaPlayers(tx, season.ID, userId, challenging.OpponentID)
+		if err != nil {
+			return err
+		}
+		if attacker.UserID == "" {
+			return newAPIError(http.StatusBadRequest, "set arena defense team first.")
+		}
+		if defender.UserID == "" || math.Abs(float64(defender.Rating-attacker.Rating)) > arenaRatingBand {
+			return newAPIError(http.StatusBadRequest, "opponent_id is error.")
+		}
+		// 挑戦者の行をロックしているので、同時に挑戦しても回数を超えない
+		challenges, err := countArenaChallenges(tx, season.ID, userId, now)
+		if err != nil {
+			return err
+		}
+		if challenges >= arenaDailyChallenges {
+			return newAPIError(http.StatusBadRequest, "no arena challenges left today.")
+		}
+		defenseTeams, err := c.getTeams(defender.UserID, defender.DefenseTeamNo)
+		if err != nil {
+			return err
+		}
+		if len(defenseTeams) == 0 || len(defenseTeams[0].Members) == 0 {
+			return newAPIError(http.StatusBadRequest, "opponent has no defense team.")
+		}
+		match, err := newArenaMatch(season.ID, attacker, defender, team, defenseTeams[0], now)
+		if err != nil {
+			return err
+		}
+		attacker.Rating += match.RatingChange
+		defender.Rating -= match.RatingChange
+		if match.Result == battleResultWin {
+			attacker.Wins += 1
+			defender.Losses += 1
+		} else {
+			attacker.Losses += 1
+			defender.Wins += 1
+		}
+		for _, v := range []ArenaPlayer{attacker, defender} {
+			// UPDATE `arena_players` SET `rating`=1516,`wins`=4,`losses`=1,`updated_at`='2021-09-10 12:00:00' WHERE season_id = 1 AND user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+			err := tx.Model(&ArenaPlayer{}).Where("season_id = ? AND user_id = ?", season.ID, v.UserID).
+				Updates(map[string]interface{}{"rating": v.Rating, "wins": v.Wins, "losses": v.Losses, "updated_at": now}).Error
+			if err != nil {
+				return err
+			}
+		}
+		//	INSERT INTO `arena_matches` (`match_id`,`season_id`,`attacker_id`,`defender_id`,`attacker_team_no`,`defender_team_no`,`attacker_power`,`defender_power`,
+		//	`attacker_rating`,`defender_rating`,`rating_change`,`seed`,`result`,`turns`,`units`,`log`,`created_at`)
+		//	VALUES ('8c0e...',1,'95daec2b-...','ba4bfb95-...',1,2,9350,8800,1500,1520,16,8231470917,'win',5,'[...]','[...]','2021-09-10 12:00:00')
+		if err := tx.Create(&match).Error; err != nil {
+			return err
+		}
+		response.Match = match.response(userId, true)
+		response.Player, err = c.arenaPlayerResponse(tx, season.ID, userId, now)
+		return err
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &response)
+	//	{"match":{"matchID":"8c0e...","seasonID":1,"attacked":true,"attackerID":"95daec2b-...","defenderID":"ba4bfb95-...","attackerPower":9350,"defenderPower":8800,
+	//	 "attackerRating":1500,"defenderRating":1520,"ratingChange":16,"result":"win","turns":5,"seed":8231470917,
+	//	 "units":[...],"log":[...],"createdAt":"2021-09-10T12:00:00Z"},
+	//	"player":{"seasonID":1,"rating":1516,"wins":4,"losses":1,"defenseTeamNo":1,"remainingChallenges":1}}
+	//	が返る
+}
+
+// localhost:8080/arena/matchesで自分が挑戦した、または挑戦された対戦の記録を新しい順に取得
+// season_idを指定しなければ今のシーズンの記録を返す
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// ?season_id=1&offset=0&limit=20でシーズンとページを受け取る
+func (c *Config) GetArenaMatches(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, limit, err := parseOffsetLimit(r, 20, maxArenaMatchesLimit)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	var seasonId int
+	if v := r.URL.Query().Get("season_id"); v != "" {
+		seasonId, err = strconv.Atoi(v)
+		if err != nil || seasonId <= 0 {
+			RespondWithError(w, http.StatusBadRequest, "season_id is error.")
+			return
+		}
+	} else {
+		season, err := c.getCurrentArenaSeason(time.Now())
+		if err != nil {
+			respondWithAPIError(w, err)
+			return
+		}
+		seasonId = season.ID
+	}
+	query := c.DB.Model(&ArenaMatch{}).Where("season_id = ? AND (attacker_id = ? OR defender_id = ?)", seasonId, userId, userId)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var matches []ArenaMatch
+	//	SELECT * FROM `arena_matches`
+	//	WHERE season_id = 1 AND (attacker_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' OR defender_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf')
+	//	ORDER BY created_at DESC, match_id LIMIT 20 OFFSET 0
+	if err := query.Order("created_at DESC, match_id").Offset(offset).Limit(limit).Find(&matches).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	matchList := make([]ArenaMatchResponse, 0, len(matches))
+	for _, v := range matches {
+		matchList = append(matchList, v.response(userId, false))
+	}
+	RespondWithJSON(w, http.StatusOK, &ArenaMatchesResponse{
+		Total:   total,
+		Offset:  offset,
+		Limit:   limit,
+		Matches: matchList,
+	})
+	//	{"total":2,"offset":0,"limit":20,"matches":[
+	//		{"matchID":"d21f...","seasonID":1,"attacked":false,"attackerID":"ba4bfb95-...","defenderID":"95daec2b-...",...,"ratingChange":-14,"result":"lose",...},
+	//		{"matchID":"8c0e...","seasonID":1,"attacked":true,"attackerID":"95daec2b-...","defenderID":"ba4bfb95-...",...,"ratingChange":16,"result":"win",...}
+	//	]}
+	//	が返る
+}
+
+// localhost:8080/admin/arena/seasonsでアリーナのシーズンを作成する
+// 他のシーズンと期間が重なるシーズンは作成できない
+// -H "x-token:yyy"で管理者のトークン情報を受け取り、認証
+// -d {"season_name":"Season 2", "start_at":"2021-10-01T00:00:00Z", "end_at":"2021-11-01T00:00:00Z", "rewards":[{"max_rank":1,"gmtoken":100},{"max_rank":10,"gmtoken":30}]}でシーズンを受け取る
+func (c *Config) CreateArenaSeason(w http.ResponseWriter, r *http.Request) {
+	if _, err := c.requireAdmin(r); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	var creating CreatingArenaSeason
+	if err := readRequestBody(r, &creating); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	if err := creating.validate(); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	season := ArenaSeason{SeasonName: creating.SeasonName, StartAt: creating.StartAt, EndAt: creating.EndAt}
+	err := c.DB.Transaction(func(tx *gorm.DB) error {
+		var overlaps []ArenaSeason
+		// SELECT * FROM `arena_seasons` WHERE start_at < '2021-11-01 00:00:00' AND end_at > '2021-10-01 00:00:00' LIMIT 1 FOR UPDATE
+		err := tx.Where("start_at < ? AND end_at > ?", season.EndAt, season.StartAt).Limit(1).
+			Clauses(clause.Locking{Strength: "UPDATE"}).Find(&overlaps).Error
+		if err != nil {
+			return err
+		}
+		if len(overlaps) != 0 {
+			return newAPIError(http.StatusBadRequest, "season overlaps "+overlaps[0].SeasonName+".")
+		}
+		// INSERT INTO `arena_seasons` (`season_name`,`start_at`,`end_at`,`paid_out`) VALUES ('Season 2','2021-10-01 00:00:00','2021-11-01 00:00:00',false)
+		if err := tx.Create(&season).Error; err != nil {
+			return err
+		}
+		for i := range creating.Rewards {
+			creating.Rewards[i].SeasonID = season.ID
+		}
+		// INSERT INTO `arena_season_rewards` (`season_id`,`max_rank`,`gmtoken`) VALUES (2,1,100),(2,10,30)
+		return tx.Create(&creating.Rewards).Error
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &season)
+	// {"id":2,"season_name":"Season 2","start_at":"2021-10-01T00:00:00Z","end_at":"2021-11-01T00:00:00Z","paid_out":false}が返る
+}
+
+// localhost:8080/admin/arena/seasons/{id}/payoutで終わったシーズンの報酬を、最終順位に応じてゲームトークンで払う
+// 順位はレーティング、勝った回数の高い順で、1回も対戦していないユーザには払わない
+// シーズンの行をロックして、全員の報酬の鋳造の予約と払い終えた印を1つのトランザクションで記録し、
+// コミットしてからユーザごとに鋳造する。鋳造に失敗したユーザには後でやり直す
+// -H "x-token:yyy"で管理者のトークン情報を受け取り、認証
+func (c *Config) PayArenaSeason(w http.ResponseWriter, r *http.Request) {
+	if _, err := c.requireAdmin(r); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	seasonId, err := pathIntId(r)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	response := ArenaSeasonPayoutResponse{SeasonID: seasonId, Payouts: make([]ArenaPayoutResponse, 0)}
+	// response.Payoutsと同じ順に、予約した鋳造のtransfer_id
+	var transferIds []string
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		var season ArenaSeason
+		// SELECT * FROM `arena_seasons` WHERE id = 1 FOR UPDATE
+		if err := tx.Where("id = ?", seasonId).Clauses(clause.Locking{Strength: "UPDATE"}).Find(&season).Error; err != nil {
+			return err
+		}
+		if season.ID == 0 {
+			return newAPIError(http.StatusNotFound, "season is not found.")
+		}
+		if time.Now().Before(season.EndAt) {
+			return newAPIError(http.StatusBadRequest, "season is not over.")
+		}
+		if season.PaidOut {
+			return newAPIError(http.StatusBadRequest, "season is already paid out.")
+		}
+		var rewards []ArenaSeasonReward
+		// SELECT * FROM `arena_season_rewards` WHERE season_id = 1 ORDER BY max_rank
+		if err := tx.Where("season_id = ?", seasonId).Order("max_rank").Find(&rewards).Error; err != nil {
+			return err
+		}
+		var players []ArenaPlayer
+		// SELECT * FROM `arena_players` WHERE season_id = 1 AND wins + losses > 0 ORDER BY rating DESC, wins DESC, user_id
+		if err := tx.Where("season_id = ? AND wins + losses > 0", seasonId).Order("rating DESC, wins DESC, user_id").Find(&players).Error; err != nil {
+			return err
+		}
+		for i, v := range players {
+			rank := i + 1
+			gmtoken := arenaRankReward(rewards, rank)
+			if gmtoken == 0 {
+				break
+			}
+			payout, transferId, err := reserveArenaPayout(tx, v, gmtoken)
+			if err != nil {
+				return err
+			}
+			transferIds = append(transferIds, transferId)
+			payout.Rank = rank
+			payout.Rating = v.Rating
+			response.Paid += 1
+			response.Gmtoken += payout.Gmtoken
+			response.Payouts = append(response.Payouts, payout)
+		}
+		// UPDATE `arena_seasons` SET `paid_out`=true WHERE id = 1
+		return tx.Model(&ArenaSeason{}).Where("id = ?", seasonId).Update("paid_out", true).Error
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	// 報酬の記録は済んでいるので、鋳造に失敗したユーザはtxHashを空のまま返し、後でやり直す
+	for i, transferId := range transferIds {
+		txHash, err := c.sendGmtokenTransfer(transferId)
+		if err != nil {
+			log.Println("gmtoken transfer", transferId, "failed:", err)
+		}
+		response.Payouts[i].TxHash = txHash
+	}
+	RespondWithJSON(w, http.StatusOK, &response)
+	//	{"seasonID":1,"paid":2,"gmtoken":130,"payouts":[
+	//		{"userID":"ba4bfb95-...","rank":1,"rating":1720,"gmtoken":100,"txHash":"0x5a7e..."},
+	//		{"userID":"95daec2b-...","rank":2,"rating":1610,"gmtoken":30,"txHash":"0xf98c..."}
+	//	]}
+	//	が返る
+}
+
+// シーズンの作成に受け取った値を確認する
+func (creating *CreatingArenaSeason) validate() error {
+	if creating.SeasonName == "" {
+		return newAPIError(http.StatusBadRequest, "season_name is error.")
+	}
+	if !creating.StartAt.Before(creating.EndAt) {
+		return newAPIError(http.StatusBadRequest, "start_at must be before end_at.")
+	}
+	if len(creating.Rewards) == 0 {
+		return newAPIError(http.StatusBadRequest, "rewards is error.")
+	}
+	ranks := make(map[int]bool, len(creating.Rewards))
+	for _, v := range creating.Rewards {
+		if v.MaxRank <= 0 || v.Gmtoken <= 0 || ranks[v.MaxRank] {
+			return newAPIError(http.StatusBadRequest, "rewards is error.")
+		}
+		ranks[v.MaxRank] = true
+	}
+	return nil
+}
+
+// dbから引数nowの時点で開いているシーズンを取得
+// 開いているシーズンがなければエラーを返す
+func (c *Config) getCurrentArenaSeason(now time.Time) (ArenaSeason, error) {
+	var seasons []ArenaSeason
+	// SELECT * FROM `arena_seasons` WHERE start_at <= '2021-09-10 12:00:00' AND end_at > '2021-09-10 12:00:00' ORDER BY start_at DESC LIMIT 1
+	if err := c.DB.Where("start_at <= ? AND end_at > ?", now, now).Order("start_at DESC").Limit(1).Find(&seasons).Error; err != nil {
+		return ArenaSeason{}, err
+	}
+	if len(seasons) == 0 {
+		return ArenaSeason{}, newAPIError(http.StatusBadRequest, "arena season is not open.")
+	}
+	return seasons[0], nil
+}
+
+// db(またはトランザクション)から、シーズンのユーザの成績を今日の残りの挑戦回数付きで取得
+// まだシーズンに参加していなければ、初期のレーティングで返す
+func (c *Config) arenaPlayerResponse(db *gorm.DB, seasonId int, userId string, now time.Time) (ArenaPlayerResponse, error) {
+	var players []ArenaPlayer
+	// SELECT * FROM `arena_players` WHERE season_id = 1 AND user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	if err := db.Where("season_id = ? AND user_id = ?", seasonId, userId).Find(&players).Error; err != nil {
+		return ArenaPlayerResponse{}, err
+	}
+	player := ArenaPlayer{SeasonID: seasonId, Rating: arenaInitialRating}
+	if len(players) != 0 {
+		player = players[0]
+	}
+	challenges, err := countArenaChallenges(db, seasonId, userId, now)
+	if err != nil {
+		return ArenaPlayerResponse{}, err
+	}
+	remaining := arenaDailyChallenges - challenges
+	if remaining < 0 {
+		remaining = 0
+	}
+	return ArenaPlayerResponse{
+		SeasonID:            seasonId,
+		Rating:              player.Rating,
+		Wins:                player.Wins,
+		Losses:              player.Losses,
+		DefenseTeamNo:       player.DefenseTeamNo,
+		RemainingChallenges: remaining,
+	}, nil
+}
+
+// 対戦相手の成績を、名前と防衛チーム付きでレスポンスの形にする
+func (c *Config) arenaOpponentResponse(player ArenaPlayer) (ArenaOpponentResponse, error) {
+	var user User
+	// SELECT * FROM `users` WHERE user_id = 'ba4bfb95-...'
+	if err := c.DB.Where("user_id = ?", player.UserID).Find(&user).Error; err != nil {
+		return ArenaOpponentResponse{}, err
+	}
+	teams, err := c.getTeams(player.UserID, player.DefenseTeamNo)
+	if err != nil {
+		return ArenaOpponentResponse{}, err
+	}
+	opponent := ArenaOpponentResponse{
+		UserID:  player.UserID,
+		Name:    user.Name,
+		Rating:  player.Rating,
+		Wins:    player.Wins,
+		Losses:  player.Losses,
+		Members: make([]TeamMemberResponse, 0),
+	}
+	if len(teams) != 0 {
+		opponent.Power = teams[0].Power
+		opponent.Members = teams[0].Members
+	}
+	return opponent, nil
+}
+
+// トランザクションtxの中で、挑戦する側とされる側のシーズンの成績を行をロックして取得
+// デッドロックしないようにuser_idの順にロックする。シーズンに参加していない方はUserIDが空で返る
+func lockArenaPlayers(tx *gorm.DB, seasonId int, attackerId string, defenderId string) (ArenaPlayer, ArenaPlayer, error) {
+	var players []ArenaPlayer
+	// SELECT * FROM `arena_players` WHERE season_id = 1 AND user_id IN ('95daec2b-...','ba4bfb95-...') ORDER BY user_id FOR UPDATE
+	err := tx.Where("season_id = ? AND user_id IN ?", seasonId, []string{attackerId, defenderId}).Order("user_id").
+		Clauses(clause.Locking{Strength: "UPDATE"}).Find(&players).Error
+	if err != nil {
+		return ArenaPlayer{}, ArenaPlayer{}, err
+	}
+	var attacker, defender ArenaPlayer
+	for _, v := range players {
+		if v.UserID == attackerId {
+			attacker = v
+		} else {
+			defender = v
+		}
+	}
+	return attacker, defender, nil
+}
+
+// db(またはトランザクション)から、ユーザがシーズンの中で引数nowと同じ日に挑戦した回数を数える
+// 日付は戦闘の回数制限と同じくdailyLimitStart関数でUTCの0時に切り替わる
+func countArenaChallenges(db *gorm.DB, seasonId int, userId string, now time.Time) (int, error) {
+	var count int64
+	// SELECT count(*) FROM `arena_matches` WHERE season_id = 1 AND attacker_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND created_at >= '2021-09-10 00:00:00'
+	err := db.Model(&ArenaMatch{}).Where("season_id = ? AND attacker_id = ? AND created_at >= ?", seasonId, userId, dailyLimitStart(now)).Count(&count).Error
+	return int(count), err
+}
+
+// チームと防衛チームを戦わせて、レーティングの変動付きで対戦の記録を作成
+func newArenaMatch(seasonId int, attacker ArenaPlayer, defender ArenaPlayer, team TeamResponse, defenseTeam TeamResponse, now time.Time) (ArenaMatch, error) {
+	matchId, err := createUUId()
+	if err != nil {
+		return ArenaMatch{}, err
+	}
+	seed, err := newBattleSeed()
+	if err != nil {
+		return ArenaMatch{}, err
+	}
+	allies := teamBattleUnits(battleSideAlly, team.Members)
+	enemies := teamBattleUnits(battleSideEnemy, defenseTeam.Members)
+	// 戦闘でHPが書き換わる前の状態を記録に残す
+	units := append(append([]battleUnit{}, allies...), enemies...)
+	outcome := simulateBattle(NewSeededRoller(seed), allies, enemies, arenaMaxTurns)
+	unitsJSON, err := json.Marshal(units)
+	if err != nil {
+		return ArenaMatch{}, err
+	}
+	logJSON, err := json.Marshal(outcome.Log)
+	if err != nil {
+		return ArenaMatch{}, err
+	}
+	result := battleResultLose
+	if outcome.Win {
+		result = battleResultWin
+	}
+	return ArenaMatch{
+		MatchID:        matchId,
+		SeasonID:       seasonId,
+		AttackerID:     attacker.UserID,
+		DefenderID:     defender.UserID,
+		AttackerTeamNo: team.TeamNo,
+		DefenderTeamNo: defenseTeam.TeamNo,
+		AttackerPower:  team.Power,
+		DefenderPower:  defenseTeam.Power,
+		AttackerRating: attacker.Rating,
+		DefenderRating: defender.Rating,
+		RatingChange:   eloRatingChange(attacker.Rating, defender.Rating, outcome.Win),
+		Seed:           seed,
+		Result:         result,
+		Turns:          outcome.Turns,
+		Units:          string(unitsJSON),
+		Log:            string(logJSON),
+		CreatedAt:      now,
+	}, nil
+}
+
+// Eloレーティングで、レーティングratingのユーザがopponentRatingのユーザと対戦したときのレーティングの変動
+// 勝つ見込みが低い相手に勝つほど大きく上がる。相手のレーティングはこの値の符号を逆にした分だけ変わる
+func eloRatingChange(rating int, opponentRating int, win bool) int {
+	expected := 1 / (1 + math.Pow(10, float64(opponentRating-rating)/400))
+	score := 0.0
+	if win {
+		score = 1
+	}
+	return int(math.Round(arenaRatingK * (score - expected)))
+}
+
+// 最終順位rankのユーザが受け取るゲームトークンの量
+// rewardsはmax_rankの小さい順に並んでいること。どの報酬にも当たらなければ0
+func arenaRankReward(rewards []ArenaSeasonReward, rank int) int {
+	i := sort.Search(len(rewards), func(i int) bool { return rewards[i].MaxRank >= rank })
+	if i == len(rewards) {
+		return 0
+	}
+	return rewards[i].Gmtoken
+}
+
+// トランザクションtxの中で、ユーザにシーズンの報酬を記録し、その鋳造をpendingの状態で予約する
+// 予約した鋳造のtransfer_idを返すので、コミットしてからsendGmtokenTransfer関数で鋳造する
+// シーズンの行をロックしてpaid_outを確かめてから呼ぶので、同じユーザに2回予約することはない
+func reserveArenaPayout(tx *gorm.DB, player ArenaPlayer, gmtoken int) (ArenaPayoutResponse, string, error) {
+	payout := ArenaPayoutResponse{UserID: player.UserID}
+	// UPDATE `arena_players` SET `reward_gmtoken`=100 WHERE season_id = 1 AND user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	err := tx.Model(&ArenaPlayer{}).Where("season_id = ? AND user_id = ?", player.SeasonID, player.UserID).
+		Update("reward_gmtoken", gmtoken).Error
+	if err != nil {
+		return ArenaPayoutResponse{}, "", err
+	}
+	transfer, err := createGmtokenTransfer(tx, player.UserID, gmtokenMint, gmtoken, gmtokenReasonArena, strconv.Itoa(player.SeasonID))
+	if err != nil {
+		return ArenaPayoutResponse{}, "", err
+	}
+	payout.Gmtoken = gmtoken
+	return payout, transfer.TransferID, nil
+}
+
+// 対戦の記録を、ユーザuserIdから見たレスポンスの形に変換
+// withLogがtrueならユニットと行動の記録も含める
+func (match ArenaMatch) response(userId string, withLog bool) ArenaMatchResponse {
+	response := ArenaMatchResponse{
+		MatchID:        match.MatchID,
+		SeasonID:       match.SeasonID,
+		Attacked:       match.AttackerID == userId,
+		AttackerID:     match.AttackerID,
+		DefenderID:     match.DefenderID,
+		AttackerPower:  match.AttackerPower,
+		DefenderPower:  match.DefenderPower,
+		AttackerRating: match.AttackerRating,
+		DefenderRating: match.DefenderRating,
+		RatingChange:   match.RatingChange,
+		Result:         match.Result,
+		Turns:          match.Turns,
+		Seed:           match.Seed,
+		CreatedAt:      match.CreatedAt,
+	}
+	// 挑戦された側から見ると、結果もレーティングの変動も逆になる
+	if !response.Attacked {
+		response.RatingChange = -match.RatingChange
+		if match.Result == battleResultWin {
+			response.Result = battleResultLose
+		} else {
+			response.Result = battleResultWin
+		}
+	}
+	if withLog {
+		if err := json.Unmarshal([]byte(match.Units), &response.Units); err != nil {
+			log.Println("arena match", match.MatchID, "has broken units:", err)
+		}
+		if err := json.Unmarshal([]byte(match.Log), &response.Log); err != nil {
+			log.Println("arena match", match.MatchID, "has broken log:", err)
+		}
+	}
+	return response
+}
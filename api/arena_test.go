@@ -0,0 +1,67 @@
+package api
+
+import "testing"
+
+func TestEloRatingChange(t *testing.T) {
+	tests := []struct {
+		name           string
+		rating         int
+		opponentRating int
+		win            bool
+		want           int
+	}{
+		{"equal win", 1500, 1500, true, arenaRatingK / 2},
+		{"equal lose", 1500, 1500, false, -arenaRatingK / 2},
+		{"upset win", 1300, 1700, true, 29},
+		{"favorite win", 1700, 1300, true, 3},
+		{"upset lose", 1700, 1300, false, -29},
+		{"favorite lose", 1300, 1700, false, -3},
+	}
+	for _, tt := range tests {
+		if got := eloRatingChange(tt.rating, tt.opponentRating, tt.win); got != tt.want {
+			t.Errorf("%s: eloRatingChange(%d, %d, %v) = %d, want %d", tt.name, tt.rating, tt.opponentRating, tt.win, got, tt.want)
+		}
+	}
+}
+
+func TestEloRatingChangeUpsetIsLarger(t *testing.T) {
+	for _, gap := range []int{50, 200, 400} {
+		upset := eloRatingChange(1500-gap, 1500+gap, true)
+		favorite := eloRatingChange(1500+gap, 1500-gap, true)
+		if upset <= favorite {
+			t.Errorf("gap %d: upset win = %d, favorite win = %d, want the upset to be larger", gap, upset, favorite)
+		}
+		// 勝った側が増える量と負けた側が減る量は等しい
+		if lose := eloRatingChange(1500+gap, 1500-gap, false); lose != -upset {
+			t.Errorf("gap %d: favorite lose = %d, want %d", gap, lose, -upset)
+		}
+	}
+}
+
+func TestArenaRankReward(t *testing.T) {
+	rewards := []ArenaSeasonReward{
+		{SeasonID: 1, MaxRank: 1, Gmtoken: 100},
+		{SeasonID: 1, MaxRank: 3, Gmtoken: 50},
+		{SeasonID: 1, MaxRank: 10, Gmtoken: 10},
+	}
+	tests := []struct {
+		rank int
+		want int
+	}{
+		{1, 100},
+		{2, 50},
+		{3, 50},
+		{4, 10},
+		{10, 10},
+		{11, 0},
+		{100, 0},
+	}
+	for _, tt := range tests {
+		if got := arenaRankReward(rewards, tt.rank); got != tt.want {
+			t.Errorf("arenaRankReward(rank %d) = %d, want %d", tt.rank, got, tt.want)
+		}
+	}
+	if got := arenaRankReward(nil, 1); got != 0 {
+		t.Errorf("arenaRankReward without rewards = %d, want 0", got)
+	}
+}
@@ -0,0 +1,462 @@
+package api
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// 戦闘の結果
+const (
+	battleResultWin  = "win"
+	battleResultLose = "lose"
+)
+
+// 1人のユーザが1日(UTC)に戦闘できる回数
+const maxDailyBattles = 30
+
+// 戦闘のステージ
+// MaxTurns: このターン数で敵を全て倒せなければ負け
+// RewardExp: 勝ったときにチームのキャラクター1体ずつが手に入れる経験値
+// RewardTickets、RewardTicketGachaID: 勝ったときに手に入るガチャチケットの枚数と、そのチケットを使えるガチャ(0ならどのガチャにも使える)
+// RewardGmtoken: 勝ったときに鋳造するゲームトークンの量
+type Stage struct {
+	ID                  int    `json:"id"`
+	StageName           string `json:"stage_name"`
+	MaxTurns            int    `json:"max_turns"`
+	RewardExp           int    `json:"reward_exp"`
+	RewardTickets       int    `json:"reward_tickets"`
+	RewardTicketGachaID int    `json:"reward_ticket_gacha_id"`
+	RewardGmtoken       int    `json:"reward_gmtoken"`
+	Retired             bool   `json:"retired"`
+}
+
+// ステージの敵
+type StageEnemy struct {
+	StageID   int    `json:"stage_id" gorm:"primaryKey"`
+	Slot      int    `json:"slot" gorm:"primaryKey"`
+	EnemyName string `json:"enemy_name"`
+	HP        int    `json:"HP" gorm:"column:HP"`
+	Attack    int    `json:"attack"`
+}
+
+// 1回の戦闘の記録
+// Seed: 戦闘の乱数のシード。UnitsとSeedから同じ戦闘を再現できる
+// Power: 戦闘したときのチーム戦力
+// Units: 戦闘を始めたときの味方と敵(battleUnitの配列のJSON)
+// Log: 戦闘の行動の記録(BattleLogEntryの配列のJSON)
+// RewardExp、RewardTickets、RewardGmtoken、MintTxHash: 実際に渡した報酬と、ゲームトークンの鋳造のトランザクションのハッシュ
+// MintTxHashはコミットしてから鋳造できたときに書き込むので、鋳造できるまでは空になる
+type Battle struct {
+	BattleID      string    `json:"battle_id" gorm:"primaryKey"`
+	UserID        string    `json:"user_id"`
+	StageID       int       `json:"stage_id"`
+	TeamNo        int       `json:"team_no"`
+	Seed          int64     `json:"seed"`
+	Power         int       `json:"power"`
+	Result        string    `json:"result"`
+	Turns         int       `json:"turns"`
+	RewardExp     int       `json:"reward_exp"`
+	RewardTickets int       `json:"reward_tickets"`
+	RewardGmtoken int       `json:"reward_gmtoken"`
+	MintTxHash    string    `json:"mint_tx_hash"`
+	Units         string    `json:"units"`
+	Log           string    `json:"log"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// 戦闘を始めるときに受け取る
+type StartingBattle struct {
+	StageID int `json:"stage_id"`
+	TeamNo  int `json:"team_no"`
+}
+
+// getBattleStages関数で返される、ステージの敵
+type StageEnemyResponse struct {
+	Slot   int    `json:"slot"`
+	Name   string `json:"name"`
+	HP     int    `json:"hp"`
+	Attack int    `json:"attack"`
+}
+
+// getBattleStages関数で返される、1つのステージ
+type StageResponse struct {
+	StageID             int                  `json:"stageID"`
+	StageName           string               `json:"stageName"`
+	MaxTurns            int                  `json:"maxTurns"`
+	RewardExp           int                  `json:"rewardExp"`
+	RewardTickets       int                  `json:"rewardTickets"`
+	RewardTicketGachaID int                  `json:"rewardTicketGachaID"`
+	RewardGmtoken       int                  `json:"rewardGmtoken"`
+	Enemies             []StageEnemyResponse `json:"enemies"`
+}
+
+// getBattleStages関数で返される
+type StagesResponse struct {
+	Stages []StageResponse `json:"stages"`
+}
+
+// startBattle関数、getBattle関数で返される、戦闘で手に入れた報酬
+type BattleRewardResponse struct {
+	Exp        int    `json:"exp"`
+	Tickets    int    `json:"tickets"`
+	Gmtoken    int    `json:"gmtoken"`
+	MintTxHash string `json:"mintTxHash,omitempty"`
+}
+
+// startBattle関数、getBattle関数で返される
+// Unitsは戦闘を始めたときの味方と敵
+type BattleResponse struct {
+	BattleID  string               `json:"battleID"`
+	StageID   int                  `json:"stageID"`
+	TeamNo    int                  `json:"teamNo"`
+	Power     int                  `json:"power"`
+	Result    string               `json:"result"`
+	Turns     int                  `json:"turns"`
+	Seed      int64                `json:"seed"`
+	Rewards   BattleRewardResponse `json:"rewards"`
+	Units     []battleUnit         `json:"units"`
+	Log       []BattleLogEntry     `json:"log"`
+	CreatedAt time.Time            `json:"createdAt"`
+}
+
+// localhost:8080/battle/stagesで戦闘できるステージの一覧を敵と報酬付きで取得
+// retiredのステージは含まない
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetBattleStages(w http.ResponseWriter, r *http.Request) {
+	if _, err := c.getUserId(r); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var stages []Stage
+	// SELECT * FROM `stages` WHERE retired = FALSE ORDER BY id
+	if err := c.DB.Where("retired = FALSE").Order("id").Find(&stages).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var enemies []StageEnemy
+	// SELECT * FROM `stage_enemies` ORDER BY stage_id, slot
+	if err := c.DB.Order("stage_id, slot").Find(&enemies).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stageEnemies := make(map[int][]StageEnemyResponse)
+	for _, v := range enemies {
+		stageEnemies[v.StageID] = append(stageEnemies[v.StageID], StageEnemyResponse{Slot: v.Slot, Name: v.EnemyName, HP: v.HP, Attack: v.Attack})
+	}
+	stageList := make([]StageResponse, 0, len(stages))
+	for _, v := range stages {
+		stageList = append(stageList, StageResponse{
+			StageID:             v.ID,
+			StageName:           v.StageName,
+			MaxTurns:            v.MaxTurns,
+			RewardExp:           v.RewardExp,
+			RewardTickets:       v.RewardTickets,
+			RewardTicketGachaID: v.RewardTicketGachaID,
+			RewardGmtoken:       v.RewardGmtoken,
+			Enemies:             stageEnemies[v.ID],
+		})
+	}
+	RespondWithJSON(w, http.StatusOK, &StagesResponse{
+		Stages: stageList,
+	})
+	//	{"stages":[
+	//		{"stageID":1,"stageName":"Moon","maxTurns":20,"rewardExp":100,"rewardTickets":0,"rewardTicketGachaID":0,"rewardGmtoken":1,
+	//		 "enemies":[{"slot":1,"name":"Slime","hp":800,"attack":60},...]},
+	//		...
+	//	]}
+	//	が返る
+}
+
+// localhost:8080/battle/startでユーザのチームとステージの敵を戦わせる
+// 戦闘はサーバーで乱数のシードを決めて行い、勝てばチームのキャラクターに経験値を、ユーザにガチャチケットとゲームトークンを渡す
+// 経験値とチケットの付与、ゲームトークンの鋳造の予約、戦闘の記録の保存は1つのトランザクションで行い、
+// ゲームトークンはコミットしてから鋳造する。鋳造に失敗したら後でやり直す
+// 戦闘できるのは1日にmaxDailyBattles回までで、ユーザの行をロックして数えるので同時に戦闘しても超えない
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"stage_id":1, "team_no":1}で戦うステージとチームを受け取る
+func (c *Config) StartBattle(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var starting StartingBattle
+	if err := readRequestBody(r, &starting); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	stage, enemies, err := c.getStage(starting.StageID)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	teams, err := c.getTeams(userId, starting.TeamNo)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if starting.TeamNo <= 0 || len(teams) == 0 || len(teams[0].Members) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "team_no is error.")
+		return
+	}
+	team := teams[0]
+	seed, err := newBattleSeed()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	allies := teamBattleUnits(battleSideAlly, team.Members)
+	enemyUnits := enemyBattleUnits(enemies)
+	// 戦闘でHPが書き換わる前の状態を記録に残す
+	units := append(append([]battleUnit{}, allies...), enemyUnits...)
+	outcome := simulateBattle(NewSeededRoller(seed), allies, enemyUnits, stage.MaxTurns)
+	battle, err := newBattle(userId, stage, team, seed, units, outcome)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var transfer GmtokenTransfer
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkDailyBattles(tx, userId, battle.CreatedAt); err != nil {
+			return err
+		}
+		if outcome.Win {
+			if err := c.grantBattleRewards(tx, userId, stage, team, &battle); err != nil {
+				return err
+			}
+		}
+		//	INSERT INTO `battles` (`battle_id`,`user_id`,`stage_id`,`team_no`,`seed`,`power`,`result`,`turns`,`reward_exp`,`reward_tickets`,`reward_gmtoken`,`mint_tx_hash`,`units`,`log`,`created_at`)
+		//	VALUES ('4f1b...','95daec2b-287c-4358-ba6f-5c29e1c3cbdf',1,1,8231470917,9350,'win',4,100,0,1,'','[...]','[...]','2021-09-10 12:00:00')
+		if err := tx.Create(&battle).Error; err != nil {
+			return err
+		}
+		if battle.RewardGmtoken > 0 {
+			transfer, err = createGmtokenTransfer(tx, userId, gmtokenMint, battle.RewardGmtoken, gmtokenReasonBattle, battle.BattleID)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	if transfer.TransferID != "" {
+		// 報酬の記録は済んでいるので、鋳造に失敗しても後でやり直す
+		txHash, err := c.sendGmtokenTransfer(transfer.TransferID)
+		if err != nil {
+			log.Println("gmtoken transfer", transfer.TransferID, "failed:", err)
+		}
+		battle.MintTxHash = txHash
+	}
+	RespondWithJSON(w, http.StatusOK, battle.response())
+	//	{"battleID":"4f1b...","stageID":1,"teamNo":1,"power":9350,"result":"win","turns":4,"seed":8231470917,
+	//	"rewards":{"exp":100,"tickets":0,"gmtoken":1,"mintTxHash":"0x5a7e..."},
+	//	"units":[{"side":"ally","slot":1,"name":"Mercury","maxHP":2120,"hp":2120,"attack":212},...,{"side":"enemy","slot":1,"name":"Slime","maxHP":800,"hp":800,"attack":60},...],
+	//	"log":[{"turn":1,"side":"ally","slot":1,"name":"Mercury","targetSlot":2,"targetName":"Goblin","damage":220,"critical":false,"targetHP":780},...],
+	//	"createdAt":"2021-09-10T12:00:00Z"}
+	//	が返る
+}
+
+// localhost:8080/battle/{battleID}でユーザの戦闘の記録を取得
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetBattle(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var battles []Battle
+	// SELECT * FROM `battles` WHERE battle_id = '4f1b...' AND user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	if err := c.DB.Where("battle_id = ? AND user_id = ?", mux.Vars(r)["id"], userId).Find(&battles).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(battles) == 0 {
+		RespondWithError(w, http.StatusNotFound, "battle is not found.")
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, battles[0].response())
+	// startBattle関数と同じ形で返る
+}
+
+// dbからretiredでないステージと、その敵を枠の順に取得
+// ステージが見つからないか、敵がいないときはエラーを返す
+func (c *Config) getStage(stageId int) (Stage, []StageEnemy, error) {
+	var stage Stage
+	// SELECT * FROM `stages` WHERE id = 1 AND retired = FALSE
+	if err := c.DB.Where("id = ? AND retired = FALSE", stageId).Find(&stage).Error; err != nil {
+		return Stage{}, nil, err
+	}
+	if stage.ID == 0 {
+		return Stage{}, nil, newAPIError(http.StatusBadRequest, "stage_id is error.")
+	}
+	var enemies []StageEnemy
+	// SELECT * FROM `stage_enemies` WHERE stage_id = 1 ORDER BY slot
+	if err := c.DB.Where("stage_id = ?", stageId).Order("slot").Find(&enemies).Error; err != nil {
+		return Stage{}, nil, err
+	}
+	if len(enemies) == 0 || stage.MaxTurns <= 0 {
+		return Stage{}, nil, newAPIError(http.StatusInternalServerError, "stage "+stage.StageName+" is broken.")
+	}
+	return stage, enemies, nil
+}
+
+// トランザクションtxの中で、勝った戦闘の報酬を渡してbattleに記録する
+// チームのキャラクターの経験値は最大レベルを超えない分だけ増やす
+// ゲームトークンはここでは鋳造せず、鋳造する量をbattleに記録するだけにする
+func (c *Config) grantBattleRewards(tx *gorm.DB, userId string, stage Stage, team TeamResponse, battle *Battle) error {
+	if stage.RewardExp > 0 {
+		userCharacterIds := make([]string, 0, len(team.Members))
+		for _, v := range team.Members {
+			userCharacterIds = append(userCharacterIds, v.UserCharacterID)
+		}
+		characters, err := getEnhancingCharacters(tx, userId, userCharacterIds)
+		if err != nil {
+			return err
+		}
+		for _, v := range characters {
+			after := v
+			after.Exp += stage.RewardExp
+			if maxExp := levelExp(v.MaxLevel); after.Exp > maxExp {
+				after.Exp = maxExp
+			}
+			if after.Exp == v.Exp {
+				continue
+			}
+			after.Level = expLevel(after.Exp, v.MaxLevel)
+			// UPDATE `user_characters` SET `exp`=200,`level`=2 WHERE user_character_id = '02091c4d-1011-4615-8fbb-fd9e681153d4'
+			err = tx.Model(&UserCharacter{}).Where("user_character_id = ?", v.UserCharacterID).
+				Updates(map[string]interface{}{"exp": after.Exp, "level": after.Level}).Error
+			if err != nil {
+				return err
+			}
+			if err := refreshCharacterSortKeys(tx, "user_characters.user_character_id = ?", v.UserCharacterID); err != nil {
+				return err
+			}
+			if _, err := saveCharacterHistory(tx, userId, characterActionBattle, v, after, nil, 0, GmtokenTransfer{}); err != nil {
+				return err
+			}
+		}
+		battle.RewardExp = stage.RewardExp
+	}
+	if stage.RewardTickets > 0 {
+		err := c.grantTickets(tx, TicketLedger{UserID: userId, GachaID: stage.RewardTicketGachaID, Amount: stage.RewardTickets, Reason: ticketReasonReward})
+		if err != nil {
+			return err
+		}
+		battle.RewardTickets = stage.RewardTickets
+	}
+	battle.RewardGmtoken = stage.RewardGmtoken
+	return nil
+}
+
+// 戦闘やアリーナの1日の回数制限で、引数nowが含まれる日の始まり
+// どちらの制限もUTCの0時に切り替わる
+func dailyLimitStart(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour)
+}
+
+// トランザクションtxの中で、ユーザの行をロックしてから今日(UTC)の戦闘の回数を数え、
+// maxDailyBattles回に達していればエラーを返す
+// ロックはトランザクションが終わるまで続くので、同じユーザの戦闘は1つずつ数えて保存される
+func checkDailyBattles(tx *gorm.DB, userId string, now time.Time) error {
+	var user User
+	// SELECT * FROM `users` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' FOR UPDATE
+	if err := tx.Where("user_id = ?", userId).Clauses(clause.Locking{Strength: "UPDATE"}).Find(&user).Error; err != nil {
+		return err
+	}
+	if user.UserID == "" {
+		return newAPIError(http.StatusBadRequest, "user is not found.")
+	}
+	var count int64
+	// SELECT count(*) FROM `battles` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND created_at >= '2021-09-10 00:00:00'
+	err := tx.Model(&Battle{}).Where("user_id = ? AND created_at >= ?", userId, dailyLimitStart(now)).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count >= maxDailyBattles {
+		return newAPIError(http.StatusTooManyRequests, "daily battle limit is reached.")
+	}
+	return nil
+}
+
+// 戦闘の結果から戦闘の記録を作成
+// 報酬はgrantBattleRewards関数で渡したときに記録する
+func newBattle(userId string, stage Stage, team TeamResponse, seed int64, units []battleUnit, outcome battleOutcome) (Battle, error) {
+	battleId, err := createUUId()
+	if err != nil {
+		return Battle{}, err
+	}
+	unitsJSON, err := json.Marshal(units)
+	if err != nil {
+		return Battle{}, err
+	}
+	logJSON, err := json.Marshal(outcome.Log)
+	if err != nil {
+		return Battle{}, err
+	}
+	result := battleResultLose
+	if outcome.Win {
+		result = battleResultWin
+	}
+	return Battle{
+		BattleID:  battleId,
+		UserID:    userId,
+		StageID:   stage.ID,
+		TeamNo:    team.TeamNo,
+		Seed:      seed,
+		Power:     team.Power,
+		Result:    result,
+		Turns:     outcome.Turns,
+		Units:     string(unitsJSON),
+		Log:       string(logJSON),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// 戦闘の乱数のシードをcrypto/randから作る
+func newBattleSeed() (int64, error) {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:]) >> 1), nil
+}
+
+// 戦闘の記録をレスポンスの形に変換
+func (battle Battle) response() BattleResponse {
+	var units []battleUnit
+	if err := json.Unmarshal([]byte(battle.Units), &units); err != nil {
+		log.Println("battle", battle.BattleID, "has broken units:", err)
+	}
+	var battleLog []BattleLogEntry
+	if err := json.Unmarshal([]byte(battle.Log), &battleLog); err != nil {
+		log.Println("battle", battle.BattleID, "has broken log:", err)
+	}
+	return BattleResponse{
+		BattleID: battle.BattleID,
+		StageID:  battle.StageID,
+		TeamNo:   battle.TeamNo,
+		Power:    battle.Power,
+		Result:   battle.Result,
+		Turns:    battle.Turns,
+		Seed:     battle.Seed,
+		Rewards: BattleRewardResponse{
+			Exp:        battle.RewardExp,
+			Tickets:    battle.RewardTickets,
+			Gmtoken:    battle.RewardGmtoken,
+			MintTxHash: battle.MintTxHash,
+		},
+		Units:     units,
+		Log:       battleLog,
+		CreatedAt: battle.CreatedAt,
+	}
+}
@@ -0,0 +1,150 @@
+package api
+
+// 味方のキャラクターの攻撃力(HPに対する割合(%))
+const battleAttackPercent = 10
+
+// ダメージのばらつき(攻撃力に対して上下何%か)
+const battleDamageSpread = 10
+
+// 会心の一撃になる確率(%)と、会心の一撃で増えるダメージ(%)
+const (
+	battleCriticalPercent = 10
+	battleCriticalBonus   = 50
+)
+
+// 戦闘の陣営
+const (
+	battleSideAlly  = "ally"
+	battleSideEnemy = "enemy"
+)
+
+// 戦闘に参加するキャラクターや敵1体分
+// HPは戦闘中に減っていく残りのHP
+type battleUnit struct {
+	Side   string `json:"side"`
+	Slot   int    `json:"slot"`
+	Name   string `json:"name"`
+	MaxHP  int    `json:"maxHP"`
+	HP     int    `json:"hp"`
+	Attack int    `json:"attack"`
+}
+
+// 戦闘の1回の行動の記録
+// TargetHPは攻撃を受けた後の残りのHP
+type BattleLogEntry struct {
+	Turn       int    `json:"turn"`
+	Side       string `json:"side"`
+	Slot       int    `json:"slot"`
+	Name       string `json:"name"`
+	TargetSlot int    `json:"targetSlot"`
+	TargetName string `json:"targetName"`
+	Damage     int    `json:"damage"`
+	Critical   bool   `json:"critical"`
+	TargetHP   int    `json:"targetHP"`
+}
+
+// simulateBattle関数で返される戦闘の結果
+// Turnsは決着がついた(または打ち切った)ターン
+type battleOutcome struct {
+	Win   bool
+	Turns int
+	Log   []BattleLogEntry
+}
+
+// チームの枠のキャラクターから陣営sideのユニットを作る
+// 攻撃力はHPのbattleAttackPercent%(最低1)
+func teamBattleUnits(side string, members []TeamMemberResponse) []battleUnit {
+	units := make([]battleUnit, 0, len(members))
+	for _, v := range members {
+		attack := v.HP * battleAttackPercent / 100
+		if attack < 1 {
+			attack = 1
+		}
+		units = append(units, battleUnit{Side: side, Slot: v.Slot, Name: v.Name, MaxHP: v.HP, HP: v.HP, Attack: attack})
+	}
+	return units
+}
+
+// ステージの敵から敵のユニットを作る
+func enemyBattleUnits(enemies []StageEnemy) []battleUnit {
+	units := make([]battleUnit, 0, len(enemies))
+	for _, v := range enemies {
+		units = append(units, battleUnit{Side: battleSideEnemy, Slot: v.Slot, Name: v.EnemyName, MaxHP: v.HP, HP: v.HP, Attack: v.Attack})
+	}
+	return units
+}
+
+// 味方と敵を戦わせて結果を返す
+// 毎ターン、残っている味方が枠の順に、続いて残っている敵が枠の順に、相手の残っているユニットから1体をrollerで選んで攻撃する
+// 同じrollerの乱数列と同じユニットからは、必ず同じ結果になる
+// 敵を全て倒せば勝ち、味方が全て倒れるかmaxTurnsターンで決着がつかなければ負け
+// allies、enemiesのHPは戦闘後の残りのHPに書き換わる
+func simulateBattle(roller Roller, allies []battleUnit, enemies []battleUnit, maxTurns int) battleOutcome {
+	var outcome battleOutcome
+	for turn := 1; turn <= maxTurns; turn++ {
+		outcome.Turns = turn
+		sides := []struct {
+			actors    []battleUnit
+			opponents []battleUnit
+		}{
+			{allies, enemies},
+			{enemies, allies},
+		}
+		for _, side := range sides {
+			opponents := side.opponents
+			for i := range side.actors {
+				actor := &side.actors[i]
+				if actor.HP <= 0 {
+					continue
+				}
+				targets := aliveBattleUnits(opponents)
+				if len(targets) == 0 {
+					break
+				}
+				target := &opponents[targets[roller.Intn(len(targets))]]
+				damage := actor.Attack * (100 - battleDamageSpread + roller.Intn(2*battleDamageSpread+1)) / 100
+				critical := roller.Intn(100) < battleCriticalPercent
+				if critical {
+					damage = damage * (100 + battleCriticalBonus) / 100
+				}
+				if damage < 1 {
+					damage = 1
+				}
+				target.HP -= damage
+				if target.HP < 0 {
+					target.HP = 0
+				}
+				outcome.Log = append(outcome.Log, BattleLogEntry{
+					Turn:       turn,
+					Side:       actor.Side,
+					Slot:       actor.Slot,
+					Name:       actor.Name,
+					TargetSlot: target.Slot,
+					TargetName: target.Name,
+					Damage:     damage,
+					Critical:   critical,
+					TargetHP:   target.HP,
+				})
+			}
+		}
+		if len(aliveBattleUnits(enemies)) == 0 {
+			outcome.Win = true
+			return outcome
+		}
+		if len(aliveBattleUnits(allies)) == 0 {
+			return outcome
+		}
+	}
+	return outcome
+}
+
+// 残りのHPが1以上のユニットのインデックスを返す
+func aliveBattleUnits(units []battleUnit) []int {
+	var alive []int
+	for i, v := range units {
+		if v.HP > 0 {
+			alive = append(alive, i)
+		}
+	}
+	return alive
+}
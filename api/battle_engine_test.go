@@ -0,0 +1,119 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+// テスト用の味方3体
+func testAllies() []battleUnit {
+	return teamBattleUnits(battleSideAlly, []TeamMemberResponse{
+		{Slot: 1, Name: "a1", HP: 300},
+		{Slot: 2, Name: "a2", HP: 200},
+		{Slot: 3, Name: "a3", HP: 100},
+	})
+}
+
+// テスト用の敵2体
+func testEnemies(hp int, attack int) []battleUnit {
+	return enemyBattleUnits([]StageEnemy{
+		{Slot: 1, EnemyName: "e1", HP: hp, Attack: attack},
+		{Slot: 2, EnemyName: "e2", HP: hp, Attack: attack},
+	})
+}
+
+func TestSimulateBattleSeededReproducible(t *testing.T) {
+	a := simulateBattle(NewSeededRoller(42), testAllies(), testEnemies(200, 15), 30)
+	b := simulateBattle(NewSeededRoller(42), testAllies(), testEnemies(200, 15), 30)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("same seed gave different results")
+	}
+	c := simulateBattle(NewSeededRoller(43), testAllies(), testEnemies(200, 15), 30)
+	if reflect.DeepEqual(a.Log, c.Log) {
+		t.Fatal("different seeds gave the same log")
+	}
+}
+
+func TestSimulateBattleTurnLimitIsLoss(t *testing.T) {
+	// 敵のHPが多すぎて、maxTurnsターンでは倒しきれない
+	for seed := int64(0); seed < 50; seed++ {
+		enemies := testEnemies(100000, 1)
+		outcome := simulateBattle(NewSeededRoller(seed), testAllies(), enemies, 5)
+		if outcome.Win {
+			t.Fatalf("seed %d: won at the turn limit", seed)
+		}
+		if outcome.Turns != 5 {
+			t.Errorf("seed %d: turns = %d, want 5", seed, outcome.Turns)
+		}
+		if len(aliveBattleUnits(enemies)) == 0 {
+			t.Errorf("seed %d: all enemies are down", seed)
+		}
+	}
+}
+
+func TestSimulateBattleWinsOnlyWhenEnemiesAreDown(t *testing.T) {
+	wins := 0
+	for seed := int64(0); seed < 200; seed++ {
+		allies := testAllies()
+		enemies := testEnemies(300, 30)
+		outcome := simulateBattle(NewSeededRoller(seed), allies, enemies, 30)
+		if outcome.Turns < 1 || outcome.Turns > 30 {
+			t.Fatalf("seed %d: turns = %d", seed, outcome.Turns)
+		}
+		if outcome.Win {
+			wins += 1
+			if alive := aliveBattleUnits(enemies); len(alive) != 0 {
+				t.Fatalf("seed %d: won with enemies %v alive", seed, alive)
+			}
+		} else if len(aliveBattleUnits(allies)) != 0 && outcome.Turns != 30 {
+			t.Fatalf("seed %d: lost at turn %d with allies alive", seed, outcome.Turns)
+		}
+	}
+	// 勝ちも負けもあるバランスのステージで確かめる
+	if wins == 0 || wins == 200 {
+		t.Errorf("wins = %d of 200, want both wins and losses", wins)
+	}
+}
+
+func TestSimulateBattleDeadUnitsNeverAct(t *testing.T) {
+	for seed := int64(0); seed < 200; seed++ {
+		allies := testAllies()
+		enemies := testEnemies(200, 40)
+		outcome := simulateBattle(NewSeededRoller(seed), allies, enemies, 30)
+		// ログから各ユニットの残りのHPをたどる
+		hp := map[string]map[int]int{battleSideAlly: {}, battleSideEnemy: {}}
+		for _, v := range testAllies() {
+			hp[battleSideAlly][v.Slot] = v.HP
+		}
+		for _, v := range testEnemies(200, 40) {
+			hp[battleSideEnemy][v.Slot] = v.HP
+		}
+		for i, v := range outcome.Log {
+			if hp[v.Side][v.Slot] <= 0 {
+				t.Fatalf("seed %d: entry %d: %s %d acted with 0 HP", seed, i, v.Side, v.Slot)
+			}
+			targetSide := battleSideEnemy
+			if v.Side == battleSideEnemy {
+				targetSide = battleSideAlly
+			}
+			if hp[targetSide][v.TargetSlot] <= 0 {
+				t.Fatalf("seed %d: entry %d: attacked %s %d with 0 HP", seed, i, targetSide, v.TargetSlot)
+			}
+			if v.TargetHP < 0 {
+				t.Fatalf("seed %d: entry %d: target HP = %d", seed, i, v.TargetHP)
+			}
+			hp[targetSide][v.TargetSlot] = v.TargetHP
+		}
+		// 戦闘後のHPもログの最後の値と一致し、0を下回らない
+		for _, units := range [][]battleUnit{allies, enemies} {
+			for _, v := range units {
+				if v.HP < 0 {
+					t.Fatalf("seed %d: %s %d HP = %d", seed, v.Side, v.Slot, v.HP)
+				}
+				if v.HP != hp[v.Side][v.Slot] {
+					t.Errorf("seed %d: %s %d HP = %d, want %d", seed, v.Side, v.Slot, v.HP, hp[v.Side][v.Slot])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// レアリティの設定
+// Retiredがtrueのレアリティのキャラクターはガチャから出なくなる
+// DuplicatePolicy: 既に持っているキャラクターを引いたときの扱い("keep"、"shards"、"refund")
+// DuplicateAuto: trueならガチャを引いたときに自動で変換し、falseならユーザが/character/convertで変換する
+// DuplicateShards: "shards"のとき、1体で手に入るかけらの数
+// DuplicateRefund: "refund"のとき、1体で払い戻すゲームトークンの量
+// MaxLevel: このレアリティのキャラクターの最大レベル
+// HPPerLevel: レベルが1上がるごとに増えるHP
+// EnhanceExp: 強化の素材にしたときの、素材のレベル1あたりの経験値
+// MaxLimitBreak: 限界突破の段階の上限
+// LimitBreakLevels、LimitBreakHP: 限界突破の1段階ごとに上がる最大レベルとHP
+// SellPrice、SellPricePerLevel: 売却したときのレベル1の売値と、レベルが1上がるごとに増える売値(ゲームトークン)
+type Rarity struct {
+	ID                int    `json:"id"`
+	RarityName        string `json:"rarity_name"`
+	Weight            uint   `json:"weight"`
+	HPup              int    `json:"HPup" gorm:"column:HPup"`
+	Grade             int    `json:"grade"`
+	DuplicatePolicy   string `json:"duplicate_policy"`
+	DuplicateAuto     bool   `json:"duplicate_auto"`
+	DuplicateShards   int    `json:"duplicate_shards"`
+	DuplicateRefund   int    `json:"duplicate_refund"`
+	MaxLevel          int    `json:"max_level"`
+	HPPerLevel        int    `json:"hp_per_level"`
+	EnhanceExp        int    `json:"enhance_exp"`
+	MaxLimitBreak     int    `json:"max_limit_break"`
+	LimitBreakLevels  int    `json:"limit_break_levels"`
+	LimitBreakHP      int    `json:"limit_break_hp" gorm:"column:limit_break_hp"`
+	SellPrice         int    `json:"sell_price"`
+	SellPricePerLevel int    `json:"sell_price_per_level"`
+	Retired           bool   `json:"retired"`
+}
+
+// キャラクターの設定
+// Retiredがtrueのキャラクターはガチャから出なくなる
+type CatalogCharacter struct {
+	ID            int    `json:"id"`
+	CharacterName string `json:"character_name"`
+	HP            int    `json:"HP" gorm:"column:HP"`
+	Retired       bool   `json:"retired"`
+}
+
+func (CatalogCharacter) TableName() string {
+	return "characters"
+}
+
+// ガチャに含まれるキャラクターの設定
+// HPはキャラクターのHPとレアリティのHPupの合計で、カタログを変更するたびに計算し直す
+// Retiredがtrueならガチャから出なくなるが、既に持っているユーザのキャラクターはそのまま残る
+type GachaCharacter struct {
+	GachaCharacterID string `json:"gacha_character_id" gorm:"primaryKey"`
+	GachaID          int    `json:"gacha_id"`
+	CharacterID      int    `json:"character_id"`
+	RarityID         int    `json:"rarity_id"`
+	HP               int    `json:"HP" gorm:"column:HP"`
+	RateUp           uint   `json:"rate_up"`
+	BoxCount         uint   `json:"box_count"`
+	IsPrize          bool   `json:"is_prize"`
+	Retired          bool   `json:"retired"`
+}
+
+// カタログの変更の記録
+// Snapshotは変更した後のカタログ全体をJSONにしたもの
+type CatalogVersion struct {
+	VersionID   int       `json:"version_id" gorm:"primaryKey"`
+	UserID      string    `json:"user_id"`
+	Description string    `json:"description"`
+	Snapshot    string    `json:"snapshot"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// カタログ全体(レアリティ、キャラクター、ガチャ、ガチャのキャラクター、確定ルール、ステップ)
+type catalogSnapshot struct {
+	Rarities        []Rarity           `json:"rarities"`
+	Characters      []CatalogCharacter `json:"characters"`
+	Gachas          []Gacha            `json:"gachas"`
+	GachaCharacters []GachaCharacter   `json:"gacha_characters"`
+	Guarantees      []GachaGuarantee   `json:"guarantees"`
+	Steps           []GachaStep        `json:"steps"`
+}
+
+// カタログを変更したときに返される
+// Itemは変更した後のレアリティ、キャラクター、ガチャ、ガチャのキャラクターのいずれか
+type CatalogChangeResponse struct {
+	VersionID int         `json:"versionID"`
+	Item      interface{} `json:"item"`
+}
+
+// getCatalogVersions関数で返される、カタログの変更の記録
+type CatalogVersionResponse struct {
+	VersionID   int       `json:"versionID"`
+	UserID      string    `json:"userID"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// getCatalogVersions関数で返される
+type CatalogVersionsResponse struct {
+	Versions []CatalogVersionResponse `json:"versions"`
+}
+
+// カタログを元に戻すときに受け取る
+type RollingBackCatalog struct {
+	VersionID int `json:"version_id"`
+}
+
+// localhost:8080/admin/catalog/versions?offset=0&limit=20でカタログの変更の記録を新しい順に取得
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+func (c *Config) GetCatalogVersions(w http.ResponseWriter, r *http.Request) {
+	if _, err := c.requireAdmin(r); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	offset, limit, err := parseOffsetLimit(r, 20, 100)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	var versions []CatalogVersion
+	// SELECT version_id, user_id, description, created_at FROM `catalog_versions` ORDER BY version_id DESC LIMIT 20
+	err = c.DB.Select("version_id, user_id, description, created_at").
+		Order("version_id DESC").Offset(offset).Limit(limit).Find(&versions).Error
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	versionList := make([]CatalogVersionResponse, 0, len(versions))
+	for _, v := range versions {
+		versionList = append(versionList, CatalogVersionResponse{VersionID: v.VersionID, UserID: v.UserID, Description: v.Description, CreatedAt: v.CreatedAt})
+	}
+	RespondWithJSON(w, http.StatusOK, &CatalogVersionsResponse{
+		Versions: versionList,
+	})
+	//	{"versions":[
+	//		{"versionID":3,"userID":"95daec2b-...","description":"update rarity 1","createdAt":"2021-11-01T12:00:00Z"},
+	//		...
+	//	]}
+	//	が返る
+}
+
+// localhost:8080/admin/catalog/rollbackでカタログを指定した変更の直後の状態に戻す
+// その変更より後に追加したものは消さずにretiredにする
+// 戻したことも新しい変更として記録する
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"version_id":n}でどの変更の直後に戻すかの情報を受け取る
+func (c *Config) RollbackCatalog(w http.ResponseWriter, r *http.Request) {
+	adminId, err := c.requireAdmin(r)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	var rollingBack RollingBackCatalog
+	if err := readRequestBody(r, &rollingBack); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	var version CatalogVersion
+	// SELECT * FROM `catalog_versions` WHERE version_id = 2
+	if err := c.DB.Where("version_id = ?", rollingBack.VersionID).Find(&version).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if version.VersionID == 0 {
+		RespondWithError(w, http.StatusBadRequest, "version_id is error.")
+		return
+	}
+	var snapshot catalogSnapshot
+	if err := json.Unmarshal([]byte(version.Snapshot), &snapshot); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	versionId, err := c.applyCatalogChange(adminId, "rollback to version "+strconv.Itoa(version.VersionID), func(tx *gorm.DB) error {
+		return restoreCatalogSnapshot(tx, snapshot)
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &CatalogChangeResponse{
+		VersionID: versionId,
+		Item:      version.VersionID,
+	})
+	// {"versionID":5,"item":2}が返る
+}
+
+// カタログを変更する
+// トランザクションの中でfnで変更し、カタログ全体を検証してHPを計算し直し、変更後のカタログを記録する
+// 変更の記録がまだなければ、変更前のカタログも記録して元に戻せるようにする
+// 設定の変わったガチャのキャラクターを持っているユーザのキャラクターは、一覧の並べ替えに使う値も計算し直す
+// 変更後は設定の変わったガチャの抽選テーブルをキャッシュから消し、記録したバージョンを返す
+func (c *Config) applyCatalogChange(userId string, description string, fn func(tx *gorm.DB) error) (int, error) {
+	var version CatalogVersion
+	var changed []int
+	err := c.DB.Transaction(func(tx *gorm.DB) error {
+		var versions int64
+		// SELECT count(*) FROM `catalog_versions`
+		if err := tx.Model(&CatalogVersion{}).Count(&versions).Error; err != nil {
+			return err
+		}
+		if versions == 0 {
+			if _, err := saveCatalogVersion(tx, userId, "initial"); err != nil {
+				return err
+			}
+		}
+		before, err := loadCatalogSnapshot(tx)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := recomputeCharacterHP(tx); err != nil {
+			return err
+		}
+		snapshot, err := loadCatalogSnapshot(tx)
+		if err != nil {
+			return err
+		}
+		if err := snapshot.validate(); err != nil {
+			return err
+		}
+		changed, err = before.changedGachas(snapshot)
+		if err != nil {
+			return err
+		}
+		if len(changed) != 0 {
+			if err := refreshCharacterSortKeys(tx, "gacha_characters.gacha_id IN ?", changed); err != nil {
+				return err
+			}
+		}
+		version, err = saveCatalogVersion(tx, userId, description)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, gachaId := range changed {
+		c.GachaTableCache.invalidate(gachaId)
+	}
+	return version.VersionID, nil
+}
+
+// ガチャごとの、抽選テーブルに関係する設定(ガチャ、ガチャのキャラクターとそのキャラクター、レアリティ、確定ルール、ステップ)
+type gachaSettings struct {
+	Gacha           Gacha
+	GachaCharacters []GachaCharacter
+	Characters      []CatalogCharacter
+	Rarities        []Rarity
+	Guarantees      []GachaGuarantee
+	Steps           []GachaStep
+}
+
+// ガチャidごとに、抽選テーブルに関係する設定をJSONにしたものを返す
+func (snapshot catalogSnapshot) gachaSettings() (map[int]string, error) {
+	characters := make(map[int]CatalogCharacter, len(snapshot.Characters))
+	for _, v := range snapshot.Characters {
+		characters[v.ID] = v
+	}
+	rarities := make(map[int]Rarity, len(snapshot.Rarities))
+	for _, v := range snapshot.Rarities {
+		rarities[v.ID] = v
+	}
+	settings := make(map[int]*gachaSettings, len(snapshot.Gachas))
+	for _, v := range snapshot.Gachas {
+		settings[v.ID] = &gachaSettings{Gacha: v}
+		if v.PityRarityID != 0 {
+			settings[v.ID].Rarities = append(settings[v.ID].Rarities, rarities[v.PityRarityID])
+		}
+	}
+	for _, v := range snapshot.GachaCharacters {
+		if gacha, ok := settings[v.GachaID]; ok {
+			gacha.GachaCharacters = append(gacha.GachaCharacters, v)
+			gacha.Characters = append(gacha.Characters, characters[v.CharacterID])
+			gacha.Rarities = append(gacha.Rarities, rarities[v.RarityID])
+		}
+	}
+	for _, v := range snapshot.Guarantees {
+		if gacha, ok := settings[v.GachaID]; ok {
+			gacha.Guarantees = append(gacha.Guarantees, v)
+			gacha.Rarities = append(gacha.Rarities, rarities[v.MinRarityID])
+		}
+	}
+	for _, v := range snapshot.Steps {
+		if gacha, ok := settings[v.GachaID]; ok {
+			gacha.Steps = append(gacha.Steps, v)
+			if v.GuaranteedRarityID != 0 {
+				gacha.Rarities = append(gacha.Rarities, rarities[v.GuaranteedRarityID])
+			}
+		}
+	}
+	encoded := make(map[int]string, len(settings))
+	for gachaId, v := range settings {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		encoded[gachaId] = string(b)
+	}
+	return encoded, nil
+}
+
+// 変更前のカタログsnapshotと変更後のカタログafterを比べ、抽選テーブルに関係する設定の変わったガチャのid一覧を返す
+func (snapshot catalogSnapshot) changedGachas(after catalogSnapshot) ([]int, error) {
+	before, err := snapshot.gachaSettings()
+	if err != nil {
+		return nil, err
+	}
+	current, err := after.gachaSettings()
+	if err != nil {
+		return nil, err
+	}
+	var changed []int
+	for gachaId, v := range current {
+		if before[gachaId] != v {
+			changed = append(changed, gachaId)
+		}
+	}
+	for gachaId := range before {
+		if _, ok := current[gachaId]; !ok {
+			changed = append(changed, gachaId)
+		}
+	}
+	sort.Ints(changed)
+	return changed, nil
+}
+
+// gacha_charactersテーブルのHPを、キャラクターのHPとレアリティのHPupの合計に計算し直す
+func recomputeCharacterHP(tx *gorm.DB) error {
+	//	UPDATE gacha_characters
+	//	JOIN characters ON gacha_characters.character_id = characters.id
+	//	JOIN rarities ON gacha_characters.rarity_id = rarities.id
+	//	SET gacha_characters.HP = rarities.HPup + characters.HP
+	return tx.Exec("UPDATE gacha_characters" +
+		" JOIN characters ON gacha_characters.character_id = characters.id" +
+		" JOIN rarities ON gacha_characters.rarity_id = rarities.id" +
+		" SET gacha_characters.HP = rarities.HPup + characters.HP").Error
+}
+
+// トランザクションtxの中でカタログ全体を読み込む
+func loadCatalogSnapshot(tx *gorm.DB) (catalogSnapshot, error) {
+	var snapshot catalogSnapshot
+	// SELECT * FROM `rarities` ORDER BY id
+	if err := tx.Order("id").Find(&snapshot.Rarities).Error; err != nil {
+		return catalogSnapshot{}, err
+	}
+	// SELECT * FROM `characters` ORDER BY id
+	if err := tx.Order("id").Find(&snapshot.Characters).Error; err != nil {
+		return catalogSnapshot{}, err
+	}
+	// SELECT * FROM `gachas` ORDER BY id
+	if err := tx.Order("id").Find(&snapshot.Gachas).Error; err != nil {
+		return catalogSnapshot{}, err
+	}
+	// SELECT * FROM `gacha_characters` ORDER BY gacha_id, gacha_character_id
+	if err := tx.Order("gacha_id, gacha_character_id").Find(&snapshot.GachaCharacters).Error; err != nil {
+		return catalogSnapshot{}, err
+	}
+	// SELECT * FROM `gacha_guarantees` ORDER BY id
+	if err := tx.Order("id").Find(&snapshot.Guarantees).Error; err != nil {
+		return catalogSnapshot{}, err
+	}
+	// SELECT * FROM `gacha_steps` ORDER BY gacha_id, step
+	if err := tx.Order("gacha_id, step").Find(&snapshot.Steps).Error; err != nil {
+		return catalogSnapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// トランザクションtxの中で今のカタログ全体を記録する
+func saveCatalogVersion(tx *gorm.DB, userId string, description string) (CatalogVersion, error) {
+	snapshot, err := loadCatalogSnapshot(tx)
+	if err != nil {
+		return CatalogVersion{}, err
+	}
+	snapshotBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return CatalogVersion{}, err
+	}
+	version := CatalogVersion{UserID: userId, Description: description, Snapshot: string(snapshotBytes), CreatedAt: time.Now()}
+	//	INSERT INTO `catalog_versions` (`user_id`,`description`,`snapshot`,`created_at`)
+	//	VALUES ('95daec2b-...','update rarity 1','{"rarities":[...],...}','2021-11-01 12:00:00')
+	if err := tx.Create(&version).Error; err != nil {
+		return CatalogVersion{}, err
+	}
+	return version, nil
+}
+
+// トランザクションtxの中でカタログをsnapshotの状態に戻す
+// ユーザのキャラクターから参照されているかもしれないので、snapshotにないレアリティ、キャラクター、ガチャ、ガチャのキャラクターは消さずにretiredにする
+// 確定ルールとステップはsnapshotの内容で置き換える
+func restoreCatalogSnapshot(tx *gorm.DB, snapshot catalogSnapshot) error {
+	var rarityIds, characterIds, gachaIds []int
+	var gachaCharacterIds []string
+	for _, v := range snapshot.Rarities {
+		rarityIds = append(rarityIds, v.ID)
+	}
+	for _, v := range snapshot.Characters {
+		characterIds = append(characterIds, v.ID)
+	}
+	for _, v := range snapshot.Gachas {
+		gachaIds = append(gachaIds, v.ID)
+	}
+	for _, v := range snapshot.GachaCharacters {
+		gachaCharacterIds = append(gachaCharacterIds, v.GachaCharacterID)
+	}
+	upserts := []struct {
+		rows    interface{}
+		model   interface{}
+		column  string
+		ids     interface{}
+		present bool
+	}{
+		{&snapshot.Rarities, &Rarity{}, "id", rarityIds, len(rarityIds) != 0},
+		{&snapshot.Characters, &CatalogCharacter{}, "id", characterIds, len(characterIds) != 0},
+		{&snapshot.Gachas, &Gacha{}, "id", gachaIds, len(gachaIds) != 0},
+		{&snapshot.GachaCharacters, &GachaCharacter{}, "gacha_character_id", gachaCharacterIds, len(gachaCharacterIds) != 0},
+	}
+	for _, v := range upserts {
+		if !v.present {
+			// UPDATE `rarities` SET `retired`=true
+			if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Model(v.model).Update("retired", true).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		//	INSERT INTO `rarities` (`id`,`rarity_name`,`weight`,`HPup`,`grade`,`retired`) VALUES (1,'SR',1,1000,3,false), ...
+		//	ON DUPLICATE KEY UPDATE `rarity_name`=VALUES(`rarity_name`), ...
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(v.rows).Error; err != nil {
+			return err
+		}
+		// UPDATE `rarities` SET `retired`=true WHERE id NOT IN (1,2,3)
+		if err := tx.Model(v.model).Where(v.column+" NOT IN ?", v.ids).Update("retired", true).Error; err != nil {
+			return err
+		}
+	}
+	// DELETE FROM `gacha_guarantees`
+	if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&GachaGuarantee{}).Error; err != nil {
+		return err
+	}
+	if len(snapshot.Guarantees) != 0 {
+		if err := tx.Create(&snapshot.Guarantees).Error; err != nil {
+			return err
+		}
+	}
+	// DELETE FROM `gacha_steps`
+	if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&GachaStep{}).Error; err != nil {
+		return err
+	}
+	if len(snapshot.Steps) != 0 {
+		if err := tx.Create(&snapshot.Steps).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// カタログ全体が矛盾なく設定されていることを確認する
+// レアリティの重みと最大レベルが1以上で、ガチャのキャラクターの参照先が存在し、
+// retiredでないガチャには出るキャラクターが1体以上いることを確認する
+// ステップアップガチャのステップ番号は、1から順に抜けも重複もなく並んでいることを確認する
+func (snapshot catalogSnapshot) validate() error {
+	rarities := make(map[int]Rarity, len(snapshot.Rarities))
+	for _, v := range snapshot.Rarities {
+		if v.Weight == 0 {
+			return newAPIError(http.StatusBadRequest, "weight of rarity "+strconv.Itoa(v.ID)+" must be greater than 0.")
+		}
+		if v.MaxLevel <= 0 {
+			return newAPIError(http.StatusBadRequest, "max_level of rarity "+strconv.Itoa(v.ID)+" must be greater than 0.")
+		}
+		rarities[v.ID] = v
+	}
+	characters := make(map[int]CatalogCharacter, len(snapshot.Characters))
+	for _, v := range snapshot.Characters {
+		characters[v.ID] = v
+	}
+	gachas := make(map[int]Gacha, len(snapshot.Gachas))
+	for _, v := range snapshot.Gachas {
+		if _, ok := rarities[v.PityRarityID]; !ok && v.HardPity+v.SoftPity > 0 {
+			return newAPIError(http.StatusBadRequest, "pity_rarity_id of gacha "+strconv.Itoa(v.ID)+" is error.")
+		}
+		gachas[v.ID] = v
+	}
+	pools := make(map[int]int)
+	boxes := make(map[int]uint)
+	for _, v := range snapshot.GachaCharacters {
+		rarity, ok := rarities[v.RarityID]
+		if !ok {
+			return newAPIError(http.StatusBadRequest, "rarity_id of gacha character "+v.GachaCharacterID+" is error.")
+		}
+		character, ok := characters[v.CharacterID]
+		if !ok {
+			return newAPIError(http.StatusBadRequest, "character_id of gacha character "+v.GachaCharacterID+" is error.")
+		}
+		if _, ok := gachas[v.GachaID]; !ok {
+			return newAPIError(http.StatusBadRequest, "gacha_id of gacha character "+v.GachaCharacterID+" is error.")
+		}
+		if v.Retired || rarity.Retired || character.Retired {
+			continue
+		}
+		pools[v.GachaID] += 1
+		boxes[v.GachaID] += v.BoxCount
+	}
+	steps := make(map[int]int)
+	for _, v := range snapshot.Steps {
+		steps[v.GachaID] += 1
+	}
+	// ステップ番号の重複がなく、全て1以上ステップ数以下なら1から順に並んでいる
+	stepNumbers := make(map[GachaStep]bool, len(snapshot.Steps))
+	for _, v := range snapshot.Steps {
+		number := GachaStep{GachaID: v.GachaID, Step: v.Step}
+		if v.Step < 1 || v.Step > steps[v.GachaID] || stepNumbers[number] {
+			return newAPIError(http.StatusBadRequest, "steps of gacha "+strconv.Itoa(v.GachaID)+" must be numbered from 1 without gaps.")
+		}
+		stepNumbers[number] = true
+	}
+	for _, v := range snapshot.Gachas {
+		if v.Retired {
+			continue
+		}
+		if pools[v.ID] == 0 {
+			return newAPIError(http.StatusBadRequest, "gacha "+strconv.Itoa(v.ID)+" has no characters.")
+		}
+		if v.GachaType == gachaTypeBox && boxes[v.ID] == 0 {
+			return newAPIError(http.StatusBadRequest, "box of gacha "+strconv.Itoa(v.ID)+" is empty.")
+		}
+		if v.GachaType == gachaTypeStepUp && steps[v.ID] == 0 {
+			return newAPIError(http.StatusBadRequest, "step-up gacha "+strconv.Itoa(v.ID)+" has no steps.")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+// ガチャ1はレアリティ1と2、ガチャ2はレアリティ3のキャラクターだけを含むカタログ
+func testCatalog() catalogSnapshot {
+	return catalogSnapshot{
+		Rarities: []Rarity{
+			{ID: 1, RarityName: "N", Weight: 70, Grade: 1, MaxLevel: 50},
+			{ID: 2, RarityName: "R", Weight: 25, Grade: 2, MaxLevel: 60},
+			{ID: 3, RarityName: "SR", Weight: 5, Grade: 3, MaxLevel: 70},
+		},
+		Characters: []CatalogCharacter{
+			{ID: 1, CharacterName: "Mercury"},
+			{ID: 2, CharacterName: "Venus"},
+			{ID: 3, CharacterName: "Earth"},
+		},
+		Gachas: []Gacha{{ID: 1, GachaName: "Gacha_A"}, {ID: 2, GachaName: "Gacha_B"}},
+		GachaCharacters: []GachaCharacter{
+			{GachaCharacterID: "a1", GachaID: 1, CharacterID: 1, RarityID: 1},
+			{GachaCharacterID: "a2", GachaID: 1, CharacterID: 2, RarityID: 2},
+			{GachaCharacterID: "b1", GachaID: 2, CharacterID: 3, RarityID: 3},
+		},
+	}
+}
+
+func TestChangedGachas(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(catalog *catalogSnapshot)
+		want   []int
+	}{
+		{"nothing", func(catalog *catalogSnapshot) {}, nil},
+		{"rarity weight", func(catalog *catalogSnapshot) { catalog.Rarities[2].Weight = 10 }, []int{2}},
+		{"character name", func(catalog *catalogSnapshot) { catalog.Characters[0].CharacterName = "Mars" }, []int{1}},
+		{"rate up", func(catalog *catalogSnapshot) { catalog.GachaCharacters[1].RateUp = 2 }, []int{1}},
+		{"new gacha", func(catalog *catalogSnapshot) { catalog.Gachas = append(catalog.Gachas, Gacha{ID: 3}) }, []int{3}},
+		{"guarantee", func(catalog *catalogSnapshot) {
+			catalog.Guarantees = append(catalog.Guarantees, GachaGuarantee{ID: 1, GachaID: 2, Every: 10, MinRarityID: 3})
+		}, []int{2}},
+		{"shared rarity", func(catalog *catalogSnapshot) {
+			catalog.GachaCharacters = append(catalog.GachaCharacters, GachaCharacter{GachaCharacterID: "b2", GachaID: 2, CharacterID: 1, RarityID: 1})
+			catalog.Rarities[0].Weight = 60
+		}, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		before, after := testCatalog(), testCatalog()
+		tt.change(&after)
+		got, err := before.changedGachas(after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: changed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateStepNumbers(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []int
+		ok    bool
+	}{
+		{"contiguous", []int{1, 2, 3}, true},
+		{"unordered", []int{2, 3, 1}, true},
+		{"gap", []int{1, 3}, false},
+		{"duplicate", []int{1, 1}, false},
+		{"from zero", []int{0, 1}, false},
+	}
+	for _, tt := range tests {
+		catalog := testCatalog()
+		catalog.Gachas[0].GachaType = gachaTypeStepUp
+		for _, step := range tt.steps {
+			catalog.Steps = append(catalog.Steps, GachaStep{GachaID: 1, Step: step, Price: 10, Times: 10})
+		}
+		if err := catalog.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
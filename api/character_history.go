@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// キャラクターの履歴の操作
+const (
+	characterActionEnhance    = "enhance"
+	characterActionLimitBreak = "limit_break"
+	characterActionSell       = "sell"
+	characterActionBattle     = "battle"
+)
+
+// キャラクターの強化や限界突破、売却、戦闘での経験値の記録
+// Action: 操作の種類("enhance"、"limit_break"、"sell"、"battle")
+// Materials: 素材にしたキャラクターのuser_character_id(文字列の配列のJSON)
+// Gmtoken、TxHash: 強化で焼却した、または売却で鋳造したゲームトークンの量と、そのトランザクションのハッシュ
+// TransferID: 焼却や鋳造の記録(gmtoken_transfersテーブル)のid。送信できるとTxHashが書き込まれる
+type CharacterHistory struct {
+	HistoryID        string    `json:"history_id" gorm:"primaryKey"`
+	UserID           string    `json:"user_id"`
+	UserCharacterID  string    `json:"user_character_id"`
+	Action           string    `json:"action"`
+	LevelBefore      int       `json:"level_before"`
+	LevelAfter       int       `json:"level_after"`
+	LimitBreakBefore int       `json:"limit_break_before"`
+	LimitBreakAfter  int       `json:"limit_break_after"`
+	ExpGained        int       `json:"exp_gained"`
+	Materials        string    `json:"materials"`
+	Gmtoken          int       `json:"gmtoken"`
+	TxHash           string    `json:"tx_hash"`
+	TransferID       string    `json:"transfer_id"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// getCharacterHistories関数で返される、1回の強化や限界突破、売却の記録
+type CharacterHistoryResponse struct {
+	HistoryID        string    `json:"historyID"`
+	Action           string    `json:"action"`
+	LevelBefore      int       `json:"levelBefore"`
+	LevelAfter       int       `json:"levelAfter"`
+	LimitBreakBefore int       `json:"limitBreakBefore"`
+	LimitBreakAfter  int       `json:"limitBreakAfter"`
+	ExpGained        int       `json:"expGained"`
+	Materials        []string  `json:"materials"`
+	Gmtoken          int       `json:"gmtoken"`
+	TxHash           string    `json:"txHash,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+// getCharacterHistories関数で返される
+type CharacterHistoriesResponse struct {
+	Total     int64                      `json:"total"`
+	Offset    int                        `json:"offset"`
+	Limit     int                        `json:"limit"`
+	Histories []CharacterHistoryResponse `json:"histories"`
+}
+
+// localhost:8080/character/{userCharacterID}/histories?offset=0&limit=20でキャラクターの強化や限界突破、売却の記録を新しい順に取得
+// limitは1以上maxGachaHistoryLimit以下(省略時は20)
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetCharacterHistories(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, limit, err := parseOffsetLimit(r, 20, maxGachaHistoryLimit)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	// 素材にされたり売却されたりして消えたキャラクターの記録も見られるように、user_charactersではなく記録のuser_idで持ち主を確認する
+	query := c.DB.Model(&CharacterHistory{}).Where("user_id = ? AND user_character_id = ?", userId, mux.Vars(r)["id"])
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var histories []CharacterHistory
+	//	SELECT * FROM `character_histories`
+	//	WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_character_id = '02091c4d-1011-4615-8fbb-fd9e681153d4'
+	//	ORDER BY created_at DESC, history_id LIMIT 20 OFFSET 0
+	if err := query.Order("created_at DESC, history_id").Offset(offset).Limit(limit).Find(&histories).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	historyList := make([]CharacterHistoryResponse, 0, len(histories))
+	for _, v := range histories {
+		historyList = append(historyList, v.response())
+	}
+	RespondWithJSON(w, http.StatusOK, &CharacterHistoriesResponse{
+		Total:     total,
+		Offset:    offset,
+		Limit:     limit,
+		Histories: historyList,
+	})
+	//	{"total":2,"offset":0,"limit":20,"histories":[
+	//		{"historyID":"6b0e...","action":"limit_break","levelBefore":80,"levelAfter":80,"limitBreakBefore":0,"limitBreakAfter":1,
+	//		 "expGained":0,"materials":["ff1583af-..."],"gmtoken":0,"createdAt":"2021-09-12T12:00:00Z"},
+	//		{"historyID":"1d7c...","action":"enhance","levelBefore":1,"levelAfter":5,"limitBreakBefore":0,"limitBreakAfter":0,
+	//		 "expGained":1300,"materials":["eaaada0c-..."],"gmtoken":10,"txHash":"0xf98c...","createdAt":"2021-09-11T12:00:00Z"}
+	//	]}
+	//	が返る
+}
+
+// トランザクションtxの中で、キャラクターtargetの強化や限界突破、売却の記録を保存し、記録のidを返す
+// afterは操作した後のキャラクター、transferはゲームトークンの焼却や鋳造の記録(なければゼロ値)
+// 焼却や鋳造が済んでいればハッシュも記録し、コミットしてから送信するならsendGmtokenTransfer関数が後で書き込む
+func saveCharacterHistory(tx *gorm.DB, userId string, action string, target enhancingCharacter, after enhancingCharacter, materialIds []string, gmtoken int, transfer GmtokenTransfer) (string, error) {
+	historyId, err := createUUId()
+	if err != nil {
+		return "", err
+	}
+	if materialIds == nil {
+		materialIds = []string{}
+	}
+	materials, err := json.Marshal(materialIds)
+	if err != nil {
+		return "", err
+	}
+	history := CharacterHistory{
+		HistoryID:        historyId,
+		UserID:           userId,
+		UserCharacterID:  target.UserCharacterID,
+		Action:           action,
+		LevelBefore:      target.Level,
+		LevelAfter:       after.Level,
+		LimitBreakBefore: target.LimitBreak,
+		LimitBreakAfter:  after.LimitBreak,
+		ExpGained:        after.Exp - target.Exp,
+		Materials:        string(materials),
+		Gmtoken:          gmtoken,
+		TxHash:           transfer.TxHash,
+		TransferID:       transfer.TransferID,
+		CreatedAt:        time.Now(),
+	}
+	//	INSERT INTO `character_histories` (`history_id`,`user_id`,`user_character_id`,`action`,`level_before`,`level_after`,`limit_break_before`,`limit_break_after`,`exp_gained`,`materials`,`gmtoken`,`tx_hash`,`transfer_id`,`created_at`)
+	//	VALUES ('1d7c...','95daec2b-287c-4358-ba6f-5c29e1c3cbdf','02091c4d-...','enhance',1,5,0,0,1300,'["eaaada0c-..."]',10,'0xf98c...','4f1e...','2021-09-11 12:00:00')
+	if err := tx.Create(&history).Error; err != nil {
+		return "", err
+	}
+	return historyId, nil
+}
+
+// 強化や限界突破、売却の記録をレスポンスの形に変換
+func (history CharacterHistory) response() CharacterHistoryResponse {
+	var materials []string
+	if err := json.Unmarshal([]byte(history.Materials), &materials); err != nil {
+		log.Println("character history", history.HistoryID, "has broken materials:", err)
+	}
+	return CharacterHistoryResponse{
+		HistoryID:        history.HistoryID,
+		Action:           history.Action,
+		LevelBefore:      history.LevelBefore,
+		LevelAfter:       history.LevelAfter,
+		LimitBreakBefore: history.LimitBreakBefore,
+		LimitBreakAfter:  history.LimitBreakAfter,
+		ExpGained:        history.ExpGained,
+		Materials:        materials,
+		Gmtoken:          history.Gmtoken,
+		TxHash:           history.TxHash,
+		CreatedAt:        history.CreatedAt,
+	}
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"time"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"gorm.io/gorm"
 	gmtoken "local.packages/gmtoken"
@@ -11,6 +12,8 @@ import (
 // Idrsa: jwtトークンの作成・認証に使用するサーバーの秘密鍵
 // MinterPrivateKey: MintGmtoken関数で使用する、Minterの秘密鍵
 // ContractAddress: GameTokenコントラクトのアドレス
+// GachaTableCache: ガチャごとの抽選テーブルのキャッシュ
+// DrawJobQueue: 非同期ガチャジョブのキュー
 type Config struct {
 	Idrsa string
 	MinterPrivateKey string
@@ -18,6 +21,8 @@ type Config struct {
 	GmtokenInstance *gmtoken.Gmtoken
 	DB *gorm.DB
 	Ethclient *ethclient.Client
+	GachaTableCache *gachaTableCache
+	DrawJobQueue *drawJobQueue
 }
 
 // main関数内でconfigインスタンス作成
@@ -29,6 +34,8 @@ func NewConfig() *Config {
 		GmtokenInstance: newGmtokenInstance("ws://localhost:7545", "./GameToken_address.txt"),
 		DB: newDBConnection("../.ssh/mysql_password", "../.ssh/mysql_user"),
 		Ethclient: newEthclient("ws://localhost:7545"),
+		GachaTableCache: newGachaTableCache(time.Minute),
+		DrawJobQueue: newDrawJobQueue(100),
 	}
 }
 
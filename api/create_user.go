@@ -12,10 +12,12 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// Role: ユーザの権限("user"か"admin")。リクエストからは変更できない
 type User struct {
 	UserID     string `json:"user_id"`
 	Name       string `json:"name"`
 	PrivateKey string `json:"private_key"`
+	Role       string `json:"-" gorm:"default:user"`
 }
 
 type TokenResponse struct {
@@ -54,7 +56,7 @@ func (c *Config) CreateUser(w http.ResponseWriter, r *http.Request) {
 	privateKeyHex := hexutil.Encode(privateKeyBytes)[2:]
 	user.PrivateKey = privateKeyHex
 	// ゲームトークンを100だけ鋳造し、新規ユーザに付与
-	if err := c.MintGmtoken(100, user.PrivateKey); err != nil {
+	if _, err := c.MintGmtoken(100, user.PrivateKey); err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
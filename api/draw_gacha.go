@@ -3,47 +3,150 @@ package api
 import (
 	"encoding/json"
 	"io/ioutil"
+	"log"
 	"net/http"
-	wr "github.com/mroth/weightedrand"
+	"strconv"
+	"time"
+	"gorm.io/gorm"
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// ClientSeed: 抽選に使うクライアントシード(省略可)
+// Async: trueなら抽選をワーカーに任せ、結果は/gacha/jobs/{id}で取得する
+// Payment: 支払い方法("gmtoken"か"ticket"、省略時は"gmtoken")
 type DrawingGacha struct {
-	GachaID int `json:"gacha_id"`
-	Times   int `json:"times"`
+	GachaID    int    `json:"gacha_id"`
+	Times      int    `json:"times"`
+	ClientSeed string `json:"client_seed"`
+	Async      bool   `json:"async"`
+	Payment    string `json:"payment"`
+	// ステップアップガチャでprepareGachaDraw関数が確認したステップ番号と価格(リクエストで送られても上書きする)
+	Step  int `json:"step"`
+	Price int `json:"price"`
+	// 非同期ガチャのジョブから引くときのジョブid(リクエストでは受け取らない)
+	JobID string `json:"-"`
 }
 
+// HardPity: 天井。この回数目の抽選では必ずPityRarityIDのレアリティのキャラクターが出る(0なら天井なし)
+// SoftPity: この回数を超えると、1回ごとにPityRarityIDのレアリティの重みがSoftPityWeightUpずつ上がる(0なら確率上昇なし)
+// PityRarityID: 天井の対象となるレアリティのid
+// StartAt, EndAt: ガチャを引ける期間(nilなら期限なし)
+// GachaType: ガチャの種類("normal"、"box"、"stepup")
+// Retired: 管理者が公開を終了したガチャ(一覧に表示せず、引けない)
+type Gacha struct {
+	ID               int        `json:"id"`
+	GachaName        string     `json:"gacha_name"`
+	GachaType        string     `json:"gacha_type"`
+	HardPity         int        `json:"hard_pity"`
+	SoftPity         int        `json:"soft_pity"`
+	SoftPityWeightUp uint       `json:"soft_pity_weight_up"`
+	PityRarityID     int        `json:"pity_rarity_id"`
+	StartAt          *time.Time `json:"start_at"`
+	EndAt            *time.Time `json:"end_at"`
+	Retired          bool       `json:"retired"`
+}
+
+// RateUp: 同じレアリティの中でのピックアップ倍率(1なら通常)
+// BoxCount: ボックスガチャで、1つのボックスに入っている数
+// IsPrize: ボックスガチャの目玉のキャラクターならtrue。引くとボックスをリセットできる
+// CharacterID: charactersテーブルのid(かけらはキャラクターごとに貯まる)
+// DuplicatePolicyなどはレアリティの重複の扱いの設定
 type Character struct {
 	GachaCharacterID string `json:"gacha_character_id"`
+	CharacterID      int    `json:"character_id"`
 	CharacterName    string `json:"character_name"`
 	Weight           uint   `json:"weight"`
+	RarityID         int    `json:"rarity_id"`
+	RarityGrade      int    `json:"rarity_grade"`
+	RateUp           uint   `json:"rate_up"`
+	RarityName       string `json:"rarity_name"`
+	BoxCount         uint   `json:"box_count"`
+	IsPrize          bool   `json:"is_prize"`
+	DuplicatePolicy  string `json:"duplicate_policy"`
+	DuplicateAuto    bool   `json:"duplicate_auto"`
+	DuplicateShards  int    `json:"duplicate_shards"`
+	DuplicateRefund  int    `json:"duplicate_refund"`
 }
 
+// GachaDrawID: このキャラクターを手に入れたガチャの記録のid
+// Level: キャラクターのレベル(手に入れたときは1)、Exp: 強化で手に入れた経験値の合計、LimitBreak: 限界突破の段階
+// Locked: trueなら売却や変換などの対象にしない、Favorite: ユーザがお気に入りにしたキャラクター
 type UserCharacter struct {
-	UserCharacterID  string `json:"user_character_id"`
-	UserID           string `json:"user_id"`
-	GachaCharacterID string `json:"gacha_character_id"`
+	UserCharacterID  string    `json:"user_character_id"`
+	UserID           string    `json:"user_id"`
+	GachaCharacterID string    `json:"gacha_character_id"`
+	GachaDrawID      string    `json:"gacha_draw_id"`
+	Level            int       `json:"level"`
+	Exp              int       `json:"exp"`
+	LimitBreak       int       `json:"limit_break"`
+	Locked           bool      `json:"locked"`
+	Favorite         bool      `json:"favorite"`
+	CreatedAt        time.Time `json:"created_at"`
 }
 
+// Convertedは重複として自動で変換したときの扱い("shards"、"refund")
 type CharacterResponse struct {
 	CharacterID string `json:"characterID"`
 	Name        string `json:"name"`
+	Converted   string `json:"converted,omitempty"`
+}
+
+// これより多く引くガチャは、1回ごとの結果を保持せずにキャラクターごとの回数だけを数える
+// 結果は1回ごとの一覧では返さず、?view=summaryか非同期ジョブでまとめて返す
+const countedDrawThreshold = 10000
+
+// executeGachaDraw関数で返される、1回のガチャの抽選結果
+// DrawedはTable.Charactersのインデックスで表した、引いたキャラクターの一覧
+// Ownedは引いたキャラクターのうち、ガチャを引く前からユーザが持っていたもの
+// ConvertedはDrawedと同じ順に、重複として自動で変換したならその扱い("shards"、"refund")、変換していなければ空文字列
+// Countsはキャラクターごとに引いた回数と、そのうち変換した数、確率の変わった回で引いた数
+// 回数がcountedDrawThresholdより多い抽選では1回ごとの結果を保持せず、DrawedとConvertedはnilになる
+// Shards、Refundは変換で手に入れたかけらの合計と払い戻したゲームトークンの量、RefundTxHashは払い戻しの鋳造のトランザクションのハッシュ
+type gachaDrawResult struct {
+	DrawID         string
+	Table          *gachaTable
+	Drawed         []int
+	Owned          map[string]bool
+	Converted      []string
+	Counts         []characterCount
+	Shards         int
+	Refund         int
+	RefundTxHash   string
+	Proof          GachaDrawProof
+	ServerSeedHash string
 }
 
 // drawGacha関数で返される
+// Shards、Refundは重複を変換して手に入れたかけらの合計と払い戻したゲームトークンの量
 type ResultResponse struct {
-	Results []CharacterResponse `json:"results"`
+	Results      []CharacterResponse `json:"results"`
+	Shards       int                 `json:"shards"`
+	Refund       int                 `json:"refund"`
+	RefundTxHash string              `json:"refundTxHash,omitempty"`
+	DrawID       string              `json:"drawID"`
+	Proof        ProofResponse       `json:"proof"`
 }
 
 // localhost:8080/gacha/drawでガチャを引いて、キャラクターを取得
 // -H "x-token:yyy"でトークン情報を受け取り、認証
-// -d {"gacha_id":n, "times":x}でどのガチャを引くか、ガチャを何回引くかの情報を受け取る
+// -d {"gacha_id":n, "times":x, "client_seed":"zzz"}でどのガチャを引くか、ガチャを何回引くか、クライアントシードの情報を受け取る
+// ステップアップガチャでは今のステップで決まった回数を引くので、timesは省略できる
+// -d {..., "payment":"ticket"}ならゲームトークンの代わりにガチャチケットを使う
+// 抽選はサーバーシード、クライアントシード、ナンスから決まり、サーバーシード公開後に/gacha/verifyで検証できる
+// -d {..., "async":true}なら抽選をワーカーに任せてジョブidをすぐに返す
+// ?view=summaryなら結果を1回ごとではなく、レアリティとキャラクターごとにまとめて返す
+// countedDrawThresholdより多く引くときは、?view=summaryかasyncを指定する
 func (c *Config) DrawGacha(w http.ResponseWriter, r *http.Request) {
 	userId, err := c.getUserId(r)
 	if err != nil {
 		RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	view := r.URL.Query().Get("view")
+	if view != "" && view != "list" && view != "summary" {
+		RespondWithError(w, http.StatusBadRequest, "view is error.")
+		return
+	}
 	body, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
@@ -55,98 +158,461 @@ func (c *Config) DrawGacha(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	contains, err := c.gachaIdContains(drawingGacha.GachaID)
+	table, err := c.prepareGachaDraw(userId, &drawingGacha)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithAPIError(w, err)
 		return
 	}
-	if !contains {
-		RespondWithError(w, http.StatusBadRequest, "gacha_id is error.")
+	// 回数の多いガチャは1回ごとの結果を保持しないので、一覧では返せない
+	if !drawingGacha.Async && view != "summary" && drawingGacha.Times > countedDrawThreshold {
+		RespondWithError(w, http.StatusBadRequest, "view=summary or async is required for more than "+strconv.Itoa(countedDrawThreshold)+" draws.")
 		return
 	}
-	// 0以下回だけガチャを引くことは出来ない
-	if drawingGacha.Times <= 0 {
-		RespondWithError(w, http.StatusBadRequest, "times is error.")
+	if drawingGacha.Async {
+		job, err := c.enqueueDrawJob(userId, drawingGacha)
+		if err != nil {
+			respondWithAPIError(w, err)
+			return
+		}
+		RespondWithJSON(w, http.StatusAccepted, &DrawJobCreatedResponse{
+			JobID: job.JobID,
+		})
+		// {"jobID":"5e0c..."}が返る
 		return
 	}
-	enoughBal, err := c.checkBalance(userId, drawingGacha.Times)
+	result, err := c.executeGachaDraw(userId, drawingGacha, table, nil)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithAPIError(w, err)
 		return
 	}
-	if !enoughBal {
-		RespondWithError(w, http.StatusBadRequest, "Balance of GameToken is not enough.")
+	if view == "summary" {
+		total, rarities := summarizeCharacterCounts(result.characterCounts(), result.Owned)
+		RespondWithJSON(w, http.StatusOK, &DrawSummaryResponse{
+			Total:        total,
+			Rarities:     rarities,
+			Shards:       result.Shards,
+			Refund:       result.Refund,
+			RefundTxHash: result.RefundTxHash,
+			DrawID:       result.DrawID,
+			Proof:        result.proofResponse(),
+		})
+		//	{"total":10,"rarities":[
+		//		{"rarityID":2,"rarityName":"R","count":2,"characters":[{"characterID":"7b6a8a4e-...","name":"Venus","count":2,"new":true,"converted":1}]},
+		//		{"rarityID":3,"rarityName":"N","count":8,"characters":[...]}
+		//	],
+		//	"shards":2,"refund":0,
+		//	"drawID":"9a1f...",
+		//	"proof":{"proofID":"3c6e...","serverSeedHash":"5d4140...","clientSeed":"zzz","nonce":3}}
+		//	が返る
 		return
 	}
-	var user User
-	// SELECT * FROM `users` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
-	c.DB.Where("user_id = ?", userId).Find(&user)
-	// drawingGacha.Times分だけゲームトークンを焼却
-	if err := c.BurnGmtoken(drawingGacha.Times, user.PrivateKey); err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+	results := make([]CharacterResponse, 0, len(result.Drawed))
+	for n := range result.Drawed {
+		results = append(results, result.characterResponse(n))
+	}
+	RespondWithJSON(w, http.StatusOK, &ResultResponse{
+		Results:      results,
+		Shards:       result.Shards,
+		Refund:       result.Refund,
+		RefundTxHash: result.RefundTxHash,
+		DrawID:       result.DrawID,
+		Proof:        result.proofResponse(),
+	})
+	//	{"results":[
+	//		{"characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Sun"},
+	//		{"characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Venus","converted":"shards"},
+	//		...
+	//		{"characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Pluto"}
+	//	],
+	//	"shards":2,"refund":0,
+	//	"drawID":"9a1f...",
+	//	"proof":{"proofID":"3c6e...","serverSeedHash":"5d4140...","clientSeed":"zzz","nonce":3}}
+	//	が返る
+}
+
+// ガチャを引く前の確認をして、抽選に使う抽選テーブルを返す
+// ガチャidが存在し、開催期間内で、回数が1以上で、ゲームトークン残高が足りていることを確認する
+// ボックスガチャでは、ボックスに回数分のキャラクターが残っていることも確認する
+// ステップアップガチャでは、timesが省略されていれば今のステップの回数にする
+// ガチャチケットで支払うときは、ゲームトークン残高の代わりにチケットの枚数を確認する
+func (c *Config) prepareGachaDraw(userId string, drawingGacha *DrawingGacha) (*gachaTable, error) {
+	if drawingGacha.Payment == "" {
+		drawingGacha.Payment = paymentGmtoken
+	}
+	if drawingGacha.Payment != paymentGmtoken && drawingGacha.Payment != paymentTicket {
+		return nil, newAPIError(http.StatusBadRequest, "payment is error.")
 	}
-	charactersList, err := c.getCharacters(drawingGacha.GachaID)
+	contains, err := c.gachaIdContains(drawingGacha.GachaID)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
 	}
-	gachaCharacterIdsDrawed := drawGachaCharacterIds(charactersList, drawingGacha.Times)
-	var characterInfo CharacterResponse
-	var results []CharacterResponse
-	var userCharacters []UserCharacter
-	count := 0
-	for _, gacha_character_id := range gachaCharacterIdsDrawed {
-		character := getCharacterInfo(charactersList, gacha_character_id)
-		characterInfo = CharacterResponse{CharacterID: gacha_character_id, Name: character.CharacterName}
-		results = append(results, characterInfo)
-		userCharacterId, err := createUUId()
+	if !contains {
+		return nil, newAPIError(http.StatusBadRequest, "gacha_id is error.")
+	}
+	// 抽選テーブルはガチャごとにキャッシュしたものを使う
+	table, err := c.getGachaTable(drawingGacha.GachaID)
+	if err != nil {
+		return nil, err
+	}
+	// 開催期間外のガチャは引けない
+	if !table.Gacha.isOpen(time.Now()) {
+		return nil, newAPIError(http.StatusBadRequest, "gacha is not available now.")
+	}
+	// 支払うゲームトークン(またはチケット)の量は、通常は1回につき1、ステップアップガチャではステップの価格
+	cost := drawingGacha.Times
+	if table.Gacha.GachaType == gachaTypeStepUp {
+		step, current, err := c.currentGachaStep(userId, table)
 		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, err.Error())
-			return
+			return nil, err
 		}
-		userCharacter := UserCharacter{UserCharacterID: userCharacterId, UserID: userId, GachaCharacterID: gacha_character_id}
-		userCharacters = append(userCharacters, userCharacter)
-		count += 1
-		if count == 10000 {
-			//	INSERT INTO `user_characters` (`user_character_id`,`user_id`,`gacha_character_id`)
-			//	VALUES ('eaaada0c-3815-4da2-b791-3447a816a3e0','c2f0d74b-0321-4f87-930f-8d85350ee6d4','7b6a8a4e-0ed8-11ec-93f3-a0c58933fdce')
-			//	, ... ,
-			//	('ff1583af-3f60-43de-839c-68094286e11a','c2f0d74b-0321-4f87-930f-8d85350ee6d4','7b6d0b6d-0ed8-11ec-93f3-a0c58933fdce')
-			c.DB.Create(&userCharacters)
-			userCharacters = userCharacters[:0]
-			count = 0
+		if drawingGacha.Times == 0 {
+			drawingGacha.Times = step.Times
 		}
+		if drawingGacha.Times != step.Times {
+			return nil, newAPIError(http.StatusBadRequest, "times must be "+strconv.Itoa(step.Times)+" for the current step.")
+		}
+		cost = step.Price
+		// 実行するときは、ここで価格と残高を確認したステップから進める
+		drawingGacha.Step = current
+		drawingGacha.Price = step.Price
+	}
+	// 0以下回だけガチャを引くことは出来ない
+	if drawingGacha.Times <= 0 {
+		return nil, newAPIError(http.StatusBadRequest, "times is error.")
 	}
-	if len(userCharacters) != 0 {
-		//	INSERT INTO `user_characters` (`user_character_id`,`user_id`,`gacha_character_id`)
-		//	VALUES ('98b27372-8806-4d33-950a-68625ed6d687','c2f0d74b-0321-4f87-930f-8d85350ee6d4','7b6c0f26-0ed8-11ec-93f3-a0c58933fdce')
-		c.DB.Create(&userCharacters)
+	// ボックスガチャはボックスに残っている数より多くは引けない
+	if table.Gacha.GachaType == gachaTypeBox {
+		_, remaining, err := c.getGachaBox(c.DB, userId, table)
+		if err != nil {
+			return nil, err
+		}
+		if boxTotal(remaining) < uint(drawingGacha.Times) {
+			return nil, newAPIError(http.StatusBadRequest, "box does not have enough characters.")
+		}
 	}
-	RespondWithJSON(w, http.StatusOK, &ResultResponse{
-		Results: results,
+	if drawingGacha.Payment == paymentTicket {
+		tickets, err := c.countUsableTickets(userId, drawingGacha.GachaID)
+		if err != nil {
+			return nil, err
+		}
+		if tickets < cost {
+			return nil, newAPIError(http.StatusBadRequest, "tickets are not enough.")
+		}
+		return table, nil
+	}
+	enoughBal, err := c.checkBalance(userId, cost)
+	if err != nil {
+		return nil, err
+	}
+	if !enoughBal {
+		return nil, newAPIError(http.StatusBadRequest, "Balance of GameToken is not enough.")
+	}
+	return table, nil
+}
+
+// ゲームトークンを焼却してガチャを引き、引いたキャラクターをdbに保存する
+// 焼却の前にガチャの記録を作り、焼却、抽選、保存の進み具合に合わせて状態を更新する
+// ガチャチケットで支払うときは焼却の代わりに、キャラクターの保存と同じトランザクションでチケットを減らす
+// 進み具合は引数progressに、段階名と処理済みの件数、全体の件数で通知する(nilなら通知しない)
+func (c *Config) executeGachaDraw(userId string, drawingGacha DrawingGacha, table *gachaTable, progress func(phase string, done int, total int)) (*gachaDrawResult, error) {
+	if progress == nil {
+		progress = func(phase string, done int, total int) {}
+	}
+	// 非同期ガチャでは確認した後にキャラクターが全てretiredになっていることがあるので、引けるキャラクターがいなければ支払う前にやめる
+	if len(table.Characters) == 0 {
+		return nil, newAPIError(http.StatusBadRequest, "gacha has no characters.")
+	}
+	// 抽選に使うサーバーシードのナンスを確保
+	seed, err := c.getActiveGachaSeed(userId)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := c.reserveNonce(seed)
+	if err != nil {
+		return nil, newAPIError(http.StatusConflict, err.Error())
+	}
+	// ステップアップガチャはprepareGachaDraw関数で確認したステップの回数、価格、確定ルールで引き、ステップを1つ進める
+	cost := drawingGacha.Times
+	var step GachaStep
+	if table.Gacha.GachaType == gachaTypeStepUp {
+		// 非同期ガチャで確認した後にステップの設定が変わっていたら、確認していない価格では支払わない
+		if current := table.step(drawingGacha.Step); current.Price != drawingGacha.Price || current.Times != drawingGacha.Times {
+			return nil, newAPIError(http.StatusConflict, "step settings have changed.")
+		}
+		step, err = c.advanceGachaStep(userId, table, drawingGacha.Step)
+		if err != nil {
+			return nil, err
+		}
+		cost = drawingGacha.Price
+		table = table.withStep(step)
+	}
+	// 支払ったのにキャラクターが手に入らなかった場合に調べられるように、焼却の前にガチャの記録を残す
+	draw, err := c.createGachaDraw(userId, drawingGacha.GachaID, drawingGacha.Times, cost, drawingGacha.Payment, drawingGacha.JobID)
+	if err != nil {
+		return nil, err
+	}
+	// 支払いが済む前に失敗したときは、状態をfailedにして進めたステップを元に戻す
+	failUnpaid := func(err error) (*gachaDrawResult, error) {
+		c.updateGachaDraw(draw.DrawID, map[string]interface{}{"status": gachaDrawFailed, "error": err.Error()})
+		if step.Step != 0 {
+			if err := c.rewindGachaStep(userId, table, drawingGacha.Step); err != nil {
+				log.Println("gacha draw", draw.DrawID, "step rewind failed:", err)
+			}
+		}
+		return nil, err
+	}
+	var burn GmtokenTransfer
+	if drawingGacha.Payment == paymentGmtoken {
+		// costだけゲームトークンを焼却し、ブロックに取り込まれて成功してから抽選する
+		progress(drawPhaseBurning, 0, drawingGacha.Times)
+		burn, err = c.burnGmtokenFirst(userId, cost, gmtokenReasonGacha, draw.DrawID)
+		if err != nil {
+			return failUnpaid(err)
+		}
+		c.updateGachaDraw(draw.DrawID, map[string]interface{}{"status": gachaDrawBurned, "burn_tx_hash": burn.TxHash})
+	}
+	// 抽選にはリクエストごとに作成したRollerを使い、他のリクエストと乱数生成器を共有しない
+	roller := newHmacRoller(seed.ServerSeed, drawingGacha.ClientSeed, nonce)
+	// 回数の少ない抽選では1回ごとの結果を、回数の多い抽選ではキャラクターごとの回数だけを保持する
+	var drawed []int
+	var counts []characterCount
+	var owned map[string]bool
+	var converted []string
+	var conversions []DuplicateConversion
+	var refund GmtokenTransfer
+	var proof GachaDrawProof
+	saving := 0
+	// チケットの消費、ボックスと天井カウンターの更新、抽選の検証情報とキャラクターの保存は1つのトランザクションで行う
+	// チケットで支払うときは、途中で失敗してもチケットだけが減ってキャラクターが手に入らないことはない
+	// ボックスはこのトランザクションでロックしてから残りを確かめるので、同時に引いて足りなくなったときはここで失敗する
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		if drawingGacha.Payment == paymentTicket {
+			// costだけチケットを減らし、減らせなければ抽選しない
+			progress(drawPhaseBurning, 0, drawingGacha.Times)
+			if err := c.consumeTickets(tx, userId, drawingGacha.GachaID, cost, draw.DrawID); err != nil {
+				return err
+			}
+		}
+		// 天井か確定ルールで確率の変わった回(ボックスガチャと回数の多い抽選では使わない)
+		var boosted []bool
+		var resultHash string
+		pityCount := 0
+		if table.Gacha.GachaType == gachaTypeBox {
+			// ボックスガチャには天井がなく、ボックスから引いたキャラクターを取り除いていく
+			var err error
+			drawed, err = c.drawGachaBox(tx, userId, table, roller, drawingGacha.Times)
+			if err != nil {
+				return err
+			}
+			counts = table.countDrawed(drawed, nil, nil)
+			resultHash = hashResults(table.gachaCharacterIds(drawed))
+		} else {
+			// 前回までのガチャで積み上がった天井カウンターを引き継いで抽選する
+			// 天井カウンターはキャラクターの保存が終わるまでロックするので、同じガチャを同時に引くと1つずつ抽選する
+			var err error
+			pityCount, err = c.lockPityCount(tx, userId, drawingGacha.GachaID)
+			if err != nil {
+				return err
+			}
+			var nextPityCount int
+			if drawingGacha.Times > countedDrawThreshold {
+				var tally drawTally
+				tally, nextPityCount = table.drawCounts(roller, drawingGacha.Times, pityCount, func(done int) {
+					progress(drawPhaseRolling, done, drawingGacha.Times)
+				})
+				counts = table.tallyCounts(tally)
+				resultHash = tally.ResultHash
+			} else {
+				boosted = make([]bool, 0, drawingGacha.Times)
+				drawed = make([]int, 0, drawingGacha.Times)
+				nextPityCount = table.drawEach(roller, drawingGacha.Times, pityCount, func(i int, b bool) {
+					drawed = append(drawed, i)
+					boosted = append(boosted, b)
+				})
+				counts = table.countDrawed(drawed, nil, boosted)
+				resultHash = hashResults(table.gachaCharacterIds(drawed))
+			}
+			if err := c.savePityCount(tx, userId, drawingGacha.GachaID, nextPityCount); err != nil {
+				return err
+			}
+		}
+		// 抽選を後から再現できるように、シード、ナンス、抽選前の天井カウンターとステップを保存
+		proof = GachaDrawProof{
+			Step:       step.Step,
+			SeedID:     seed.SeedID,
+			UserID:     userId,
+			GachaID:    drawingGacha.GachaID,
+			ClientSeed: drawingGacha.ClientSeed,
+			Nonce:      nonce,
+			Times:      drawingGacha.Times,
+			PityCount:  pityCount,
+			TableHash:  table.SnapshotHash,
+			ResultHash: resultHash,
+		}
+		if err := c.saveGachaDrawProof(tx, &proof); err != nil {
+			return err
+		}
+		// 新しく手に入れたキャラクターが分かるように、保存する前に持っていたキャラクターを調べておく
+		gachaCharacterIds := make([]string, 0, len(counts))
+		for _, v := range counts {
+			gachaCharacterIds = append(gachaCharacterIds, v.GachaCharacterID)
+		}
+		var err error
+		owned, err = c.getOwnedGachaCharacterIds(tx, userId, gachaCharacterIds)
+		if err != nil {
+			return err
+		}
+		// 重複したキャラクターのうち、レアリティの設定で自動で変換するものはuser_charactersに保存せずに変換する
+		// 1回ごとの結果があれば、レスポンスで分かるように何回目を変換したかも調べる
+		if drawed != nil {
+			converted = table.autoConversions(drawed, owned)
+			counts = table.countDrawed(drawed, converted, boosted)
+		} else {
+			autoConversionCounts(counts, owned)
+		}
+		conversions, err = drawConversions(userId, draw.DrawID, counts)
+		if err != nil {
+			return err
+		}
+		for _, v := range counts {
+			saving += v.Count - v.Converted
+		}
+		progress(drawPhaseSaving, 0, saving)
+		// 変換しないキャラクターを、キャラクターごとに残す数だけ10000件ずつまとめて保存する
+		userCharacters := make([]UserCharacter, 0, 10000)
+		saved := 0
+		now := time.Now()
+		for _, v := range counts {
+			for n := 0; n < v.Count-v.Converted; n++ {
+				userCharacterId, err := createUUId()
+				if err != nil {
+					return err
+				}
+				userCharacters = append(userCharacters, UserCharacter{UserCharacterID: userCharacterId, UserID: userId, GachaCharacterID: v.GachaCharacterID, GachaDrawID: draw.DrawID, Level: 1, CreatedAt: now})
+				if len(userCharacters) == 10000 {
+					//	INSERT INTO `user_characters` (`user_character_id`,`user_id`,`gacha_character_id`,`gacha_draw_id`,`level`,`exp`,`limit_break`,`locked`,`favorite`,`created_at`)
+					//	VALUES ('eaaada0c-3815-4da2-b791-3447a816a3e0','c2f0d74b-0321-4f87-930f-8d85350ee6d4','7b6a8a4e-0ed8-11ec-93f3-a0c58933fdce','9a1f...',1,0,0,false,false,'2021-09-10 12:00:01')
+					//	, ... ,
+					//	('ff1583af-3f60-43de-839c-68094286e11a','c2f0d74b-0321-4f87-930f-8d85350ee6d4','7b6d0b6d-0ed8-11ec-93f3-a0c58933fdce','9a1f...',1,0,0,false,false,'2021-09-10 12:00:01')
+					if err := tx.Create(&userCharacters).Error; err != nil {
+						return err
+					}
+					saved += len(userCharacters)
+					userCharacters = userCharacters[:0]
+					progress(drawPhaseSaving, saved, saving)
+				}
+			}
+		}
+		if len(userCharacters) != 0 {
+			//	INSERT INTO `user_characters` (`user_character_id`,`user_id`,`gacha_character_id`,`gacha_draw_id`,`level`,`exp`,`limit_break`,`locked`,`favorite`,`created_at`)
+			//	VALUES ('98b27372-8806-4d33-950a-68625ed6d687','c2f0d74b-0321-4f87-930f-8d85350ee6d4','7b6c0f26-0ed8-11ec-93f3-a0c58933fdce','9a1f...',1,0,0,false,false,'2021-09-10 12:00:01')
+			if err := tx.Create(&userCharacters).Error; err != nil {
+				return err
+			}
+		}
+		// 一覧の並べ替えに使う値を、保存したキャラクターにまとめて設定する
+		if err := refreshCharacterSortKeys(tx, "user_characters.gacha_draw_id = ?", draw.DrawID); err != nil {
+			return err
+		}
+		// 引いたキャラクターごとの回数は、変換したものも含めて、新しく手に入れたかどうかと一緒に記録する
+		if err := saveGachaDrawCharacters(tx, draw.DrawID, counts, owned); err != nil {
+			return err
+		}
+		// 変換の記録とかけら、払い戻しの鋳造の予約も、キャラクターの保存と同じトランザクションで保存する
+		refund, err = saveDuplicateConversions(tx, conversions)
+		if err != nil {
+			return err
+		}
+		// UPDATE `gacha_draws` SET `proof_id`='3c6e...',`refund`=0,`shards`=20,`status`='completed',`updated_at`='2021-09-10 12:00:01' WHERE draw_id = '9a1f...'
+		return tx.Model(&GachaDraw{}).Where("draw_id = ?", draw.DrawID).
+			Updates(map[string]interface{}{"status": gachaDrawCompleted, "proof_id": proof.ProofID, "shards": sumConversionShards(conversions), "refund": sumConversionRefund(conversions)}).Error
 	})
-	//	{"results":[
-	//		{"characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Sun"},
-	//		{"characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Venus"},
-	//		...
-	//		{"characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Pluto"}
-	//	]}
-	//	が返る
+	if err != nil {
+		// チケットの消費はトランザクションと一緒に取り消され、焼却したゲームトークンは鋳造して返すので、支払う前に失敗したものとして扱う
+		if burn.TransferID != "" {
+			c.compensateGmtokenBurn(burn, burn.Amount)
+		}
+		return failUnpaid(err)
+	}
+	// 払い戻しはキャラクターの保存が済んでから鋳造し、失敗してもガチャは完了したものとして後で鋳造し直す
+	var refundTxHash string
+	if refund.TransferID != "" {
+		refundTxHash, err = c.sendGmtokenTransfer(refund.TransferID)
+		if err != nil {
+			log.Println("gmtoken transfer", refund.TransferID, "failed:", err)
+		}
+	}
+	progress(drawPhaseSaving, saving, saving)
+	return &gachaDrawResult{
+		DrawID:         draw.DrawID,
+		Table:          table,
+		Drawed:         drawed,
+		Counts:         counts,
+		Owned:          owned,
+		Converted:      converted,
+		Shards:         sumConversionShards(conversions),
+		Refund:         refund.Amount,
+		RefundTxHash:   refundTxHash,
+		Proof:          proof,
+		ServerSeedHash: seed.ServerSeedHash,
+	}, nil
+}
+
+// n回目に引いたキャラクターをレスポンスの形に変換
+func (result *gachaDrawResult) characterResponse(n int) CharacterResponse {
+	character := result.Table.Characters[result.Drawed[n]]
+	response := CharacterResponse{CharacterID: character.GachaCharacterID, Name: character.CharacterName}
+	if n < len(result.Converted) {
+		response.Converted = result.Converted[n]
+	}
+	return response
+}
+
+// 抽選結果から、レスポンスに含める抽選の検証情報を作成
+func (result *gachaDrawResult) proofResponse() ProofResponse {
+	return ProofResponse{
+		ProofID:        result.Proof.ProofID,
+		ServerSeedHash: result.ServerSeedHash,
+		ClientSeed:     result.Proof.ClientSeed,
+		Nonce:          result.Proof.Nonce,
+	}
 }
 
-// dbのgacha_charactersテーブルからgacha_id一覧を取得
-// 引数のgachaIdがその中に含まれていたらtrue、含まれていなかったらfalseを返す
+// dbのgacha_charactersテーブルから、ガチャidが引数gachaIdのガチャで引けるキャラクターの数を数える
+// ガチャ、キャラクター、レアリティのどれかがretiredなら引けないので数えない(抽選テーブルを作るgetCharacters関数と同じ条件)
+// 1体以上いればtrue、いなければfalseを返す
 func (c *Config) gachaIdContains(gachaId int) (bool, error) {
-	var gachaIds []int
-	// SELECT gacha_id FROM `gacha_characters`
-	c.DB.Table("gacha_characters").Select("gacha_id").Scan(&gachaIds)
-	for _, v := range gachaIds {
-		if v == gachaId {
-			return true, nil
-		}
+	var count int64
+	//	SELECT count(*)
+	//	FROM `gacha_characters`
+	//	join gachas
+	//	on gacha_characters.gacha_id = gachas.id
+	//	join characters
+	//	on gacha_characters.character_id = characters.id
+	//	join rarities
+	//	on gacha_characters.rarity_id = rarities.id
+	//	WHERE gacha_characters.gacha_id = 1 AND gachas.retired = FALSE AND gacha_characters.retired = FALSE AND characters.retired = FALSE AND rarities.retired = FALSE
+	err := c.DB.Table("gacha_characters").
+		Joins("join gachas on gacha_characters.gacha_id = gachas.id").
+		Joins("join characters on gacha_characters.character_id = characters.id").
+		Joins("join rarities on gacha_characters.rarity_id = rarities.id").
+		Where("gacha_characters.gacha_id = ? AND gachas.retired = FALSE AND gacha_characters.retired = FALSE AND characters.retired = FALSE AND rarities.retired = FALSE", gachaId).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// 引数nowの時刻がガチャの開催期間内ならtrueを返す
+func (g Gacha) isOpen(now time.Time) bool {
+	if g.StartAt != nil && now.Before(*g.StartAt) {
+		return false
+	}
+	if g.EndAt != nil && !now.Before(*g.EndAt) {
+		return false
 	}
-	return false, nil
+	return true
 }
 
 // dbのusersテーブルからuser_idが引数userIdのユーザ情報を取得
@@ -163,45 +629,23 @@ func (c *Config) checkBalance(userId string, times int) (bool, error) {
 	return times <= balance, nil
 }
 
-// charactersListからキャラクターのgacha_character_idとweightを取り出しchoicesに格納
-// times回分だけchoicesからWeighted Random Selectionを実行
-func drawGachaCharacterIds(charactersList []Character, times int) []string {
-	var choices []wr.Choice
-	for i := 0; i < len(charactersList); i++ {
-		choices = append(choices, wr.Choice{Item: charactersList[i].GachaCharacterID, Weight: charactersList[i].Weight})
-	}
-	var gachaCharacterIdsDrawed []string
-	for i := 0; i < times; i++ {
-		chooser, _ := wr.NewChooser(choices...)
-		gachaCharacterIdsDrawed = append(gachaCharacterIdsDrawed, chooser.Pick().(string))
-	}
-	return gachaCharacterIdsDrawed
-}
-
-// dbからキャラクターのgacha_character_id、名前、weightの情報を取得
-// ガチャidが引数gacha_idのキャラクターに限る
+// dbからキャラクターのgacha_character_id、キャラクターid、名前、weight、レアリティid、レアリティのgrade、ピックアップ倍率、レアリティ名、ボックスに入っている数、目玉かどうか、重複の扱いの情報を取得
+// ガチャidが引数gacha_idのキャラクターに限り、retiredのキャラクターとレアリティは含まない
+// 抽選結果はキャラクターの並び順で決まるので、同じ設定なら同じ順になるようにgacha_character_id順に返す
 func (c *Config) getCharacters(gacha_id int) ([]Character, error) {
 	var charactersList []Character
-	//	SELECT gacha_characters.gacha_character_id, characters.character_name, rarities.weight
+	//	SELECT gacha_characters.gacha_character_id, gacha_characters.character_id, characters.character_name, rarities.weight, gacha_characters.rarity_id, rarities.grade AS rarity_grade, gacha_characters.rate_up, rarities.rarity_name, gacha_characters.box_count, gacha_characters.is_prize, rarities.duplicate_policy, rarities.duplicate_auto, rarities.duplicate_shards, rarities.duplicate_refund
 	//	FROM `gacha_characters`
 	//	join characters
 	//	on gacha_characters.character_id = characters.id
 	//	join rarities
 	//	on gacha_characters.rarity_id = rarities.id
-	//	WHERE gacha_id = 1
-	c.DB.Table("gacha_characters").Select("gacha_characters.gacha_character_id, characters.character_name, rarities.weight").
+	//	WHERE gacha_id = 1 AND gacha_characters.retired = FALSE AND characters.retired = FALSE AND rarities.retired = FALSE
+	//	ORDER BY gacha_characters.gacha_character_id
+	c.DB.Table("gacha_characters").Select("gacha_characters.gacha_character_id, gacha_characters.character_id, characters.character_name, rarities.weight, gacha_characters.rarity_id, rarities.grade AS rarity_grade, gacha_characters.rate_up, rarities.rarity_name, gacha_characters.box_count, gacha_characters.is_prize, rarities.duplicate_policy, rarities.duplicate_auto, rarities.duplicate_shards, rarities.duplicate_refund").
 		Joins("join characters on gacha_characters.character_id = characters.id").
 		Joins("join rarities on gacha_characters.rarity_id = rarities.id").
-		Where("gacha_id = ?", gacha_id).Scan(&charactersList)
+		Where("gacha_id = ? AND gacha_characters.retired = FALSE AND characters.retired = FALSE AND rarities.retired = FALSE", gacha_id).
+		Order("gacha_characters.gacha_character_id").Scan(&charactersList)
 	return charactersList, nil
 }
-
-// 引数のcharactersListからGachaCharacterIDが引数gacha_character_idのデータを取得
-func getCharacterInfo(charactersList []Character, gacha_character_id string) Character {
-	for i := 0; i < len(charactersList); i++ {
-		if charactersList[i].GachaCharacterID == gacha_character_id {
-			return charactersList[i]
-		}
-	}
-	return Character{}
-}
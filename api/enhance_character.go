@@ -0,0 +1,280 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// レベル1から2に上げるのに必要な経験値。レベルLからL+1に上げるにはL倍の経験値が必要
+const levelExpBase = 100
+
+// 強化するキャラクターと同じキャラクターを素材にしたときの経験値の倍率
+const duplicateExpBonus = 2
+
+// ゲームトークン1で手に入る経験値
+const gmtokenEnhanceExp = 100
+
+// 1回の強化で素材にできるキャラクターの最大の数
+const maxEnhanceMaterials = 100
+
+// MaterialIDs: 素材にするキャラクターのuser_character_id
+// Gmtoken: 経験値に換えるゲームトークンの量(省略可)
+type EnhancingCharacter struct {
+	MaterialIDs []string `json:"material_ids"`
+	Gmtoken     int      `json:"gmtoken"`
+}
+
+// enhanceCharacter関数で返される
+// GainedExpは実際に増えた経験値(最大レベルを超える分は捨てる)、Consumedは素材にしたキャラクターの数
+// Gmtokenは経験値に換えたゲームトークンの量(最大レベルに届くのに必要な分だけ焼却する)
+// BurnTxHashは焼却のトランザクションのハッシュ(ゲームトークンを使わなかったときは含まれない)
+type EnhanceResponse struct {
+	GainedExp  int                         `json:"gainedExp"`
+	Consumed   int                         `json:"consumed"`
+	Gmtoken    int                         `json:"gmtoken"`
+	BurnTxHash string                      `json:"burnTxHash,omitempty"`
+	Character  UserCharacterDetailResponse `json:"character"`
+}
+
+// 強化するキャラクターや素材として読み込む、レベルと経験値の設定付きのユーザのキャラクター
+type enhancingCharacter struct {
+	UserCharacterID string
+	CharacterID     int
+	CharacterName   string
+	Level           int
+	Exp             int
+	LimitBreak      int
+	Locked          bool
+	MaxLevel        int
+	MaxLimitBreak   int
+	EnhanceExp      int
+}
+
+// localhost:8080/character/{userCharacterID}/enhanceでキャラクターに素材のキャラクターやゲームトークンを与えてレベルを上げる
+// ロックされたキャラクターとチームに入っているキャラクターは素材にできない
+// ゲームトークンは最大レベルに届くのに必要な分だけ、強化する前に焼却し、焼却が成功してから経験値を増やす
+// 素材のキャラクターの削除、経験値とレベルの更新、記録の保存は1つのトランザクションで行い、
+// 焼却した後にトランザクションが失敗したら、焼却した分を鋳造して返す
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"material_ids":["eaaada0c-...","ff1583af-..."], "gmtoken":10}で素材のキャラクターとゲームトークンの量を受け取る
+func (c *Config) EnhanceCharacter(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	userCharacterId := mux.Vars(r)["id"]
+	var enhancing EnhancingCharacter
+	if err := readRequestBody(r, &enhancing); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	materialIds := uniqueStrings(enhancing.MaterialIDs)
+	if len(materialIds) > maxEnhanceMaterials {
+		RespondWithError(w, http.StatusBadRequest, "material_ids is error.")
+		return
+	}
+	for _, v := range materialIds {
+		if v == userCharacterId {
+			RespondWithError(w, http.StatusBadRequest, "material_ids is error.")
+			return
+		}
+	}
+	if enhancing.Gmtoken < 0 || len(materialIds) == 0 && enhancing.Gmtoken == 0 {
+		RespondWithError(w, http.StatusBadRequest, "gmtoken is error.")
+		return
+	}
+	var burn GmtokenTransfer
+	if enhancing.Gmtoken > 0 {
+		enoughBal, err := c.checkBalance(userId, enhancing.Gmtoken)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !enoughBal {
+			RespondWithError(w, http.StatusBadRequest, "Balance of GameToken is not enough.")
+			return
+		}
+		// 焼却する量を決めるために、トランザクションの外で強化するキャラクターと素材を確認する
+		target, gained, err := getEnhancingTarget(c.DB, userId, userCharacterId, materialIds)
+		if err != nil {
+			respondWithAPIError(w, err)
+			return
+		}
+		if amount := enhanceGmtoken(target, gained, enhancing.Gmtoken); amount > 0 {
+			// 同時に強化しても、残高の足りない焼却は失敗するので経験値だけが増えることはない
+			burn, err = c.burnGmtokenFirst(userId, amount, gmtokenReasonEnhance, userCharacterId)
+			if errors.Is(err, errGmtokenTxReverted) {
+				RespondWithError(w, http.StatusBadRequest, "Balance of GameToken is not enough.")
+				return
+			}
+			if err != nil {
+				RespondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
+	response := EnhanceResponse{Consumed: len(materialIds)}
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		target, gained, err := getEnhancingTarget(tx, userId, userCharacterId, materialIds)
+		if err != nil {
+			return err
+		}
+		if len(materialIds) != 0 {
+			// DELETE FROM `user_characters` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_character_id IN ('eaaada0c-...','ff1583af-...')
+			if err := tx.Where("user_id = ? AND user_character_id IN ?", userId, materialIds).Delete(&UserCharacter{}).Error; err != nil {
+				return err
+			}
+		}
+		// 素材で足りない経験値の分だけ、焼却したゲームトークンを使う
+		response.Gmtoken = enhanceGmtoken(target, gained, burn.Amount)
+		gained += response.Gmtoken * gmtokenEnhanceExp
+		maxExp := levelExp(target.MaxLevel)
+		after := target
+		after.Exp += gained
+		if after.Exp > maxExp {
+			after.Exp = maxExp
+		}
+		after.Level = expLevel(after.Exp, target.MaxLevel)
+		response.GainedExp = after.Exp - target.Exp
+		// UPDATE `user_characters` SET `exp`=1500,`level`=5 WHERE user_character_id = '02091c4d-1011-4615-8fbb-fd9e681153d4'
+		err = tx.Model(&UserCharacter{}).Where("user_character_id = ?", userCharacterId).
+			Updates(map[string]interface{}{"exp": after.Exp, "level": after.Level}).Error
+		if err != nil {
+			return err
+		}
+		if err := refreshCharacterSortKeys(tx, "user_characters.user_character_id = ?", userCharacterId); err != nil {
+			return err
+		}
+		_, err = saveCharacterHistory(tx, userId, characterActionEnhance, target, after, materialIds, response.Gmtoken, burn)
+		return err
+	})
+	if err != nil {
+		if burn.TransferID != "" {
+			c.compensateGmtokenBurn(burn, burn.Amount)
+		}
+		respondWithAPIError(w, err)
+		return
+	}
+	// 焼却してからロックするまでに他のリクエストで経験値が増えて、焼却した分を使い切らなかったときは余りを返す
+	if unused := burn.Amount - response.Gmtoken; unused > 0 {
+		c.compensateGmtokenBurn(burn, unused)
+	}
+	response.BurnTxHash = burn.TxHash
+	row, err := c.getUserCharacterDetail(userId, userCharacterId)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	response.Character = row.response()
+	RespondWithJSON(w, http.StatusOK, &response)
+	//	{"gainedExp":1300,"consumed":2,"gmtoken":10,"burnTxHash":"0xf98c...",
+	//	"character":{"userCharacterID":"02091c4d-...","name":"Mercury",...,"hp":2400,"level":5,"exp":1500,"nextLevelExp":2000,"maxLevel":80,...}}
+	//	が返る
+}
+
+// 強化するキャラクターと素材を読み込み、強化できることと素材にできることを確認する
+// 強化するキャラクターと、素材から手に入る経験値の合計を返す
+// トランザクションの中で呼べば、強化するキャラクターと素材の行をロックする
+func getEnhancingTarget(tx *gorm.DB, userId string, userCharacterId string, materialIds []string) (enhancingCharacter, int, error) {
+	targets, err := getEnhancingCharacters(tx, userId, []string{userCharacterId})
+	if err != nil {
+		return enhancingCharacter{}, 0, err
+	}
+	if len(targets) == 0 {
+		return enhancingCharacter{}, 0, newAPIError(http.StatusNotFound, "character is not found.")
+	}
+	target := targets[0]
+	if target.Level >= target.MaxLevel {
+		return enhancingCharacter{}, 0, newAPIError(http.StatusBadRequest, "level is max.")
+	}
+	if len(materialIds) == 0 {
+		return target, 0, nil
+	}
+	materials, err := getEnhancingCharacters(tx, userId, materialIds)
+	if err != nil {
+		return enhancingCharacter{}, 0, err
+	}
+	if len(materials) != len(materialIds) {
+		return enhancingCharacter{}, 0, newAPIError(http.StatusBadRequest, "material_ids is error.")
+	}
+	gained := 0
+	for _, v := range materials {
+		if v.Locked {
+			return enhancingCharacter{}, 0, newAPIError(http.StatusBadRequest, v.CharacterName+" is locked.")
+		}
+		gained += v.materialExp(target)
+	}
+	if err := checkNotInTeam(tx, userId, materialIds); err != nil {
+		return enhancingCharacter{}, 0, err
+	}
+	return target, gained, nil
+}
+
+// 素材から経験値gainedを手に入れたtargetが、最大レベルに届くのに使うゲームトークンの量
+// 引数gmtokenより多くは使わない
+func enhanceGmtoken(target enhancingCharacter, gained int, gmtoken int) int {
+	missing := levelExp(target.MaxLevel) - target.Exp - gained
+	if missing <= 0 {
+		return 0
+	}
+	amount := (missing + gmtokenEnhanceExp - 1) / gmtokenEnhanceExp
+	if amount > gmtoken {
+		return gmtoken
+	}
+	return amount
+}
+
+// トランザクションtxの中で、ユーザが持っているキャラクターのうちuser_character_idが引数userCharacterIdsのものを、レベルと限界突破の設定付きで取得
+// MaxLevelは限界突破で上がった後の最大レベル
+// 他のリクエストが同時に強化や限界突破、素材にしないように、行をロックする
+func getEnhancingCharacters(tx *gorm.DB, userId string, userCharacterIds []string) ([]enhancingCharacter, error) {
+	var characters []enhancingCharacter
+	//	SELECT user_characters.user_character_id, gacha_characters.character_id, characters.character_name, user_characters.level, user_characters.exp, user_characters.limit_break, user_characters.locked,
+	//	rarities.max_level + user_characters.limit_break * rarities.limit_break_levels AS max_level, rarities.max_limit_break, rarities.enhance_exp
+	//	FROM `user_characters`
+	//	join gacha_characters
+	//	on user_characters.gacha_character_id = gacha_characters.gacha_character_id
+	//	join characters
+	//	on gacha_characters.character_id = characters.id
+	//	join rarities
+	//	on gacha_characters.rarity_id = rarities.id
+	//	WHERE user_characters.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_characters.user_character_id IN ('eaaada0c-...','ff1583af-...')
+	//	FOR UPDATE
+	err := tx.Table("user_characters").
+		Select("user_characters.user_character_id, gacha_characters.character_id, characters.character_name, user_characters.level, user_characters.exp, user_characters.limit_break, user_characters.locked, "+userCharacterMaxLevel+" AS max_level, rarities.max_limit_break, rarities.enhance_exp").
+		Joins("join gacha_characters on user_characters.gacha_character_id = gacha_characters.gacha_character_id").
+		Joins("join characters on gacha_characters.character_id = characters.id").
+		Joins("join rarities on gacha_characters.rarity_id = rarities.id").
+		Where("user_characters.user_id = ? AND user_characters.user_character_id IN ?", userId, userCharacterIds).
+		Clauses(clause.Locking{Strength: "UPDATE"}).Scan(&characters).Error
+	return characters, err
+}
+
+// 素材にしたときにtargetが手に入れる経験値
+// レアリティの経験値に素材のレベルをかけ、同じキャラクターならさらに倍率をかける
+func (material enhancingCharacter) materialExp(target enhancingCharacter) int {
+	exp := material.EnhanceExp * material.Level
+	if material.CharacterID == target.CharacterID {
+		exp *= duplicateExpBonus
+	}
+	return exp
+}
+
+// レベル1から引数levelまで上げるのに必要な経験値の合計
+func levelExp(level int) int {
+	return levelExpBase * level * (level - 1) / 2
+}
+
+// 経験値の合計expで到達するレベル。maxLevelを超えない
+func expLevel(exp int, maxLevel int) int {
+	level := 1
+	for level < maxLevel && levelExp(level+1) <= exp {
+		level += 1
+	}
+	return level
+}
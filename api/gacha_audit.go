@@ -0,0 +1,531 @@
+package api
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// 排出率の監査
+// 期間内にガチャで引かれたキャラクターをgacha_draw_charactersテーブルから数え、引いたときの抽選テーブルの重みから計算した排出率とカイ二乗適合度検定で比べる
+// 期間の途中で重みが変わっていれば、抽選テーブルの設定(gacha_table_snapshots)ごとに期待度数を計算して足し合わせる
+// 天井と確定ルールで確率の変わった回(gacha_draw_characters.boosted)は重み通りに引かれないので検定から除く
+const (
+	// p値がこれより小さければ、結果が重みからずれているとして警告する
+	gachaAuditAlpha = 0.001
+	// 期待度数がこれより小さいキャラクターはまとめて1つの区分として検定する
+	gachaAuditMinExpected = 5.0
+)
+
+// 監査の警告の回数と、ガチャごとの最新のp値(/debug/varsで公開する)
+var (
+	gachaAuditAlerts  = expvar.NewInt("gacha_audit_alerts")
+	gachaAuditPValues = expvar.NewMap("gacha_audit_p_values")
+)
+
+// 1回の監査の結果
+// Pulls: 検定に使った回数(確率の変わった回と、引いたときの抽選テーブルが分からない回を除く)
+// BoostedPulls: 天井か確定ルールで確率の変わった回数
+// ExcludedPulls: 引いたときの抽選テーブルの設定が見つからない回数
+// DegreesOfFreedom: 自由度(0なら回数が少なすぎて検定していない)
+// Alert: PValueがAlphaより小さく、結果が重みからずれている
+// Details: キャラクターごとの実際の回数と期待度数(GachaAuditCategoryの配列のJSON)
+type GachaAuditReport struct {
+	ReportID         string    `json:"report_id" gorm:"primaryKey"`
+	GachaID          int       `json:"gacha_id"`
+	PeriodStart      time.Time `json:"period_start"`
+	PeriodEnd        time.Time `json:"period_end"`
+	Pulls            int       `json:"pulls"`
+	BoostedPulls     int       `json:"boosted_pulls"`
+	ExcludedPulls    int       `json:"excluded_pulls"`
+	ChiSquared       float64   `json:"chi_squared"`
+	DegreesOfFreedom int       `json:"degrees_of_freedom"`
+	PValue           float64   `json:"p_value"`
+	Alpha            float64   `json:"alpha"`
+	Alert            bool      `json:"alert"`
+	Details          string    `json:"details"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// 監査でのキャラクターごとの実際の回数と期待度数
+type GachaAuditCategory struct {
+	CharacterID string  `json:"characterID"`
+	Name        string  `json:"name"`
+	RarityName  string  `json:"rarityName"`
+	Probability float64 `json:"probability"`
+	Observed    int     `json:"observed"`
+	Expected    float64 `json:"expected"`
+}
+
+// 監査の結果のレスポンス
+type GachaAuditReportResponse struct {
+	ReportID         string               `json:"reportID"`
+	GachaID          int                  `json:"gachaID"`
+	PeriodStart      time.Time            `json:"periodStart"`
+	PeriodEnd        time.Time            `json:"periodEnd"`
+	Pulls            int                  `json:"pulls"`
+	BoostedPulls     int                  `json:"boostedPulls"`
+	ExcludedPulls    int                  `json:"excludedPulls"`
+	ChiSquared       float64              `json:"chiSquared"`
+	DegreesOfFreedom int                  `json:"degreesOfFreedom"`
+	PValue           float64              `json:"pValue"`
+	Alpha            float64              `json:"alpha"`
+	Alert            bool                 `json:"alert"`
+	Categories       []GachaAuditCategory `json:"categories"`
+	CreatedAt        time.Time            `json:"createdAt"`
+}
+
+// getGachaAudits関数で返される
+type GachaAuditsResponse struct {
+	Reports []GachaAuditReportResponse `json:"reports"`
+}
+
+// 監査を実行するときに受け取る
+type AuditingGacha struct {
+	GachaID int       `json:"gacha_id"`
+	StartAt time.Time `json:"start_at"`
+	EndAt   time.Time `json:"end_at"`
+}
+
+// gacha_draw_charactersテーブルを、抽選テーブルの設定とキャラクターごとに数えた結果
+type gachaAuditCount struct {
+	TableHash        string
+	GachaCharacterID string
+	Count            int
+	Boosted          int
+}
+
+// intervalの区切り(24時間ならUTCの0時)ごとに、直前のintervalの期間について全てのガチャの監査を実行するゴルーチンを起動する
+// 起動したときにも、直前の期間でまだ監査していないガチャがあれば監査する
+func (c *Config) StartGachaAudit(interval time.Duration) {
+	go func() {
+		end := time.Now().Truncate(interval)
+		c.auditAllGachas(end.Add(-interval), end)
+		for {
+			next := end.Add(interval)
+			time.Sleep(time.Until(next))
+			c.auditAllGachas(end, next)
+			end = next
+		}
+	}()
+}
+
+// retiredでない、ボックスガチャ以外の全てのガチャの監査を実行する
+// 同じ期間の監査の結果がすでにあるガチャは飛ばす
+// 失敗したガチャはログに残して次のガチャに進む
+func (c *Config) auditAllGachas(start time.Time, end time.Time) {
+	var gachaIds []int
+	// SELECT id FROM `gachas` WHERE retired = FALSE AND gacha_type <> 'box'
+	if err := c.DB.Table("gachas").Where("retired = FALSE AND gacha_type <> ?", gachaTypeBox).Pluck("id", &gachaIds).Error; err != nil {
+		log.Println("gacha audit failed:", err)
+		return
+	}
+	var audited []int
+	// SELECT gacha_id FROM `gacha_audit_reports` WHERE period_start = '2021-11-01 00:00:00' AND period_end = '2021-11-02 00:00:00'
+	if err := c.DB.Table("gacha_audit_reports").Where("period_start = ? AND period_end = ?", start, end).Pluck("gacha_id", &audited).Error; err != nil {
+		log.Println("gacha audit failed:", err)
+		return
+	}
+	skip := make(map[int]bool, len(audited))
+	for _, gachaId := range audited {
+		skip[gachaId] = true
+	}
+	for _, gachaId := range gachaIds {
+		if skip[gachaId] {
+			continue
+		}
+		if _, err := c.auditGacha(gachaId, start, end); err != nil {
+			log.Println("gacha audit", gachaId, "failed:", err)
+		}
+	}
+}
+
+// localhost:8080/admin/gacha/audits?gacha_id=1&offset=0&limit=20で監査の結果を新しい順に取得
+// gacha_idを省略すると全てのガチャの結果を返す
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+func (c *Config) GetGachaAudits(w http.ResponseWriter, r *http.Request) {
+	if _, err := c.requireAdmin(r); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	offset, limit, err := parseOffsetLimit(r, 20, 100)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	query := c.DB.Order("created_at DESC").Offset(offset).Limit(limit)
+	if v := r.URL.Query().Get("gacha_id"); v != "" {
+		gachaId, err := strconv.Atoi(v)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "gacha_id is error.")
+			return
+		}
+		query = query.Where("gacha_id = ?", gachaId)
+	}
+	var reports []GachaAuditReport
+	// SELECT * FROM `gacha_audit_reports` WHERE gacha_id = 1 ORDER BY created_at DESC LIMIT 20
+	if err := query.Find(&reports).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	reportList := make([]GachaAuditReportResponse, 0, len(reports))
+	for _, report := range reports {
+		reportList = append(reportList, report.response())
+	}
+	RespondWithJSON(w, http.StatusOK, &GachaAuditsResponse{
+		Reports: reportList,
+	})
+	//	{"reports":[
+	//		{"reportID":"5d1c...","gachaID":1,"periodStart":"2021-11-01T00:00:00Z","periodEnd":"2021-11-02T00:00:00Z",
+	//		 "pulls":91234,"boostedPulls":9876,"excludedPulls":0,"chiSquared":8.1,"degreesOfFreedom":9,"pValue":0.52,"alpha":0.001,"alert":false,
+	//		 "categories":[{"characterID":"7b6a...","name":"Mercury","rarityName":"SR","probability":0.01,"observed":905,"expected":912.34},...],
+	//		 "createdAt":"2021-11-02T00:00:00Z"},
+	//		...
+	//	]}
+	//	が返る
+}
+
+// localhost:8080/debug/varsで監査の警告の回数などのメトリクスを取得
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+func (c *Config) GetDebugVars(w http.ResponseWriter, r *http.Request) {
+	if _, err := c.requireAdmin(r); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	expvar.Handler().ServeHTTP(w, r)
+	// レスポンスの例
+	//	{"cmdline":["./app"],"gacha_audit_alerts":1,"gacha_audit_p_values":{"1":0.52,"2":0.0004},"memstats":{...}}
+	//	が返る
+}
+
+// localhost:8080/admin/gacha/auditsで指定した期間の監査をすぐに実行
+// retiredのガチャも監査できる
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"gacha_id":1, "start_at":"2021-11-01T00:00:00Z", "end_at":"2021-11-02T00:00:00Z"}で監査するガチャと期間を受け取る
+func (c *Config) RunGachaAudit(w http.ResponseWriter, r *http.Request) {
+	if _, err := c.requireAdmin(r); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	var auditingGacha AuditingGacha
+	if err := readRequestBody(r, &auditingGacha); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	if !auditingGacha.StartAt.Before(auditingGacha.EndAt) {
+		RespondWithError(w, http.StatusBadRequest, "start_at must be before end_at.")
+		return
+	}
+	report, err := c.auditGacha(auditingGacha.GachaID, auditingGacha.StartAt, auditingGacha.EndAt)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, report.response())
+	//	{"reportID":"5d1c...","gachaID":1,...,"pValue":0.52,"alpha":0.001,"alert":false,"categories":[...],...}
+	//	が返る
+}
+
+// ガチャidが引数gachaIdのガチャの、start以降end未満に引かれたキャラクターを監査して結果を保存する
+// 期待度数は今の重みではなく、それぞれの回を引いたときの抽選テーブルの設定から計算する
+// 結果が重みからずれていればログに残し、警告の回数を増やす
+func (c *Config) auditGacha(gachaId int, start time.Time, end time.Time) (*GachaAuditReport, error) {
+	gacha, err := c.getGacha(gachaId)
+	if err != nil {
+		return nil, err
+	}
+	if gacha.ID == 0 {
+		return nil, newAPIError(http.StatusBadRequest, "gacha_id is error.")
+	}
+	if gacha.GachaType == gachaTypeBox {
+		return nil, newAPIError(http.StatusBadRequest, "box gachas are not audited.")
+	}
+	var counts []gachaAuditCount
+	//	SELECT gacha_draw_proofs.table_hash, gacha_draw_characters.gacha_character_id, SUM(gacha_draw_characters.count) AS count, SUM(gacha_draw_characters.boosted) AS boosted
+	//	FROM `gacha_draw_characters`
+	//	join gacha_draws
+	//	on gacha_draw_characters.gacha_draw_id = gacha_draws.draw_id
+	//	join gacha_draw_proofs
+	//	on gacha_draws.proof_id = gacha_draw_proofs.proof_id
+	//	WHERE gacha_draws.gacha_id = 1 AND gacha_draws.created_at >= '2021-11-01 00:00:00' AND gacha_draws.created_at < '2021-11-02 00:00:00'
+	//	GROUP BY gacha_draw_proofs.table_hash, gacha_draw_characters.gacha_character_id
+	err = c.DB.Table("gacha_draw_characters").
+		Select("gacha_draw_proofs.table_hash, gacha_draw_characters.gacha_character_id, SUM(gacha_draw_characters.count) AS count, SUM(gacha_draw_characters.boosted) AS boosted").
+		Joins("join gacha_draws on gacha_draw_characters.gacha_draw_id = gacha_draws.draw_id").
+		Joins("join gacha_draw_proofs on gacha_draws.proof_id = gacha_draw_proofs.proof_id").
+		Where("gacha_draws.gacha_id = ? AND gacha_draws.created_at >= ? AND gacha_draws.created_at < ?", gachaId, start, end).
+		Group("gacha_draw_proofs.table_hash, gacha_draw_characters.gacha_character_id").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	reportId, err := createUUId()
+	if err != nil {
+		return nil, err
+	}
+	report := GachaAuditReport{ReportID: reportId, GachaID: gachaId, PeriodStart: start, PeriodEnd: end, Alpha: gachaAuditAlpha, PValue: 1, CreatedAt: time.Now()}
+	// 引いたときの抽選テーブルを設定ごとに読み込む
+	tables := make(map[string]*gachaTable)
+	for _, v := range counts {
+		if _, ok := tables[v.TableHash]; ok {
+			continue
+		}
+		tables[v.TableHash], err = c.loadGachaTableSnapshot(v.TableHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	categories := report.countAuditCategories(counts, tables)
+	observed, expected := chiSquaredCells(categories, gachaAuditMinExpected)
+	if len(observed) >= 2 {
+		report.ChiSquared = chiSquared(observed, expected)
+		report.DegreesOfFreedom = len(observed) - 1
+		report.PValue = chiSquaredPValue(report.ChiSquared, report.DegreesOfFreedom)
+		report.Alert = report.PValue < gachaAuditAlpha
+	}
+	details, err := json.Marshal(categories)
+	if err != nil {
+		return nil, err
+	}
+	report.Details = string(details)
+	//	INSERT INTO `gacha_audit_reports` (`report_id`,`gacha_id`,`period_start`,`period_end`,`pulls`,...,`created_at`)
+	//	VALUES ('5d1c...',1,'2021-11-01 00:00:00','2021-11-02 00:00:00',91234,...,'2021-11-02 00:00:00')
+	if err := c.DB.Create(&report).Error; err != nil {
+		return nil, err
+	}
+	gachaAuditPValues.Set(strconv.Itoa(gachaId), expvarFloat(report.PValue))
+	if report.Alert {
+		gachaAuditAlerts.Add(1)
+		log.Printf("gacha audit alert: gacha %d from %s to %s deviates from the configured weights (chi2=%.2f, df=%d, p=%.3g < %g, report %s)",
+			gachaId, start.Format(time.RFC3339), end.Format(time.RFC3339), report.ChiSquared, report.DegreesOfFreedom, report.PValue, gachaAuditAlpha, report.ReportID)
+	}
+	return &report, nil
+}
+
+// 抽選テーブルの設定とキャラクターごとに数えた回数countsから、キャラクターごとの実際の回数と期待度数を計算する
+// tablesは設定のハッシュから抽選テーブルを引く(見つからなかった設定はnil)
+// 設定ごとの排出率に、その設定で確率の変わらない回に引いた回数を掛けて期待度数を足し合わせる
+// 検定に使った回数、確率の変わった回数、除いた回数はreportに書き込む
+func (report *GachaAuditReport) countAuditCategories(counts []gachaAuditCount, tables map[string]*gachaTable) []GachaAuditCategory {
+	// 抽選テーブルの設定ごとに、確率の変わらない回の数を数える
+	pulls := make(map[string]int)
+	for _, v := range counts {
+		report.BoostedPulls += v.Boosted
+		pulls[v.TableHash] += v.Count - v.Boosted
+	}
+	// 設定ごとの排出率に、その設定で引いた回数を掛けて期待度数を足し合わせる
+	categories := make([]GachaAuditCategory, 0)
+	index := make(map[string]int)
+	for tableHash, n := range pulls {
+		table := tables[tableHash]
+		if table == nil || len(table.Characters) == 0 {
+			report.ExcludedPulls += n
+			delete(pulls, tableHash)
+			continue
+		}
+		for _, category := range table.auditCategories() {
+			i, ok := index[category.CharacterID]
+			if !ok {
+				i = len(categories)
+				index[category.CharacterID] = i
+				categories = append(categories, GachaAuditCategory{CharacterID: category.CharacterID, Name: category.Name, RarityName: category.RarityName})
+			}
+			categories[i].Expected += category.Probability * float64(n)
+		}
+		report.Pulls += n
+	}
+	for _, v := range counts {
+		if _, ok := pulls[v.TableHash]; !ok {
+			continue
+		}
+		// 設定に含まれないキャラクターは記録が壊れているので、検定から除く
+		if _, ok := tables[v.TableHash].index[v.GachaCharacterID]; !ok {
+			report.ExcludedPulls += v.Count - v.Boosted
+			report.Pulls -= v.Count - v.Boosted
+			continue
+		}
+		categories[index[v.GachaCharacterID]].Observed += v.Count - v.Boosted
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Expected != categories[j].Expected {
+			return categories[i].Expected > categories[j].Expected
+		}
+		return categories[i].CharacterID < categories[j].CharacterID
+	})
+	// 期間全体での排出率は、設定ごとの排出率を引いた回数で重み付けした平均になる
+	if report.Pulls > 0 {
+		for i := range categories {
+			categories[i].Probability = categories[i].Expected / float64(report.Pulls)
+		}
+	}
+	return categories
+}
+
+// 確率の変わらない回での、キャラクターごとの排出率を返す
+// レアリティの排出率(重みの合計の割合)に、レアリティの中でのピックアップ倍率の割合を掛けたもの
+func (t *gachaTable) auditCategories() []GachaAuditCategory {
+	categories := make([]GachaAuditCategory, len(t.Characters))
+	totalWeight := float64(t.rarityTotals[len(t.rarityTotals)-1])
+	for _, pool := range t.pools {
+		rateUpTotal := float64(pool.totals[len(pool.totals)-1])
+		for _, i := range pool.Members {
+			character := t.Characters[i]
+			categories[i] = GachaAuditCategory{
+				CharacterID: character.GachaCharacterID,
+				Name:        character.CharacterName,
+				RarityName:  character.RarityName,
+				Probability: float64(pool.Weight) / totalWeight * float64(rateUpWeight(character)) / rateUpTotal,
+			}
+		}
+	}
+	return categories
+}
+
+// カイ二乗検定に使う区分ごとの実際の回数と期待度数を返す
+// 期待度数がminExpectedより小さいキャラクターは、期待度数の小さい順にminExpected以上になるまで1つの区分にまとめる
+// まとめてもminExpectedに届かなければ、残りで一番期待度数の小さい区分に足す
+func chiSquaredCells(categories []GachaAuditCategory, minExpected float64) ([]float64, []float64) {
+	sorted := make([]GachaAuditCategory, len(categories))
+	copy(sorted, categories)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Expected < sorted[j].Expected
+	})
+	var observed, expected []float64
+	mergedObserved, mergedExpected, merged := 0.0, 0.0, 0
+	for _, v := range sorted {
+		if v.Expected < minExpected || (merged > 0 && mergedExpected < minExpected) {
+			mergedObserved += float64(v.Observed)
+			mergedExpected += v.Expected
+			merged += 1
+			continue
+		}
+		observed = append(observed, float64(v.Observed))
+		expected = append(expected, v.Expected)
+	}
+	if merged > 0 {
+		if mergedExpected >= minExpected || len(observed) == 0 {
+			observed = append(observed, mergedObserved)
+			expected = append(expected, mergedExpected)
+		} else {
+			observed[0] += mergedObserved
+			expected[0] += mergedExpected
+		}
+	}
+	// 期待度数が0の区分は検定できないので除く
+	n := 0
+	for i := range expected {
+		if expected[i] > 0 {
+			observed[n], expected[n] = observed[i], expected[i]
+			n++
+		}
+	}
+	return observed[:n], expected[:n]
+}
+
+// カイ二乗統計量 Σ(実際の回数-期待度数)^2/期待度数 を返す
+func chiSquared(observed []float64, expected []float64) float64 {
+	x := 0.0
+	for i := range observed {
+		d := observed[i] - expected[i]
+		x += d * d / expected[i]
+	}
+	return x
+}
+
+// 自由度dfのカイ二乗分布で、統計量がx以上になる確率(p値)を返す
+// 正則化された上側不完全ガンマ関数Q(df/2, x/2)に等しい
+func chiSquaredPValue(x float64, df int) float64 {
+	if x <= 0 {
+		return 1
+	}
+	return upperIncompleteGamma(float64(df)/2, x/2)
+}
+
+// 正則化された上側不完全ガンマ関数Q(a, x)を返す
+// x < a+1では級数展開でP(a, x)を求めて1から引き、それ以外では連分数展開で直接求める
+func upperIncompleteGamma(a float64, x float64) float64 {
+	if x < a+1 {
+		return 1 - lowerGammaSeries(a, x)
+	}
+	return upperGammaContinuedFraction(a, x)
+}
+
+// 正則化された下側不完全ガンマ関数P(a, x)を級数展開で求める
+func lowerGammaSeries(a float64, x float64) float64 {
+	lgamma, _ := math.Lgamma(a)
+	term := 1 / a
+	sum := term
+	for n := 1; n < 1000; n++ {
+		term *= x / (a + float64(n))
+		sum += term
+		if math.Abs(term) < math.Abs(sum)*1e-15 {
+			break
+		}
+	}
+	return sum * math.Exp(-x+a*math.Log(x)-lgamma)
+}
+
+// 正則化された上側不完全ガンマ関数Q(a, x)を連分数展開(修正Lentz法)で求める
+func upperGammaContinuedFraction(a float64, x float64) float64 {
+	const tiny = 1e-300
+	lgamma, _ := math.Lgamma(a)
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < 1000; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+	return math.Exp(-x+a*math.Log(x)-lgamma) * h
+}
+
+// 監査の結果をレスポンスの形に変換
+func (report *GachaAuditReport) response() GachaAuditReportResponse {
+	categories := make([]GachaAuditCategory, 0)
+	if err := json.Unmarshal([]byte(report.Details), &categories); err != nil {
+		log.Println("gacha audit report", report.ReportID, "has broken details:", err)
+	}
+	return GachaAuditReportResponse{
+		ReportID:         report.ReportID,
+		GachaID:          report.GachaID,
+		PeriodStart:      report.PeriodStart,
+		PeriodEnd:        report.PeriodEnd,
+		Pulls:            report.Pulls,
+		BoostedPulls:     report.BoostedPulls,
+		ExcludedPulls:    report.ExcludedPulls,
+		ChiSquared:       report.ChiSquared,
+		DegreesOfFreedom: report.DegreesOfFreedom,
+		PValue:           report.PValue,
+		Alpha:            report.Alpha,
+		Alert:            report.Alert,
+		Categories:       categories,
+		CreatedAt:        report.CreatedAt,
+	}
+}
+
+// expvar.Mapに入れるfloat64の値
+func expvarFloat(v float64) *expvar.Float {
+	f := new(expvar.Float)
+	f.Set(v)
+	return f
+}
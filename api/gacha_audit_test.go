@@ -0,0 +1,67 @@
+package api
+
+import (
+	"testing"
+)
+
+// 抽選テーブルtableでtimes回引いた結果を、監査で数える形にする
+func auditCounts(table *gachaTable, tableHash string, roller Roller, times int, pityCount int) []gachaAuditCount {
+	counts := make([]gachaAuditCount, len(table.Characters))
+	for i, character := range table.Characters {
+		counts[i] = gachaAuditCount{TableHash: tableHash, GachaCharacterID: character.GachaCharacterID}
+	}
+	table.drawEach(roller, times, pityCount, func(i int, boosted bool) {
+		counts[i].Count += 1
+		if boosted {
+			counts[i].Boosted += 1
+		}
+	})
+	return counts
+}
+
+// 監査の結果がずれていればtrueを返す
+func auditAlert(categories []GachaAuditCategory) bool {
+	observed, expected := chiSquaredCells(categories, gachaAuditMinExpected)
+	return chiSquaredPValue(chiSquared(observed, expected), len(observed)-1) < gachaAuditAlpha
+}
+
+func TestAuditUsesWeightsAtPullTime(t *testing.T) {
+	gacha := Gacha{ID: 1, SoftPity: 20, SoftPityWeightUp: 50, PityRarityID: testRaritySR}
+	before := newGachaTable(gacha, testCharacters(), nil)
+	// 期間の途中でSRの重みを上げ、Nのキャラクターを1体外した
+	characters := testCharacters()[1:]
+	characters[3].Weight = 100
+	characters[4].Weight = 100
+	after := newGachaTable(gacha, characters, nil)
+
+	roller := NewSeededRoller(6)
+	counts := append(auditCounts(before, "before", roller, 50000, 0), auditCounts(after, "after", roller, 50000, 0)...)
+
+	var report GachaAuditReport
+	categories := report.countAuditCategories(counts, map[string]*gachaTable{"before": before, "after": after})
+	if auditAlert(categories) {
+		t.Errorf("audit with the weights at pull time alerted: %+v", categories)
+	}
+	if report.Pulls+report.BoostedPulls != 100000 || report.BoostedPulls == 0 || report.ExcludedPulls != 0 {
+		t.Errorf("pulls = %d, boosted = %d, excluded = %d", report.Pulls, report.BoostedPulls, report.ExcludedPulls)
+	}
+	if len(categories) != len(before.Characters) {
+		t.Errorf("categories = %d, want %d", len(categories), len(before.Characters))
+	}
+
+	// 今の重みだけで監査すると、前の重みで引いた回がずれて見える
+	var current GachaAuditReport
+	if !auditAlert(current.countAuditCategories(counts, map[string]*gachaTable{"before": after, "after": after})) {
+		t.Error("audit with only the current weights did not alert")
+	}
+}
+
+func TestAuditExcludesUnknownTables(t *testing.T) {
+	table := newGachaTable(Gacha{ID: 1}, testCharacters(), nil)
+	counts := auditCounts(table, "missing", NewSeededRoller(7), 1000, 0)
+	var report GachaAuditReport
+	categories := report.countAuditCategories(counts, map[string]*gachaTable{"missing": nil})
+	if report.ExcludedPulls != 1000 || report.Pulls != 0 || len(categories) != 0 {
+		t.Errorf("pulls = %d, excluded = %d, categories = %d", report.Pulls, report.ExcludedPulls, len(categories))
+	}
+}
@@ -0,0 +1,303 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// ガチャの種類
+// normal: キャラクターの重みで抽選し、何回引いても排出確率が変わらない
+// box: ユーザごとのボックスから引いたキャラクターを取り除いていく
+const (
+	gachaTypeNormal = "normal"
+	gachaTypeBox    = "box"
+)
+
+// ユーザのガチャごとのボックス
+// Roundはボックスをリセットした回数+1
+type GachaBox struct {
+	UserID  string `json:"user_id" gorm:"primaryKey"`
+	GachaID int    `json:"gacha_id" gorm:"primaryKey"`
+	Round   int    `json:"round"`
+}
+
+// ボックスに残っているキャラクターの数
+// 行がないキャラクターは、gacha_charactersテーブルのbox_countだけ残っているものとする
+type GachaBoxItem struct {
+	UserID           string `json:"user_id" gorm:"primaryKey"`
+	GachaID          int    `json:"gacha_id" gorm:"primaryKey"`
+	GachaCharacterID string `json:"gacha_character_id" gorm:"primaryKey"`
+	Remaining        uint   `json:"remaining"`
+}
+
+// ボックスのリセットで受け取る
+type ResettingBox struct {
+	GachaID int `json:"gacha_id"`
+}
+
+// getGachaBox関数、resetGachaBox関数で返される
+// Resettableはボックスをリセットできるならtrue
+type BoxResponse struct {
+	GachaID    int               `json:"gachaID"`
+	Round      int               `json:"round"`
+	Remaining  uint              `json:"remaining"`
+	Total      uint              `json:"total"`
+	Resettable bool              `json:"resettable"`
+	Items      []BoxItemResponse `json:"items"`
+}
+
+// ボックスに入っているキャラクター
+// Prizeはボックスの目玉のキャラクターならtrue
+type BoxItemResponse struct {
+	CharacterID string `json:"characterID"`
+	Name        string `json:"name"`
+	RarityName  string `json:"rarityName"`
+	Remaining   uint   `json:"remaining"`
+	Total       uint   `json:"total"`
+	Prize       bool   `json:"prize"`
+}
+
+// localhost:8080/gacha/box?gacha_id=nでボックスガチャの、ユーザのボックスの中身を取得
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetGachaBox(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	gachaId, err := strconv.Atoi(r.URL.Query().Get("gacha_id"))
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "gacha_id is error.")
+		return
+	}
+	table, err := c.getBoxGachaTable(gachaId)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	box, remaining, err := c.getGachaBox(c.DB, userId, table)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, table.boxResponse(box, remaining))
+	//	{"gachaID":4,"round":1,"remaining":49,"total":51,"resettable":true,"items":[
+	//		{"characterID":"7b6a8a4e-...","name":"Mercury","rarityName":"SR","remaining":0,"total":1,"prize":true},
+	//		{"characterID":"7b6d0b6d-...","name":"Venus","rarityName":"R","remaining":4,"total":5,"prize":false},
+	//		...
+	//	]}
+	//	が返る
+}
+
+// localhost:8080/gacha/box/resetでボックスガチャの、ユーザのボックスを最初の中身に戻す
+// 目玉のキャラクターを引いた後か、ボックスが空になった後でなければリセットできない
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"gacha_id":n}でどのガチャのボックスをリセットするかの情報を受け取る
+func (c *Config) ResetGachaBox(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var resettingBox ResettingBox
+	if err := json.Unmarshal(body, &resettingBox); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	table, err := c.getBoxGachaTable(resettingBox.GachaID)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	var box GachaBox
+	var remaining []uint
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		box, remaining, err = c.lockGachaBox(tx, userId, table)
+		if err != nil {
+			return err
+		}
+		if !table.boxResettable(remaining) {
+			return newAPIError(http.StatusBadRequest, "box cannot be reset until the prize is drawn.")
+		}
+		// DELETE FROM `gacha_box_items` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 4
+		if err := tx.Where("user_id = ? AND gacha_id = ?", userId, table.Gacha.ID).Delete(&GachaBoxItem{}).Error; err != nil {
+			return err
+		}
+		box.Round += 1
+		// UPDATE `gacha_boxes` SET `round`=2 WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 4
+		if err := tx.Model(&GachaBox{}).Where("user_id = ? AND gacha_id = ?", userId, table.Gacha.ID).Update("round", box.Round).Error; err != nil {
+			return err
+		}
+		remaining = table.boxRemaining(nil)
+		return nil
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, table.boxResponse(box, remaining))
+	//	{"gachaID":4,"round":2,"remaining":51,"total":51,"resettable":false,"items":[...]}
+	//	が返る
+}
+
+// ガチャidが引数gachaIdのボックスガチャの抽選テーブルを取得
+// ボックスガチャでなければエラーを返す
+func (c *Config) getBoxGachaTable(gachaId int) (*gachaTable, error) {
+	contains, err := c.gachaIdContains(gachaId)
+	if err != nil {
+		return nil, err
+	}
+	if !contains {
+		return nil, newAPIError(http.StatusBadRequest, "gacha_id is error.")
+	}
+	table, err := c.getGachaTable(gachaId)
+	if err != nil {
+		return nil, err
+	}
+	if table.Gacha.GachaType != gachaTypeBox {
+		return nil, newAPIError(http.StatusBadRequest, "gacha is not a box gacha.")
+	}
+	return table, nil
+}
+
+// ユーザのボックスと、Charactersの順に並べたボックスに残っているキャラクターの数を取得
+// まだボックスを引いたことがなければ、1回目の満杯のボックスを返す
+func (c *Config) getGachaBox(db *gorm.DB, userId string, table *gachaTable) (GachaBox, []uint, error) {
+	box := GachaBox{UserID: userId, GachaID: table.Gacha.ID, Round: 1}
+	// SELECT * FROM `gacha_boxes` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 4
+	if err := db.Where("user_id = ? AND gacha_id = ?", userId, table.Gacha.ID).Find(&box).Error; err != nil {
+		return GachaBox{}, nil, err
+	}
+	var items []GachaBoxItem
+	// SELECT * FROM `gacha_box_items` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 4
+	if err := db.Where("user_id = ? AND gacha_id = ?", userId, table.Gacha.ID).Find(&items).Error; err != nil {
+		return GachaBox{}, nil, err
+	}
+	return box, table.boxRemaining(items), nil
+}
+
+// トランザクションtxの中で、ユーザのボックスを他のリクエストから変更されないようにロックして取得
+// ボックスの行がなければ作成してからロックする
+func (c *Config) lockGachaBox(tx *gorm.DB, userId string, table *gachaTable) (GachaBox, []uint, error) {
+	//	INSERT INTO `gacha_boxes` (`user_id`,`gacha_id`,`round`)
+	//	VALUES ('95daec2b-287c-4358-ba6f-5c29e1c3cbdf',4,1)
+	//	ON DUPLICATE KEY UPDATE `user_id`=`user_id`
+	box := GachaBox{UserID: userId, GachaID: table.Gacha.ID, Round: 1}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&box).Error; err != nil {
+		return GachaBox{}, nil, err
+	}
+	// SELECT * FROM `gacha_boxes` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 4 FOR UPDATE
+	return c.getGachaBox(tx.Clauses(clause.Locking{Strength: "UPDATE"}).Session(&gorm.Session{}), userId, table)
+}
+
+// トランザクションtxの中で、ユーザのボックスをロックしてtimes回分だけ抽選し、引いたキャラクターをボックスから取り除く
+// 引いたキャラクターのインデックス一覧を返す
+// ボックスに残っているキャラクターがtimesより少なければエラーを返す
+func (c *Config) drawGachaBox(tx *gorm.DB, userId string, table *gachaTable, roller Roller, times int) ([]int, error) {
+	_, remaining, err := c.lockGachaBox(tx, userId, table)
+	if err != nil {
+		return nil, err
+	}
+	if boxTotal(remaining) < uint(times) {
+		return nil, newAPIError(http.StatusBadRequest, "box does not have enough characters.")
+	}
+	drawed := drawBoxItems(roller, remaining, times)
+	items := make([]GachaBoxItem, 0, len(remaining))
+	for i, character := range table.Characters {
+		if character.BoxCount != 0 {
+			items = append(items, GachaBoxItem{UserID: userId, GachaID: table.Gacha.ID, GachaCharacterID: character.GachaCharacterID, Remaining: remaining[i]})
+		}
+	}
+	//	INSERT INTO `gacha_box_items` (`user_id`,`gacha_id`,`gacha_character_id`,`remaining`)
+	//	VALUES ('95daec2b-287c-4358-ba6f-5c29e1c3cbdf',4,'7b6a8a4e-...',0), ... ,('95daec2b-287c-4358-ba6f-5c29e1c3cbdf',4,'7b6d0b6d-...',4)
+	//	ON DUPLICATE KEY UPDATE `remaining`=VALUES(`remaining`)
+	if err := tx.Clauses(clause.OnConflict{DoUpdates: clause.AssignmentColumns([]string{"remaining"})}).Create(&items).Error; err != nil {
+		return nil, err
+	}
+	return drawed, nil
+}
+
+// ボックスに残っているキャラクターの数remainingからtimes回分だけ抽選する
+// 1回ごとに残っている数に比例した確率でキャラクターを選び、remainingから1つ減らす
+// 引いたキャラクターのインデックス一覧を返す
+func drawBoxItems(roller Roller, remaining []uint, times int) []int {
+	drawed := make([]int, 0, times)
+	for i := 0; i < times; i++ {
+		p := pickWeighted(roller, remaining)
+		remaining[p] -= 1
+		drawed = append(drawed, p)
+	}
+	return drawed
+}
+
+// ボックスの行itemsから、Charactersの順に並べたボックスに残っているキャラクターの数を返す
+func (t *gachaTable) boxRemaining(items []GachaBoxItem) []uint {
+	remaining := make([]uint, len(t.Characters))
+	for i, character := range t.Characters {
+		remaining[i] = character.BoxCount
+	}
+	for _, item := range items {
+		if i, ok := t.index[item.GachaCharacterID]; ok {
+			remaining[i] = item.Remaining
+		}
+	}
+	return remaining
+}
+
+// 目玉のキャラクターを1つでも引いたか、ボックスが空ならtrueを返す
+func (t *gachaTable) boxResettable(remaining []uint) bool {
+	for i, character := range t.Characters {
+		if character.IsPrize && remaining[i] < character.BoxCount {
+			return true
+		}
+	}
+	return boxTotal(remaining) == 0
+}
+
+// ボックスに残っているキャラクターの数の合計
+func boxTotal(remaining []uint) uint {
+	var total uint
+	for _, v := range remaining {
+		total += v
+	}
+	return total
+}
+
+// ボックスの中身をレスポンスの形に変換
+func (t *gachaTable) boxResponse(box GachaBox, remaining []uint) *BoxResponse {
+	items := make([]BoxItemResponse, 0, len(t.Characters))
+	var total uint
+	for i, character := range t.Characters {
+		if character.BoxCount == 0 {
+			continue
+		}
+		total += character.BoxCount
+		items = append(items, BoxItemResponse{
+			CharacterID: character.GachaCharacterID,
+			Name:        character.CharacterName,
+			RarityName:  character.RarityName,
+			Remaining:   remaining[i],
+			Total:       character.BoxCount,
+			Prize:       character.IsPrize,
+		})
+	}
+	return &BoxResponse{
+		GachaID:    box.GachaID,
+		Round:      box.Round,
+		Remaining:  boxTotal(remaining),
+		Total:      total,
+		Resettable: t.boxResettable(remaining),
+		Items:      items,
+	}
+}
@@ -0,0 +1,532 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// 既に持っているキャラクターを引いたとき(重複)の扱い
+// keep: そのまま保存する
+// shards: そのキャラクターのかけらに変換する
+// refund: ゲームトークンの一部を払い戻す
+const (
+	duplicatePolicyKeep   = "keep"
+	duplicatePolicyShards = "shards"
+	duplicatePolicyRefund = "refund"
+)
+
+// ユーザがキャラクターごとに持っているかけらの数
+type UserCharacterShard struct {
+	UserID      string `json:"user_id" gorm:"primaryKey"`
+	CharacterID int    `json:"character_id" gorm:"primaryKey"`
+	Count       int    `json:"count"`
+}
+
+// 重複したキャラクターを変換した記録
+// 1回の変換で同じキャラクターをCount体変換したものを1行にまとめる
+// GachaDrawID: ガチャを引いたときに自動で変換したならそのガチャの記録のid、ユーザが変換したなら空
+// TxHash: 払い戻しの鋳造のトランザクションのハッシュ(Refundが1以上で空なら、まだ鋳造できていない)
+// TransferID: 払い戻しの鋳造の記録(gmtoken_transfersテーブル)のid。1回の変換の払い戻しはまとめて1回で鋳造する
+type DuplicateConversion struct {
+	ConversionID     string    `json:"conversion_id" gorm:"primaryKey"`
+	UserID           string    `json:"user_id"`
+	GachaDrawID      string    `json:"gacha_draw_id"`
+	GachaCharacterID string    `json:"gacha_character_id"`
+	CharacterID      int       `json:"character_id"`
+	Policy           string    `json:"policy"`
+	Count            int       `json:"count"`
+	Shards           int       `json:"shards"`
+	Refund           int       `json:"refund"`
+	TxHash           string    `json:"tx_hash"`
+	TransferID       string    `json:"transfer_id"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// 重複したキャラクターを変換するときに受け取る
+type ConvertingCharacters struct {
+	UserCharacterIDs []string `json:"user_character_ids"`
+}
+
+// 変換の記録のレスポンス
+type ConversionResponse struct {
+	ConversionID string    `json:"conversionID"`
+	DrawID       string    `json:"drawID,omitempty"`
+	CharacterID  string    `json:"characterID"`
+	Name         string    `json:"name"`
+	Policy       string    `json:"policy"`
+	Count        int       `json:"count"`
+	Shards       int       `json:"shards"`
+	Refund       int       `json:"refund"`
+	TxHash       string    `json:"txHash"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// convertCharacters関数で返される
+type ConvertResponse struct {
+	Shards       int                  `json:"shards"`
+	Refund       int                  `json:"refund"`
+	RefundTxHash string               `json:"refundTxHash"`
+	Conversions  []ConversionResponse `json:"conversions"`
+}
+
+// getCharacterConversions関数で返される
+type ConversionsResponse struct {
+	Total       int64                `json:"total"`
+	Offset      int                  `json:"offset"`
+	Limit       int                  `json:"limit"`
+	Conversions []ConversionResponse `json:"conversions"`
+}
+
+// ユーザが持っているキャラクターごとのかけら
+type ShardResponse struct {
+	CharacterID int    `json:"characterID"`
+	Name        string `json:"name"`
+	Count       int    `json:"count"`
+}
+
+// getCharacterShards関数で返される
+type ShardsResponse struct {
+	Shards []ShardResponse `json:"shards"`
+}
+
+// 変換の記録の1行分として読み込む、キャラクター名付きの変換の記録
+type duplicateConversionRow struct {
+	DuplicateConversion
+	CharacterName string
+}
+
+// ユーザが変換しようとしているキャラクターと、そのキャラクターの重複の扱いの設定
+type convertingCharacter struct {
+	UserCharacterID string
+	Locked          bool
+	Character
+}
+
+// localhost:8080/character/convertでユーザが持っているキャラクターのうち重複したものを変換
+// 変換できるのは、レアリティの重複の扱いが"shards"か"refund"のキャラクターだけ
+// 同じキャラクターを全て変換することはできず、少なくとも1体は残す
+// ロックされたキャラクターとチームに入っているキャラクターは変換できない
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"user_character_ids":["eaaada0c-...","ff1583af-..."]}で変換するキャラクターを受け取る
+func (c *Config) ConvertCharacters(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var convertingCharacters ConvertingCharacters
+	if err := readRequestBody(r, &convertingCharacters); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	userCharacterIds := uniqueStrings(convertingCharacters.UserCharacterIDs)
+	if len(userCharacterIds) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "user_character_ids is error.")
+		return
+	}
+	var conversions []DuplicateConversion
+	var refund GmtokenTransfer
+	names := make(map[string]string)
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		characters, err := getConvertingCharacters(tx, userId, userCharacterIds)
+		if err != nil {
+			return err
+		}
+		// キャラクターごとに変換する数を数え、持っている数より少ないことを確認する
+		converting := make(map[string]int)
+		var gachaCharacterIds []string
+		for _, v := range characters {
+			if !convertible(v.Character) {
+				return newAPIError(http.StatusBadRequest, v.CharacterName+" cannot be converted.")
+			}
+			if v.Locked {
+				return newAPIError(http.StatusBadRequest, v.CharacterName+" is locked.")
+			}
+			if converting[v.GachaCharacterID] == 0 {
+				gachaCharacterIds = append(gachaCharacterIds, v.GachaCharacterID)
+			}
+			converting[v.GachaCharacterID] += 1
+			names[v.GachaCharacterID] = v.CharacterName
+		}
+		if err := checkNotInTeam(tx, userId, userCharacterIds); err != nil {
+			return err
+		}
+		owned, err := countOwnedCharacters(tx, userId, gachaCharacterIds)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, v := range characters {
+			count := converting[v.GachaCharacterID]
+			if count == 0 {
+				continue
+			}
+			if count >= owned[v.GachaCharacterID] {
+				return newAPIError(http.StatusBadRequest, "at least one "+v.CharacterName+" must be kept.")
+			}
+			conversion, err := newDuplicateConversion(userId, "", v.Character, count, now)
+			if err != nil {
+				return err
+			}
+			conversions = append(conversions, conversion)
+			converting[v.GachaCharacterID] = 0
+		}
+		// DELETE FROM `user_characters` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_character_id IN ('eaaada0c-...','ff1583af-...')
+		if err := tx.Where("user_id = ? AND user_character_id IN ?", userId, userCharacterIds).Delete(&UserCharacter{}).Error; err != nil {
+			return err
+		}
+		refund, err = saveDuplicateConversions(tx, conversions)
+		return err
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	var txHash string
+	if refund.TransferID != "" {
+		// キャラクターの変換は済んでいるので、払い戻しに失敗したら後で鋳造し直す
+		txHash, err = c.sendGmtokenTransfer(refund.TransferID)
+		if err != nil {
+			log.Println("gmtoken transfer", refund.TransferID, "failed:", err)
+		}
+	}
+	conversionList := make([]ConversionResponse, 0, len(conversions))
+	for _, v := range conversions {
+		if v.Refund > 0 {
+			v.TxHash = txHash
+		}
+		conversionList = append(conversionList, duplicateConversionRow{DuplicateConversion: v, CharacterName: names[v.GachaCharacterID]}.response())
+	}
+	RespondWithJSON(w, http.StatusOK, &ConvertResponse{
+		Shards:       sumConversionShards(conversions),
+		Refund:       refund.Amount,
+		RefundTxHash: txHash,
+		Conversions:  conversionList,
+	})
+	//	{"shards":10,"refund":0,"refundTxHash":"","conversions":[
+	//		{"conversionID":"1c9e...","characterID":"7b6a8a4e-...","name":"Mercury","policy":"shards","count":1,"shards":10,"refund":0,"txHash":"","createdAt":"2021-09-10T12:00:00Z"}
+	//	]}
+	//	が返る
+}
+
+// localhost:8080/character/shardsでユーザが持っているかけらをキャラクターごとに取得
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetCharacterShards(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	shards := make([]ShardResponse, 0)
+	//	SELECT user_character_shards.character_id, characters.character_name AS name, user_character_shards.count
+	//	FROM `user_character_shards`
+	//	join characters
+	//	on user_character_shards.character_id = characters.id
+	//	WHERE user_character_shards.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_character_shards.count > 0
+	//	ORDER BY user_character_shards.character_id
+	err = c.DB.Table("user_character_shards").
+		Select("user_character_shards.character_id, characters.character_name AS name, user_character_shards.count").
+		Joins("join characters on user_character_shards.character_id = characters.id").
+		Where("user_character_shards.user_id = ? AND user_character_shards.count > 0", userId).
+		Order("user_character_shards.character_id").Scan(&shards).Error
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &ShardsResponse{
+		Shards: shards,
+	})
+	//	{"shards":[{"characterID":1,"name":"Mercury","count":20},{"characterID":2,"name":"Venus","count":4}]}
+	//	が返る
+}
+
+// localhost:8080/character/conversions?offset=0&limit=20でユーザの変換の記録を新しい順に取得
+// ガチャで自動で変換したものも、ユーザが変換したものも含む
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetCharacterConversions(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, limit, err := parseOffsetLimit(r, 20, maxGachaHistoryLimit)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	var total int64
+	// SELECT count(*) FROM `duplicate_conversions` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	if err := c.DB.Model(&DuplicateConversion{}).Where("user_id = ?", userId).Count(&total).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	conversions, err := c.getDuplicateConversions(c.DB.Where("duplicate_conversions.user_id = ?", userId).Offset(offset).Limit(limit))
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &ConversionsResponse{
+		Total:       total,
+		Offset:      offset,
+		Limit:       limit,
+		Conversions: conversions,
+	})
+	//	{"total":3,"offset":0,"limit":20,"conversions":[
+	//		{"conversionID":"1c9e...","drawID":"9a1f...","characterID":"7b6a8a4e-...","name":"Mercury","policy":"shards","count":2,"shards":20,"refund":0,"txHash":"","createdAt":"2021-09-10T12:00:00Z"},
+	//		...
+	//	]}
+	//	が返る
+}
+
+// 条件queryに当てはまる変換の記録を、キャラクター名付きで新しい順に取得
+func (c *Config) getDuplicateConversions(query *gorm.DB) ([]ConversionResponse, error) {
+	var rows []duplicateConversionRow
+	//	SELECT duplicate_conversions.*, characters.character_name
+	//	FROM `duplicate_conversions`
+	//	join characters
+	//	on duplicate_conversions.character_id = characters.id
+	//	WHERE duplicate_conversions.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	//	ORDER BY duplicate_conversions.created_at DESC, duplicate_conversions.conversion_id
+	//	LIMIT 20
+	err := query.Table("duplicate_conversions").Select("duplicate_conversions.*, characters.character_name").
+		Joins("join characters on duplicate_conversions.character_id = characters.id").
+		Order("duplicate_conversions.created_at DESC, duplicate_conversions.conversion_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	conversions := make([]ConversionResponse, 0, len(rows))
+	for _, v := range rows {
+		conversions = append(conversions, v.response())
+	}
+	return conversions, nil
+}
+
+// 変換の記録をレスポンスの形に変換
+func (row duplicateConversionRow) response() ConversionResponse {
+	return ConversionResponse{
+		ConversionID: row.ConversionID,
+		DrawID:       row.GachaDrawID,
+		CharacterID:  row.GachaCharacterID,
+		Name:         row.CharacterName,
+		Policy:       row.Policy,
+		Count:        row.Count,
+		Shards:       row.Shards,
+		Refund:       row.Refund,
+		TxHash:       row.TxHash,
+		CreatedAt:    row.CreatedAt,
+	}
+}
+
+// 重複の扱いが"shards"か"refund"ならtrueを返す
+func convertible(character Character) bool {
+	return character.DuplicatePolicy == duplicatePolicyShards || character.DuplicatePolicy == duplicatePolicyRefund
+}
+
+// 引いたキャラクターのうち、ガチャを引いたときに自動で変換するものを調べる
+// ownedに含まれるキャラクターと、同じガチャで2体目以降に引いたキャラクターを重複とする
+// 引いた順に、変換するならその重複の扱い、変換しないなら空文字列を並べて返す
+func (t *gachaTable) autoConversions(drawed []int, owned map[string]bool) []string {
+	converted := make([]string, len(drawed))
+	seen := make([]bool, len(t.Characters))
+	for i, character := range t.Characters {
+		seen[i] = owned[character.GachaCharacterID]
+	}
+	for n, i := range drawed {
+		character := t.Characters[i]
+		if seen[i] && character.DuplicateAuto && convertible(character) {
+			converted[n] = character.DuplicatePolicy
+		}
+		seen[i] = true
+	}
+	return converted
+}
+
+// キャラクターごとに引いた回数countsのうち、ガチャを引いたときに自動で変換する数をConvertedに書き込む
+// autoConversions関数と同じく、ownedに含まれるキャラクターは全て、それ以外は2体目以降を重複とする
+func autoConversionCounts(counts []characterCount, owned map[string]bool) {
+	for i, v := range counts {
+		if !v.DuplicateAuto || !convertible(v.Character) {
+			continue
+		}
+		counts[i].Converted = v.Count
+		if !owned[v.GachaCharacterID] {
+			counts[i].Converted -= 1
+		}
+	}
+}
+
+// キャラクターごとに引いた回数countsのうち、自動で変換するものの変換の記録を作成する
+func drawConversions(userId string, drawId string, counts []characterCount) ([]DuplicateConversion, error) {
+	var conversions []DuplicateConversion
+	now := time.Now()
+	for _, v := range counts {
+		if v.Converted == 0 {
+			continue
+		}
+		conversion, err := newDuplicateConversion(userId, drawId, v.Character, v.Converted, now)
+		if err != nil {
+			return nil, err
+		}
+		conversions = append(conversions, conversion)
+	}
+	return conversions, nil
+}
+
+// キャラクターcharacterをcount体変換する記録を作成する
+// 手に入るかけらの数と払い戻す量はレアリティの設定から決める
+func newDuplicateConversion(userId string, drawId string, character Character, count int, now time.Time) (DuplicateConversion, error) {
+	conversionId, err := createUUId()
+	if err != nil {
+		return DuplicateConversion{}, err
+	}
+	conversion := DuplicateConversion{
+		ConversionID:     conversionId,
+		UserID:           userId,
+		GachaDrawID:      drawId,
+		GachaCharacterID: character.GachaCharacterID,
+		CharacterID:      character.CharacterID,
+		Policy:           character.DuplicatePolicy,
+		Count:            count,
+		CreatedAt:        now,
+	}
+	switch character.DuplicatePolicy {
+	case duplicatePolicyShards:
+		conversion.Shards = count * character.DuplicateShards
+	case duplicatePolicyRefund:
+		conversion.Refund = count * character.DuplicateRefund
+	}
+	return conversion, nil
+}
+
+// トランザクションtxの中で変換の記録を保存し、かけらを増やす
+// 払い戻しがあれば、その合計の鋳造をpendingの状態で記録して返す(なければゼロ値を返す)
+// 鋳造はコミットしてからsendGmtokenTransfer関数で行い、送信できたら変換の記録にハッシュが書き込まれる
+func saveDuplicateConversions(tx *gorm.DB, conversions []DuplicateConversion) (GmtokenTransfer, error) {
+	if len(conversions) == 0 {
+		return GmtokenTransfer{}, nil
+	}
+	var refund GmtokenTransfer
+	if amount := sumConversionRefund(conversions); amount > 0 {
+		var err error
+		refund, err = createGmtokenTransfer(tx, conversions[0].UserID, gmtokenMint, amount, gmtokenReasonRefund, conversions[0].GachaDrawID)
+		if err != nil {
+			return GmtokenTransfer{}, err
+		}
+		for i := range conversions {
+			if conversions[i].Refund > 0 {
+				conversions[i].TransferID = refund.TransferID
+			}
+		}
+	}
+	//	INSERT INTO `duplicate_conversions` (`conversion_id`,`user_id`,`gacha_draw_id`,`gacha_character_id`,`character_id`,`policy`,`count`,`shards`,`refund`,`tx_hash`,`transfer_id`,`created_at`)
+	//	VALUES ('1c9e...','95daec2b-287c-4358-ba6f-5c29e1c3cbdf','9a1f...','7b6a8a4e-...',1,'shards',2,20,0,'','','2021-09-10 12:00:01')
+	if err := tx.Create(&conversions).Error; err != nil {
+		return GmtokenTransfer{}, err
+	}
+	for _, v := range conversions {
+		if v.Shards == 0 {
+			continue
+		}
+		//	INSERT INTO `user_character_shards` (`user_id`,`character_id`,`count`)
+		//	VALUES ('95daec2b-287c-4358-ba6f-5c29e1c3cbdf',1,20)
+		//	ON DUPLICATE KEY UPDATE `count`=count + 20
+		shard := UserCharacterShard{UserID: v.UserID, CharacterID: v.CharacterID, Count: v.Shards}
+		err := tx.Clauses(clause.OnConflict{DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("count + ?", v.Shards)})}).
+			Create(&shard).Error
+		if err != nil {
+			return GmtokenTransfer{}, err
+		}
+	}
+	return refund, nil
+}
+
+// 変換の記録で手に入るかけらの合計を返す
+func sumConversionShards(conversions []DuplicateConversion) int {
+	shards := 0
+	for _, v := range conversions {
+		shards += v.Shards
+	}
+	return shards
+}
+
+// 変換の記録で払い戻すゲームトークンの合計を返す
+func sumConversionRefund(conversions []DuplicateConversion) int {
+	refund := 0
+	for _, v := range conversions {
+		refund += v.Refund
+	}
+	return refund
+}
+
+// トランザクションtxの中で、ユーザが持っているキャラクターのうちuser_character_idが引数userCharacterIdsのものを、重複の扱いの設定付きで取得
+// 他のリクエストが同時に変換しないように、行をロックする
+// 見つからないキャラクターがあればエラーを返す
+func getConvertingCharacters(tx *gorm.DB, userId string, userCharacterIds []string) ([]convertingCharacter, error) {
+	var characters []convertingCharacter
+	//	SELECT user_characters.user_character_id, user_characters.locked, gacha_characters.gacha_character_id, gacha_characters.character_id, characters.character_name,
+	//	rarities.duplicate_policy, rarities.duplicate_shards, rarities.duplicate_refund
+	//	FROM `user_characters`
+	//	join gacha_characters
+	//	on user_characters.gacha_character_id = gacha_characters.gacha_character_id
+	//	join characters
+	//	on gacha_characters.character_id = characters.id
+	//	join rarities
+	//	on gacha_characters.rarity_id = rarities.id
+	//	WHERE user_characters.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_characters.user_character_id IN ('eaaada0c-...','ff1583af-...')
+	//	FOR UPDATE
+	err := tx.Table("user_characters").
+		Select("user_characters.user_character_id, user_characters.locked, gacha_characters.gacha_character_id, gacha_characters.character_id, characters.character_name, rarities.duplicate_policy, rarities.duplicate_shards, rarities.duplicate_refund").
+		Joins("join gacha_characters on user_characters.gacha_character_id = gacha_characters.gacha_character_id").
+		Joins("join characters on gacha_characters.character_id = characters.id").
+		Joins("join rarities on gacha_characters.rarity_id = rarities.id").
+		Where("user_characters.user_id = ? AND user_characters.user_character_id IN ?", userId, userCharacterIds).
+		Clauses(clause.Locking{Strength: "UPDATE"}).Scan(&characters).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(characters) != len(userCharacterIds) {
+		return nil, newAPIError(http.StatusBadRequest, "user_character_ids is error.")
+	}
+	return characters, nil
+}
+
+// トランザクションtxの中で、ユーザが持っている引数gachaCharacterIdsのキャラクターの数をgacha_character_idごとに数える
+// 他のリクエストが同時に変換しないように、行をロックする
+func countOwnedCharacters(tx *gorm.DB, userId string, gachaCharacterIds []string) (map[string]int, error) {
+	var counts []struct {
+		GachaCharacterID string
+		Count            int
+	}
+	//	SELECT gacha_character_id, COUNT(*) AS count FROM `user_characters`
+	//	WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_character_id IN ('7b6a8a4e-...')
+	//	GROUP BY gacha_character_id
+	//	FOR UPDATE
+	err := tx.Table("user_characters").Select("gacha_character_id, COUNT(*) AS count").
+		Where("user_id = ? AND gacha_character_id IN ?", userId, gachaCharacterIds).
+		Group("gacha_character_id").Clauses(clause.Locking{Strength: "UPDATE"}).Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]int, len(counts))
+	for _, v := range counts {
+		owned[v.GachaCharacterID] = v.Count
+	}
+	return owned, nil
+}
+
+// 重複を除いた文字列の一覧を、最初に現れた順に返す
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
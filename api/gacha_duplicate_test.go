@@ -0,0 +1,47 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAutoConversionCountsMatchesAutoConversions(t *testing.T) {
+	characters := testCharacters()
+	for i := range characters {
+		characters[i].DuplicateAuto = true
+		characters[i].DuplicatePolicy = duplicatePolicyShards
+	}
+	// r1は自動で変換せず、r2は重複しても残す
+	characters[2].DuplicateAuto = false
+	characters[3].DuplicatePolicy = duplicatePolicyKeep
+	table := newGachaTable(Gacha{ID: 1}, characters, nil)
+	owned := map[string]bool{"n1": true, "r2": true}
+
+	drawed, _ := table.draw(NewSeededRoller(10), 500, 0)
+	want := table.countDrawed(drawed, table.autoConversions(drawed, owned), nil)
+	tally, _ := table.drawCounts(NewSeededRoller(10), 500, 0, nil)
+	got := table.tallyCounts(tally)
+	autoConversionCounts(got, owned)
+	for i := range got {
+		got[i].Boosted = 0
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("counts = %+v, want %+v", got, want)
+	}
+	for _, v := range got {
+		switch v.GachaCharacterID {
+		case "n1":
+			if v.Converted != v.Count {
+				t.Errorf("owned n1 converted %d of %d", v.Converted, v.Count)
+			}
+		case "n2", "sr1", "sr2":
+			if v.Converted != v.Count-1 {
+				t.Errorf("%s converted %d of %d", v.GachaCharacterID, v.Converted, v.Count)
+			}
+		default:
+			if v.Converted != 0 {
+				t.Errorf("%s converted %d", v.GachaCharacterID, v.Converted)
+			}
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package api
+
+// ガチャ1つ分の抽選テーブル
+// キャラクターの一覧とレアリティごとの累積重みを1度だけ作り、何回の抽選でも使い回す
+// 抽選結果はCharactersのインデックスで表す
+type gachaTable struct {
+	Gacha      Gacha
+	Guarantees []GachaGuarantee
+	Characters []Character
+	pools      []rarityPool
+	// 天井や確定ルールが関係しない回で使う、レアリティの累積重み
+	rarityTotals []uint64
+	// gacha_character_idからCharactersのインデックスを引く
+	index map[string]int
+	// ステップアップガチャのステップの設定(ステップ順)
+	Steps []GachaStep
+	// gacha_table_snapshotsテーブルに保存した、このテーブルの設定のハッシュ
+	SnapshotHash string
+}
+
+// ガチャの抽選で使う、レアリティごとにまとめたキャラクター一覧
+// Weightはレアリティに含まれるキャラクターのweightの合計
+// Gradeはレアリティの高さ(大きいほど高レアリティ)
+// MembersはgachaTable.Charactersのインデックス、totalsはその順に並べたピックアップ倍率の累積
+type rarityPool struct {
+	RarityID int
+	Grade    int
+	Weight   uint
+	Members  []int
+	totals   []uint64
+}
+
+// ガチャの設定とキャラクター一覧から抽選テーブルを作成
+// レアリティの重みはそのレアリティのキャラクターのweightの合計なので、キャラクターごとの排出確率は変わらない
+// レアリティの中ではピックアップ倍率RateUpを重みとするので、ピックアップしてもレアリティごとの排出確率は変わらない
+func newGachaTable(gacha Gacha, charactersList []Character, guarantees []GachaGuarantee) *gachaTable {
+	t := &gachaTable{
+		Gacha:      gacha,
+		Guarantees: guarantees,
+		Characters: charactersList,
+		index:      make(map[string]int, len(charactersList)),
+	}
+	for i, character := range charactersList {
+		t.index[character.GachaCharacterID] = i
+		p := 0
+		for p < len(t.pools) && t.pools[p].RarityID != character.RarityID {
+			p++
+		}
+		if p == len(t.pools) {
+			t.pools = append(t.pools, rarityPool{RarityID: character.RarityID, Grade: character.RarityGrade})
+		}
+		pool := &t.pools[p]
+		pool.Weight += character.Weight
+		pool.Members = append(pool.Members, i)
+		pool.totals = appendTotal(pool.totals, rateUpWeight(character))
+	}
+	for _, pool := range t.pools {
+		t.rarityTotals = appendTotal(t.rarityTotals, pool.Weight)
+	}
+	return t
+}
+
+// charactersListのキャラクターからtimes回分だけ抽選を実行
+// 引いたキャラクターのgacha_character_id一覧と、抽選後の天井カウンターを返す
+func drawGachaCharacterIds(roller Roller, charactersList []Character, times int, gacha Gacha, pityCount int, guarantees []GachaGuarantee) ([]string, int) {
+	t := newGachaTable(gacha, charactersList, guarantees)
+	drawed, pityCount := t.draw(roller, times, pityCount)
+	return t.gachaCharacterIds(drawed), pityCount
+}
+
+// times回分だけ抽選を実行し、引いたキャラクターのインデックス一覧と抽選後の天井カウンターを返す
+func (t *gachaTable) draw(roller Roller, times int, pityCount int) ([]int, int) {
+	drawed := make([]int, 0, times)
+	pityCount = t.drawEach(roller, times, pityCount, func(i int, boosted bool) {
+		drawed = append(drawed, i)
+	})
+	return drawed, pityCount
+}
+
+// キャラクターごとにまとめた抽選結果
+// Counts、BoostedはCharactersのインデックスごとの引いた回数と、そのうち天井か確定ルールで確率の変わった回に引いた数
+// ResultHashは引いた順のgacha_character_id一覧のハッシュ(hashResults関数と同じ値)
+type drawTally struct {
+	Counts     []int
+	Boosted    []int
+	ResultHash string
+}
+
+// times回分だけ抽選を実行し、キャラクターごとにまとめた抽選結果と抽選後の天井カウンターを返す
+// 1回ごとの結果を保持しないので、回数の多い抽選でもメモリを使わない
+// progressには10000回ごとに、それまでに引いた回数を渡す(nilなら通知しない)
+func (t *gachaTable) drawCounts(roller Roller, times int, pityCount int, progress func(done int)) (drawTally, int) {
+	tally := drawTally{Counts: make([]int, len(t.Characters)), Boosted: make([]int, len(t.Characters))}
+	hasher := newResultHasher()
+	done := 0
+	pityCount = t.drawEach(roller, times, pityCount, func(i int, boosted bool) {
+		tally.Counts[i] += 1
+		if boosted {
+			tally.Boosted[i] += 1
+		}
+		hasher.add(t.Characters[i].GachaCharacterID)
+		done += 1
+		if progress != nil && done%10000 == 0 {
+			progress(done)
+		}
+	})
+	tally.ResultHash = hasher.sum()
+	return tally, pityCount
+}
+
+// times回分だけ抽選を実行し、1回ごとに引いたキャラクターのインデックスと、その回が天井か確定ルールで確率の変わった回かをfnに渡す
+// 1回ごとにまずレアリティを、次にそのレアリティの中からキャラクターを累積重みの二分探索で選ぶ
+// 天井カウンターpityCountは1回ごとに1増え、天井対象のレアリティを引くと0に戻る
+// Guaranteesに当てはまる回では、そのルールで決められたレアリティ以上のキャラクターだけから選ぶ
+// 乱数は引数rollerから取り出すので、同じ乱数列からは同じ結果になる
+// 抽選後の天井カウンターを返す
+func (t *gachaTable) drawEach(roller Roller, times int, pityCount int, fn func(i int, boosted bool)) int {
+	for i := 0; i < times; i++ {
+		pityCount += 1
+		minGrade := guaranteedGrade(t.Guarantees, i+1)
+		boosted := minGrade != 0 || t.pityActive(pityCount)
+		var p int
+		if !boosted {
+			p = pickTotals(roller, t.rarityTotals)
+		} else {
+			p = pickWeighted(roller, rarityWeights(t.pools, t.Gacha, pityCount, minGrade))
+		}
+		pool := &t.pools[p]
+		fn(pool.Members[pickTotals(roller, pool.totals)], boosted)
+		if pool.RarityID == t.Gacha.PityRarityID {
+			pityCount = 0
+		}
+	}
+	return pityCount
+}
+
+// 天井カウンターpityCount回目の抽選で、天井による確率の変化があればtrueを返す
+func (t *gachaTable) pityActive(pityCount int) bool {
+	if t.Gacha.HardPity > 0 && pityCount >= t.Gacha.HardPity {
+		return true
+	}
+	return t.Gacha.SoftPity > 0 && pityCount > t.Gacha.SoftPity
+}
+
+// インデックス一覧をgacha_character_id一覧に変換
+func (t *gachaTable) gachaCharacterIds(drawed []int) []string {
+	gachaCharacterIds := make([]string, len(drawed))
+	for i, v := range drawed {
+		gachaCharacterIds[i] = t.Characters[v].GachaCharacterID
+	}
+	return gachaCharacterIds
+}
+
+// レアリティの中でキャラクターを選ぶときの重み
+// ピックアップ倍率が設定されていなければ1とする
+func rateUpWeight(character Character) uint {
+	if character.RateUp == 0 {
+		return 1
+	}
+	return character.RateUp
+}
+
+// 天井カウンターpityCount回目の抽選で使う、レアリティごとの重みを返す
+// Gradeが引数minGrade未満のレアリティの重みは0にする
+// pityCountがHardPityに達していれば天井対象のレアリティ以外の重みを0にする
+// pityCountがSoftPityを超えていれば天井対象のレアリティの重みを上げる
+func rarityWeights(pools []rarityPool, gacha Gacha, pityCount int, minGrade int) []uint {
+	hasPityRarity := false
+	hasMinGrade := false
+	for _, pool := range pools {
+		if pool.RarityID == gacha.PityRarityID {
+			hasPityRarity = true
+		}
+		if pool.Grade >= minGrade {
+			hasMinGrade = true
+		}
+	}
+	var weights []uint
+	for _, pool := range pools {
+		weight := pool.Weight
+		if hasMinGrade && pool.Grade < minGrade {
+			weight = 0
+		}
+		if hasPityRarity && gacha.HardPity > 0 && pityCount >= gacha.HardPity {
+			// 天井はminGradeの指定より優先する
+			if pool.RarityID == gacha.PityRarityID {
+				weight = pool.Weight
+			} else {
+				weight = 0
+			}
+		} else if gacha.SoftPity > 0 && pityCount > gacha.SoftPity && pool.RarityID == gacha.PityRarityID {
+			weight += gacha.SoftPityWeightUp * uint(pityCount-gacha.SoftPity)
+		}
+		weights = append(weights, weight)
+	}
+	return weights
+}
+
+// 累積重みの末尾にweightを足した値を追加する
+func appendTotal(totals []uint64, weight uint) []uint64 {
+	total := uint64(weight)
+	if len(totals) != 0 {
+		total += totals[len(totals)-1]
+	}
+	return append(totals, total)
+}
+
+// 累積重みtotalsから、重みに比例した確率でインデックスを1つ選ぶ
+// 0以上合計未満の乱数rに対し、累積重みがrより大きくなる最初のインデックスを二分探索で求める
+func pickTotals(roller Roller, totals []uint64) int {
+	r := uint64(roller.Intn(int(totals[len(totals)-1])))
+	i, j := 0, len(totals)
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if totals[h] <= r {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	return i
+}
+
+// weightsの重みに比例した確率でインデックスを1つ選ぶ
+// weightsの合計は1以上でなければならない
+func pickWeighted(roller Roller, weights []uint) int {
+	total := 0
+	for _, weight := range weights {
+		total += int(weight)
+	}
+	r := roller.Intn(total)
+	for i, weight := range weights {
+		r -= int(weight)
+		if r < 0 {
+			return i
+		}
+	}
+	return len(weights) - 1
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// テスト用のレアリティ
+const (
+	testRarityN  = 1
+	testRarityR  = 2
+	testRaritySR = 3
+)
+
+// テスト用のキャラクター一覧
+// レアリティの重みはN:700、R:250、SR:50で、SRのうち1体はピックアップ倍率3
+func testCharacters() []Character {
+	return []Character{
+		{GachaCharacterID: "n1", CharacterName: "n1", Weight: 400, RarityID: testRarityN, RarityGrade: 1, RarityName: "N"},
+		{GachaCharacterID: "n2", CharacterName: "n2", Weight: 300, RarityID: testRarityN, RarityGrade: 1, RarityName: "N"},
+		{GachaCharacterID: "r1", CharacterName: "r1", Weight: 150, RarityID: testRarityR, RarityGrade: 2, RarityName: "R"},
+		{GachaCharacterID: "r2", CharacterName: "r2", Weight: 100, RarityID: testRarityR, RarityGrade: 2, RarityName: "R"},
+		{GachaCharacterID: "sr1", CharacterName: "sr1", Weight: 25, RarityID: testRaritySR, RarityGrade: 3, RarityName: "SR", RateUp: 3},
+		{GachaCharacterID: "sr2", CharacterName: "sr2", Weight: 25, RarityID: testRaritySR, RarityGrade: 3, RarityName: "SR"},
+	}
+}
+
+// 抽選結果のキャラクターごとの回数が、テーブルの排出率に従っているかカイ二乗検定で確かめる
+// 乱数のシードを固定しているので、p値は毎回同じになる
+func assertDistribution(t *testing.T, table *gachaTable, counts []int) {
+	t.Helper()
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	categories := table.auditCategories()
+	for i := range categories {
+		categories[i].Observed = counts[i]
+		categories[i].Expected = categories[i].Probability * float64(total)
+	}
+	observed, expected := chiSquaredCells(categories, gachaAuditMinExpected)
+	x := chiSquared(observed, expected)
+	if p := chiSquaredPValue(x, len(observed)-1); p < gachaAuditAlpha {
+		t.Errorf("distribution deviates from weights: chi2=%.2f p=%.3g observed=%v expected=%v", x, p, observed, expected)
+	}
+}
+
+func TestDrawRarityWeights(t *testing.T) {
+	table := newGachaTable(Gacha{ID: 1}, testCharacters(), nil)
+	tally, _ := table.drawCounts(NewSeededRoller(1), 200000, 0, nil)
+	counts := tally.Counts
+	assertDistribution(t, table, counts)
+
+	// ピックアップ倍率はレアリティの中だけで効くので、SRの合計は重み通りの5%になる
+	sr := counts[4] + counts[5]
+	if rate := float64(sr) / 200000; math.Abs(rate-0.05) > 0.003 {
+		t.Errorf("SR rate = %.4f, want 0.05", rate)
+	}
+	// ピックアップされたsr1はsr2の3倍引かれる
+	if ratio := float64(counts[4]) / float64(counts[5]); math.Abs(ratio-3) > 0.3 {
+		t.Errorf("rate-up ratio = %.2f, want 3", ratio)
+	}
+}
+
+func TestDrawSeededReproducible(t *testing.T) {
+	table := newGachaTable(Gacha{ID: 1, HardPity: 30, PityRarityID: testRaritySR}, testCharacters(), nil)
+	a, pityA := table.draw(NewSeededRoller(42), 1000, 3)
+	b, pityB := table.draw(NewSeededRoller(42), 1000, 3)
+	if !reflect.DeepEqual(a, b) || pityA != pityB {
+		t.Fatal("same seed gave different results")
+	}
+	c, _ := table.draw(NewSeededRoller(43), 1000, 3)
+	if reflect.DeepEqual(a, c) {
+		t.Fatal("different seeds gave the same results")
+	}
+}
+
+func TestDrawCountsMatchesDraw(t *testing.T) {
+	gacha := Gacha{ID: 1, SoftPity: 5, SoftPityWeightUp: 100, HardPity: 10, PityRarityID: testRaritySR}
+	guarantees := []GachaGuarantee{{Every: 10, MinRarityID: testRarityR, MinGrade: 2}}
+	table := newGachaTable(gacha, testCharacters(), guarantees)
+	drawed, pityA := table.draw(NewSeededRoller(9), 25000, 4)
+	progress := 0
+	tally, pityB := table.drawCounts(NewSeededRoller(9), 25000, 4, func(done int) {
+		progress = done
+	})
+	if pityA != pityB {
+		t.Errorf("pity count = %d, want %d", pityB, pityA)
+	}
+	if progress != 20000 {
+		t.Errorf("last progress = %d, want 20000", progress)
+	}
+	// 1回ごとの結果から数えた回数とハッシュが一致する
+	counts := make([]int, len(table.Characters))
+	for _, i := range drawed {
+		counts[i] += 1
+	}
+	if !reflect.DeepEqual(counts, tally.Counts) {
+		t.Errorf("counts = %v, want %v", tally.Counts, counts)
+	}
+	if want := hashResults(table.gachaCharacterIds(drawed)); tally.ResultHash != want {
+		t.Errorf("result hash = %s, want %s", tally.ResultHash, want)
+	}
+	boosted := 0
+	for _, v := range tally.Boosted {
+		boosted += v
+	}
+	if boosted < 2500 {
+		t.Errorf("boosted = %d, want at least the 2500 guaranteed pulls", boosted)
+	}
+}
+
+func TestDrawHardPity(t *testing.T) {
+	gacha := Gacha{ID: 1, HardPity: 20, PityRarityID: testRaritySR}
+	table := newGachaTable(gacha, testCharacters(), nil)
+	pityCount := 0
+	sinceSR := 0
+	hits := 0
+	pityCount = table.drawEach(NewSeededRoller(2), 100000, pityCount, func(i int, boosted bool) {
+		sinceSR += 1
+		if sinceSR == gacha.HardPity && !boosted {
+			t.Fatalf("pull %d since the last SR is not boosted", sinceSR)
+		}
+		if table.Characters[i].RarityID == testRaritySR {
+			sinceSR = 0
+			hits += 1
+		}
+		if sinceSR >= gacha.HardPity {
+			t.Fatalf("no SR within %d pulls", gacha.HardPity)
+		}
+	})
+	if pityCount != sinceSR {
+		t.Errorf("pity count = %d, want %d", pityCount, sinceSR)
+	}
+	// 天井がなければ5%なので、天井があればそれより多く引ける
+	if rate := float64(hits) / 100000; rate <= 0.05 {
+		t.Errorf("SR rate with hard pity = %.4f, want more than 0.05", rate)
+	}
+
+	// 天井の手前から引き始めれば、天井カウンターを引き継いで1回目で確定する
+	drawed, pity := table.draw(NewSeededRoller(3), 1, gacha.HardPity-1)
+	if table.Characters[drawed[0]].RarityID != testRaritySR || pity != 0 {
+		t.Errorf("draw at hard pity gave rarity %d and pity %d", table.Characters[drawed[0]].RarityID, pity)
+	}
+}
+
+func TestDrawSoftPity(t *testing.T) {
+	gacha := Gacha{ID: 1, SoftPity: 10, SoftPityWeightUp: 100, PityRarityID: testRaritySR}
+	table := newGachaTable(gacha, testCharacters(), nil)
+	// 天井カウンターごとに、その回の抽選数とSRを引いた数を数える
+	pulls := make(map[int]int)
+	hits := make(map[int]int)
+	pityCount := 0
+	table.drawEach(NewSeededRoller(4), 300000, 0, func(i int, boosted bool) {
+		pityCount += 1
+		if boosted != (pityCount > gacha.SoftPity) {
+			t.Fatalf("pull at pity %d boosted = %v", pityCount, boosted)
+		}
+		pulls[pityCount] += 1
+		if table.Characters[i].RarityID == testRaritySR {
+			hits[pityCount] += 1
+			pityCount = 0
+		}
+	})
+	for pity := 1; pity <= gacha.SoftPity+5; pity++ {
+		weight := 50.0
+		if pity > gacha.SoftPity {
+			weight += float64(gacha.SoftPityWeightUp) * float64(pity-gacha.SoftPity)
+		}
+		want := weight / (950 + weight)
+		n := float64(pulls[pity])
+		if n < 1000 {
+			continue
+		}
+		// 二項分布の標準偏差の4倍までのずれは許す
+		got := float64(hits[pity]) / n
+		if sigma := math.Sqrt(want * (1 - want) / n); math.Abs(got-want) > 4*sigma {
+			t.Errorf("SR rate at pity %d = %.4f, want %.4f", pity, got, want)
+		}
+	}
+}
+
+func TestDrawGuarantees(t *testing.T) {
+	guarantees := []GachaGuarantee{
+		{Every: 10, MinRarityID: testRarityR, MinGrade: 2},
+		{Every: 50, MinRarityID: testRaritySR, MinGrade: 3},
+	}
+	table := newGachaTable(Gacha{ID: 1}, testCharacters(), guarantees)
+	roller := NewSeededRoller(5)
+	// 確定ルールは1回のガチャの中で数えるので、100連を何回引いても同じ回が確定する
+	counts := make([]int, len(table.Characters))
+	for draw := 0; draw < 2000; draw++ {
+		n := 0
+		table.drawEach(roller, 100, 0, func(i int, boosted bool) {
+			n += 1
+			grade := table.Characters[i].RarityGrade
+			switch {
+			case n%50 == 0 && grade < 3:
+				t.Fatalf("pull %d gave grade %d, want SR", n, grade)
+			case n%10 == 0 && grade < 2:
+				t.Fatalf("pull %d gave grade %d, want R or higher", n, grade)
+			}
+			if boosted != (n%10 == 0) {
+				t.Fatalf("pull %d boosted = %v", n, boosted)
+			}
+			if !boosted {
+				counts[i] += 1
+			}
+		})
+	}
+	// 確定しない回は重み通りに引かれる
+	assertDistribution(t, table, counts)
+}
+
+func TestGuaranteedGrade(t *testing.T) {
+	guarantees := []GachaGuarantee{
+		{Every: 10, MinGrade: 2},
+		{Every: 50, MinGrade: 3},
+		{Every: 0, MinGrade: 4},
+	}
+	for n, want := range map[int]int{1: 0, 9: 0, 10: 2, 20: 2, 50: 3, 100: 3} {
+		if got := guaranteedGrade(guarantees, n); got != want {
+			t.Errorf("guaranteedGrade(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+// 1回ごとに抽選テーブルを作り直す場合との比較
+func BenchmarkDrawRebuildTable(b *testing.B) {
+	characters := benchmarkCharacters(1000)
+	gacha := Gacha{ID: 1, SoftPity: 70, SoftPityWeightUp: 60, HardPity: 90, PityRarityID: testRaritySR}
+	roller := NewSeededRoller(1)
+	b.ResetTimer()
+	pityCount := 0
+	for i := 0; i < b.N; i++ {
+		_, pityCount = drawGachaCharacterIds(roller, characters, 1, gacha, pityCount, nil)
+	}
+}
+
+func BenchmarkDrawList(b *testing.B) {
+	table := newGachaTable(Gacha{ID: 1, SoftPity: 70, SoftPityWeightUp: 60, HardPity: 90, PityRarityID: testRaritySR}, benchmarkCharacters(1000), nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	table.draw(NewSeededRoller(1), b.N, 0)
+}
+
+func BenchmarkDrawCounts(b *testing.B) {
+	table := newGachaTable(Gacha{ID: 1, SoftPity: 70, SoftPityWeightUp: 60, HardPity: 90, PityRarityID: testRaritySR}, benchmarkCharacters(1000), nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	table.drawCounts(NewSeededRoller(1), b.N, 0, nil)
+}
+
+// 3つのレアリティにn体ずつ分けたキャラクター一覧
+func benchmarkCharacters(n int) []Character {
+	characters := make([]Character, 0, n)
+	for i := 0; i < n; i++ {
+		rarity := testRarityN + i%3
+		characters = append(characters, Character{
+			GachaCharacterID: fmt.Sprintf("c%04d", i),
+			Weight:           uint(100 / rarity),
+			RarityID:         rarity,
+			RarityGrade:      rarity,
+			RateUp:           uint(1 + i%2),
+		})
+	}
+	return characters
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// 1回のガチャでtimes回引くとき、Every回目ごとの抽選はMinRarityIDのレアリティ以上のキャラクターだけから選ぶルール
+// 例えばEvery=10、MinRarityID=2(R)なら10連ごとにR以上が1体確定する
+// MinGradeはMinRarityIDのレアリティのgrade
+type GachaGuarantee struct {
+	ID          int `json:"id"`
+	GachaID     int `json:"gacha_id"`
+	Every       int `json:"every"`
+	MinRarityID int `json:"min_rarity_id"`
+	MinGrade    int `json:"min_grade" gorm:"->"`
+}
+
+// dbのgacha_guaranteesテーブルからガチャidが引数gachaIdの確定ルールを取得
+func (c *Config) getGachaGuarantees(gachaId int) ([]GachaGuarantee, error) {
+	var guarantees []GachaGuarantee
+	//	SELECT gacha_guarantees.*, rarities.grade AS min_grade
+	//	FROM `gacha_guarantees`
+	//	join rarities
+	//	on gacha_guarantees.min_rarity_id = rarities.id
+	//	WHERE gacha_id = 1
+	//	ORDER BY gacha_guarantees.id
+	err := c.DB.Table("gacha_guarantees").Select("gacha_guarantees.*, rarities.grade AS min_grade").
+		Joins("join rarities on gacha_guarantees.min_rarity_id = rarities.id").
+		Where("gacha_id = ?", gachaId).Order("gacha_guarantees.id").Scan(&guarantees).Error
+	if err != nil {
+		return nil, err
+	}
+	return guarantees, nil
+}
+
+// 1回のガチャのn回目(1から数える)の抽選で、最低限保証されるレアリティのgradeを返す
+// 当てはまるルールが複数あれば一番高いgradeを、1つもなければ0を返す
+func guaranteedGrade(guarantees []GachaGuarantee, n int) int {
+	minGrade := 0
+	for _, guarantee := range guarantees {
+		if guarantee.Every > 0 && n%guarantee.Every == 0 && guarantee.MinGrade > minGrade {
+			minGrade = guarantee.MinGrade
+		}
+	}
+	return minGrade
+}
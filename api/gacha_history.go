@@ -0,0 +1,392 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// ガチャの記録の状態
+// pending: 支払う前(ガチャチケットで支払うときは、チケットの消費とキャラクターの保存が終わるまでこの状態のまま)
+// burned: ゲームトークンを焼却したが、キャラクターの保存が終わっていない
+// completed: キャラクターの保存まで終わった
+// failed: 支払いが済む前に失敗した(ゲームトークンを焼却できなかった、チケットが足りなかったなど)
+// 焼却した後にキャラクターの保存に失敗したときも、焼却した分を鋳造して返してからfailedにする
+const (
+	gachaDrawPending   = "pending"
+	gachaDrawBurned    = "burned"
+	gachaDrawCompleted = "completed"
+	gachaDrawFailed    = "failed"
+)
+
+// 履歴のページングで1度に返す最大件数
+const maxGachaHistoryLimit = 100
+
+// 1回のガチャのリクエストの記録
+// Paymentは支払い方法、Costは焼却したゲームトークン(またはチケット)の量、BurnTxHashは焼却のトランザクションのハッシュ
+// Shards、Refundは重複を変換して手に入れたかけらの合計と払い戻したゲームトークンの量、RefundTxHashは払い戻しのトランザクションのハッシュ
+// Errorは途中で失敗したときのエラーメッセージ
+type GachaDraw struct {
+	DrawID       string    `json:"draw_id"`
+	UserID       string    `json:"user_id"`
+	GachaID      int       `json:"gacha_id"`
+	Times        int       `json:"times"`
+	Cost         int       `json:"cost"`
+	Payment      string    `json:"payment"`
+	Status       string    `json:"status"`
+	BurnTxHash   string    `json:"burn_tx_hash"`
+	Shards       int       `json:"shards"`
+	Refund       int       `json:"refund"`
+	RefundTxHash string    `json:"refund_tx_hash"`
+	ProofID      string    `json:"proof_id"`
+	JobID        string    `json:"job_id"`
+	Error        string    `json:"error"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// 1回のガチャで引いたキャラクターごとの回数の記録
+// ガチャを引いたときにキャラクターの保存と同じトランザクションで保存し、後から変更しない
+// 引いたキャラクターを売却や強化の素材に使っても、重複として変換して保存しなくても残る
+// RarityIDは引いたときのレアリティ、Countは引いた回数、ConvertedはCountのうち重複として自動で変換した数
+// BoostedはCountのうち天井か確定ルールで確率の変わった回に引いた数
+// IsNewはこのガチャを引く前に持っていなかったキャラクターならtrue
+type GachaDrawCharacter struct {
+	GachaDrawID      string `json:"gacha_draw_id" gorm:"primaryKey"`
+	GachaCharacterID string `json:"gacha_character_id" gorm:"primaryKey"`
+	RarityID         int    `json:"rarity_id"`
+	Count            int    `json:"count"`
+	Converted        int    `json:"converted"`
+	Boosted          int    `json:"boosted"`
+	IsNew            bool   `json:"is_new"`
+}
+
+// getGachaHistory関数で返される、1回のガチャの記録
+// Grantedはこのガチャで手に入れたキャラクターの数、ConvertedはGrantedのうち重複として自動で変換した数
+type GachaDrawResponse struct {
+	DrawID       string    `json:"drawID"`
+	GachaID      int       `json:"gachaID"`
+	GachaName    string    `json:"gachaName"`
+	Times        int       `json:"times"`
+	Cost         int       `json:"cost"`
+	Payment      string    `json:"payment"`
+	Status       string    `json:"status"`
+	BurnTxHash   string    `json:"burnTxHash"`
+	Shards       int       `json:"shards"`
+	Refund       int       `json:"refund"`
+	RefundTxHash string    `json:"refundTxHash,omitempty"`
+	ProofID      string    `json:"proofID"`
+	Error        string    `json:"error,omitempty"`
+	Granted      int       `json:"granted"`
+	Converted    int       `json:"converted"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// getGachaHistory関数で返される
+type GachaHistoryResponse struct {
+	Total  int64               `json:"total"`
+	Offset int                 `json:"offset"`
+	Limit  int                 `json:"limit"`
+	Draws  []GachaDrawResponse `json:"draws"`
+}
+
+// getGachaHistoryDraw関数で返される
+// Conversionsはこのガチャで重複として自動で変換したキャラクターの記録
+type GachaHistoryDrawResponse struct {
+	Draw        GachaDrawResponse       `json:"draw"`
+	Rarities    []RaritySummaryResponse `json:"rarities"`
+	Conversions []ConversionResponse    `json:"conversions"`
+}
+
+// 一覧の1行分として読み込む、ガチャ名付きのガチャの記録
+type gachaDrawRow struct {
+	GachaDraw
+	GachaName string
+}
+
+// localhost:8080/gacha/history?offset=0&limit=20&gacha_id=nでユーザのガチャの記録を新しい順に取得
+// gacha_idを省略すると全てのガチャが対象になる
+// limitは1以上maxGachaHistoryLimit以下(省略時は20)
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetGachaHistory(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, limit, err := parseOffsetLimit(r, 20, maxGachaHistoryLimit)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	gachaId := 0
+	if v := r.URL.Query().Get("gacha_id"); v != "" {
+		gachaId, err = strconv.Atoi(v)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "gacha_id is error.")
+			return
+		}
+	}
+	//	SELECT gacha_draws.*, gachas.gacha_name
+	//	FROM `gacha_draws`
+	//	join gachas
+	//	on gacha_draws.gacha_id = gachas.id
+	//	WHERE gacha_draws.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	//	ORDER BY gacha_draws.created_at DESC, gacha_draws.draw_id
+	//	LIMIT 20 OFFSET 0
+	query := c.DB.Table("gacha_draws").
+		Joins("join gachas on gacha_draws.gacha_id = gachas.id").
+		Where("gacha_draws.user_id = ?", userId)
+	if gachaId != 0 {
+		query = query.Where("gacha_draws.gacha_id = ?", gachaId)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var rows []gachaDrawRow
+	err = query.Select("gacha_draws.*, gachas.gacha_name").
+		Order("gacha_draws.created_at DESC, gacha_draws.draw_id").
+		Offset(offset).Limit(limit).Scan(&rows).Error
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	drawIds := make([]string, 0, len(rows))
+	for _, v := range rows {
+		drawIds = append(drawIds, v.DrawID)
+	}
+	granted, err := c.countGrantedCharacters(drawIds)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	draws := make([]GachaDrawResponse, 0, len(rows))
+	for _, v := range rows {
+		draws = append(draws, v.response(granted[v.DrawID]))
+	}
+	RespondWithJSON(w, http.StatusOK, &GachaHistoryResponse{
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+		Draws:  draws,
+	})
+	//	{"total":42,"offset":0,"limit":20,"draws":[
+	//		{"drawID":"9a1f...","gachaID":1,"gachaName":"Gacha_A","times":10,"cost":10,"payment":"gmtoken","status":"completed",
+	//		"burnTxHash":"0xf98c...","shards":2,"refund":0,"proofID":"3c6e...","granted":10,"converted":1,"createdAt":"2021-09-10T12:00:00Z"},
+	//		...
+	//	]}
+	//	が返る
+}
+
+// localhost:8080/gacha/history/{id}で1回のガチャの記録と、そのガチャで手に入れたキャラクターをレアリティごとにまとめて取得
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetGachaHistoryDraw(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var row gachaDrawRow
+	//	SELECT gacha_draws.*, gachas.gacha_name
+	//	FROM `gacha_draws`
+	//	join gachas
+	//	on gacha_draws.gacha_id = gachas.id
+	//	WHERE gacha_draws.draw_id = '9a1f...' AND gacha_draws.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	err = c.DB.Table("gacha_draws").Select("gacha_draws.*, gachas.gacha_name").
+		Joins("join gachas on gacha_draws.gacha_id = gachas.id").
+		Where("gacha_draws.draw_id = ? AND gacha_draws.user_id = ?", mux.Vars(r)["id"], userId).
+		Scan(&row).Error
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if row.DrawID == "" {
+		RespondWithError(w, http.StatusNotFound, "draw is not found.")
+		return
+	}
+	counts, err := c.getDrawCharacterCounts(userId, 0, row.DrawID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	granted := grantedCount{}
+	for _, v := range counts {
+		granted.Count += v.Count
+		granted.Converted += v.Converted
+	}
+	_, rarities := summarizeCharacterCounts(counts, nil)
+	conversions, err := c.getDuplicateConversions(c.DB.Where("duplicate_conversions.user_id = ? AND duplicate_conversions.gacha_draw_id = ?", userId, row.DrawID))
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &GachaHistoryDrawResponse{
+		Draw:        row.response(granted),
+		Rarities:    rarities,
+		Conversions: conversions,
+	})
+	//	{"draw":{"drawID":"9a1f...","gachaID":1,"gachaName":"Gacha_A","times":10,"cost":10,"status":"completed",...,"shards":2,"granted":10,"converted":1},
+	//	"rarities":[{"rarityID":2,"rarityName":"R","count":2,"characters":[{"characterID":"c115174c-...","name":"Venus","count":2,"converted":1}]},...],
+	//	"conversions":[{"conversionID":"5e2c...","drawID":"9a1f...","characterID":"c115174c-...","name":"Venus","policy":"shards","count":1,"shards":2,"refund":0,...}]}
+	//	が返る
+}
+
+// 1回のガチャで手に入れたキャラクターの数と、そのうち重複として変換した数
+type grantedCount struct {
+	Count     int
+	Converted int
+}
+
+// ガチャの記録をレスポンスの形に変換
+func (row gachaDrawRow) response(granted grantedCount) GachaDrawResponse {
+	return GachaDrawResponse{
+		DrawID:       row.DrawID,
+		GachaID:      row.GachaID,
+		GachaName:    row.GachaName,
+		Times:        row.Times,
+		Cost:         row.Cost,
+		Payment:      row.Payment,
+		Status:       row.Status,
+		BurnTxHash:   row.BurnTxHash,
+		Shards:       row.Shards,
+		Refund:       row.Refund,
+		RefundTxHash: row.RefundTxHash,
+		ProofID:      row.ProofID,
+		Error:        row.Error,
+		Granted:      granted.Count,
+		Converted:    granted.Converted,
+		CreatedAt:    row.CreatedAt,
+	}
+}
+
+// dbのgacha_draw_charactersテーブルから、引数drawIdsのガチャごとに手に入れたキャラクターの数と、そのうち重複として変換した数を数える
+func (c *Config) countGrantedCharacters(drawIds []string) (map[string]grantedCount, error) {
+	granted := make(map[string]grantedCount, len(drawIds))
+	if len(drawIds) == 0 {
+		return granted, nil
+	}
+	var counts []struct {
+		GachaDrawID string
+		Count       int
+		Converted   int
+	}
+	//	SELECT gacha_draw_id, SUM(count) AS count, SUM(converted) AS converted FROM `gacha_draw_characters`
+	//	WHERE gacha_draw_id IN ('9a1f...','0c7d...')
+	//	GROUP BY gacha_draw_id
+	err := c.DB.Table("gacha_draw_characters").Select("gacha_draw_id, SUM(count) AS count, SUM(converted) AS converted").
+		Where("gacha_draw_id IN ?", drawIds).
+		Group("gacha_draw_id").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range counts {
+		granted[v.GachaDrawID] = grantedCount{Count: v.Count, Converted: v.Converted}
+	}
+	return granted, nil
+}
+
+// dbのgacha_draw_charactersテーブルから、ユーザがガチャで引いたキャラクターをgacha_character_idごとに数える
+// 引数gachaIdが0でなければ、そのガチャで引いたキャラクターに限る
+// 引数drawIdが空でなければ、その回のガチャで引いたキャラクターに限る
+// レアリティは引いたときのものを使う
+func (c *Config) getDrawCharacterCounts(userId string, gachaId int, drawId string) ([]characterCount, error) {
+	var counts []characterCount
+	//	SELECT gacha_draw_characters.gacha_character_id, characters.character_name, gacha_draw_characters.rarity_id, rarities.rarity_name, rarities.grade AS rarity_grade,
+	//	SUM(gacha_draw_characters.count) AS count, SUM(gacha_draw_characters.converted) AS converted, SUM(gacha_draw_characters.boosted) AS boosted,
+	//	MAX(gacha_draw_characters.is_new) AS is_new
+	//	FROM `gacha_draw_characters`
+	//	join gacha_draws
+	//	on gacha_draw_characters.gacha_draw_id = gacha_draws.draw_id
+	//	join gacha_characters
+	//	on gacha_draw_characters.gacha_character_id = gacha_characters.gacha_character_id
+	//	join characters
+	//	on gacha_characters.character_id = characters.id
+	//	join rarities
+	//	on gacha_draw_characters.rarity_id = rarities.id
+	//	WHERE gacha_draws.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_draws.draw_id = '9a1f...'
+	//	GROUP BY gacha_draw_characters.gacha_character_id, characters.character_name, gacha_draw_characters.rarity_id, rarities.rarity_name, rarities.grade
+	query := c.DB.Table("gacha_draw_characters").
+		Select("gacha_draw_characters.gacha_character_id, characters.character_name, gacha_draw_characters.rarity_id, rarities.rarity_name, rarities.grade AS rarity_grade, "+
+			"SUM(gacha_draw_characters.count) AS count, SUM(gacha_draw_characters.converted) AS converted, SUM(gacha_draw_characters.boosted) AS boosted, "+
+			"MAX(gacha_draw_characters.is_new) AS is_new").
+		Joins("join gacha_draws on gacha_draw_characters.gacha_draw_id = gacha_draws.draw_id").
+		Joins("join gacha_characters on gacha_draw_characters.gacha_character_id = gacha_characters.gacha_character_id").
+		Joins("join characters on gacha_characters.character_id = characters.id").
+		Joins("join rarities on gacha_draw_characters.rarity_id = rarities.id").
+		Where("gacha_draws.user_id = ?", userId)
+	if gachaId != 0 {
+		query = query.Where("gacha_draws.gacha_id = ?", gachaId)
+	}
+	if drawId != "" {
+		query = query.Where("gacha_draws.draw_id = ?", drawId)
+	}
+	err := query.Group("gacha_draw_characters.gacha_character_id, characters.character_name, gacha_draw_characters.rarity_id, rarities.rarity_name, rarities.grade").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// トランザクションtxの中で、1回のガチャで引いたキャラクターごとの回数を保存する
+// ownedはガチャを引く前に持っていたキャラクターのgacha_character_id
+func saveGachaDrawCharacters(tx *gorm.DB, drawId string, counts []characterCount, owned map[string]bool) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	rows := make([]GachaDrawCharacter, 0, len(counts))
+	for _, v := range counts {
+		rows = append(rows, GachaDrawCharacter{
+			GachaDrawID:      drawId,
+			GachaCharacterID: v.GachaCharacterID,
+			RarityID:         v.RarityID,
+			Count:            v.Count,
+			Converted:        v.Converted,
+			Boosted:          v.Boosted,
+			IsNew:            !owned[v.GachaCharacterID],
+		})
+	}
+	//	INSERT INTO `gacha_draw_characters` (`gacha_draw_id`,`gacha_character_id`,`rarity_id`,`count`,`converted`,`boosted`,`is_new`)
+	//	VALUES ('9a1f...','7b6a8a4e-...',2,2,1,1,true),('9a1f...','7b6d0b6d-...',3,8,0,0,false)
+	return tx.Create(&rows).Error
+}
+
+// ガチャの記録をpendingの状態で作成してdbに保存
+// 非同期ガチャのジョブから引くときは、jobIdでジョブと結びつける(それ以外は空)
+func (c *Config) createGachaDraw(userId string, gachaId int, times int, cost int, payment string, jobId string) (GachaDraw, error) {
+	drawId, err := createUUId()
+	if err != nil {
+		return GachaDraw{}, err
+	}
+	draw := GachaDraw{
+		DrawID:  drawId,
+		UserID:  userId,
+		GachaID: gachaId,
+		Times:   times,
+		Cost:    cost,
+		Payment: payment,
+		Status:  gachaDrawPending,
+		JobID:   jobId,
+	}
+	//	INSERT INTO `gacha_draws` (`draw_id`,`user_id`,`gacha_id`,`times`,`cost`,`payment`,`status`,`burn_tx_hash`,`shards`,`refund`,`refund_tx_hash`,`proof_id`,`job_id`,`error`,`created_at`,`updated_at`)
+	//	VALUES ('9a1f...','95daec2b-287c-4358-ba6f-5c29e1c3cbdf',1,10,10,'gmtoken','pending','',0,0,'','','','','2021-09-10 12:00:00','2021-09-10 12:00:00')
+	if err := c.DB.Create(&draw).Error; err != nil {
+		return GachaDraw{}, err
+	}
+	return draw, nil
+}
+
+// ガチャの記録を更新する
+// 記録の更新に失敗してもガチャ自体は続けられるので、エラーはログに残すだけにする
+func (c *Config) updateGachaDraw(drawId string, values map[string]interface{}) {
+	// UPDATE `gacha_draws` SET `status`='burned',`burn_tx_hash`='0xf98c...',`updated_at`='2021-09-10 12:00:01' WHERE draw_id = '9a1f...'
+	if err := c.DB.Model(&GachaDraw{}).Where("draw_id = ?", drawId).Updates(values).Error; err != nil {
+		log.Println("gacha draw", drawId, "update failed:", err)
+	}
+}
@@ -0,0 +1,404 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"github.com/gorilla/mux"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// 非同期ガチャジョブの状態
+const (
+	drawJobQueued    = "queued"
+	drawJobRunning   = "running"
+	drawJobCompleted = "completed"
+	drawJobFailed    = "failed"
+)
+
+// executeGachaDraw関数の処理の段階
+const (
+	drawPhaseBurning = "burning"
+	drawPhaseRolling = "rolling"
+	drawPhaseSaving  = "saving"
+)
+
+// 完了したジョブを保持しておく時間と、期限切れのジョブを消す間隔
+// ジョブを消しても、抽選の結果はガチャの記録(/gacha/history)に残る
+const (
+	drawJobRetention     = time.Hour
+	drawJobExpirySweep   = 10 * time.Minute
+	drawJobInterruptedBy = "interrupted by a server restart"
+)
+
+// 結果のページングで1度に返す最大件数
+const maxDrawJobResultsLimit = 1000
+
+// 非同期で実行するガチャのジョブ
+// サーバーが再起動してもジョブの状態を調べられるように、dbのgacha_draw_jobsテーブルに保存する
+// Requestは受け取ったDrawingGachaのJSON、Phase、Done、Totalで処理の進み具合を表す
+// DrawIDはジョブで引いたガチャの記録のid(支払いの前に失敗していれば空)
+type GachaDrawJob struct {
+	JobID      string     `json:"job_id" gorm:"primaryKey"`
+	UserID     string     `json:"user_id"`
+	GachaID    int        `json:"gacha_id"`
+	Times      int        `json:"times"`
+	Request    string     `json:"request"`
+	Status     string     `json:"status"`
+	Phase      string     `json:"phase"`
+	Done       int        `json:"done"`
+	Total      int        `json:"total"`
+	Error      string     `json:"error"`
+	DrawID     string     `json:"draw_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+// 非同期ガチャジョブのキュー
+// ジョブの状態と結果はdbに保存し、キューにはジョブidだけを入れる
+type drawJobQueue struct {
+	queue chan string
+}
+
+// 同時に待機できるジョブ数がsizeのキューを作成
+func newDrawJobQueue(size int) *drawJobQueue {
+	return &drawJobQueue{queue: make(chan string, size)}
+}
+
+// drawGacha関数で非同期モードのときに返される
+type DrawJobCreatedResponse struct {
+	JobID string `json:"jobID"`
+}
+
+// getDrawJob関数で返される
+// Summary、Shards、Refund、Proofはジョブが完了したときだけ含まれる
+// DrawIDは支払いの前に失敗したジョブでは含まれない
+type DrawJobResponse struct {
+	JobID   string                  `json:"jobID"`
+	GachaID int                     `json:"gachaID"`
+	Times   int                     `json:"times"`
+	Status  string                  `json:"status"`
+	Phase   string                  `json:"phase"`
+	Done    int                     `json:"done"`
+	Total   int                     `json:"total"`
+	Error   string                  `json:"error,omitempty"`
+	Summary []RaritySummaryResponse `json:"summary,omitempty"`
+	Shards  int                     `json:"shards,omitempty"`
+	Refund  int                     `json:"refund,omitempty"`
+	DrawID  string                  `json:"drawID,omitempty"`
+	Proof   *ProofResponse          `json:"proof,omitempty"`
+}
+
+// getDrawJobResults関数で返される
+// Totalは引いたキャラクターの種類の数
+type DrawJobResultsResponse struct {
+	Total   int                        `json:"total"`
+	Offset  int                        `json:"offset"`
+	Limit   int                        `json:"limit"`
+	Results []CharacterSummaryResponse `json:"results"`
+}
+
+// n個のワーカーを起動し、キューに入ったジョブを順に実行する
+// 起動したときに、前回の起動で実行中だったジョブは失敗として記録し、待機中だったジョブはキューに入れ直す
+// 実行中だったジョブは支払いが済んでいるかもしれないので、やり直さずにガチャの記録のidを残す
+// 期限切れのジョブを消すゴルーチンも起動する
+// サーバーは1台で動かす前提で、他のサーバーが実行中のジョブは考えない
+func (c *Config) StartDrawWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for jobId := range c.DrawJobQueue.queue {
+				c.runDrawJob(jobId)
+			}
+		}()
+	}
+	if err := c.recoverDrawJobs(); err != nil {
+		log.Println("gacha job recovery failed:", err)
+	}
+	go func() {
+		ticker := time.NewTicker(drawJobExpirySweep)
+		for now := range ticker.C {
+			if err := c.removeExpiredDrawJobs(now); err != nil {
+				log.Println("gacha job expiry failed:", err)
+			}
+		}
+	}()
+}
+
+// 前回の起動で実行中だったジョブを失敗として記録し、待機中だったジョブをキューに入れ直す
+func (c *Config) recoverDrawJobs() error {
+	var running []GachaDrawJob
+	// SELECT * FROM `gacha_draw_jobs` WHERE status = 'running'
+	if err := c.DB.Where("status = ?", drawJobRunning).Find(&running).Error; err != nil {
+		return err
+	}
+	for _, job := range running {
+		c.finishDrawJob(job.JobID, nil, errors.New(drawJobInterruptedBy))
+	}
+	var queued []string
+	// SELECT job_id FROM `gacha_draw_jobs` WHERE status = 'queued' ORDER BY created_at
+	if err := c.DB.Model(&GachaDrawJob{}).Where("status = ?", drawJobQueued).Order("created_at").Pluck("job_id", &queued).Error; err != nil {
+		return err
+	}
+	// キューに入りきらない分はワーカーが空くまで待って入れる
+	go func() {
+		for _, jobId := range queued {
+			c.DrawJobQueue.queue <- jobId
+		}
+	}()
+	return nil
+}
+
+// 完了してからdrawJobRetentionが過ぎたジョブをdbから消す
+func (c *Config) removeExpiredDrawJobs(now time.Time) error {
+	// DELETE FROM `gacha_draw_jobs` WHERE finished_at < '2021-11-01 11:00:00'
+	return c.DB.Where("finished_at < ?", now.Add(-drawJobRetention)).Delete(&GachaDrawJob{}).Error
+}
+
+// ジョブを作成してdbに保存し、キューに入れる
+// キューがいっぱいならジョブを消してエラーを返す
+func (c *Config) enqueueDrawJob(userId string, drawingGacha DrawingGacha) (GachaDrawJob, error) {
+	jobId, err := createUUId()
+	if err != nil {
+		return GachaDrawJob{}, err
+	}
+	request, err := json.Marshal(drawingGacha)
+	if err != nil {
+		return GachaDrawJob{}, err
+	}
+	job := GachaDrawJob{
+		JobID:   jobId,
+		UserID:  userId,
+		GachaID: drawingGacha.GachaID,
+		Times:   drawingGacha.Times,
+		Request: string(request),
+		Status:  drawJobQueued,
+		Total:   drawingGacha.Times,
+	}
+	//	INSERT INTO `gacha_draw_jobs` (`job_id`,`user_id`,`gacha_id`,`times`,`request`,`status`,`phase`,`done`,`total`,`error`,`draw_id`,`created_at`,`updated_at`,`finished_at`)
+	//	VALUES ('5e0c...','95daec2b-287c-4358-ba6f-5c29e1c3cbdf',1,1000000,'{"gacha_id":1,"times":1000000,...}','queued','',0,1000000,'','','2021-11-01 12:00:00','2021-11-01 12:00:00',NULL)
+	if err := c.DB.Create(&job).Error; err != nil {
+		return GachaDrawJob{}, err
+	}
+	select {
+	case c.DrawJobQueue.queue <- jobId:
+		return job, nil
+	default:
+		// DELETE FROM `gacha_draw_jobs` WHERE job_id = '5e0c...'
+		if err := c.DB.Where("job_id = ?", jobId).Delete(&GachaDrawJob{}).Error; err != nil {
+			log.Println("gacha job", jobId, "could not be removed:", err)
+		}
+		return GachaDrawJob{}, newAPIError(http.StatusServiceUnavailable, "too many gacha jobs, try again later.")
+	}
+}
+
+// dbからジョブidとユーザidが一致するジョブを取得
+// 見つからなければfalseを返す
+func (c *Config) getDrawJob(jobId string, userId string) (GachaDrawJob, bool, error) {
+	var job GachaDrawJob
+	// SELECT * FROM `gacha_draw_jobs` WHERE job_id = '5e0c...' AND user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	if err := c.DB.Where("job_id = ? AND user_id = ?", jobId, userId).Find(&job).Error; err != nil {
+		return GachaDrawJob{}, false, err
+	}
+	return job, job.JobID != "", nil
+}
+
+// ジョブを実行し、進み具合と結果をdbのジョブに書き込む
+// 他のワーカーが先に実行を始めていれば何もしない
+func (c *Config) runDrawJob(jobId string) {
+	// UPDATE `gacha_draw_jobs` SET `status`='running',`updated_at`='2021-11-01 12:00:01' WHERE job_id = '5e0c...' AND status = 'queued'
+	started := c.DB.Model(&GachaDrawJob{}).Where("job_id = ? AND status = ?", jobId, drawJobQueued).Update("status", drawJobRunning)
+	if started.Error != nil {
+		log.Println("gacha job", jobId, "could not be started:", started.Error)
+		return
+	}
+	if started.RowsAffected == 0 {
+		return
+	}
+	var job GachaDrawJob
+	// SELECT * FROM `gacha_draw_jobs` WHERE job_id = '5e0c...'
+	if err := c.DB.Where("job_id = ?", jobId).Find(&job).Error; err != nil {
+		c.finishDrawJob(jobId, nil, err)
+		return
+	}
+	var drawingGacha DrawingGacha
+	if err := json.Unmarshal([]byte(job.Request), &drawingGacha); err != nil {
+		c.finishDrawJob(jobId, nil, err)
+		return
+	}
+	drawingGacha.JobID = jobId
+	table, err := c.getGachaTable(drawingGacha.GachaID)
+	if err != nil {
+		c.finishDrawJob(jobId, nil, err)
+		return
+	}
+	result, err := c.executeGachaDraw(job.UserID, drawingGacha, table, func(phase string, done int, total int) {
+		// UPDATE `gacha_draw_jobs` SET `done`=420000,`phase`='rolling',`total`=1000000,`updated_at`='2021-11-01 12:00:05' WHERE job_id = '5e0c...'
+		err := c.DB.Model(&GachaDrawJob{}).Where("job_id = ?", jobId).
+			Updates(map[string]interface{}{"phase": phase, "done": done, "total": total}).Error
+		if err != nil {
+			log.Println("gacha job", jobId, "progress could not be recorded:", err)
+		}
+	})
+	c.finishDrawJob(jobId, result, err)
+}
+
+// ジョブを完了か失敗として記録する
+// 失敗したときも、支払いの後なら調べられるようにガチャの記録のidを残す
+func (c *Config) finishDrawJob(jobId string, result *gachaDrawResult, err error) {
+	now := time.Now()
+	values := map[string]interface{}{"status": drawJobCompleted, "finished_at": &now}
+	if err != nil {
+		log.Println("gacha job", jobId, "failed:", err)
+		values["status"] = drawJobFailed
+		values["error"] = err.Error()
+		var drawIds []string
+		// SELECT draw_id FROM `gacha_draws` WHERE job_id = '5e0c...'
+		if err := c.DB.Model(&GachaDraw{}).Where("job_id = ?", jobId).Pluck("draw_id", &drawIds).Error; err != nil {
+			log.Println("gacha job", jobId, "draw could not be found:", err)
+		} else if len(drawIds) != 0 {
+			values["draw_id"] = drawIds[0]
+		}
+	} else {
+		values["draw_id"] = result.DrawID
+	}
+	// UPDATE `gacha_draw_jobs` SET `draw_id`='9a1f...',`finished_at`='2021-11-01 12:01:00',`status`='completed',`updated_at`='2021-11-01 12:01:00' WHERE job_id = '5e0c...'
+	if err := c.DB.Model(&GachaDrawJob{}).Where("job_id = ?", jobId).Updates(values).Error; err != nil {
+		log.Println("gacha job", jobId, "could not be finished:", err)
+	}
+}
+
+// localhost:8080/gacha/jobs/{id}で非同期ガチャジョブの進み具合を取得
+// ジョブが完了していれば、レアリティとキャラクターごとにまとめた結果と抽選の検証情報も返す
+// 結果はガチャの記録から読み込むので、サーバーが再起動しても返せる
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetDrawJob(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	job, ok, err := c.getDrawJob(mux.Vars(r)["id"], userId)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, "job is not found.")
+		return
+	}
+	response := DrawJobResponse{
+		JobID:   job.JobID,
+		GachaID: job.GachaID,
+		Times:   job.Times,
+		Status:  job.Status,
+		Phase:   job.Phase,
+		Done:    job.Done,
+		Total:   job.Total,
+		Error:   job.Error,
+		DrawID:  job.DrawID,
+	}
+	if job.Status == drawJobCompleted {
+		counts, err := c.getDrawCharacterCounts(userId, 0, job.DrawID)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		_, response.Summary = summarizeCharacterCounts(counts, ownedBeforeDraw(counts))
+		var draw GachaDraw
+		// SELECT * FROM `gacha_draws` WHERE draw_id = '9a1f...'
+		if err := c.DB.Where("draw_id = ?", job.DrawID).Find(&draw).Error; err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		response.Shards = draw.Shards
+		response.Refund = draw.Refund
+		proof, err := c.getProofResponse(draw.ProofID)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		response.Proof = &proof
+	}
+	RespondWithJSON(w, http.StatusOK, &response)
+	//	{"jobID":"5e0c...","gachaID":1,"times":1000000,"status":"running","phase":"rolling","done":420000,"total":1000000}
+	//	が返る
+}
+
+// localhost:8080/gacha/jobs/{id}/results?offset=0&limit=100で完了したジョブの抽選結果を、キャラクターごとの回数にしてレアリティの高い順に取得
+// 回数の多いガチャは1回ごとの結果を保持しないので、引いた順には返さない
+// limitは1以上maxDrawJobResultsLimit以下(省略時は100)
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetDrawJobResults(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	job, ok, err := c.getDrawJob(mux.Vars(r)["id"], userId)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, "job is not found.")
+		return
+	}
+	if job.Status != drawJobCompleted {
+		RespondWithError(w, http.StatusConflict, "job is not completed.")
+		return
+	}
+	offset, limit, err := parseOffsetLimit(r, 100, maxDrawJobResultsLimit)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	counts, err := c.getDrawCharacterCounts(userId, 0, job.DrawID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, rarities := summarizeCharacterCounts(counts, ownedBeforeDraw(counts))
+	var characters []CharacterSummaryResponse
+	for _, rarity := range rarities {
+		characters = append(characters, rarity.Characters...)
+	}
+	results := make([]CharacterSummaryResponse, 0, limit)
+	for n := offset; n < len(characters) && n < offset+limit; n++ {
+		results = append(results, characters[n])
+	}
+	RespondWithJSON(w, http.StatusOK, &DrawJobResultsResponse{
+		Total:   len(characters),
+		Offset:  offset,
+		Limit:   limit,
+		Results: results,
+	})
+	//	{"total":12,"offset":0,"limit":100,"results":[
+	//		{"characterID":"7b6a8a4e-...","name":"Mercury","count":10021,"new":true,"converted":10020},
+	//		...
+	//	]}
+	//	が返る
+}
+
+// クエリパラメータのoffsetとlimitを読み込む
+// limitを省略したときはdefaultLimitとし、maxLimitより大きいときはエラーを返す
+func parseOffsetLimit(r *http.Request, defaultLimit int, maxLimit int) (int, int, error) {
+	offset, limit := 0, defaultLimit
+	var err error
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, newAPIError(http.StatusBadRequest, "offset is error.")
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxLimit {
+			return 0, 0, newAPIError(http.StatusBadRequest, "limit is error.")
+		}
+	}
+	return offset, limit, nil
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// ユーザがガチャごとに、天井対象のレアリティを最後に引いてから何回ガチャを引いたか
+type GachaPityCount struct {
+	UserID  string `json:"user_id" gorm:"primaryKey"`
+	GachaID int    `json:"gacha_id" gorm:"primaryKey"`
+	Count   int    `json:"count"`
+}
+
+// dbのgachasテーブルからidが引数gachaIdのガチャ情報を取得
+func (c *Config) getGacha(gachaId int) (Gacha, error) {
+	var gacha Gacha
+	// SELECT * FROM `gachas` WHERE id = 1
+	if err := c.DB.Where("id = ?", gachaId).Find(&gacha).Error; err != nil {
+		return Gacha{}, err
+	}
+	return gacha, nil
+}
+
+// トランザクションtxの中で、dbのgacha_pity_countsテーブルからユーザのガチャごとの天井カウンターを取得
+// 同じガチャを同時に引いたときに天井カウンターを上書きし合わないように、トランザクションが終わるまで行をロックする
+// まだガチャを引いたことがなければ0の行を作成してからロックし、0を返す
+func (c *Config) lockPityCount(tx *gorm.DB, userId string, gachaId int) (int, error) {
+	//	INSERT INTO `gacha_pity_counts` (`user_id`,`gacha_id`,`count`)
+	//	VALUES ('95daec2b-287c-4358-ba6f-5c29e1c3cbdf',1,0)
+	//	ON DUPLICATE KEY UPDATE `user_id`=`user_id`
+	pityCount := GachaPityCount{UserID: userId, GachaID: gachaId}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&pityCount).Error; err != nil {
+		return 0, err
+	}
+	// SELECT * FROM `gacha_pity_counts` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 1 FOR UPDATE
+	if err := tx.Where("user_id = ? AND gacha_id = ?", userId, gachaId).Clauses(clause.Locking{Strength: "UPDATE"}).Find(&pityCount).Error; err != nil {
+		return 0, err
+	}
+	return pityCount.Count, nil
+}
+
+// トランザクションtxの中で、dbのgacha_pity_countsテーブルにユーザのガチャごとの天井カウンターを保存
+// lockPityCount関数でロックした行を、同じトランザクションの中で更新する
+func (c *Config) savePityCount(tx *gorm.DB, userId string, gachaId int, count int) error {
+	//	INSERT INTO `gacha_pity_counts` (`user_id`,`gacha_id`,`count`)
+	//	VALUES ('95daec2b-287c-4358-ba6f-5c29e1c3cbdf',1,12)
+	//	ON DUPLICATE KEY UPDATE `count`=VALUES(`count`)
+	pityCount := GachaPityCount{UserID: userId, GachaID: gachaId, Count: count}
+	return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&pityCount).Error
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"time"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// ガチャの抽選に使うサーバーシード
+// ServerSeedHashだけを事前に公開し、ServerSeedはローテーションするまで公開しない
+// Nonceは次のガチャで使う値で、ガチャを引くたびに1増える
+type GachaSeed struct {
+	SeedID         string     `json:"seed_id"`
+	UserID         string     `json:"user_id"`
+	ServerSeed     string     `json:"server_seed"`
+	ServerSeedHash string     `json:"server_seed_hash"`
+	Nonce          int        `json:"nonce"`
+	CreatedAt      time.Time  `json:"created_at"`
+	RevealedAt     *time.Time `json:"revealed_at"`
+}
+
+// getGachaSeed関数、rotateGachaSeed関数で返される
+// ServerSeedは公開済みのシードでのみ返す
+type SeedResponse struct {
+	SeedID         string `json:"seedID"`
+	ServerSeedHash string `json:"serverSeedHash"`
+	ServerSeed     string `json:"serverSeed,omitempty"`
+	Nonce          int    `json:"nonce"`
+}
+
+// rotateGachaSeed関数で返される
+type RotateSeedResponse struct {
+	Revealed SeedResponse `json:"revealed"`
+	Next     SeedResponse `json:"next"`
+}
+
+// localhost:8080/gacha/seedで次のガチャで使うサーバーシードのハッシュとナンスを取得
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetGachaSeed(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	seed, err := c.getActiveGachaSeed(userId)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &SeedResponse{
+		SeedID:         seed.SeedID,
+		ServerSeedHash: seed.ServerSeedHash,
+		Nonce:          seed.Nonce,
+	})
+	// {"seedID":"0b1f...","serverSeedHash":"5d41402abc4b2a76b9719d911017c592...","nonce":3}が返る
+}
+
+// localhost:8080/gacha/seed/rotateで今のサーバーシードを公開し、新しいサーバーシードに切り替える
+// 公開したサーバーシードで引いたガチャは/gacha/verifyで検証できるようになる
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) RotateGachaSeed(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// 公開と新しいサーバーシードの作成はユーザの行をロックして行うので、同時にローテーションしても作成するのは1つだけ
+	var seed, next GachaSeed
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		seed, err = c.lockActiveGachaSeed(tx, userId)
+		if err != nil {
+			return err
+		}
+		// UPDATE `gacha_seeds` SET `revealed_at`='2021-11-01 12:00:00' WHERE seed_id = '0b1f...'
+		if err := tx.Model(&GachaSeed{}).Where("seed_id = ?", seed.SeedID).Update("revealed_at", time.Now()).Error; err != nil {
+			return err
+		}
+		next, err = c.createGachaSeed(tx, userId)
+		return err
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &RotateSeedResponse{
+		Revealed: SeedResponse{SeedID: seed.SeedID, ServerSeedHash: seed.ServerSeedHash, ServerSeed: seed.ServerSeed, Nonce: seed.Nonce},
+		Next:     SeedResponse{SeedID: next.SeedID, ServerSeedHash: next.ServerSeedHash, Nonce: next.Nonce},
+	})
+}
+
+// dbのgacha_seedsテーブルからユーザのまだ公開していないサーバーシードを取得
+// なければ新しく作成する
+func (c *Config) getActiveGachaSeed(userId string) (GachaSeed, error) {
+	var seed GachaSeed
+	err := c.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		seed, err = c.lockActiveGachaSeed(tx, userId)
+		return err
+	})
+	return seed, err
+}
+
+// トランザクションtxの中で、ユーザの行をロックしてからまだ公開していないサーバーシードを取得し、なければ新しく作成する
+// ロックはトランザクションが終わるまで続くので、同時に呼ばれても公開していないサーバーシードが2つできることはない
+func (c *Config) lockActiveGachaSeed(tx *gorm.DB, userId string) (GachaSeed, error) {
+	var user User
+	// SELECT * FROM `users` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' FOR UPDATE
+	if err := tx.Where("user_id = ?", userId).Clauses(clause.Locking{Strength: "UPDATE"}).Find(&user).Error; err != nil {
+		return GachaSeed{}, err
+	}
+	if user.UserID == "" {
+		return GachaSeed{}, newAPIError(http.StatusBadRequest, "user is not found.")
+	}
+	var seeds []GachaSeed
+	// SELECT * FROM `gacha_seeds` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND revealed_at IS NULL LIMIT 1
+	if err := tx.Where("user_id = ? AND revealed_at IS NULL", userId).Limit(1).Find(&seeds).Error; err != nil {
+		return GachaSeed{}, err
+	}
+	if len(seeds) != 0 {
+		return seeds[0], nil
+	}
+	return c.createGachaSeed(tx, userId)
+}
+
+// トランザクションtxの中で、32バイトのサーバーシードを生成し、dbのgacha_seedsテーブルに保存
+func (c *Config) createGachaSeed(tx *gorm.DB, userId string) (GachaSeed, error) {
+	seedId, err := createUUId()
+	if err != nil {
+		return GachaSeed{}, err
+	}
+	seedBytes := make([]byte, 32)
+	if _, err := rand.Read(seedBytes); err != nil {
+		return GachaSeed{}, err
+	}
+	serverSeed := hex.EncodeToString(seedBytes)
+	seed := GachaSeed{
+		SeedID:         seedId,
+		UserID:         userId,
+		ServerSeed:     serverSeed,
+		ServerSeedHash: hashServerSeed(serverSeed),
+		Nonce:          0,
+		CreatedAt:      time.Now(),
+	}
+	//	INSERT INTO `gacha_seeds` (`seed_id`,`user_id`,`server_seed`,`server_seed_hash`,`nonce`,`created_at`,`revealed_at`)
+	//	VALUES ('0b1f...','95daec2b-287c-4358-ba6f-5c29e1c3cbdf','9f86d0...','5d4140...',0,'2021-11-01 12:00:00',NULL)
+	if err := tx.Create(&seed).Error; err != nil {
+		return GachaSeed{}, err
+	}
+	return seed, nil
+}
+
+// サーバーシードのナンスを1つ確保し、確保したナンスを返す
+// 同時に引かれたガチャが同じナンスを使わないように、ナンスが読み込んだ時のままの場合だけ更新する
+// 読み込んだ後にローテーションで公開されたサーバーシードも使わない
+func (c *Config) reserveNonce(seed GachaSeed) (int, error) {
+	// UPDATE `gacha_seeds` SET `nonce`=4 WHERE seed_id = '0b1f...' AND nonce = 3 AND revealed_at IS NULL
+	result := c.DB.Model(&GachaSeed{}).Where("seed_id = ? AND nonce = ? AND revealed_at IS NULL", seed.SeedID, seed.Nonce).Update("nonce", seed.Nonce+1)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, fmt.Errorf("nonce of seed %s is already used or revealed", seed.SeedID)
+	}
+	return seed.Nonce, nil
+}
+
+// サーバーシードのSHA-256ハッシュを16進数文字列で返す
+func hashServerSeed(serverSeed string) string {
+	sum := sha256.Sum256([]byte(serverSeed))
+	return hex.EncodeToString(sum[:])
+}
+
+// HMAC-SHA256(サーバーシード, "クライアントシード:ナンス:ラウンド")から乱数を作る乱数源
+// 同じサーバーシード、クライアントシード、ナンスからは常に同じ乱数列ができる
+type hmacSource struct {
+	mac        hash.Hash
+	clientSeed string
+	nonce      int
+	round      int
+	buf        []byte
+}
+
+// サーバーシード、クライアントシード、ナンスからhmacSourceを作成
+func newHmacSource(serverSeed string, clientSeed string, nonce int) *hmacSource {
+	return &hmacSource{
+		mac:        hmac.New(sha256.New, []byte(serverSeed)),
+		clientSeed: clientSeed,
+		nonce:      nonce,
+	}
+}
+
+// 64ビットの乱数を返す
+// HMACの出力32バイトを使い切ったら、ラウンドを1増やして次のHMACを計算する
+func (s *hmacSource) Uint64() uint64 {
+	if len(s.buf) < 8 {
+		s.mac.Reset()
+		fmt.Fprintf(s.mac, "%s:%d:%d", s.clientSeed, s.nonce, s.round)
+		s.buf = s.mac.Sum(nil)
+		s.round += 1
+	}
+	v := binary.BigEndian.Uint64(s.buf[:8])
+	s.buf = s.buf[8:]
+	return v
+}
@@ -0,0 +1,428 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"gopkg.in/yaml.v3"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// gacha-simサブコマンドで表示するコストの百分位
+var simPercentiles = []int{10, 25, 50, 75, 90, 99}
+
+// YAMLファイルで定義する、シミュレーション用のガチャ
+// dbのgachas、rarities、gacha_characters、gacha_guarantees、gacha_stepsテーブルと同じ設定を1つのファイルにまとめたもの
+// 例
+//
+//	name: Gacha_A
+//	hard_pity: 90
+//	soft_pity: 74
+//	soft_pity_weight_up: 6
+//	pity_rarity_id: 1
+//	rarities:
+//	  - {id: 1, name: SR, weight: 1, grade: 3}
+//	  - {id: 2, name: R, weight: 5, grade: 2}
+//	characters:
+//	  - {name: Mercury, rarity_id: 1}
+//	  - {name: Venus, rarity_id: 2, rate_up: 3}
+//	guarantees:
+//	  - {every: 10, min_rarity_id: 2}
+type simBanner struct {
+	Name             string         `yaml:"name"`
+	GachaType        string         `yaml:"gacha_type"`
+	HardPity         int            `yaml:"hard_pity"`
+	SoftPity         int            `yaml:"soft_pity"`
+	SoftPityWeightUp uint           `yaml:"soft_pity_weight_up"`
+	PityRarityID     int            `yaml:"pity_rarity_id"`
+	Rarities         []simRarity    `yaml:"rarities"`
+	Characters       []simCharacter `yaml:"characters"`
+	Guarantees       []simGuarantee `yaml:"guarantees"`
+	Steps            []simStep      `yaml:"steps"`
+}
+
+// YAMLファイルで定義するレアリティ
+type simRarity struct {
+	ID     int    `yaml:"id"`
+	Name   string `yaml:"name"`
+	Weight uint   `yaml:"weight"`
+	Grade  int    `yaml:"grade"`
+}
+
+// YAMLファイルで定義するガチャのキャラクター
+type simCharacter struct {
+	Name     string `yaml:"name"`
+	RarityID int    `yaml:"rarity_id"`
+	RateUp   uint   `yaml:"rate_up"`
+}
+
+// YAMLファイルで定義する確定ルール
+type simGuarantee struct {
+	Every       int `yaml:"every"`
+	MinRarityID int `yaml:"min_rarity_id"`
+}
+
+// YAMLファイルで定義するステップアップガチャのステップ(並び順がステップ順)
+type simStep struct {
+	Price              int `yaml:"price"`
+	Times              int `yaml:"times"`
+	GuaranteedRarityID int `yaml:"guaranteed_rarity_id"`
+}
+
+// gacha-simサブコマンドの設定
+// Runs: シミュレーションするプレイヤーの人数
+// MaxPulls: 1人のプレイヤーが引く回数
+// Times: 1回のガチャで引く回数(ステップアップガチャではステップの設定を使う)
+// Seed: 乱数のシード値(同じシード値なら同じ結果になる)
+type gachaSimOptions struct {
+	Runs     int
+	MaxPulls int
+	Times    int
+	Seed     int64
+}
+
+// シミュレーションの結果
+// RarityCounts: レアリティ(抽選テーブルのpoolsの順)ごとの引いた回数
+// Costs: キャラクターごと、プレイヤーごとの、そのキャラクターを初めて引くまでに使ったゲームトークンの量(引けなければ-1)
+type gachaSimResult struct {
+	Table        *gachaTable
+	Options      gachaSimOptions
+	Pulls        int
+	RarityCounts []int
+	Costs        [][]int
+}
+
+// gacha-simサブコマンド
+// ガチャの設定をdb(-gacha)かYAMLファイル(-file)から読み込み、本番と同じ抽選処理(天井、確定ルールを含む)で大量に抽選して
+// レアリティごとの排出率と、キャラクターごとの入手までのコストの平均と百分位をoutに表示する
+// -csvを指定すると、キャラクターごとの1から100までの百分位のコストをCSVファイルに書き出す
+// argsはサブコマンド名より後の引数
+func RunGachaSim(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("gacha-sim", flag.ContinueOnError)
+	flags.SetOutput(out)
+	gachaId := flags.Int("gacha", 0, "id of the gacha to load from the database")
+	file := flags.String("file", "", "YAML file with the gacha definition")
+	runs := flags.Int("runs", 10000, "number of simulated players")
+	maxPulls := flags.Int("pulls", 1000, "number of pulls per player")
+	times := flags.Int("times", 10, "number of pulls per draw (ignored for step-up gachas)")
+	seed := flags.Int64("seed", 1, "random seed")
+	csvPath := flags.String("csv", "", "write the cost percentile curves to this CSV file")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if (*gachaId == 0) == (*file == "") {
+		return errors.New("either -gacha or -file is required")
+	}
+	if *runs <= 0 || *maxPulls <= 0 || *times <= 0 {
+		return errors.New("-runs, -pulls and -times must be greater than 0")
+	}
+	var table *gachaTable
+	var err error
+	if *file != "" {
+		table, err = loadSimBanner(*file)
+	} else {
+		table, err = loadSimGachaTable(*gachaId)
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkSimGachaTable(table); err != nil {
+		return err
+	}
+	result := simulateGacha(table, gachaSimOptions{Runs: *runs, MaxPulls: *maxPulls, Times: *times, Seed: *seed})
+	if err := result.print(out); err != nil {
+		return err
+	}
+	if *csvPath != "" {
+		return result.writeCSV(*csvPath)
+	}
+	return nil
+}
+
+// dbからガチャidが引数gachaIdの抽選テーブルを読み込む
+func loadSimGachaTable(gachaId int) (*gachaTable, error) {
+	db, err := GetConnection("../.ssh/mysql_password", "../.ssh/mysql_user")
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{DB: db}
+	table, err := c.loadGachaTable(gachaId)
+	if err != nil {
+		return nil, err
+	}
+	if table.Gacha.ID == 0 {
+		return nil, errors.New("gacha " + strconv.Itoa(gachaId) + " is not found")
+	}
+	return table, nil
+}
+
+// YAMLファイルfileからガチャの定義を読み込み、抽選テーブルを作成
+func loadSimBanner(file string) (*gachaTable, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var banner simBanner
+	if err := yaml.Unmarshal(data, &banner); err != nil {
+		return nil, err
+	}
+	return banner.gachaTable()
+}
+
+// YAMLファイルのガチャの定義から抽選テーブルを作成
+// キャラクターのgacha_character_idには名前を使う
+func (b *simBanner) gachaTable() (*gachaTable, error) {
+	rarities := make(map[int]simRarity, len(b.Rarities))
+	for _, rarity := range b.Rarities {
+		if rarity.Weight == 0 {
+			return nil, errors.New("weight of rarity " + strconv.Itoa(rarity.ID) + " must be greater than 0")
+		}
+		rarities[rarity.ID] = rarity
+	}
+	grade := func(rarityId int) (int, error) {
+		rarity, ok := rarities[rarityId]
+		if !ok {
+			return 0, errors.New("rarity " + strconv.Itoa(rarityId) + " is not defined")
+		}
+		return rarity.Grade, nil
+	}
+	gacha := Gacha{
+		GachaName:        b.Name,
+		GachaType:        b.GachaType,
+		HardPity:         b.HardPity,
+		SoftPity:         b.SoftPity,
+		SoftPityWeightUp: b.SoftPityWeightUp,
+		PityRarityID:     b.PityRarityID,
+	}
+	if err := gacha.validate(); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(b.Characters))
+	var charactersList []Character
+	for _, v := range b.Characters {
+		if names[v.Name] {
+			return nil, errors.New("character " + v.Name + " is defined twice")
+		}
+		names[v.Name] = true
+		rarityGrade, err := grade(v.RarityID)
+		if err != nil {
+			return nil, err
+		}
+		charactersList = append(charactersList, Character{
+			GachaCharacterID: v.Name,
+			CharacterName:    v.Name,
+			Weight:           rarities[v.RarityID].Weight,
+			RarityID:         v.RarityID,
+			RarityGrade:      rarityGrade,
+			RateUp:           v.RateUp,
+			RarityName:       rarities[v.RarityID].Name,
+		})
+	}
+	var guarantees []GachaGuarantee
+	for _, v := range b.Guarantees {
+		minGrade, err := grade(v.MinRarityID)
+		if err != nil {
+			return nil, err
+		}
+		guarantees = append(guarantees, GachaGuarantee{Every: v.Every, MinRarityID: v.MinRarityID, MinGrade: minGrade})
+	}
+	table := newGachaTable(gacha, charactersList, guarantees)
+	for i, v := range b.Steps {
+		guaranteedGrade := 0
+		if v.GuaranteedRarityID != 0 {
+			g, err := grade(v.GuaranteedRarityID)
+			if err != nil {
+				return nil, err
+			}
+			guaranteedGrade = g
+		}
+		table.Steps = append(table.Steps, GachaStep{Step: i + 1, Price: v.Price, Times: v.Times, GuaranteedRarityID: v.GuaranteedRarityID, GuaranteedGrade: guaranteedGrade})
+	}
+	return table, nil
+}
+
+// 抽選テーブルがシミュレーションできるものであることを確認する
+// ボックスガチャはプレイヤーごとのボックスの中身で結果が変わるので対象外
+func checkSimGachaTable(table *gachaTable) error {
+	if table.Gacha.GachaType == gachaTypeBox {
+		return errors.New("box gachas cannot be simulated")
+	}
+	if len(table.Characters) == 0 || table.rarityTotals[len(table.rarityTotals)-1] == 0 {
+		return errors.New("gacha has no characters to draw")
+	}
+	if table.Gacha.GachaType == gachaTypeStepUp {
+		if len(table.Steps) == 0 {
+			return errors.New("step-up gacha has no steps")
+		}
+		for _, step := range table.Steps {
+			if step.Times <= 0 {
+				return errors.New("times of step " + strconv.Itoa(step.Step) + " must be greater than 0")
+			}
+		}
+	}
+	return nil
+}
+
+// Runs人のプレイヤーがそれぞれMaxPulls回以上引くまでガチャを引き続けるシミュレーションを実行
+// プレイヤーごとに天井カウンターは0から、ステップアップガチャのステップは1から始める
+// 通常のガチャは1回にTimes回引いてTimesだけ、ステップアップガチャはステップの回数引いてステップの価格だけゲームトークンを使う
+func simulateGacha(table *gachaTable, options gachaSimOptions) *gachaSimResult {
+	result := &gachaSimResult{
+		Table:        table,
+		Options:      options,
+		RarityCounts: make([]int, len(table.pools)),
+		Costs:        make([][]int, len(table.Characters)),
+	}
+	// キャラクターのインデックスからレアリティのpoolsのインデックスを引く
+	characterPools := make([]int, len(table.Characters))
+	for p, pool := range table.pools {
+		for _, i := range pool.Members {
+			characterPools[i] = p
+		}
+	}
+	for i := range result.Costs {
+		result.Costs[i] = make([]int, options.Runs)
+	}
+	roller := NewSeededRoller(options.Seed)
+	for run := 0; run < options.Runs; run++ {
+		for i := range result.Costs {
+			result.Costs[i][run] = -1
+		}
+		pityCount, pulls, cost, step := 0, 0, 0, 1
+		for pulls < options.MaxPulls {
+			drawTable, times, price := table, options.Times, options.Times
+			if table.Gacha.GachaType == gachaTypeStepUp {
+				gachaStep := table.step(step)
+				drawTable, times, price = table.withStep(gachaStep), gachaStep.Times, gachaStep.Price
+				step = gachaStep.Step%len(table.Steps) + 1
+			}
+			cost += price
+			pityCount = drawTable.drawEach(roller, times, pityCount, func(i int, boosted bool) {
+				result.RarityCounts[characterPools[i]] += 1
+				if result.Costs[i][run] < 0 {
+					result.Costs[i][run] = cost
+				}
+			})
+			pulls += times
+		}
+		result.Pulls += pulls
+	}
+	for _, costs := range result.Costs {
+		sortSimCosts(costs)
+	}
+	return result
+}
+
+// コストを小さい順に並べ、引けなかった(-1の)プレイヤーを最後にする
+func sortSimCosts(costs []int) {
+	sort.Slice(costs, func(i, j int) bool {
+		if costs[i] < 0 || costs[j] < 0 {
+			return costs[j] < 0 && costs[i] >= 0
+		}
+		return costs[i] < costs[j]
+	})
+}
+
+// 小さい順に並べたコストのp百分位を返す
+// その百分位のプレイヤーがキャラクターを引けていなければ-1を返す
+func simPercentile(costs []int, p int) int {
+	i := int(math.Ceil(float64(p)/100*float64(len(costs)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return costs[i]
+}
+
+// 引けたプレイヤーの割合と、引けたプレイヤーのコストの平均を返す
+func simMean(costs []int) (float64, float64) {
+	obtained, total := 0, 0
+	for _, cost := range costs {
+		if cost >= 0 {
+			obtained += 1
+			total += cost
+		}
+	}
+	if obtained == 0 {
+		return 0, 0
+	}
+	return float64(obtained) / float64(len(costs)), float64(total) / float64(obtained)
+}
+
+// シミュレーションの結果をoutに表で表示する
+func (result *gachaSimResult) print(out io.Writer) error {
+	table := result.Table
+	options := result.Options
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	gachaType := table.Gacha.GachaType
+	if gachaType == "" {
+		gachaType = gachaTypeNormal
+	}
+	fmt.Fprintf(w, "gacha: %s (%s)\truns: %d\tpulls per run: %d\tseed: %d\n\n", table.Gacha.GachaName, gachaType, options.Runs, options.MaxPulls, options.Seed)
+	fmt.Fprintln(w, "rarity\tweight rate\tsimulated rate\tpulls")
+	totalWeight := table.rarityTotals[len(table.rarityTotals)-1]
+	for p, pool := range table.pools {
+		fmt.Fprintf(w, "%s\t%.3f%%\t%.3f%%\t%d\n",
+			table.Characters[pool.Members[0]].RarityName,
+			float64(pool.Weight)/float64(totalWeight)*100,
+			float64(result.RarityCounts[p])/float64(result.Pulls)*100,
+			result.RarityCounts[p])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprint(w, "character\trarity\tobtained\tmean cost")
+	for _, p := range simPercentiles {
+		fmt.Fprintf(w, "\tp%d", p)
+	}
+	fmt.Fprintln(w)
+	for i, character := range table.Characters {
+		costs := result.Costs[i]
+		obtained, mean := simMean(costs)
+		fmt.Fprintf(w, "%s\t%s\t%.1f%%\t%.1f", character.CharacterName, character.RarityName, obtained*100, mean)
+		for _, p := range simPercentiles {
+			if cost := simPercentile(costs, p); cost >= 0 {
+				fmt.Fprintf(w, "\t%d", cost)
+			} else {
+				fmt.Fprint(w, "\t-")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "\n(costs are in GMT; \"-\" means not obtained within the pulls per run)")
+	return w.Flush()
+}
+
+// キャラクターごとの1から100までの百分位のコストをCSVファイルpathに書き出す
+// 引けなかった百分位のコストは空にする
+func (result *gachaSimResult) writeCSV(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"character", "rarity", "percentile", "cost"})
+	for i, character := range result.Table.Characters {
+		for p := 1; p <= 100; p++ {
+			cost := ""
+			if v := simPercentile(result.Costs[i], p); v >= 0 {
+				cost = strconv.Itoa(v)
+			}
+			w.Write([]string{character.CharacterName, character.RarityName, strconv.Itoa(p), cost})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
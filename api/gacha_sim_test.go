@@ -0,0 +1,170 @@
+package api
+
+import (
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+	"gopkg.in/yaml.v3"
+)
+
+// リポジトリのgacha_sim/gacha_a.yaml(mysql/ddl.sqlのGacha_Aと同じ設定)
+const testSimBannerFile = "../gacha_sim/gacha_a.yaml"
+
+// testSimBannerFileのガチャの定義を読み込む
+func loadTestSimBanner(t *testing.T) simBanner {
+	t.Helper()
+	data, err := ioutil.ReadFile(testSimBannerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var banner simBanner
+	if err := yaml.Unmarshal(data, &banner); err != nil {
+		t.Fatal(err)
+	}
+	return banner
+}
+
+func TestLoadSimBanner(t *testing.T) {
+	table, err := loadSimBanner(testSimBannerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSimGachaTable(table); err != nil {
+		t.Fatal(err)
+	}
+	gacha := table.Gacha
+	if gacha.GachaName != "Gacha_A" || gacha.HardPity != 90 || gacha.SoftPity != 74 || gacha.SoftPityWeightUp != 6 || gacha.PityRarityID != 1 {
+		t.Errorf("gacha = %+v", gacha)
+	}
+	if len(table.Characters) != 10 {
+		t.Fatalf("characters = %d, want 10", len(table.Characters))
+	}
+	// キャラクターの重みはレアリティの重みで、レアリティごとに合計される
+	weights := make([]uint, 0, len(table.pools))
+	for _, pool := range table.pools {
+		weights = append(weights, pool.Weight)
+	}
+	if want := []uint{1, 15, 84}; !reflect.DeepEqual(weights, want) {
+		t.Errorf("rarity weights = %v, want %v", weights, want)
+	}
+	venus := table.Characters[table.index["Venus"]]
+	if venus.RarityID != 2 || venus.RarityGrade != 2 || venus.RarityName != "R" || venus.Weight != 5 || venus.RateUp != 3 {
+		t.Errorf("Venus = %+v", venus)
+	}
+	if want := []GachaGuarantee{{Every: 10, MinRarityID: 2, MinGrade: 2}}; !reflect.DeepEqual(table.Guarantees, want) {
+		t.Errorf("guarantees = %+v, want %+v", table.Guarantees, want)
+	}
+}
+
+func TestSimBannerGachaTableErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(banner *simBanner)
+	}{
+		{"zero weight", func(banner *simBanner) { banner.Rarities[0].Weight = 0 }},
+		{"undefined rarity", func(banner *simBanner) { banner.Characters[0].RarityID = 9 }},
+		{"undefined guarantee rarity", func(banner *simBanner) { banner.Guarantees[0].MinRarityID = 9 }},
+		{"duplicate character", func(banner *simBanner) { banner.Characters[1].Name = banner.Characters[0].Name }},
+	}
+	for _, tt := range tests {
+		banner := loadTestSimBanner(t)
+		tt.change(&banner)
+		if _, err := banner.gachaTable(); err == nil {
+			t.Errorf("%s: gachaTable() returned no error", tt.name)
+		}
+	}
+}
+
+func TestSortSimCosts(t *testing.T) {
+	costs := []int{30, -1, 10, -1, 20}
+	sortSimCosts(costs)
+	if want := []int{10, 20, 30, -1, -1}; !reflect.DeepEqual(costs, want) {
+		t.Errorf("costs = %v, want %v", costs, want)
+	}
+}
+
+func TestSimPercentile(t *testing.T) {
+	tests := []struct {
+		costs []int
+		p     int
+		want  int
+	}{
+		{[]int{10, 20, 30, 40}, 0, 10},
+		{[]int{10, 20, 30, 40}, 25, 10},
+		{[]int{10, 20, 30, 40}, 26, 20},
+		{[]int{10, 20, 30, 40}, 50, 20},
+		{[]int{10, 20, 30, 40}, 100, 40},
+		{[]int{10, 20, -1, -1}, 50, 20},
+		{[]int{10, 20, -1, -1}, 75, -1},
+	}
+	for _, tt := range tests {
+		if got := simPercentile(tt.costs, tt.p); got != tt.want {
+			t.Errorf("simPercentile(%v, %d) = %d, want %d", tt.costs, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestSimulateGachaSeededReproducible(t *testing.T) {
+	table, err := loadSimBanner(testSimBannerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := gachaSimOptions{Runs: 100, MaxPulls: 200, Times: 10, Seed: 42}
+	a := simulateGacha(table, options)
+	b := simulateGacha(table, options)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("same seed gave different results")
+	}
+	options.Seed = 43
+	if c := simulateGacha(table, options); reflect.DeepEqual(a.Costs, c.Costs) {
+		t.Fatal("different seeds gave the same results")
+	}
+}
+
+func TestSimulateGachaRarityRates(t *testing.T) {
+	// 天井と確定ルールを外すと、レアリティごとの排出率は重みの割合に近づく
+	banner := loadTestSimBanner(t)
+	banner.HardPity, banner.SoftPity, banner.SoftPityWeightUp, banner.PityRarityID = 0, 0, 0, 0
+	banner.Guarantees = nil
+	table, err := banner.gachaTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := simulateGacha(table, gachaSimOptions{Runs: 200, MaxPulls: 1000, Times: 10, Seed: 1})
+	if result.Pulls != 200000 {
+		t.Fatalf("pulls = %d, want 200000", result.Pulls)
+	}
+	total := table.rarityTotals[len(table.rarityTotals)-1]
+	for p, pool := range table.pools {
+		want := float64(pool.Weight) / float64(total)
+		got := float64(result.RarityCounts[p]) / float64(result.Pulls)
+		if math.Abs(got-want) > 0.005 {
+			t.Errorf("rarity %d rate = %.4f, want %.4f", pool.RarityID, got, want)
+		}
+	}
+}
+
+func TestSimulateGachaHardPityCapsCost(t *testing.T) {
+	banner := loadTestSimBanner(t)
+	table, err := banner.gachaTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SRはMercuryだけなので、1回ずつ引けば天井の回数までに必ず引ける
+	options := gachaSimOptions{Runs: 1000, MaxPulls: banner.HardPity, Times: 1, Seed: 7}
+	costs := simulateGacha(table, options).Costs[table.index["Mercury"]]
+	if worst := simPercentile(costs, 100); worst < 0 || worst > banner.HardPity {
+		t.Errorf("worst cost of Mercury = %d, want at most %d", worst, banner.HardPity)
+	}
+	// 天井がなければ、同じ回数では引けないプレイヤーがいる
+	banner.HardPity, banner.SoftPity, banner.SoftPityWeightUp, banner.PityRarityID = 0, 0, 0, 0
+	table, err = banner.gachaTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	costs = simulateGacha(table, options).Costs[table.index["Mercury"]]
+	if worst := simPercentile(costs, 100); worst >= 0 {
+		t.Errorf("worst cost of Mercury without pity = %d, want some players without it", worst)
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"net/http"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// ステップアップガチャ
+// ユーザごとに今のステップが決まっていて、1回のガチャで1ステップ進む
+// 最後のステップを引くと最初のステップに戻る
+const gachaTypeStepUp = "stepup"
+
+// ステップアップガチャの1ステップの設定
+// Price: このステップで焼却するゲームトークンの量
+// Times: このステップで引く回数
+// GuaranteedRarityID: このステップの最後の1回で確定するレアリティのid(0なら確定なし)
+// GuaranteedGradeはGuaranteedRarityIDのレアリティのgrade
+type GachaStep struct {
+	GachaID            int `json:"gacha_id" gorm:"primaryKey"`
+	Step               int `json:"step" gorm:"primaryKey"`
+	Price              int `json:"price"`
+	Times              int `json:"times"`
+	GuaranteedRarityID int `json:"guaranteed_rarity_id"`
+	GuaranteedGrade    int `json:"guaranteed_grade" gorm:"->"`
+}
+
+// ユーザのステップアップガチャごとの、次に引くステップ
+type UserGachaStep struct {
+	UserID  string `json:"user_id" gorm:"primaryKey"`
+	GachaID int    `json:"gacha_id" gorm:"primaryKey"`
+	Step    int    `json:"step"`
+}
+
+// getGachaList関数のレスポンスに含まれる、ユーザが次に引くステップ
+type StepResponse struct {
+	Step               int `json:"step"`
+	Steps              int `json:"steps"`
+	Price              int `json:"price"`
+	Times              int `json:"times"`
+	GuaranteedRarityID int `json:"guaranteedRarityID"`
+}
+
+// dbのgacha_stepsテーブルからガチャidが引数gachaIdのステップの設定をステップ順に取得
+func (c *Config) getGachaSteps(gachaId int) ([]GachaStep, error) {
+	var steps []GachaStep
+	//	SELECT gacha_steps.*, COALESCE(rarities.grade, 0) AS guaranteed_grade
+	//	FROM `gacha_steps`
+	//	left join rarities
+	//	on gacha_steps.guaranteed_rarity_id = rarities.id
+	//	WHERE gacha_id = 5
+	//	ORDER BY step
+	err := c.DB.Table("gacha_steps").Select("gacha_steps.*, COALESCE(rarities.grade, 0) AS guaranteed_grade").
+		Joins("left join rarities on gacha_steps.guaranteed_rarity_id = rarities.id").
+		Where("gacha_id = ?", gachaId).Order("step").Scan(&steps).Error
+	if err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// dbのuser_gacha_stepsテーブルからユーザが次に引くステップを取得
+// まだ引いたことがなければ1を返す
+func (c *Config) getUserGachaStep(userId string, gachaId int) (int, error) {
+	userStep := UserGachaStep{Step: 1}
+	// SELECT * FROM `user_gacha_steps` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 5
+	if err := c.DB.Where("user_id = ? AND gacha_id = ?", userId, gachaId).Find(&userStep).Error; err != nil {
+		return 0, err
+	}
+	return userStep.Step, nil
+}
+
+// ユーザが次に引くステップの設定と、user_gacha_stepsテーブルに保存されているステップ番号を返す
+// ステップの設定が変わって範囲外になっていれば最初のステップとする
+func (c *Config) currentGachaStep(userId string, table *gachaTable) (GachaStep, int, error) {
+	if len(table.Steps) == 0 {
+		return GachaStep{}, 0, newAPIError(http.StatusInternalServerError, "step-up gacha has no steps.")
+	}
+	current, err := c.getUserGachaStep(userId, table.Gacha.ID)
+	if err != nil {
+		return GachaStep{}, 0, err
+	}
+	return table.step(current), current, nil
+}
+
+// ユーザのステップを、prepareGachaDraw関数で確認したステップ番号currentから1つ進め、今回引くステップの設定を返す
+// 確認した後に同じユーザの他のリクエストがステップを進めていたら、確認していない価格で支払わないようにエラーを返す
+func (c *Config) advanceGachaStep(userId string, table *gachaTable, current int) (GachaStep, error) {
+	if len(table.Steps) == 0 {
+		return GachaStep{}, newAPIError(http.StatusInternalServerError, "step-up gacha has no steps.")
+	}
+	//	INSERT INTO `user_gacha_steps` (`user_id`,`gacha_id`,`step`)
+	//	VALUES ('95daec2b-287c-4358-ba6f-5c29e1c3cbdf',5,1)
+	//	ON DUPLICATE KEY UPDATE `user_id`=`user_id`
+	userStep := UserGachaStep{UserID: userId, GachaID: table.Gacha.ID, Step: 1}
+	if err := c.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&userStep).Error; err != nil {
+		return GachaStep{}, err
+	}
+	step := table.step(current)
+	// UPDATE `user_gacha_steps` SET `step`=3 WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 5 AND step = 2
+	result := c.DB.Model(&UserGachaStep{}).Where("user_id = ? AND gacha_id = ? AND step = ?", userId, table.Gacha.ID, current).Update("step", table.nextStep(step))
+	if result.Error != nil {
+		return GachaStep{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return GachaStep{}, newAPIError(http.StatusConflict, "another gacha draw is in progress.")
+	}
+	return step, nil
+}
+
+// advanceGachaStep関数でステップ番号currentから進めたステップを、ゲームトークンを焼却できなかったときに元に戻す
+func (c *Config) rewindGachaStep(userId string, table *gachaTable, current int) error {
+	next := table.nextStep(table.step(current))
+	// UPDATE `user_gacha_steps` SET `step`=2 WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 5 AND step = 3
+	return c.DB.Model(&UserGachaStep{}).Where("user_id = ? AND gacha_id = ? AND step = ?", userId, table.Gacha.ID, next).Update("step", current).Error
+}
+
+// ステップ番号stepの設定を返す
+// 範囲外なら最初のステップの設定を返す
+func (t *gachaTable) step(step int) GachaStep {
+	for _, v := range t.Steps {
+		if v.Step == step {
+			return v
+		}
+	}
+	return t.Steps[0]
+}
+
+// stepの次に引くステップ番号を返す
+// ステップの番号ではなく並び順で進め、最後のステップの次は最初のステップに戻る
+func (t *gachaTable) nextStep(step GachaStep) int {
+	for i, v := range t.Steps {
+		if v.Step == step.Step {
+			return t.Steps[(i+1)%len(t.Steps)].Step
+		}
+	}
+	return t.Steps[0].Step
+}
+
+// ステップの抽選で使う確定ルールを返す
+// ガチャの確定ルールに、ステップの最後の1回でGuaranteedRarityID以上が確定するルールを加える
+func (t *gachaTable) stepGuarantees(step GachaStep) []GachaGuarantee {
+	guarantees := make([]GachaGuarantee, len(t.Guarantees), len(t.Guarantees)+1)
+	copy(guarantees, t.Guarantees)
+	if step.GuaranteedRarityID != 0 {
+		guarantees = append(guarantees, GachaGuarantee{GachaID: step.GachaID, Every: step.Times, MinRarityID: step.GuaranteedRarityID, MinGrade: step.GuaranteedGrade})
+	}
+	return guarantees
+}
+
+// ステップの確定ルールで抽選する抽選テーブルを返す
+// レアリティごとの累積重みなどは元の抽選テーブルと共有する
+func (t *gachaTable) withStep(step GachaStep) *gachaTable {
+	stepTable := *t
+	stepTable.Guarantees = t.stepGuarantees(step)
+	return &stepTable
+}
+
+// ステップの設定をレスポンスの形に変換
+func (t *gachaTable) stepResponse(step GachaStep) *StepResponse {
+	return &StepResponse{
+		Step:               step.Step,
+		Steps:              len(t.Steps),
+		Price:              step.Price,
+		Times:              step.Times,
+		GuaranteedRarityID: step.GuaranteedRarityID,
+	}
+}
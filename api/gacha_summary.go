@@ -0,0 +1,191 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"gorm.io/gorm"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// drawGacha関数で?view=summaryのときに返される
+type DrawSummaryResponse struct {
+	Total        int                     `json:"total"`
+	Rarities     []RaritySummaryResponse `json:"rarities"`
+	Shards       int                     `json:"shards"`
+	Refund       int                     `json:"refund"`
+	RefundTxHash string                  `json:"refundTxHash,omitempty"`
+	DrawID       string                  `json:"drawID"`
+	Proof        ProofResponse           `json:"proof"`
+}
+
+// getGachaSummary関数で返される
+type HistorySummaryResponse struct {
+	Total    int                     `json:"total"`
+	Rarities []RaritySummaryResponse `json:"rarities"`
+}
+
+// レアリティごとにまとめた抽選結果
+type RaritySummaryResponse struct {
+	RarityID   int                        `json:"rarityID"`
+	RarityName string                     `json:"rarityName"`
+	Count      int                        `json:"count"`
+	Characters []CharacterSummaryResponse `json:"characters"`
+}
+
+// キャラクターごとにまとめた抽選結果
+// Newはこのガチャを引く前にユーザが持っていなかったキャラクターならtrue
+// ConvertedはCountのうち、重複として自動で変換した数
+type CharacterSummaryResponse struct {
+	CharacterID string `json:"characterID"`
+	Name        string `json:"name"`
+	Count       int    `json:"count"`
+	New         bool   `json:"new,omitempty"`
+	Converted   int    `json:"converted,omitempty"`
+}
+
+// キャラクターと、そのキャラクターを引いた回数、そのうち重複として変換した数と確率の変わった回で引いた数
+type characterCount struct {
+	Character
+	Count     int
+	Converted int
+	Boosted   int
+	IsNew     bool
+}
+
+// localhost:8080/gacha/summary?gacha_id=nでユーザがこれまでに引いたキャラクターを、レアリティとキャラクターごとにまとめて取得
+// gacha_idを省略すると全てのガチャが対象になる
+// 重複として変換したキャラクターや、売却や強化の素材にして今は持っていないキャラクターも数える
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetGachaSummary(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	gachaId := 0
+	if v := r.URL.Query().Get("gacha_id"); v != "" {
+		gachaId, err = strconv.Atoi(v)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "gacha_id is error.")
+			return
+		}
+	}
+	counts, err := c.getDrawCharacterCounts(userId, gachaId, "")
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	total, rarities := summarizeCharacterCounts(counts, nil)
+	RespondWithJSON(w, http.StatusOK, &HistorySummaryResponse{
+		Total:    total,
+		Rarities: rarities,
+	})
+	//	{"total":120,"rarities":[
+	//		{"rarityID":1,"rarityName":"SR","count":2,"characters":[{"characterID":"7b6a8a4e-...","name":"Mercury","count":2,"converted":1}]},
+	//		...
+	//	]}
+	//	が返る
+}
+
+// トランザクションtxの中で、dbのuser_charactersテーブルから、引数gachaCharacterIdsのうちユーザが既に持っているものを返す
+func (c *Config) getOwnedGachaCharacterIds(tx *gorm.DB, userId string, gachaCharacterIds []string) (map[string]bool, error) {
+	var owned []string
+	//	SELECT DISTINCT gacha_character_id FROM `user_characters`
+	//	WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_character_id IN ('7b6a8a4e-...','7b6d0b6d-...')
+	err := tx.Table("user_characters").Distinct("gacha_character_id").
+		Where("user_id = ? AND gacha_character_id IN ?", userId, gachaCharacterIds).
+		Scan(&owned).Error
+	if err != nil {
+		return nil, err
+	}
+	ownedSet := make(map[string]bool, len(owned))
+	for _, v := range owned {
+		ownedSet[v] = true
+	}
+	return ownedSet, nil
+}
+
+// 記録したガチャのキャラクターごとの回数から、ガチャを引く前に持っていたキャラクターのgacha_character_idを返す
+func ownedBeforeDraw(counts []characterCount) map[string]bool {
+	owned := make(map[string]bool, len(counts))
+	for _, v := range counts {
+		if !v.IsNew {
+			owned[v.GachaCharacterID] = true
+		}
+	}
+	return owned
+}
+
+// 抽選結果からキャラクターごとに引いた回数と、そのうち変換した数を数える
+func (result *gachaDrawResult) characterCounts() []characterCount {
+	counts := make([]characterCount, len(result.Counts))
+	copy(counts, result.Counts)
+	return counts
+}
+
+// キャラクターごとにまとめた抽選結果を、引いたキャラクターごとの回数の一覧にする
+func (t *gachaTable) tallyCounts(tally drawTally) []characterCount {
+	var characterCounts []characterCount
+	for i, count := range tally.Counts {
+		if count != 0 {
+			characterCounts = append(characterCounts, characterCount{Character: t.Characters[i], Count: count, Boosted: tally.Boosted[i]})
+		}
+	}
+	return characterCounts
+}
+
+// 引いたキャラクターのインデックス一覧から、キャラクターごとに引いた回数と、そのうち変換した数、確率の変わった回で引いた数を数える
+// converted、boostedはdrawedと同じ順に並べたもの(boostedはボックスガチャではnil)
+func (t *gachaTable) countDrawed(drawed []int, converted []string, boosted []bool) []characterCount {
+	counts := make([]characterCount, len(t.Characters))
+	for n, i := range drawed {
+		counts[i].Count += 1
+		if n < len(converted) && converted[n] != "" {
+			counts[i].Converted += 1
+		}
+		if n < len(boosted) && boosted[n] {
+			counts[i].Boosted += 1
+		}
+	}
+	var characterCounts []characterCount
+	for i, v := range counts {
+		if v.Count != 0 {
+			v.Character = t.Characters[i]
+			characterCounts = append(characterCounts, v)
+		}
+	}
+	return characterCounts
+}
+
+// キャラクターごとの回数をレアリティごとにまとめ、合計の回数とレアリティの高い順に並べた一覧を返す
+// ownedに含まれないキャラクターはNewをtrueにする(ownedがnilなら全てfalse)
+func summarizeCharacterCounts(counts []characterCount, owned map[string]bool) (int, []RaritySummaryResponse) {
+	sort.SliceStable(counts, func(i, j int) bool {
+		if counts[i].RarityGrade != counts[j].RarityGrade {
+			return counts[i].RarityGrade > counts[j].RarityGrade
+		}
+		if counts[i].RarityID != counts[j].RarityID {
+			return counts[i].RarityID < counts[j].RarityID
+		}
+		return counts[i].Count > counts[j].Count
+	})
+	total := 0
+	rarities := make([]RaritySummaryResponse, 0)
+	for _, v := range counts {
+		total += v.Count
+		if len(rarities) == 0 || rarities[len(rarities)-1].RarityID != v.RarityID {
+			rarities = append(rarities, RaritySummaryResponse{RarityID: v.RarityID, RarityName: v.RarityName})
+		}
+		rarity := &rarities[len(rarities)-1]
+		rarity.Count += v.Count
+		rarity.Characters = append(rarity.Characters, CharacterSummaryResponse{
+			CharacterID: v.GachaCharacterID,
+			Name:        v.CharacterName,
+			Count:       v.Count,
+			New:         owned != nil && !owned[v.GachaCharacterID],
+			Converted:   v.Converted,
+		})
+	}
+	return total, rarities
+}
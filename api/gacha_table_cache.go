@@ -0,0 +1,82 @@
+package api
+
+import (
+	"sync"
+	"time"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// ガチャごとの抽選テーブルのキャッシュ
+// カタログ(キャラクター、レアリティ、ガチャ)を変更したときはinvalidateで消す
+// dbを直接書き換えた場合に備えて、ttlより古いテーブルは作り直す
+type gachaTableCache struct {
+	mu     sync.RWMutex
+	ttl    time.Duration
+	tables map[int]cachedGachaTable
+}
+
+type cachedGachaTable struct {
+	table    *gachaTable
+	loadedAt time.Time
+}
+
+// 有効期間ttlの抽選テーブルのキャッシュを作成
+func newGachaTableCache(ttl time.Duration) *gachaTableCache {
+	return &gachaTableCache{ttl: ttl, tables: make(map[int]cachedGachaTable)}
+}
+
+// キャッシュからガチャidが引数gachaIdの抽選テーブルを取得
+// キャッシュになければdbから読み込んで作成し、キャッシュに保存する
+func (c *Config) getGachaTable(gachaId int) (*gachaTable, error) {
+	cache := c.GachaTableCache
+	cache.mu.RLock()
+	cached, ok := cache.tables[gachaId]
+	cache.mu.RUnlock()
+	if ok && time.Since(cached.loadedAt) < cache.ttl {
+		return cached.table, nil
+	}
+	table, err := c.loadGachaTable(gachaId)
+	if err != nil {
+		return nil, err
+	}
+	cache.mu.Lock()
+	cache.tables[gachaId] = cachedGachaTable{table: table, loadedAt: time.Now()}
+	cache.mu.Unlock()
+	return table, nil
+}
+
+// dbからガチャの設定、キャラクター一覧、確定ルール(ステップアップガチャならステップの設定も)を読み込み、抽選テーブルを作成
+// 抽選の記録から参照できるように、テーブルの設定をgacha_table_snapshotsテーブルに保存する
+func (c *Config) loadGachaTable(gachaId int) (*gachaTable, error) {
+	gacha, err := c.getGacha(gachaId)
+	if err != nil {
+		return nil, err
+	}
+	charactersList, err := c.getCharacters(gachaId)
+	if err != nil {
+		return nil, err
+	}
+	guarantees, err := c.getGachaGuarantees(gachaId)
+	if err != nil {
+		return nil, err
+	}
+	table := newGachaTable(gacha, charactersList, guarantees)
+	if gacha.GachaType == gachaTypeStepUp {
+		table.Steps, err = c.getGachaSteps(gachaId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	table.SnapshotHash, err = c.saveGachaTableSnapshot(table)
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// ガチャidが引数gachaIdの抽選テーブルをキャッシュから消す
+func (cache *gachaTableCache) invalidate(gachaId int) {
+	cache.mu.Lock()
+	delete(cache.tables, gachaId)
+	cache.mu.Unlock()
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// 抽選テーブルの設定を保存したもの
+// 抽選の検証や排出率の監査で、引いた時点の重みと天井の設定を使うために、抽選の記録からSnapshotHashで参照する
+// Snapshotは同じ設定なら同じ文字列になるので、そのSHA-256ハッシュをidとして使い回す
+type GachaTableSnapshot struct {
+	SnapshotHash string    `json:"snapshot_hash" gorm:"primaryKey"`
+	GachaID      int       `json:"gacha_id"`
+	Snapshot     string    `json:"snapshot"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// GachaTableSnapshot.Snapshotに保存する抽選テーブルの設定
+type gachaTableSettings struct {
+	Gacha      Gacha            `json:"gacha"`
+	Characters []Character      `json:"characters"`
+	Guarantees []GachaGuarantee `json:"guarantees"`
+	Steps      []GachaStep      `json:"steps"`
+}
+
+// 抽選テーブルの設定をdbのgacha_table_snapshotsテーブルに保存し、そのハッシュを返す
+// 同じ設定がすでに保存されていれば何もしない
+func (c *Config) saveGachaTableSnapshot(table *gachaTable) (string, error) {
+	snapshot, err := json.Marshal(gachaTableSettings{
+		Gacha:      table.Gacha,
+		Characters: table.Characters,
+		Guarantees: table.Guarantees,
+		Steps:      table.Steps,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(snapshot)
+	row := GachaTableSnapshot{
+		SnapshotHash: hex.EncodeToString(sum[:]),
+		GachaID:      table.Gacha.ID,
+		Snapshot:     string(snapshot),
+		CreatedAt:    time.Now(),
+	}
+	//	INSERT INTO `gacha_table_snapshots` (`snapshot_hash`,`gacha_id`,`snapshot`,`created_at`)
+	//	VALUES ('9f2c...',1,'{"gacha":{...},"characters":[...],...}','2021-11-01 12:00:00')
+	//	ON DUPLICATE KEY UPDATE `snapshot_hash`=`snapshot_hash`
+	if err := c.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+		return "", err
+	}
+	return row.SnapshotHash, nil
+}
+
+// dbのgacha_table_snapshotsテーブルからハッシュが引数snapshotHashの設定を読み込み、抽選テーブルを作り直す
+// 見つからなければnilを返す
+func (c *Config) loadGachaTableSnapshot(snapshotHash string) (*gachaTable, error) {
+	var row GachaTableSnapshot
+	// SELECT * FROM `gacha_table_snapshots` WHERE snapshot_hash = '9f2c...'
+	if err := c.DB.Where("snapshot_hash = ?", snapshotHash).Find(&row).Error; err != nil {
+		return nil, err
+	}
+	if row.SnapshotHash == "" {
+		return nil, nil
+	}
+	var settings gachaTableSettings
+	if err := json.Unmarshal([]byte(row.Snapshot), &settings); err != nil {
+		return nil, err
+	}
+	table := newGachaTable(settings.Gacha, settings.Characters, settings.Guarantees)
+	table.Steps = settings.Steps
+	table.SnapshotHash = row.SnapshotHash
+	return table, nil
+}
@@ -0,0 +1,345 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// ガチャの支払い方法
+// gmtoken: ゲームトークンを焼却する
+// ticket: ガチャチケットを使う
+const (
+	paymentGmtoken = "gmtoken"
+	paymentTicket  = "ticket"
+)
+
+// ガチャチケットの増減の理由
+const (
+	ticketReasonAdmin    = "admin"
+	ticketReasonReward   = "reward"
+	ticketReasonPurchase = "purchase"
+	ticketReasonDraw     = "draw"
+)
+
+// ガチャチケット1枚の価格(焼却するゲームトークンの量)
+const ticketPrice = 1
+
+// ユーザが持っているガチャチケットの枚数
+// GachaIDが0のチケットはどのガチャにも使える
+type UserTicket struct {
+	UserID  string `json:"user_id" gorm:"primaryKey"`
+	GachaID int    `json:"gacha_id" gorm:"primaryKey"`
+	Count   int    `json:"count"`
+}
+
+// ガチャチケットの増減の記録
+// Amountは増えたなら正、減ったなら負の枚数、Balanceは増減した後の枚数
+// DrawIDはガチャで使ったときのガチャの記録のid、TxHashは購入したときの焼却のトランザクションのハッシュ
+type TicketLedger struct {
+	LedgerID  string    `json:"ledger_id"`
+	UserID    string    `json:"user_id"`
+	GachaID   int       `json:"gacha_id"`
+	Amount    int       `json:"amount"`
+	Balance   int       `json:"balance"`
+	Reason    string    `json:"reason"`
+	DrawID    string    `json:"draw_id"`
+	TxHash    string    `json:"tx_hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 管理者がガチャチケットを付与するときに受け取る
+// Reasonは"admin"か"reward"(省略時は"admin")
+type GrantingTicket struct {
+	UserID  string `json:"user_id"`
+	GachaID int    `json:"gacha_id"`
+	Count   int    `json:"count"`
+	Reason  string `json:"reason"`
+}
+
+// ガチャチケットを購入するときに受け取る
+type PurchasingTicket struct {
+	GachaID int `json:"gacha_id"`
+	Count   int `json:"count"`
+}
+
+// ユーザが持っているガチャチケット
+type TicketResponse struct {
+	GachaID int `json:"gachaID"`
+	Count   int `json:"count"`
+}
+
+// getTicketList関数、grantTicket関数、purchaseTicket関数で返される
+type TicketsResponse struct {
+	Tickets []TicketResponse `json:"tickets"`
+}
+
+// localhost:8080/ticket/listでユーザが持っているガチャチケットを取得
+// gachaIDが0のチケットはどのガチャにも使える
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetTicketList(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tickets, err := c.getTicketsResponse(userId)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, tickets)
+	//	{"tickets":[{"gachaID":0,"count":3},{"gachaID":1,"count":10}]}
+	//	が返る
+}
+
+// localhost:8080/admin/ticket/grantで管理者がユーザにガチャチケットを付与
+// -H "x-token:yyy"でトークン情報を受け取り、管理者であることを確認
+// -d {"user_id":"xxx", "gacha_id":n, "count":x, "reason":"reward"}で付与するユーザ、ガチャid(0ならどのガチャにも使える)、枚数、理由を受け取る
+func (c *Config) GrantTicket(w http.ResponseWriter, r *http.Request) {
+	if _, err := c.requireAdmin(r); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var grantingTicket GrantingTicket
+	if err := json.Unmarshal(body, &grantingTicket); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if grantingTicket.Reason == "" {
+		grantingTicket.Reason = ticketReasonAdmin
+	}
+	if grantingTicket.Reason != ticketReasonAdmin && grantingTicket.Reason != ticketReasonReward {
+		RespondWithError(w, http.StatusBadRequest, "reason is error.")
+		return
+	}
+	if grantingTicket.Count <= 0 {
+		RespondWithError(w, http.StatusBadRequest, "count is error.")
+		return
+	}
+	if err := c.checkTicketTarget(grantingTicket.UserID, grantingTicket.GachaID); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		return c.grantTickets(tx, TicketLedger{UserID: grantingTicket.UserID, GachaID: grantingTicket.GachaID, Amount: grantingTicket.Count, Reason: grantingTicket.Reason})
+	})
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tickets, err := c.getTicketsResponse(grantingTicket.UserID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, tickets)
+	//	{"tickets":[{"gachaID":0,"count":13}]}
+	//	が返る
+}
+
+// localhost:8080/ticket/purchaseでゲームトークンを焼却してガチャチケットを購入
+// 1枚につきticketPriceだけゲームトークンを焼却する
+// 焼却が成功してからチケットを増やし、チケットを増やせなかったときは焼却した分を鋳造して返す
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"gacha_id":n, "count":x}で購入するチケットのガチャid(0ならどのガチャにも使える)と枚数を受け取る
+func (c *Config) PurchaseTicket(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var purchasingTicket PurchasingTicket
+	if err := json.Unmarshal(body, &purchasingTicket); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if purchasingTicket.Count <= 0 {
+		RespondWithError(w, http.StatusBadRequest, "count is error.")
+		return
+	}
+	if err := c.checkTicketTarget(userId, purchasingTicket.GachaID); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	cost := purchasingTicket.Count * ticketPrice
+	enoughBal, err := c.checkBalance(userId, cost)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !enoughBal {
+		RespondWithError(w, http.StatusBadRequest, "Balance of GameToken is not enough.")
+		return
+	}
+	burn, err := c.burnGmtokenFirst(userId, cost, gmtokenReasonTicket, strconv.Itoa(purchasingTicket.GachaID))
+	if errors.Is(err, errGmtokenTxReverted) {
+		RespondWithError(w, http.StatusBadRequest, "Balance of GameToken is not enough.")
+		return
+	}
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		return c.grantTickets(tx, TicketLedger{UserID: userId, GachaID: purchasingTicket.GachaID, Amount: purchasingTicket.Count, Reason: ticketReasonPurchase, TxHash: burn.TxHash})
+	})
+	if err != nil {
+		c.compensateGmtokenBurn(burn, burn.Amount)
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tickets, err := c.getTicketsResponse(userId)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, tickets)
+	//	{"tickets":[{"gachaID":1,"count":10}]}
+	//	が返る
+}
+
+// チケットを付与するユーザとガチャidが存在することを確認する
+// ガチャidが0ならどのガチャにも使えるチケットとする
+func (c *Config) checkTicketTarget(userId string, gachaId int) error {
+	var user User
+	// SELECT * FROM `users` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	if err := c.DB.Where("user_id = ?", userId).Find(&user).Error; err != nil {
+		return err
+	}
+	if user.UserID == "" {
+		return newAPIError(http.StatusBadRequest, "user_id is error.")
+	}
+	if gachaId == 0 {
+		return nil
+	}
+	contains, err := c.gachaIdContains(gachaId)
+	if err != nil {
+		return err
+	}
+	if !contains {
+		return newAPIError(http.StatusBadRequest, "gacha_id is error.")
+	}
+	return nil
+}
+
+// dbのuser_ticketsテーブルからユーザが持っているガチャチケットを取得
+func (c *Config) getTicketsResponse(userId string) (*TicketsResponse, error) {
+	var userTickets []UserTicket
+	// SELECT * FROM `user_tickets` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND count > 0 ORDER BY gacha_id
+	if err := c.DB.Where("user_id = ? AND count > 0", userId).Order("gacha_id").Find(&userTickets).Error; err != nil {
+		return nil, err
+	}
+	tickets := make([]TicketResponse, 0, len(userTickets))
+	for _, v := range userTickets {
+		tickets = append(tickets, TicketResponse{GachaID: v.GachaID, Count: v.Count})
+	}
+	return &TicketsResponse{Tickets: tickets}, nil
+}
+
+// ユーザがガチャidが引数gachaIdのガチャに使えるチケットの枚数を返す
+// そのガチャ専用のチケットと、どのガチャにも使えるチケットの合計
+func (c *Config) countUsableTickets(userId string, gachaId int) (int, error) {
+	var count int
+	// SELECT COALESCE(SUM(count), 0) FROM `user_tickets` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id IN (1,0)
+	err := c.DB.Model(&UserTicket{}).Select("COALESCE(SUM(count), 0)").
+		Where("user_id = ? AND gacha_id IN ?", userId, []int{gachaId, 0}).Scan(&count).Error
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// トランザクションtxの中で、ledger.Amountだけユーザのガチャチケットを増やし、増減の記録を残す
+func (c *Config) grantTickets(tx *gorm.DB, ledger TicketLedger) error {
+	//	INSERT INTO `user_tickets` (`user_id`,`gacha_id`,`count`)
+	//	VALUES ('95daec2b-287c-4358-ba6f-5c29e1c3cbdf',0,0)
+	//	ON DUPLICATE KEY UPDATE `user_id`=`user_id`
+	userTicket := UserTicket{UserID: ledger.UserID, GachaID: ledger.GachaID}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&userTicket).Error; err != nil {
+		return err
+	}
+	// SELECT * FROM `user_tickets` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 0 FOR UPDATE
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND gacha_id = ?", ledger.UserID, ledger.GachaID).Find(&userTicket).Error
+	if err != nil {
+		return err
+	}
+	return c.addTickets(tx, userTicket, ledger)
+}
+
+// トランザクションtxの中で、ガチャidが引数gachaIdのガチャに使うチケットをcount枚減らし、増減の記録を残す
+// そのガチャ専用のチケットから先に使い、足りなければどのガチャにも使えるチケットを使う
+// 合計でcount枚に足りなければエラーを返す
+func (c *Config) consumeTickets(tx *gorm.DB, userId string, gachaId int, count int, drawId string) error {
+	var userTickets []UserTicket
+	// SELECT * FROM `user_tickets` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id IN (1,0) ORDER BY gacha_id DESC FOR UPDATE
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND gacha_id IN ?", userId, []int{gachaId, 0}).
+		Order("gacha_id DESC").Find(&userTickets).Error
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, v := range userTickets {
+		total += v.Count
+	}
+	if total < count {
+		return newAPIError(http.StatusBadRequest, "tickets are not enough.")
+	}
+	for _, v := range userTickets {
+		if count == 0 {
+			break
+		}
+		used := v.Count
+		if used > count {
+			used = count
+		}
+		if used == 0 {
+			continue
+		}
+		if err := c.addTickets(tx, v, TicketLedger{UserID: userId, GachaID: v.GachaID, Amount: -used, Reason: ticketReasonDraw, DrawID: drawId}); err != nil {
+			return err
+		}
+		count -= used
+	}
+	return nil
+}
+
+// トランザクションtxの中で、ロック済みのuserTicketの枚数をledger.Amountだけ増やし、増減の記録を残す
+func (c *Config) addTickets(tx *gorm.DB, userTicket UserTicket, ledger TicketLedger) error {
+	ledgerId, err := createUUId()
+	if err != nil {
+		return err
+	}
+	ledger.LedgerID = ledgerId
+	ledger.Balance = userTicket.Count + ledger.Amount
+	ledger.CreatedAt = time.Now()
+	// UPDATE `user_tickets` SET `count`=13 WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_id = 0
+	err = tx.Model(&UserTicket{}).Where("user_id = ? AND gacha_id = ?", userTicket.UserID, userTicket.GachaID).
+		Update("count", ledger.Balance).Error
+	if err != nil {
+		return err
+	}
+	//	INSERT INTO `ticket_ledgers` (`ledger_id`,`user_id`,`gacha_id`,`amount`,`balance`,`reason`,`draw_id`,`tx_hash`,`created_at`)
+	//	VALUES ('1d2c...','95daec2b-287c-4358-ba6f-5c29e1c3cbdf',0,10,13,'admin','','','2021-11-01 12:00:00')
+	return tx.Create(&ledger).Error
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"time"
+	"gorm.io/gorm"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// 1回のガチャの抽選を再現するための情報
+// PityCountは抽選前の天井カウンター、ResultHashは引いたgacha_character_id一覧のハッシュ
+// Stepはステップアップガチャで引いたステップ(それ以外のガチャでは0)
+// TableHashは抽選に使ったテーブルの設定(gacha_table_snapshotsテーブル)のハッシュ
+type GachaDrawProof struct {
+	ProofID    string    `json:"proof_id"`
+	SeedID     string    `json:"seed_id"`
+	UserID     string    `json:"user_id"`
+	GachaID    int       `json:"gacha_id"`
+	ClientSeed string    `json:"client_seed"`
+	Nonce      int       `json:"nonce"`
+	Times      int       `json:"times"`
+	PityCount  int       `json:"pity_count"`
+	Step       int       `json:"step"`
+	TableHash  string    `json:"table_hash"`
+	ResultHash string    `json:"result_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// drawGacha関数のレスポンスに含まれる、抽選の検証に必要な情報
+type ProofResponse struct {
+	ProofID        string `json:"proofID"`
+	ServerSeedHash string `json:"serverSeedHash"`
+	ClientSeed     string `json:"clientSeed"`
+	Nonce          int    `json:"nonce"`
+}
+
+// /gacha/verifyで再現できる1回のガチャの最大の回数
+// これより多く引いたガチャは、公開されたサーバーシードを使ってVerifyGachaDraw関数で手元で検証する
+const maxVerifyTimes = countedDrawThreshold
+
+// /gacha/verifyのページングで1度に返す最大の結果の件数
+const maxVerifyResultsLimit = 1000
+
+// verifyGacha関数で返される
+// Resultsは再現した結果のうちOffset番目からLimit件で、Totalは再現した結果の全件数
+type VerifyResponse struct {
+	ProofID        string              `json:"proofID"`
+	ServerSeed     string              `json:"serverSeed"`
+	ServerSeedHash string              `json:"serverSeedHash"`
+	ClientSeed     string              `json:"clientSeed"`
+	Nonce          int                 `json:"nonce"`
+	Verified       bool                `json:"verified"`
+	Total          int                 `json:"total"`
+	Offset         int                 `json:"offset"`
+	Limit          int                 `json:"limit"`
+	Results        []CharacterResponse `json:"results"`
+}
+
+// localhost:8080/gacha/verify?proof_id=xxx&offset=0&limit=100で自分が引いた過去のガチャの抽選を再現し、結果が一致するか検証
+// サーバーシードが/gacha/seed/rotateで公開済みで、回数がmaxVerifyTimes回以下のガチャに限る
+// 抽選は今の設定ではなく、抽選したときに保存したキャラクター構成と天井の設定で再現する
+// 一致するかは全ての結果で確かめ、結果はoffset番目からlimit件(1以上maxVerifyResultsLimit以下、省略時は100)を返す
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) VerifyGacha(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, limit, err := parseOffsetLimit(r, 100, maxVerifyResultsLimit)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	proofId := r.URL.Query().Get("proof_id")
+	var proof GachaDrawProof
+	// SELECT * FROM `gacha_draw_proofs` WHERE proof_id = '3c6e...' AND user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	if err := c.DB.Where("proof_id = ? AND user_id = ?", proofId, userId).Find(&proof).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if proof.ProofID == "" {
+		RespondWithError(w, http.StatusBadRequest, "proof_id is error.")
+		return
+	}
+	if proof.Times > maxVerifyTimes {
+		RespondWithError(w, http.StatusBadRequest, "draws over "+strconv.Itoa(maxVerifyTimes)+" times cannot be verified here.")
+		return
+	}
+	var seed GachaSeed
+	// SELECT * FROM `gacha_seeds` WHERE seed_id = '0b1f...'
+	if err := c.DB.Where("seed_id = ?", proof.SeedID).Find(&seed).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if seed.RevealedAt == nil {
+		RespondWithError(w, http.StatusBadRequest, "server seed is not revealed yet.")
+		return
+	}
+	table, err := c.loadGachaTableSnapshot(proof.TableHash)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if table == nil {
+		RespondWithError(w, http.StatusInternalServerError, "gacha table snapshot is not found.")
+		return
+	}
+	// ボックスガチャの抽選はその時のボックスの中身で決まるので、ここでは再現できない
+	if table.Gacha.GachaType == gachaTypeBox {
+		RespondWithError(w, http.StatusBadRequest, "box gacha draws cannot be verified.")
+		return
+	}
+	// ステップアップガチャは、引いたステップの確定ルールで再現する
+	guarantees := table.Guarantees
+	if proof.Step != 0 && len(table.Steps) != 0 {
+		guarantees = table.stepGuarantees(table.step(proof.Step))
+	}
+	gachaCharacterIds, err := VerifyGachaDraw(seed.ServerSeed, seed.ServerSeedHash, proof.ClientSeed, proof.Nonce, table.Characters, table.Gacha, guarantees, proof.PityCount, proof.Times)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	results := make([]CharacterResponse, 0, limit)
+	for n := offset; n < len(gachaCharacterIds) && n < offset+limit; n++ {
+		character := table.Characters[table.index[gachaCharacterIds[n]]]
+		results = append(results, CharacterResponse{CharacterID: gachaCharacterIds[n], Name: character.CharacterName})
+	}
+	RespondWithJSON(w, http.StatusOK, &VerifyResponse{
+		ProofID:        proof.ProofID,
+		ServerSeed:     seed.ServerSeed,
+		ServerSeedHash: seed.ServerSeedHash,
+		ClientSeed:     proof.ClientSeed,
+		Nonce:          proof.Nonce,
+		Verified:       hashResults(gachaCharacterIds) == proof.ResultHash,
+		Total:          len(gachaCharacterIds),
+		Offset:         offset,
+		Limit:          limit,
+		Results:        results,
+	})
+	//	{"proofID":"3c6e...","serverSeed":"9f86d0...","serverSeedHash":"5d4140...","clientSeed":"my-seed","nonce":3,"verified":true,
+	//	 "total":10,"offset":0,"limit":100,"results":[{"characterID":"7b6a8a4e-...","name":"Mercury"},...]}
+	//	が返る
+}
+
+// 公開されたサーバーシードとクライアントシード、ナンスから抽選を再現し、引いたgacha_character_id一覧を返す
+// サーバーシードのハッシュが事前に公開されたserverSeedHashと一致しなければエラーを返す
+// charactersList、gacha、guaranteesは抽選時と同じガチャの設定、pityCountは抽選前の天井カウンターを渡す
+func VerifyGachaDraw(serverSeed string, serverSeedHash string, clientSeed string, nonce int, charactersList []Character, gacha Gacha, guarantees []GachaGuarantee, pityCount int, times int) ([]string, error) {
+	if hashServerSeed(serverSeed) != serverSeedHash {
+		return nil, fmt.Errorf("server seed does not match its hash")
+	}
+	roller := newHmacRoller(serverSeed, clientSeed, nonce)
+	gachaCharacterIds, _ := drawGachaCharacterIds(roller, charactersList, times, gacha, pityCount, guarantees)
+	return gachaCharacterIds, nil
+}
+
+// トランザクションtxの中で、dbのgacha_draw_proofsテーブルに抽選の検証情報を保存
+func (c *Config) saveGachaDrawProof(tx *gorm.DB, proof *GachaDrawProof) error {
+	proofId, err := createUUId()
+	if err != nil {
+		return err
+	}
+	proof.ProofID = proofId
+	proof.CreatedAt = time.Now()
+	//	INSERT INTO `gacha_draw_proofs` (`proof_id`,`seed_id`,`user_id`,`gacha_id`,`client_seed`,`nonce`,`times`,`pity_count`,`step`,`table_hash`,`result_hash`,`created_at`)
+	//	VALUES ('3c6e...','0b1f...','95daec2b-287c-4358-ba6f-5c29e1c3cbdf',1,'my-seed',3,10,12,0,'9f2c...','a591a6...','2021-11-01 12:00:00')
+	return tx.Create(proof).Error
+}
+
+// dbのgacha_draw_proofsテーブルから保存した抽選の検証情報を読み込み、レスポンスの形に変換
+func (c *Config) getProofResponse(proofId string) (ProofResponse, error) {
+	var proof ProofResponse
+	//	SELECT gacha_draw_proofs.proof_id, gacha_seeds.server_seed_hash, gacha_draw_proofs.client_seed, gacha_draw_proofs.nonce
+	//	FROM `gacha_draw_proofs`
+	//	join gacha_seeds
+	//	on gacha_draw_proofs.seed_id = gacha_seeds.seed_id
+	//	WHERE gacha_draw_proofs.proof_id = '3c6e...'
+	err := c.DB.Table("gacha_draw_proofs").
+		Select("gacha_draw_proofs.proof_id, gacha_seeds.server_seed_hash, gacha_draw_proofs.client_seed, gacha_draw_proofs.nonce").
+		Joins("join gacha_seeds on gacha_draw_proofs.seed_id = gacha_seeds.seed_id").
+		Where("gacha_draw_proofs.proof_id = ?", proofId).
+		Scan(&proof).Error
+	return proof, err
+}
+
+// 引いたgacha_character_id一覧をカンマで繋げた文字列のSHA-256ハッシュを返す
+func hashResults(gachaCharacterIds []string) string {
+	hasher := newResultHasher()
+	for _, v := range gachaCharacterIds {
+		hasher.add(v)
+	}
+	return hasher.sum()
+}
+
+// 引いたgacha_character_idを1つずつ受け取り、hashResults関数と同じハッシュを計算する
+// 一覧を保持しないので、回数の多い抽選でもメモリを使わない
+type resultHasher struct {
+	hash  hash.Hash
+	count int
+	buf   []byte
+}
+
+func newResultHasher() *resultHasher {
+	return &resultHasher{hash: sha256.New()}
+}
+
+// 次に引いたgacha_character_idを追加する
+func (h *resultHasher) add(gachaCharacterId string) {
+	h.buf = h.buf[:0]
+	if h.count > 0 {
+		h.buf = append(h.buf, ',')
+	}
+	h.buf = append(h.buf, gachaCharacterId...)
+	h.hash.Write(h.buf)
+	h.count += 1
+}
+
+// それまでに追加したgacha_character_id一覧のハッシュを返す
+func (h *resultHasher) sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
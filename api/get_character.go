@@ -0,0 +1,176 @@
+package api
+
+import (
+	"net/http"
+	"time"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// getCharacter関数で返される
+// CharacterIDはgacha_character_id、BaseCharacterIDはcharactersテーブルのid
+// HPはレベルと限界突破に応じて上がった後のHP、NextLevelExpは次のレベルに必要な経験値の合計(最大レベルなら0)
+// MaxLevelは限界突破で上がった後の最大レベル
+// Locked、Favoriteは/character/lock、/character/favoriteで切り替えたロックとお気に入り(切り替えるまではfalse)
+// GachaID、GachaName、DrawIDはキャラクターを手に入れたガチャとその記録のid、CreatedAtは手に入れた日時
+type UserCharacterDetailResponse struct {
+	UserCharacterID string    `json:"userCharacterID"`
+	CharacterID     string    `json:"characterID"`
+	BaseCharacterID int       `json:"baseCharacterID"`
+	Name            string    `json:"name"`
+	RarityID        int       `json:"rarityID"`
+	RarityName      string    `json:"rarityName"`
+	RarityGrade     int       `json:"rarityGrade"`
+	HP              int       `json:"hp"`
+	Level           int       `json:"level"`
+	Exp             int       `json:"exp"`
+	NextLevelExp    int       `json:"nextLevelExp"`
+	MaxLevel        int       `json:"maxLevel"`
+	LimitBreak      int       `json:"limitBreak"`
+	MaxLimitBreak   int       `json:"maxLimitBreak"`
+	Locked          bool      `json:"locked"`
+	Favorite        bool      `json:"favorite"`
+	GachaID         int       `json:"gachaID"`
+	GachaName       string    `json:"gachaName"`
+	DrawID          string    `json:"drawID"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// ユーザのキャラクターのHPを計算する式
+// ガチャのキャラクターのHP(キャラクターのHPとレアリティのHPup)に、レベルが1上がるごとにレアリティのhp_per_levelを、
+// 限界突破の1段階ごとにレアリティのlimit_break_hpを足す
+const userCharacterHP = "gacha_characters.HP + (user_characters.level - 1) * rarities.hp_per_level + user_characters.limit_break * rarities.limit_break_hp"
+
+// user_charactersテーブルの並べ替え用のカラム(sort_grade、sort_hp、sort_name)を、カタログとレベル、限界突破の段階から計算し直す
+// キャラクター一覧のrarity、hp、nameの並べ替えをインデックスで行うために、並べ替える値をuser_charactersにも持たせている
+// キャラクターを手に入れたときと、レベル、限界突破の段階、カタログを変更したときにトランザクションtxの中で呼ぶ
+func refreshCharacterSortKeys(tx *gorm.DB, where string, args ...interface{}) error {
+	//	UPDATE user_characters
+	//	JOIN gacha_characters ON user_characters.gacha_character_id = gacha_characters.gacha_character_id
+	//	JOIN characters ON gacha_characters.character_id = characters.id
+	//	JOIN rarities ON gacha_characters.rarity_id = rarities.id
+	//	SET user_characters.sort_grade = rarities.grade, user_characters.sort_hp = gacha_characters.HP + ..., user_characters.sort_name = characters.character_name
+	//	WHERE user_characters.user_character_id = '02091c4d-1011-4615-8fbb-fd9e681153d4'
+	return tx.Exec("UPDATE user_characters"+
+		" JOIN gacha_characters ON user_characters.gacha_character_id = gacha_characters.gacha_character_id"+
+		" JOIN characters ON gacha_characters.character_id = characters.id"+
+		" JOIN rarities ON gacha_characters.rarity_id = rarities.id"+
+		" SET user_characters.sort_grade = rarities.grade, user_characters.sort_hp = "+userCharacterHP+", user_characters.sort_name = characters.character_name"+
+		" WHERE "+where, args...).Error
+}
+
+// ユーザのキャラクターの最大レベルを計算する式
+// レアリティの最大レベルに、限界突破の1段階ごとにレアリティのlimit_break_levelsを足す
+const userCharacterMaxLevel = "rarities.max_level + user_characters.limit_break * rarities.limit_break_levels"
+
+// 詳細として読み込む、キャラクターとガチャの情報付きのユーザのキャラクター
+type userCharacterDetailRow struct {
+	UserCharacterID  string
+	GachaCharacterID string
+	CharacterID      int
+	CharacterName    string
+	RarityID         int
+	RarityName       string
+	RarityGrade      int
+	HP               int `gorm:"column:HP"`
+	Level            int
+	Exp              int
+	MaxLevel         int
+	LimitBreak       int
+	MaxLimitBreak    int
+	Locked           bool
+	Favorite         bool
+	GachaID          int
+	GachaName        string
+	GachaDrawID      string
+	CreatedAt        time.Time
+}
+
+// localhost:8080/character/{userCharacterID}でユーザが所持しているキャラクター1体の詳細を取得
+// 他のユーザのキャラクターは見つからないものとして扱う
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetCharacter(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	row, err := c.getUserCharacterDetail(userId, mux.Vars(r)["id"])
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, row.response())
+	//	{"userCharacterID":"02091c4d-1011-4615-8fbb-fd9e681153d4","characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","baseCharacterID":1,"name":"Mercury",
+	//	"rarityID":1,"rarityName":"SR","rarityGrade":3,"hp":2000,"level":1,"exp":0,"nextLevelExp":100,"maxLevel":80,"limitBreak":0,"maxLimitBreak":4,"locked":false,"favorite":false,
+	//	"gachaID":1,"gachaName":"Gacha_A","drawID":"9a1f...","createdAt":"2021-09-10T12:00:00Z"}
+	//	が返る
+}
+
+// dbからユーザuserIdのキャラクターuserCharacterIdの詳細を取得
+// 見つからないときは404のapiErrorを返す
+func (c *Config) getUserCharacterDetail(userId string, userCharacterId string) (userCharacterDetailRow, error) {
+	var rows []userCharacterDetailRow
+	//	SELECT user_characters.user_character_id, user_characters.gacha_character_id, gacha_characters.character_id, characters.character_name, gacha_characters.rarity_id, rarities.rarity_name, rarities.grade AS rarity_grade, gacha_characters.HP + (user_characters.level - 1) * rarities.hp_per_level + user_characters.limit_break * rarities.limit_break_hp AS HP,
+	//	user_characters.level, user_characters.exp, rarities.max_level + user_characters.limit_break * rarities.limit_break_levels AS max_level, user_characters.limit_break, rarities.max_limit_break, user_characters.locked, user_characters.favorite, gacha_characters.gacha_id, gachas.gacha_name, user_characters.gacha_draw_id, user_characters.created_at
+	//	FROM `user_characters`
+	//	join gacha_characters
+	//	on user_characters.gacha_character_id = gacha_characters.gacha_character_id
+	//	join characters
+	//	on gacha_characters.character_id = characters.id
+	//	join rarities
+	//	on gacha_characters.rarity_id = rarities.id
+	//	join gachas
+	//	on gacha_characters.gacha_id = gachas.id
+	//	WHERE user_characters.user_character_id = '02091c4d-1011-4615-8fbb-fd9e681153d4' AND user_characters.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	err := c.DB.Table("user_characters").
+		Select("user_characters.user_character_id, user_characters.gacha_character_id, gacha_characters.character_id, characters.character_name, gacha_characters.rarity_id, rarities.rarity_name, rarities.grade AS rarity_grade, "+userCharacterHP+" AS HP, user_characters.level, user_characters.exp, "+userCharacterMaxLevel+" AS max_level, user_characters.limit_break, rarities.max_limit_break, user_characters.locked, user_characters.favorite, gacha_characters.gacha_id, gachas.gacha_name, user_characters.gacha_draw_id, user_characters.created_at").
+		Joins("join gacha_characters on user_characters.gacha_character_id = gacha_characters.gacha_character_id").
+		Joins("join characters on gacha_characters.character_id = characters.id").
+		Joins("join rarities on gacha_characters.rarity_id = rarities.id").
+		Joins("join gachas on gacha_characters.gacha_id = gachas.id").
+		Where("user_characters.user_character_id = ? AND user_characters.user_id = ?", userCharacterId, userId).
+		Scan(&rows).Error
+	if err != nil {
+		return userCharacterDetailRow{}, err
+	}
+	if len(rows) == 0 {
+		return userCharacterDetailRow{}, newAPIError(http.StatusNotFound, "character is not found.")
+	}
+	return rows[0], nil
+}
+
+// ユーザのキャラクターの詳細をレスポンスの形に変換
+func (row userCharacterDetailRow) response() UserCharacterDetailResponse {
+	return UserCharacterDetailResponse{
+		UserCharacterID: row.UserCharacterID,
+		CharacterID:     row.GachaCharacterID,
+		BaseCharacterID: row.CharacterID,
+		Name:            row.CharacterName,
+		RarityID:        row.RarityID,
+		RarityName:      row.RarityName,
+		RarityGrade:     row.RarityGrade,
+		HP:              row.HP,
+		Level:           row.Level,
+		Exp:             row.Exp,
+		NextLevelExp:    row.nextLevelExp(),
+		MaxLevel:        row.MaxLevel,
+		LimitBreak:      row.LimitBreak,
+		MaxLimitBreak:   row.MaxLimitBreak,
+		Locked:          row.Locked,
+		Favorite:        row.Favorite,
+		GachaID:         row.GachaID,
+		GachaName:       row.GachaName,
+		DrawID:          row.GachaDrawID,
+		CreatedAt:       row.CreatedAt,
+	}
+}
+
+// 次のレベルに必要な経験値の合計。最大レベルなら0
+func (row userCharacterDetailRow) nextLevelExp() int {
+	if row.Level >= row.MaxLevel {
+		return 0
+	}
+	return levelExp(row.Level + 1)
+}
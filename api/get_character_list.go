@@ -1,22 +1,117 @@
 package api
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
+	"gorm.io/gorm"
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// キャラクター一覧の1ページに含められる最大の数
+const maxCharacterListLimit = 200
+
+// CharacterIDはgacha_character_id、RarityGradeはレアリティのgrade、HPはレベルと限界突破に応じて上がった後のHP、GachaIDはそのキャラクターを排出したガチャのid
+// CreatedAtはキャラクターを手に入れた日時
 type UserCharacterResponse struct {
-	UserCharacterID string `json:"userCharacterID"`
-	CharacterID     string `json:"characterID"`
-	Name            string `json:"name"`
+	UserCharacterID string    `json:"userCharacterID"`
+	CharacterID     string    `json:"characterID"`
+	Name            string    `json:"name"`
+	RarityID        int       `json:"rarityID"`
+	RarityName      string    `json:"rarityName"`
+	RarityGrade     int       `json:"rarityGrade"`
+	HP              int       `json:"hp"`
+	Level           int       `json:"level"`
+	LimitBreak      int       `json:"limitBreak"`
+	Locked          bool      `json:"locked"`
+	Favorite        bool      `json:"favorite"`
+	GachaID         int       `json:"gachaID"`
+	CreatedAt       time.Time `json:"createdAt"`
 }
 
 // getCharacterList関数で返される
+// NextCursorは次のページを取得するときにcursorに指定する値。最後のページでは含まれない
 type CharactersResponse struct {
 	Characters []UserCharacterResponse `json:"characters"`
+	NextCursor string                  `json:"nextCursor,omitempty"`
+}
+
+// 一覧の1行分として読み込む、キャラクターの情報付きのユーザのキャラクター
+type userCharacterRow struct {
+	UserCharacterID  string
+	GachaCharacterID string
+	CharacterName    string
+	RarityID         int
+	RarityName       string
+	RarityGrade      int
+	HP               int `gorm:"column:HP"`
+	Level            int
+	LimitBreak       int
+	Locked           bool
+	Favorite         bool
+	GachaID          int
+	CreatedAt        time.Time
+	SortGrade        int
+	SortHP           int
+	SortName         string
+}
+
+// キャラクター一覧の並び順
+// columnは並べ替えるカラム、keyはカーソルに入れる行の値、parseはカーソルの値をクエリの引数に戻す関数
+// columnはuser_idとのインデックスがあるuser_charactersのカラムに限り、結合したテーブルのカラムや式では並べ替えない
+type characterSort struct {
+	column string
+	key    func(row userCharacterRow) string
+	parse  func(value string) (interface{}, error)
+}
+
+// sortに指定できる並び順
+var characterSorts = map[string]characterSort{
+	"acquired": {
+		column: "user_characters.created_at",
+		key:    func(row userCharacterRow) string { return row.CreatedAt.Format(time.RFC3339Nano) },
+		parse: func(value string) (interface{}, error) {
+			return time.Parse(time.RFC3339Nano, value)
+		},
+	},
+	"rarity": {
+		column: "user_characters.sort_grade",
+		key:    func(row userCharacterRow) string { return strconv.Itoa(row.SortGrade) },
+		parse: func(value string) (interface{}, error) {
+			return strconv.Atoi(value)
+		},
+	},
+	"hp": {
+		column: "user_characters.sort_hp",
+		key:    func(row userCharacterRow) string { return strconv.Itoa(row.SortHP) },
+		parse: func(value string) (interface{}, error) {
+			return strconv.Atoi(value)
+		},
+	},
+	"name": {
+		column: "user_characters.sort_name",
+		key:    func(row userCharacterRow) string { return row.SortName },
+		parse: func(value string) (interface{}, error) {
+			return value, nil
+		},
+	},
 }
 
-// localhost:8080/character/listでユーザが所持しているキャラクター一覧情報を取得
+// キャラクター一覧のカーソル
+// 前のページの最後の行の並べ替えの値とuser_character_idを、並び順と一緒に入れる
+type characterCursor struct {
+	Sort            string `json:"s"`
+	Order           string `json:"o"`
+	Value           string `json:"v"`
+	UserCharacterID string `json:"id"`
+}
+
+// localhost:8080/character/list?limit=50&cursor=xxx&sort=acquired&order=descでユーザが所持しているキャラクター一覧情報を取得
+// rarity_id、character_id(charactersテーブルのid)、gacha_id、acquired_from、acquired_to(RFC3339)、locked、favorite(trueかfalse)で絞り込める
+// sortはacquired(手に入れた日時、省略時)、rarity、hp、name、orderはdesc(省略時)、asc
+// limitは1以上maxCharacterListLimit以下(省略時は50)
 // -H "x-token:yyy"でトークン情報を受け取り、認証
 func (c *Config) GetCharacterList(w http.ResponseWriter, r *http.Request) {
 	userId, err := c.getUserId(r)
@@ -24,61 +119,207 @@ func (c *Config) GetCharacterList(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	allCharactersList, err := c.getAllCharacters()
+	query, err := c.userCharacterQuery(userId, r)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithAPIError(w, err)
 		return
 	}
-	userCharactersList, err := c.getUserCharacters(userId)
+	rows, nextCursor, err := pageUserCharacters(query, r, 50, maxCharacterListLimit)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithAPIError(w, err)
 		return
 	}
-	var characters []UserCharacterResponse
-	var userCharacterInfo UserCharacterResponse
-	if len(userCharactersList) == 0 {
-		characters = make([]UserCharacterResponse, 0)
-	} else {
-		for _, v := range userCharactersList {
-			gacha_character_id := v.GachaCharacterID
-			character := getCharacterInfo(allCharactersList, gacha_character_id)
-			characterName := character.CharacterName
-			userCharacterInfo = UserCharacterResponse{UserCharacterID: v.UserCharacterID, CharacterID: gacha_character_id, Name: characterName}
-			characters = append(characters, userCharacterInfo)
-		}
+	characters := make([]UserCharacterResponse, 0, len(rows))
+	for _, v := range rows {
+		characters = append(characters, v.response())
 	}
 	RespondWithJSON(w, http.StatusOK, &CharactersResponse{
 		Characters: characters,
+		NextCursor: nextCursor,
 	})
 	//	{"characters":[
-	//		{"userCharacterID":"02091c4d-1011-4615-8fbb-fd9e681153d4","characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Sun"},
-	//		{"userCharacterID":"0fed4c04-153c-4980-9a66-1424f1f7a445","characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Venus"},
+	//		{"userCharacterID":"02091c4d-1011-4615-8fbb-fd9e681153d4","characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Sun",
+	//		 "rarityID":1,"rarityName":"SR","rarityGrade":3,"hp":2000,"level":1,"limitBreak":0,"locked":true,"favorite":false,"gachaID":1,"createdAt":"2021-09-10T12:00:00Z"},
 	//		...
-	//		{"userCharacterID":"95a281d5-86f0-4251-a4cb-5873231f4a96","characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Pluto"}
-	//	]}
+	//		{"userCharacterID":"95a281d5-86f0-4251-a4cb-5873231f4a96","characterID":"c115174c-05ad-11ec-8679-a0c58933fdce","name":"Pluto",...}
+	//	],
+	//	"nextCursor":"eyJzIjoiYWNxdWlyZWQi..."}
 	//	が返る
 }
 
-// dbのuser_charactersテーブルからuser_idが引数user_idのデータを取得
-func (c *Config) getUserCharacters(user_id string) ([]UserCharacter, error) {
-	var userCharactersList []UserCharacter
-	// SELECT * FROM `user_characters`  WHERE (user_id = '703a0b0a-1541-487e-be5b-906e9541b021')
-	c.DB.Where("user_id = ?", user_id).Find(&userCharactersList)
-	return userCharactersList, nil
-}
-
-// dbから全てのキャラクターのgacha_character_id、名前、weightの情報を取得
-func (c *Config) getAllCharacters() ([]Character, error) {
-	var charactersList []Character
-	//	SELECT gacha_characters.gacha_character_id, characters.character_name, rarities.weight
-	//	FROM `gacha_characters`
+// ユーザのキャラクターをキャラクターの情報と一緒に読み込むクエリを作り、クエリパラメータの条件で絞り込む
+func (c *Config) userCharacterQuery(userId string, r *http.Request) (*gorm.DB, error) {
+	//	SELECT user_characters.user_character_id, user_characters.gacha_character_id, characters.character_name, gacha_characters.rarity_id, rarities.rarity_name, rarities.grade AS rarity_grade, gacha_characters.HP + (user_characters.level - 1) * rarities.hp_per_level + user_characters.limit_break * rarities.limit_break_hp AS HP,
+	//	user_characters.level, user_characters.limit_break, user_characters.locked, user_characters.favorite, gacha_characters.gacha_id, user_characters.created_at,
+	//	user_characters.sort_grade, user_characters.sort_hp, user_characters.sort_name
+	//	FROM `user_characters`
+	//	join gacha_characters
+	//	on user_characters.gacha_character_id = gacha_characters.gacha_character_id
 	//	join characters
 	//	on gacha_characters.character_id = characters.id
 	//	join rarities
 	//	on gacha_characters.rarity_id = rarities.id
-	c.DB.Table("gacha_characters").Select("gacha_characters.gacha_character_id, characters.character_name, rarities.weight").
+	//	WHERE user_characters.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND gacha_characters.rarity_id = 1
+	query := c.DB.Table("user_characters").
+		Select("user_characters.user_character_id, user_characters.gacha_character_id, characters.character_name, gacha_characters.rarity_id, rarities.rarity_name, rarities.grade AS rarity_grade, "+userCharacterHP+" AS HP, user_characters.level, user_characters.limit_break, user_characters.locked, user_characters.favorite, gacha_characters.gacha_id, user_characters.created_at, "+
+			"user_characters.sort_grade, user_characters.sort_hp, user_characters.sort_name").
+		Joins("join gacha_characters on user_characters.gacha_character_id = gacha_characters.gacha_character_id").
 		Joins("join characters on gacha_characters.character_id = characters.id").
 		Joins("join rarities on gacha_characters.rarity_id = rarities.id").
-		Scan(&charactersList)
-	return charactersList, nil
+		Where("user_characters.user_id = ?", userId)
+	filters := []struct {
+		param  string
+		column string
+	}{
+		{"rarity_id", "gacha_characters.rarity_id"},
+		{"character_id", "gacha_characters.character_id"},
+		{"gacha_id", "gacha_characters.gacha_id"},
+	}
+	for _, f := range filters {
+		v := r.URL.Query().Get(f.param)
+		if v == "" {
+			continue
+		}
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, f.param+" is error.")
+		}
+		query = query.Where(f.column+" = ?", id)
+	}
+	if v := r.URL.Query().Get("acquired_from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, "acquired_from is error.")
+		}
+		query = query.Where("user_characters.created_at >= ?", from)
+	}
+	if v := r.URL.Query().Get("acquired_to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, "acquired_to is error.")
+		}
+		query = query.Where("user_characters.created_at < ?", to)
+	}
+	for _, column := range []string{"locked", "favorite"} {
+		v := r.URL.Query().Get(column)
+		if v == "" {
+			continue
+		}
+		flag, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, column+" is error.")
+		}
+		query = query.Where("user_characters."+column+" = ?", flag)
+	}
+	return query, nil
+}
+
+// クエリパラメータのsort、order、cursor、limitでqueryを並べ替えて1ページ分を読み込む
+// 次のページがあるときは、そのカーソルも返す
+func pageUserCharacters(query *gorm.DB, r *http.Request, defaultLimit int, maxLimit int) ([]userCharacterRow, string, error) {
+	sortName := r.URL.Query().Get("sort")
+	if sortName == "" {
+		sortName = "acquired"
+	}
+	sort, ok := characterSorts[sortName]
+	if !ok {
+		return nil, "", newAPIError(http.StatusBadRequest, "sort is error.")
+	}
+	order := r.URL.Query().Get("order")
+	if order == "" {
+		order = "desc"
+	}
+	if order != "desc" && order != "asc" {
+		return nil, "", newAPIError(http.StatusBadRequest, "order is error.")
+	}
+	limit := defaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxLimit {
+			return nil, "", newAPIError(http.StatusBadRequest, "limit is error.")
+		}
+	}
+	// カーソルがあるときは、前のページの最後の行より後ろの行だけを読み込む
+	// 並べ替えの値が同じ行はuser_character_idで順番を決める
+	//	WHERE ... AND (user_characters.created_at < '2021-09-10 12:00:00' OR (user_characters.created_at = '2021-09-10 12:00:00' AND user_characters.user_character_id < '95a2...'))
+	//	ORDER BY user_characters.created_at DESC, user_characters.user_character_id DESC
+	//	LIMIT 51
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		cursor, err := decodeCharacterCursor(v)
+		if err != nil || cursor.Sort != sortName || cursor.Order != order {
+			return nil, "", newAPIError(http.StatusBadRequest, "cursor is error.")
+		}
+		value, err := sort.parse(cursor.Value)
+		if err != nil {
+			return nil, "", newAPIError(http.StatusBadRequest, "cursor is error.")
+		}
+		op := "<"
+		if order == "asc" {
+			op = ">"
+		}
+		query = query.Where("("+sort.column+" "+op+" ? OR ("+sort.column+" = ? AND user_characters.user_character_id "+op+" ?))",
+			value, value, cursor.UserCharacterID)
+	}
+	var rows []userCharacterRow
+	// 次のページがあるかを調べるため、1行多く読み込む
+	err := query.Order(sort.column + " " + order + ", user_characters.user_character_id " + order).
+		Limit(limit + 1).Scan(&rows).Error
+	if err != nil {
+		return nil, "", err
+	}
+	if len(rows) <= limit {
+		return rows, "", nil
+	}
+	rows = rows[:limit]
+	last := rows[limit-1]
+	nextCursor, err := encodeCharacterCursor(characterCursor{
+		Sort:            sortName,
+		Order:           order,
+		Value:           sort.key(last),
+		UserCharacterID: last.UserCharacterID,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return rows, nextCursor, nil
+}
+
+// カーソルをjsonにしてURLに入れられる形にエンコードする
+func encodeCharacterCursor(cursor characterCursor) (string, error) {
+	b, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// encodeCharacterCursor関数でエンコードしたカーソルを戻す
+func decodeCharacterCursor(v string) (characterCursor, error) {
+	var cursor characterCursor
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(b, &cursor)
+	return cursor, err
+}
+
+// ユーザのキャラクターをレスポンスの形に変換
+func (row userCharacterRow) response() UserCharacterResponse {
+	return UserCharacterResponse{
+		UserCharacterID: row.UserCharacterID,
+		CharacterID:     row.GachaCharacterID,
+		Name:            row.CharacterName,
+		RarityID:        row.RarityID,
+		RarityName:      row.RarityName,
+		RarityGrade:     row.RarityGrade,
+		HP:              row.HP,
+		Level:           row.Level,
+		LimitBreak:      row.LimitBreak,
+		Locked:          row.Locked,
+		Favorite:        row.Favorite,
+		GachaID:         row.GachaID,
+		CreatedAt:       row.CreatedAt,
+	}
 }
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"net/http"
+	"time"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// GachaType: ガチャの種類("normal"、"box"、"stepup")
+// Status: 開催中なら"active"、開催前なら"upcoming"
+// PityCount: 天井対象のレアリティを最後に引いてから何回ガチャを引いたか
+// PullsToHardPity: あと何回で天井に達するか(天井なしのガチャでは0)
+// CurrentStep: ステップアップガチャで、ユーザが次に引くステップ(それ以外のガチャでは含まれない)
+type GachaResponse struct {
+	GachaID         int                         `json:"gachaID"`
+	Name            string                      `json:"name"`
+	GachaType       string                      `json:"gachaType"`
+	Status          string                      `json:"status"`
+	StartAt         *time.Time                  `json:"startAt"`
+	EndAt           *time.Time                  `json:"endAt"`
+	Featured        []FeaturedCharacterResponse `json:"featured"`
+	HardPity        int                         `json:"hardPity"`
+	SoftPity        int                         `json:"softPity"`
+	PityRarityID    int                         `json:"pityRarityID"`
+	PityCount       int                         `json:"pityCount"`
+	PullsToHardPity int                         `json:"pullsToHardPity"`
+	CurrentStep     *StepResponse               `json:"currentStep,omitempty"`
+}
+
+// ピックアップ対象のキャラクター
+type FeaturedCharacterResponse struct {
+	CharacterID string `json:"characterID"`
+	Name        string `json:"name"`
+	RateUp      int    `json:"rateUp"`
+}
+
+// ピックアップ対象のキャラクターの情報をdbから取得するときに使う
+type featuredCharacter struct {
+	GachaID          int
+	GachaCharacterID string
+	CharacterName    string
+	RateUp           int
+}
+
+// getGachaList関数で返される
+type GachasResponse struct {
+	Gachas []GachaResponse `json:"gachas"`
+}
+
+// localhost:8080/gacha/listで開催中と開催予定のガチャ一覧と、ユーザのガチャごとの天井カウンターを取得
+// 開催期間が終わったガチャとretiredのガチャは含まない
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetGachaList(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	var gachas []Gacha
+	// SELECT * FROM `gachas` WHERE (end_at IS NULL OR end_at > '2021-11-01 12:00:00') AND retired = FALSE
+	if err := c.DB.Where("end_at IS NULL OR end_at > ?", now).Where("retired = FALSE").Find(&gachas).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	featured, err := c.getFeaturedCharacters()
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var pityCounts []GachaPityCount
+	// SELECT * FROM `gacha_pity_counts` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	if err := c.DB.Where("user_id = ?", userId).Find(&pityCounts).Error; err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	gachaList := make([]GachaResponse, 0)
+	for _, gacha := range gachas {
+		pityCount := 0
+		for _, v := range pityCounts {
+			if v.GachaID == gacha.ID {
+				pityCount = v.Count
+			}
+		}
+		// 天井の回数を管理画面で下げると天井カウンターが超えていることがあるので、0より小さくしない
+		pullsToHardPity := 0
+		if gacha.HardPity > 0 && pityCount < gacha.HardPity {
+			pullsToHardPity = gacha.HardPity - pityCount
+		}
+		status := "active"
+		if !gacha.isOpen(now) {
+			status = "upcoming"
+		}
+		var currentStep *StepResponse
+		if gacha.GachaType == gachaTypeStepUp {
+			table, err := c.getGachaTable(gacha.ID)
+			if err != nil {
+				RespondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			step, _, err := c.currentGachaStep(userId, table)
+			if err != nil {
+				respondWithAPIError(w, err)
+				return
+			}
+			currentStep = table.stepResponse(step)
+		}
+		featuredList := make([]FeaturedCharacterResponse, 0)
+		for _, v := range featured {
+			if v.GachaID == gacha.ID {
+				featuredList = append(featuredList, FeaturedCharacterResponse{CharacterID: v.GachaCharacterID, Name: v.CharacterName, RateUp: v.RateUp})
+			}
+		}
+		gachaList = append(gachaList, GachaResponse{
+			GachaID:         gacha.ID,
+			Name:            gacha.GachaName,
+			GachaType:       gacha.GachaType,
+			Status:          status,
+			StartAt:         gacha.StartAt,
+			EndAt:           gacha.EndAt,
+			Featured:        featuredList,
+			HardPity:        gacha.HardPity,
+			SoftPity:        gacha.SoftPity,
+			PityRarityID:    gacha.PityRarityID,
+			PityCount:       pityCount,
+			PullsToHardPity: pullsToHardPity,
+			CurrentStep:     currentStep,
+		})
+	}
+	RespondWithJSON(w, http.StatusOK, &GachasResponse{
+		Gachas: gachaList,
+	})
+	//	{"gachas":[
+	//		{"gachaID":1,"name":"Gacha_A","gachaType":"normal","status":"active","startAt":null,"endAt":null,
+	//		 "featured":[{"characterID":"7b6a8a4e-0ed8-11ec-93f3-a0c58933fdce","name":"Venus","rateUp":3}],
+	//		 "hardPity":90,"softPity":74,"pityRarityID":1,"pityCount":12,"pullsToHardPity":78},
+	//		...
+	//		{"gachaID":5,"name":"StepUp_A","gachaType":"stepup",...,
+	//		 "currentStep":{"step":2,"steps":5,"price":8,"times":10,"guaranteedRarityID":0}}
+	//	]}
+	//	が返る
+}
+
+// dbからピックアップ倍率が1より大きい、retiredでないキャラクターの情報を取得
+func (c *Config) getFeaturedCharacters() ([]featuredCharacter, error) {
+	var featured []featuredCharacter
+	//	SELECT gacha_characters.gacha_id, gacha_characters.gacha_character_id, characters.character_name, gacha_characters.rate_up
+	//	FROM `gacha_characters`
+	//	join characters
+	//	on gacha_characters.character_id = characters.id
+	//	WHERE gacha_characters.rate_up > 1 AND gacha_characters.retired = FALSE
+	err := c.DB.Table("gacha_characters").Select("gacha_characters.gacha_id, gacha_characters.gacha_character_id, characters.character_name, gacha_characters.rate_up").
+		Joins("join characters on gacha_characters.character_id = characters.id").
+		Where("gacha_characters.rate_up > 1 AND gacha_characters.retired = FALSE").Scan(&featured).Error
+	if err != nil {
+		return nil, err
+	}
+	return featured, nil
+}
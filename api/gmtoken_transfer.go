@@ -0,0 +1,265 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"time"
+	"gorm.io/gorm"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// ゲームトークンの鋳造と焼却の種類
+const (
+	gmtokenMint = "mint"
+	gmtokenBurn = "burn"
+)
+
+// ゲームトークンの鋳造と焼却の状態
+// pending: まだ送信していない(送信に失敗したときもこの状態に戻してやり直す)
+// sending: 送信を始めた。ブロックに取り込まれたか分からないまま残っていたら、二重に送らないようにやり直さない
+// done: 送信したトランザクションがブロックに取り込まれて成功した
+// failed: gmtokenTransferMaxAttempts回送信に失敗したか、先に焼却する操作で焼却に失敗した。やり直さない
+const (
+	gmtokenTransferPending = "pending"
+	gmtokenTransferSending = "sending"
+	gmtokenTransferDone    = "done"
+	gmtokenTransferFailed  = "failed"
+)
+
+// ゲームトークンを鋳造、焼却する操作
+// ticket: ガチャチケットの購入(RefIDはチケットのガチャid)
+// refund: 重複したキャラクターの変換の払い戻し(RefIDはガチャで自動で変換したならガチャの記録のdraw_id、ユーザが変換したなら空)
+// gacha: ガチャの支払い(RefIDはガチャの記録のdraw_id。焼却のハッシュはガチャの記録にも書き込む)
+// compensate: 先に焼却した後の操作に失敗したときに、焼却した分を鋳造して返す(RefIDは焼却の記録のtransfer_id)
+const (
+	gmtokenReasonEnhance    = "enhance"
+	gmtokenReasonSell       = "sell"
+	gmtokenReasonBattle     = "battle"
+	gmtokenReasonArena      = "arena"
+	gmtokenReasonGacha      = "gacha"
+	gmtokenReasonRefund     = "refund"
+	gmtokenReasonTicket     = "ticket"
+	gmtokenReasonCompensate = "compensate"
+)
+
+// 送信に失敗した鋳造と焼却をやり直すまでの間隔
+const gmtokenTransferRetryInterval = time.Minute
+
+// 送信をやり直す回数の上限。これだけ失敗したらfailedにしてやり直さない
+const gmtokenTransferMaxAttempts = 10
+
+// ゲームトークンの鋳造と焼却の記録
+// dbの変更と同じトランザクションでpendingの状態で作成し、コミットしてから送信するので、
+// トランザクションが取り消されたのに鋳造や焼却だけが済むことはない
+// Kind: "mint"、"burn"、Reason: 鋳造、焼却した操作、RefID: 操作の対象のid(強化したキャラクターのuser_character_idなど。複数あれば空)
+// TxHash: 送信したトランザクションのハッシュ(sendingのまま残っていれば、このハッシュでブロックに取り込まれたか確かめる)
+// Attempts: 送信した回数、Error: 最後に送信に失敗したときのエラーメッセージ
+type GmtokenTransfer struct {
+	TransferID string    `json:"transfer_id" gorm:"primaryKey"`
+	UserID     string    `json:"user_id"`
+	Kind       string    `json:"kind"`
+	Amount     int       `json:"amount"`
+	Reason     string    `json:"reason"`
+	RefID      string    `json:"ref_id"`
+	Status     string    `json:"status"`
+	TxHash     string    `json:"tx_hash"`
+	Attempts   int       `json:"attempts"`
+	Error      string    `json:"error"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// トランザクションtxの中で、ゲームトークンの鋳造か焼却をpendingの状態で記録する
+// 送信はトランザクションをコミットしてからsendGmtokenTransfer関数で行う
+func createGmtokenTransfer(tx *gorm.DB, userId string, kind string, amount int, reason string, refId string) (GmtokenTransfer, error) {
+	transferId, err := createUUId()
+	if err != nil {
+		return GmtokenTransfer{}, err
+	}
+	transfer := GmtokenTransfer{
+		TransferID: transferId,
+		UserID:     userId,
+		Kind:       kind,
+		Amount:     amount,
+		Reason:     reason,
+		RefID:      refId,
+		Status:     gmtokenTransferPending,
+	}
+	//	INSERT INTO `gmtoken_transfers` (`transfer_id`,`user_id`,`kind`,`amount`,`reason`,`ref_id`,`status`,`tx_hash`,`attempts`,`error`,`created_at`,`updated_at`)
+	//	VALUES ('4f1e...','95daec2b-287c-4358-ba6f-5c29e1c3cbdf','burn',10,'enhance','02091c4d-...','pending','',0,'','2021-09-11 12:00:00','2021-09-11 12:00:00')
+	if err := tx.Create(&transfer).Error; err != nil {
+		return GmtokenTransfer{}, err
+	}
+	return transfer, nil
+}
+
+// pendingのゲームトークンの鋳造か焼却を送信し、トランザクションのハッシュを返す
+// 送信に失敗したらpendingに戻して後でやり直し、gmtokenTransferMaxAttempts回失敗したらfailedにする
+func (c *Config) sendGmtokenTransfer(transferId string) (string, error) {
+	return c.sendGmtokenTransferAttempts(transferId, gmtokenTransferMaxAttempts)
+}
+
+// pendingのゲームトークンの鋳造か焼却を送信し、ブロックに取り込まれて成功するまで待ってトランザクションのハッシュを返す
+// 送信する前にsendingにして、同じ記録を他のリクエストややり直しが同時に送らないようにする
+// 成功したら操作の記録にもハッシュを書き込み、失敗したら送信した回数がmaxAttemptsに達するまではpendingに戻す
+// 取り込まれたか分からないまま待つのをやめたときは、二重に送らないようにsendingのまま残してerrGmtokenTxUnconfirmedを返す
+func (c *Config) sendGmtokenTransferAttempts(transferId string, maxAttempts int) (string, error) {
+	// UPDATE `gmtoken_transfers` SET `attempts`=attempts + 1,`status`='sending',`updated_at`='2021-09-11 12:00:00' WHERE transfer_id = '4f1e...' AND status = 'pending'
+	claimed := c.DB.Model(&GmtokenTransfer{}).Where("transfer_id = ? AND status = ?", transferId, gmtokenTransferPending).
+		Updates(map[string]interface{}{"status": gmtokenTransferSending, "attempts": gorm.Expr("attempts + 1")})
+	if claimed.Error != nil {
+		return "", claimed.Error
+	}
+	if claimed.RowsAffected == 0 {
+		return "", errors.New("gmtoken transfer " + transferId + " is not pending")
+	}
+	var transfer GmtokenTransfer
+	// SELECT * FROM `gmtoken_transfers` WHERE transfer_id = '4f1e...'
+	if err := c.DB.Where("transfer_id = ?", transferId).Find(&transfer).Error; err != nil {
+		return "", err
+	}
+	var user User
+	// SELECT * FROM `users` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+	err := c.DB.Where("user_id = ?", transfer.UserID).Find(&user).Error
+	var txHash string
+	if err == nil {
+		if transfer.Kind == gmtokenMint {
+			txHash, err = c.MintGmtoken(transfer.Amount, user.PrivateKey)
+		} else {
+			txHash, err = c.BurnGmtoken(transfer.Amount, user.PrivateKey)
+		}
+	}
+	if err == nil {
+		// 待っている間に止まっても、sendingの記録からハッシュを確かめられるように先に書き込む
+		// UPDATE `gmtoken_transfers` SET `tx_hash`='0xf98c...',`updated_at`='2021-09-11 12:00:01' WHERE transfer_id = '4f1e...'
+		if err := c.DB.Model(&GmtokenTransfer{}).Where("transfer_id = ?", transferId).Update("tx_hash", txHash).Error; err != nil {
+			log.Println("gmtoken transfer", transferId, "was sent as", txHash, "but could not be recorded:", err)
+		}
+		err = c.waitGmtokenTx(txHash)
+		if errors.Is(err, errGmtokenTxUnconfirmed) {
+			log.Println("gmtoken transfer", transferId, "is left sending:", err)
+			return "", err
+		}
+	}
+	if err != nil {
+		status := gmtokenTransferPending
+		if transfer.Attempts >= maxAttempts {
+			status = gmtokenTransferFailed
+		}
+		// UPDATE `gmtoken_transfers` SET `error`='...',`status`='pending',`updated_at`='2021-09-11 12:00:01' WHERE transfer_id = '4f1e...'
+		if err := c.DB.Model(&GmtokenTransfer{}).Where("transfer_id = ?", transferId).
+			Updates(map[string]interface{}{"status": status, "error": err.Error()}).Error; err != nil {
+			log.Println("gmtoken transfer", transferId, "could not be released:", err)
+		}
+		return "", err
+	}
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		// UPDATE `gmtoken_transfers` SET `status`='done',`tx_hash`='0xf98c...',`updated_at`='2021-09-11 12:00:01' WHERE transfer_id = '4f1e...'
+		err := tx.Model(&GmtokenTransfer{}).Where("transfer_id = ?", transferId).
+			Updates(map[string]interface{}{"status": gmtokenTransferDone, "tx_hash": txHash}).Error
+		if err != nil {
+			return err
+		}
+		return recordGmtokenTxHash(tx, transfer, txHash)
+	})
+	if err != nil {
+		// 送信は済んでいるので、やり直さずにログに残す
+		log.Println("gmtoken transfer", transferId, "was sent as", txHash, "but could not be recorded:", err)
+	}
+	return txHash, nil
+}
+
+// ユーザのゲームトークンをすぐに焼却し、ブロックに取り込まれて成功したら焼却の記録を返す
+// 焼却が済んでからdbを変更する操作で使い、焼却に失敗したら記録をfailedにしてやり直さない
+// 取り込まれたか分からないときはsendingのまま残すので、後で取り込まれていたら管理者が確かめて返す
+// 焼却した後の変更に失敗したときは、compensateGmtokenBurn関数で焼却した分を返す
+func (c *Config) burnGmtokenFirst(userId string, amount int, reason string, refId string) (GmtokenTransfer, error) {
+	transfer, err := createGmtokenTransfer(c.DB, userId, gmtokenBurn, amount, reason, refId)
+	if err != nil {
+		return GmtokenTransfer{}, err
+	}
+	txHash, err := c.sendGmtokenTransferAttempts(transfer.TransferID, 1)
+	if err != nil {
+		return GmtokenTransfer{}, err
+	}
+	transfer.Status = gmtokenTransferDone
+	transfer.TxHash = txHash
+	return transfer, nil
+}
+
+// burnGmtokenFirst関数で焼却した後の操作に失敗したときに、焼却した分のうちamountだけ鋳造して返す
+// 鋳造は記録してから送信するので、送信に失敗しても後でやり直す
+func (c *Config) compensateGmtokenBurn(burn GmtokenTransfer, amount int) {
+	transfer, err := createGmtokenTransfer(c.DB, burn.UserID, gmtokenMint, amount, gmtokenReasonCompensate, burn.TransferID)
+	if err != nil {
+		log.Println("gmtoken burn", burn.TransferID, "could not be compensated:", err)
+		return
+	}
+	if _, err := c.sendGmtokenTransfer(transfer.TransferID); err != nil {
+		log.Println("gmtoken transfer", transfer.TransferID, "failed:", err)
+	}
+}
+
+// トランザクションtxの中で、送信できたゲームトークンの鋳造か焼却のハッシュを操作の記録に書き込む
+// 強化の焼却のように、操作を記録する前に送信するものはsaveCharacterHistory関数などでハッシュを書き込むので何もしない
+func recordGmtokenTxHash(tx *gorm.DB, transfer GmtokenTransfer, txHash string) error {
+	switch transfer.Reason {
+	case gmtokenReasonSell:
+		// UPDATE `character_histories` SET `tx_hash`='0xf98c...' WHERE transfer_id = '4f1e...'
+		return tx.Model(&CharacterHistory{}).Where("transfer_id = ?", transfer.TransferID).Update("tx_hash", txHash).Error
+	case gmtokenReasonRefund:
+		// UPDATE `duplicate_conversions` SET `tx_hash`='0x8369...' WHERE transfer_id = '4f1e...'
+		if err := tx.Model(&DuplicateConversion{}).Where("transfer_id = ?", transfer.TransferID).Update("tx_hash", txHash).Error; err != nil {
+			return err
+		}
+		if transfer.RefID == "" {
+			return nil
+		}
+		// UPDATE `gacha_draws` SET `refund_tx_hash`='0x8369...',`updated_at`='2021-09-10 12:00:02' WHERE draw_id = '9a1f...'
+		return tx.Model(&GachaDraw{}).Where("draw_id = ?", transfer.RefID).Update("refund_tx_hash", txHash).Error
+	case gmtokenReasonBattle:
+		// UPDATE `battles` SET `mint_tx_hash`='0x5a7e...' WHERE battle_id = '4f1b...'
+		return tx.Model(&Battle{}).Where("battle_id = ?", transfer.RefID).Update("mint_tx_hash", txHash).Error
+	case gmtokenReasonArena:
+		// UPDATE `arena_players` SET `reward_tx_hash`='0x5a7e...' WHERE season_id = 1 AND user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf'
+		return tx.Model(&ArenaPlayer{}).Where("season_id = ? AND user_id = ?", transfer.RefID, transfer.UserID).Update("reward_tx_hash", txHash).Error
+	}
+	return nil
+}
+
+// 送信に失敗したゲームトークンの鋳造と焼却を、gmtokenTransferRetryIntervalごとにやり直すゴルーチンを起動する
+// 起動したときにsendingのまま残っている記録は、ブロックに取り込まれたか分からないのでやり直さずにログで知らせる
+// サーバーは1台で動かす前提で、他のサーバーが送信中の記録は考えない
+func (c *Config) StartGmtokenTransfers() {
+	var sending []GmtokenTransfer
+	// SELECT * FROM `gmtoken_transfers` WHERE status = 'sending'
+	if err := c.DB.Where("status = ?", gmtokenTransferSending).Find(&sending).Error; err != nil {
+		log.Println("gmtoken transfers could not be checked:", err)
+	}
+	for _, v := range sending {
+		log.Println("gmtoken transfer", v.TransferID, "was interrupted while sending and needs to be checked on chain:", v.TxHash)
+	}
+	go func() {
+		ticker := time.NewTicker(gmtokenTransferRetryInterval)
+		for now := range ticker.C {
+			c.retryGmtokenTransfers(now)
+		}
+	}()
+}
+
+// 作成してからgmtokenTransferRetryInterval以上経ってもpendingのままの鋳造と焼却を送信し直す
+func (c *Config) retryGmtokenTransfers(now time.Time) {
+	var transferIds []string
+	// SELECT transfer_id FROM `gmtoken_transfers` WHERE status = 'pending' AND updated_at < '2021-09-11 11:59:00' ORDER BY created_at
+	err := c.DB.Model(&GmtokenTransfer{}).Where("status = ? AND updated_at < ?", gmtokenTransferPending, now.Add(-gmtokenTransferRetryInterval)).
+		Order("created_at").Pluck("transfer_id", &transferIds).Error
+	if err != nil {
+		log.Println("gmtoken transfers could not be loaded:", err)
+		return
+	}
+	for _, transferId := range transferIds {
+		if _, err := c.sendGmtokenTransfer(transferId); err != nil {
+			log.Println("gmtoken transfer", transferId, "failed:", err)
+		}
+	}
+}
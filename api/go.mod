@@ -9,8 +9,9 @@ require (
 	github.com/ethereum/go-ethereum v1.10.11
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/google/uuid v1.3.0
-	github.com/mroth/weightedrand v0.4.1
+	github.com/gorilla/mux v1.8.0
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/driver/mysql v1.1.2
 	gorm.io/gorm v1.21.16
 	local.packages/gmtoken v0.0.0-00010101000000-000000000000
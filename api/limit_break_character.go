@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// MaterialIDs: 素材にする同じキャラクターのuser_character_id。1体につき限界突破が1段階上がる
+type LimitBreakingCharacter struct {
+	MaterialIDs []string `json:"material_ids"`
+}
+
+// limitBreakCharacter関数で返される
+// Consumedは素材にしたキャラクターの数
+type LimitBreakResponse struct {
+	Consumed  int                         `json:"consumed"`
+	Character UserCharacterDetailResponse `json:"character"`
+}
+
+// localhost:8080/character/{userCharacterID}/limit_breakで同じキャラクターを素材にしてキャラクターを限界突破する
+// 限界突破の段階ごとに最大レベルとHPが上がる。段階の上限はレアリティごとに決まる
+// 素材はcharactersテーブルのidが同じで、ロックされておらずチームに入っていないキャラクターに限る
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"material_ids":["ff1583af-..."]}で素材のキャラクターを受け取る
+func (c *Config) LimitBreakCharacter(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	userCharacterId := mux.Vars(r)["id"]
+	var limitBreaking LimitBreakingCharacter
+	if err := readRequestBody(r, &limitBreaking); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	materialIds := uniqueStrings(limitBreaking.MaterialIDs)
+	if len(materialIds) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "material_ids is error.")
+		return
+	}
+	for _, v := range materialIds {
+		if v == userCharacterId {
+			RespondWithError(w, http.StatusBadRequest, "material_ids is error.")
+			return
+		}
+	}
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		targets, err := getEnhancingCharacters(tx, userId, []string{userCharacterId})
+		if err != nil {
+			return err
+		}
+		if len(targets) == 0 {
+			return newAPIError(http.StatusNotFound, "character is not found.")
+		}
+		target := targets[0]
+		if target.LimitBreak+len(materialIds) > target.MaxLimitBreak {
+			return newAPIError(http.StatusBadRequest, "limit_break is max.")
+		}
+		materials, err := getEnhancingCharacters(tx, userId, materialIds)
+		if err != nil {
+			return err
+		}
+		if len(materials) != len(materialIds) {
+			return newAPIError(http.StatusBadRequest, "material_ids is error.")
+		}
+		for _, v := range materials {
+			if v.CharacterID != target.CharacterID {
+				return newAPIError(http.StatusBadRequest, v.CharacterName+" is not the same character.")
+			}
+			if v.Locked {
+				return newAPIError(http.StatusBadRequest, v.CharacterName+" is locked.")
+			}
+		}
+		if err := checkNotInTeam(tx, userId, materialIds); err != nil {
+			return err
+		}
+		// DELETE FROM `user_characters` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_character_id IN ('ff1583af-...')
+		if err := tx.Where("user_id = ? AND user_character_id IN ?", userId, materialIds).Delete(&UserCharacter{}).Error; err != nil {
+			return err
+		}
+		after := target
+		after.LimitBreak += len(materialIds)
+		// UPDATE `user_characters` SET `limit_break`=1 WHERE user_character_id = '02091c4d-1011-4615-8fbb-fd9e681153d4'
+		err = tx.Model(&UserCharacter{}).Where("user_character_id = ?", userCharacterId).
+			Update("limit_break", after.LimitBreak).Error
+		if err != nil {
+			return err
+		}
+		if err := refreshCharacterSortKeys(tx, "user_characters.user_character_id = ?", userCharacterId); err != nil {
+			return err
+		}
+		_, err = saveCharacterHistory(tx, userId, characterActionLimitBreak, target, after, materialIds, 0, GmtokenTransfer{})
+		return err
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	row, err := c.getUserCharacterDetail(userId, userCharacterId)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &LimitBreakResponse{
+		Consumed:  len(materialIds),
+		Character: row.response(),
+	})
+	//	{"consumed":1,
+	//	"character":{"userCharacterID":"02091c4d-...","name":"Mercury",...,"hp":2600,"level":80,"maxLevel":85,"limitBreak":1,"maxLimitBreak":4,...}}
+	//	が返る
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http"
+	"gorm.io/gorm"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// 1回でロックやお気に入りを切り替えられるキャラクターの最大の数
+const maxFlagCharacters = 1000
+
+// UserCharacterIDs: ロックを切り替えるキャラクターのuser_character_id
+// Locked: trueならロックし、falseなら解除する
+type LockingCharacters struct {
+	UserCharacterIDs []string `json:"user_character_ids"`
+	Locked           bool     `json:"locked"`
+}
+
+// UserCharacterIDs: お気に入りを切り替えるキャラクターのuser_character_id
+// Favorite: trueならお気に入りにし、falseなら外す
+type FavoritingCharacters struct {
+	UserCharacterIDs []string `json:"user_character_ids"`
+	Favorite         bool     `json:"favorite"`
+}
+
+// lockCharacters関数、favoriteCharacters関数で返される
+// Updatedは切り替えたキャラクターの数
+type CharacterFlagsResponse struct {
+	Updated int `json:"updated"`
+}
+
+// localhost:8080/character/lockでキャラクターのロックをまとめて切り替える
+// ロックしたキャラクターは売却や強化、限界突破の素材、重複の変換に使えなくなる(チームに入れたキャラクターも同じ)
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"user_character_ids":["eaaada0c-...","ff1583af-..."], "locked":true}で切り替えるキャラクターとロックするかどうかを受け取る
+func (c *Config) LockCharacters(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var locking LockingCharacters
+	if err := readRequestBody(r, &locking); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	updated, err := c.updateCharacterFlag(userId, locking.UserCharacterIDs, "locked", locking.Locked)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &CharacterFlagsResponse{
+		Updated: updated,
+	})
+	// {"updated":2}が返る
+}
+
+// localhost:8080/character/favoriteでキャラクターのお気に入りをまとめて切り替える
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"user_character_ids":["eaaada0c-...","ff1583af-..."], "favorite":true}で切り替えるキャラクターとお気に入りにするかどうかを受け取る
+func (c *Config) FavoriteCharacters(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var favoriting FavoritingCharacters
+	if err := readRequestBody(r, &favoriting); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	updated, err := c.updateCharacterFlag(userId, favoriting.UserCharacterIDs, "favorite", favoriting.Favorite)
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &CharacterFlagsResponse{
+		Updated: updated,
+	})
+	// {"updated":2}が返る
+}
+
+// ユーザが持っているキャラクターのうちuser_character_idが引数userCharacterIdsのもののcolumnをvalueにする
+// 持っていないキャラクターが含まれるときは、どれも更新せずにエラーを返す
+func (c *Config) updateCharacterFlag(userId string, userCharacterIds []string, column string, value bool) (int, error) {
+	userCharacterIds = uniqueStrings(userCharacterIds)
+	if len(userCharacterIds) == 0 || len(userCharacterIds) > maxFlagCharacters {
+		return 0, newAPIError(http.StatusBadRequest, "user_character_ids is error.")
+	}
+	err := c.DB.Transaction(func(tx *gorm.DB) error {
+		// UPDATE `user_characters` SET `locked`=true WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_character_id IN ('eaaada0c-...','ff1583af-...')
+		result := tx.Model(&UserCharacter{}).Where("user_id = ? AND user_character_id IN ?", userId, userCharacterIds).Update(column, value)
+		if result.Error != nil {
+			return result.Error
+		}
+		// 既に同じ値のキャラクターは更新した行数に含まれないので、持っているかは数え直して確認する
+		if int(result.RowsAffected) == len(userCharacterIds) {
+			return nil
+		}
+		var count int64
+		// SELECT count(*) FROM `user_characters` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_character_id IN ('eaaada0c-...','ff1583af-...')
+		if err := tx.Model(&UserCharacter{}).Where("user_id = ? AND user_character_id IN ?", userId, userCharacterIds).Count(&count).Error; err != nil {
+			return err
+		}
+		if int(count) != len(userCharacterIds) {
+			return newAPIError(http.StatusBadRequest, "user_character_ids is error.")
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(userCharacterIds), nil
+}
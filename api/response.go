@@ -11,7 +11,23 @@ import (
 type ErrorResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
-	Status  string   `json:"status"`
+	Status  string `json:"status"`
+}
+
+// ステータスコード付きのエラー
+// ハンドラ以外の関数から、クライアントに返すステータスコードを指定するときに使う
+type apiError struct {
+	Code    int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// ステータスコードcodeとメッセージmessageのエラーを作成
+func newAPIError(code int, message string) error {
+	return &apiError{Code: code, Message: message}
 }
 
 // エラーレスポンスを返す
@@ -28,4 +44,14 @@ func RespondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.WriteHeader(code)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(jsonData)
+}
+
+// エラーの種類に応じたエラーレスポンスを返す
+// apiErrorならそのステータスコードを、それ以外なら500を返す
+func respondWithAPIError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*apiError); ok {
+		RespondWithError(w, e.Code, e.Message)
+		return
+	}
+	RespondWithError(w, http.StatusInternalServerError, err.Error())
 }
\ No newline at end of file
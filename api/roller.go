@@ -0,0 +1,70 @@
+package api
+
+import (
+	"math/rand"
+)
+
+// ガチャなどの抽選に使う乱数生成器
+// 実装はどれもゴルーチン間で共有せず、リクエストごとに作成して使う
+type Roller interface {
+	// 0以上n未満の一様な乱数を返す(nは1以上)
+	Intn(n int) int
+}
+
+// 64ビットの乱数を返す乱数源
+type uint64Source interface {
+	Uint64() uint64
+}
+
+// シード値から決まった乱数列を返すRoller
+// テストやシミュレーションで結果を再現するために使う
+type seededRoller struct {
+	rand *rand.Rand
+}
+
+// シード値seedから決まった乱数列を返すRollerを作成
+func NewSeededRoller(seed int64) Roller {
+	return &seededRoller{rand: rand.New(rand.NewSource(seed))}
+}
+
+// 64ビットの乱数を返す
+func (r *seededRoller) Uint64() uint64 {
+	return r.rand.Uint64()
+}
+
+// 0以上n未満の一様な乱数を返す
+func (r *seededRoller) Intn(n int) int {
+	return uniformIntn(r, n)
+}
+
+// HMAC-SHA256(サーバーシード, "クライアントシード:ナンス:ラウンド")を乱数源とするRoller
+// 本番のガチャの抽選に使い、サーバーシード公開後に同じ抽選を再現できる
+type hmacRoller struct {
+	source *hmacSource
+}
+
+// サーバーシード、クライアントシード、ナンスからRollerを作成
+func newHmacRoller(serverSeed string, clientSeed string, nonce int) Roller {
+	return &hmacRoller{source: newHmacSource(serverSeed, clientSeed, nonce)}
+}
+
+// 0以上n未満の一様な乱数を返す
+func (r *hmacRoller) Intn(n int) int {
+	return uniformIntn(r.source, n)
+}
+
+// 乱数源srcから0以上n未満の一様な乱数を作る
+// 2^64がnで割り切れない分の偏りが出ないように、端数にあたる乱数は捨ててやり直す
+func uniformIntn(src uint64Source, n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+	bound := uint64(n)
+	threshold := -bound % bound
+	for {
+		v := src.Uint64()
+		if v >= threshold {
+			return int(v % bound)
+		}
+	}
+}
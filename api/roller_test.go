@@ -0,0 +1,80 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+// 決まった値を順に返す乱数源
+type fixedSource struct {
+	values []uint64
+}
+
+func (s *fixedSource) Uint64() uint64 {
+	v := s.values[0]
+	s.values = s.values[1:]
+	return v
+}
+
+func TestSeededRollerReproducible(t *testing.T) {
+	a, b := NewSeededRoller(7), NewSeededRoller(7)
+	for i := 0; i < 1000; i++ {
+		if x, y := a.Intn(1000), b.Intn(1000); x != y {
+			t.Fatalf("roll %d: %d != %d", i, x, y)
+		}
+	}
+}
+
+func TestSeededRollerUniform(t *testing.T) {
+	const n, rolls = 10, 100000
+	roller := NewSeededRoller(8)
+	counts := make([]float64, n)
+	for i := 0; i < rolls; i++ {
+		v := roller.Intn(n)
+		if v < 0 || v >= n {
+			t.Fatalf("Intn(%d) = %d", n, v)
+		}
+		counts[v] += 1
+	}
+	expected := make([]float64, n)
+	for i := range expected {
+		expected[i] = rolls / n
+	}
+	x := chiSquared(counts, expected)
+	if p := chiSquaredPValue(x, n-1); p < gachaAuditAlpha {
+		t.Errorf("rolls are not uniform: chi2=%.2f p=%.3g counts=%v", x, p, counts)
+	}
+}
+
+func TestUniformIntnRejectsBiasedValues(t *testing.T) {
+	// 2^64を3で割った余りは1なので、0は捨てて次の値を使う
+	src := &fixedSource{values: []uint64{0, 5}}
+	if v := uniformIntn(src, 3); v != 2 {
+		t.Errorf("uniformIntn = %d, want 2", v)
+	}
+	if len(src.values) != 0 {
+		t.Errorf("biased value was not rejected")
+	}
+}
+
+func TestHmacRollerMatchesHmac(t *testing.T) {
+	roller := newHmacRoller("server", "client", 3)
+	mac := hmac.New(sha256.New, []byte("server"))
+	mac.Write([]byte("client:3:0"))
+	sum := mac.Sum(nil)
+	// 1ラウンドのHMACから64ビットの乱数が4つ取れる
+	for i := 0; i < 4; i++ {
+		want := int(binary.BigEndian.Uint64(sum[i*8:]) % 1000)
+		if got := roller.Intn(1000); got != want {
+			t.Fatalf("roll %d = %d, want %d", i, got, want)
+		}
+	}
+	mac.Reset()
+	mac.Write([]byte("client:3:1"))
+	sum = mac.Sum(nil)
+	if got, want := roller.Intn(1000), int(binary.BigEndian.Uint64(sum)%1000); got != want {
+		t.Errorf("first roll of round 1 = %d, want %d", got, want)
+	}
+}
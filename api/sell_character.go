@@ -0,0 +1,177 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// 1回で売却できるキャラクターの最大の数
+const maxSellCharacters = 1000
+
+// UserCharacterIDs: 売却するキャラクターのuser_character_id
+type SellingCharacters struct {
+	UserCharacterIDs []string `json:"user_character_ids"`
+}
+
+// sellCharacters関数で返される、売却したキャラクター1体分
+type SoldCharacterResponse struct {
+	UserCharacterID string `json:"userCharacterID"`
+	Name            string `json:"name"`
+	Level           int    `json:"level"`
+	Price           int    `json:"price"`
+}
+
+// sellCharacters関数で返される
+// Gmtokenは受け取ったゲームトークンの合計、MintTxHashはその鋳造のトランザクションのハッシュ
+type SellResponse struct {
+	Sold       int                     `json:"sold"`
+	Gmtoken    int                     `json:"gmtoken"`
+	MintTxHash string                  `json:"mintTxHash,omitempty"`
+	Characters []SoldCharacterResponse `json:"characters"`
+}
+
+// 売却するキャラクターとして読み込む、売値の設定付きのユーザのキャラクター
+// gormは埋め込んだ非公開の構造体のカラムを読み込まないので、enhancingCharacterと同じカラムを並べる
+type sellingCharacter struct {
+	UserCharacterID   string
+	CharacterID       int
+	CharacterName     string
+	Level             int
+	Exp               int
+	LimitBreak        int
+	Locked            bool
+	SellPrice         int
+	SellPricePerLevel int
+}
+
+// localhost:8080/character/sellでキャラクターを売却し、ゲームトークンを受け取る
+// 売値はレアリティの売値に、レベルが1上がるごとにレアリティのsell_price_per_levelを足したもの
+// ロックされたキャラクターとチームに入っているキャラクターは売却できない
+// キャラクターの削除、記録と鋳造の予定の保存は1つのトランザクションで行い、ゲームトークンはコミットしてから鋳造する
+// 鋳造に失敗したときは後で鋳造し直す(MintTxHashは含まれない)
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"user_character_ids":["eaaada0c-...","ff1583af-..."]}で売却するキャラクターを受け取る
+func (c *Config) SellCharacters(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var selling SellingCharacters
+	if err := readRequestBody(r, &selling); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	userCharacterIds := uniqueStrings(selling.UserCharacterIDs)
+	if len(userCharacterIds) == 0 || len(userCharacterIds) > maxSellCharacters {
+		RespondWithError(w, http.StatusBadRequest, "user_character_ids is error.")
+		return
+	}
+	response := SellResponse{Sold: len(userCharacterIds)}
+	var transfer GmtokenTransfer
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		characters, err := getSellingCharacters(tx, userId, userCharacterIds)
+		if err != nil {
+			return err
+		}
+		if len(characters) != len(userCharacterIds) {
+			return newAPIError(http.StatusBadRequest, "user_character_ids is error.")
+		}
+		response.Characters = make([]SoldCharacterResponse, 0, len(characters))
+		for _, v := range characters {
+			if v.Locked {
+				return newAPIError(http.StatusBadRequest, v.CharacterName+" is locked.")
+			}
+			price := v.price()
+			response.Gmtoken += price
+			response.Characters = append(response.Characters, SoldCharacterResponse{
+				UserCharacterID: v.UserCharacterID,
+				Name:            v.CharacterName,
+				Level:           v.Level,
+				Price:           price,
+			})
+		}
+		if err := checkNotInTeam(tx, userId, userCharacterIds); err != nil {
+			return err
+		}
+		// DELETE FROM `user_characters` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_character_id IN ('eaaada0c-...','ff1583af-...')
+		if err := tx.Where("user_id = ? AND user_character_id IN ?", userId, userCharacterIds).Delete(&UserCharacter{}).Error; err != nil {
+			return err
+		}
+		// 鋳造はコミットしてから行うので、トランザクションが取り消されたのに鋳造だけが済むことはない
+		if response.Gmtoken > 0 {
+			transfer, err = createGmtokenTransfer(tx, userId, gmtokenMint, response.Gmtoken, gmtokenReasonSell, "")
+			if err != nil {
+				return err
+			}
+		}
+		for _, v := range characters {
+			if _, err := saveCharacterHistory(tx, userId, characterActionSell, v.enhancing(), v.enhancing(), nil, v.price(), transfer); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	if transfer.TransferID != "" {
+		response.MintTxHash, err = c.sendGmtokenTransfer(transfer.TransferID)
+		if err != nil {
+			log.Println("gmtoken transfer", transfer.TransferID, "will be retried:", err)
+		}
+	}
+	RespondWithJSON(w, http.StatusOK, &response)
+	//	{"sold":2,"gmtoken":13,"mintTxHash":"0x5a7e...","characters":[
+	//		{"userCharacterID":"eaaada0c-...","name":"Mars","level":1,"price":1},
+	//		{"userCharacterID":"ff1583af-...","name":"Venus","level":5,"price":12}
+	//	]}
+	//	が返る
+}
+
+// トランザクションtxの中で、ユーザが持っているキャラクターのうちuser_character_idが引数userCharacterIdsのものを、売値の設定付きで取得
+// 他のリクエストが同時に強化や売却をしないように、行をロックする
+func getSellingCharacters(tx *gorm.DB, userId string, userCharacterIds []string) ([]sellingCharacter, error) {
+	var characters []sellingCharacter
+	//	SELECT user_characters.user_character_id, gacha_characters.character_id, characters.character_name, user_characters.level, user_characters.exp, user_characters.limit_break, user_characters.locked,
+	//	rarities.sell_price, rarities.sell_price_per_level
+	//	FROM `user_characters`
+	//	join gacha_characters
+	//	on user_characters.gacha_character_id = gacha_characters.gacha_character_id
+	//	join characters
+	//	on gacha_characters.character_id = characters.id
+	//	join rarities
+	//	on gacha_characters.rarity_id = rarities.id
+	//	WHERE user_characters.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_characters.user_character_id IN ('eaaada0c-...','ff1583af-...')
+	//	FOR UPDATE
+	err := tx.Table("user_characters").
+		Select("user_characters.user_character_id, gacha_characters.character_id, characters.character_name, user_characters.level, user_characters.exp, user_characters.limit_break, user_characters.locked, rarities.sell_price, rarities.sell_price_per_level").
+		Joins("join gacha_characters on user_characters.gacha_character_id = gacha_characters.gacha_character_id").
+		Joins("join characters on gacha_characters.character_id = characters.id").
+		Joins("join rarities on gacha_characters.rarity_id = rarities.id").
+		Where("user_characters.user_id = ? AND user_characters.user_character_id IN ?", userId, userCharacterIds).
+		Clauses(clause.Locking{Strength: "UPDATE"}).Scan(&characters).Error
+	return characters, err
+}
+
+// 記録の保存に使う、レベルと限界突破の段階だけのキャラクター
+func (character sellingCharacter) enhancing() enhancingCharacter {
+	return enhancingCharacter{
+		UserCharacterID: character.UserCharacterID,
+		CharacterID:     character.CharacterID,
+		CharacterName:   character.CharacterName,
+		Level:           character.Level,
+		Exp:             character.Exp,
+		LimitBreak:      character.LimitBreak,
+		Locked:          character.Locked,
+	}
+}
+
+// キャラクターの売値
+func (character sellingCharacter) price() int {
+	return character.SellPrice + (character.Level-1)*character.SellPricePerLevel
+}
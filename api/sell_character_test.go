@@ -0,0 +1,25 @@
+package api
+
+import "testing"
+
+func TestSellingCharacterPrice(t *testing.T) {
+	tests := []struct {
+		name          string
+		level         int
+		sellPrice     int
+		pricePerLevel int
+		want          int
+	}{
+		{"level 1", 1, 100, 10, 100},
+		{"level 2", 2, 100, 10, 110},
+		{"level 50", 50, 100, 10, 590},
+		{"no level bonus", 50, 100, 0, 100},
+		{"not sellable", 1, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		character := sellingCharacter{Level: tt.level, SellPrice: tt.sellPrice, SellPricePerLevel: tt.pricePerLevel}
+		if got := character.price(); got != tt.want {
+			t.Errorf("%s: price() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// ユーザが保存できるチームの数
+const maxTeams = 5
+
+// 1つのチームに入れられるキャラクターの最大の数
+const maxTeamMembers = 5
+
+// チームの名前の最大の長さ
+const maxTeamNameLength = 32
+
+// チームが全ての枠を埋めているときのチーム戦力のボーナス(%)
+const fullTeamBonus = 10
+
+// 同じレアリティのキャラクターが2体目から1体増えるごとのチーム戦力のボーナス(%)
+const rarityTeamBonus = 5
+
+// ユーザのチーム
+// TeamNo: 1からmaxTeamsまでのチームの番号
+type Team struct {
+	UserID    string    `json:"user_id" gorm:"primaryKey"`
+	TeamNo    int       `json:"team_no" gorm:"primaryKey"`
+	TeamName  string    `json:"team_name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// チームの枠に入れたキャラクター
+// Slot: 1からmaxTeamMembersまでの枠の番号
+type TeamMember struct {
+	UserID          string `json:"user_id" gorm:"primaryKey"`
+	TeamNo          int    `json:"team_no" gorm:"primaryKey"`
+	Slot            int    `json:"slot" gorm:"primaryKey"`
+	UserCharacterID string `json:"user_character_id"`
+}
+
+// チームを保存するときに受け取る
+type SavingTeam struct {
+	TeamNo   int                `json:"team_no"`
+	TeamName string             `json:"team_name"`
+	Members  []SavingTeamMember `json:"members"`
+}
+
+// チームの枠と、そこに入れるキャラクターのuser_character_id
+type SavingTeamMember struct {
+	Slot            int    `json:"slot"`
+	UserCharacterID string `json:"user_character_id"`
+}
+
+// getTeams関数で返される、チームの枠に入れたキャラクター
+// CharacterIDはgacha_character_id、HPはレベルと限界突破に応じて上がった後のHP
+type TeamMemberResponse struct {
+	Slot            int    `json:"slot"`
+	UserCharacterID string `json:"userCharacterID"`
+	CharacterID     string `json:"characterID"`
+	Name            string `json:"name"`
+	RarityID        int    `json:"rarityID"`
+	RarityName      string `json:"rarityName"`
+	Level           int    `json:"level"`
+	LimitBreak      int    `json:"limitBreak"`
+	HP              int    `json:"hp"`
+}
+
+// getTeams関数で返される、1つのチーム
+// PowerはキャラクターのHPの合計にボーナスを足したチーム戦力
+type TeamResponse struct {
+	TeamNo   int                  `json:"teamNo"`
+	TeamName string               `json:"teamName"`
+	Power    int                  `json:"power"`
+	Members  []TeamMemberResponse `json:"members"`
+}
+
+// getTeams関数で返される
+type TeamsResponse struct {
+	Teams []TeamResponse `json:"teams"`
+}
+
+// チームの枠の1行分として読み込む、キャラクターの情報付きのチームのキャラクター
+type teamMemberRow struct {
+	TeamNo           int
+	Slot             int
+	UserCharacterID  string
+	GachaCharacterID string
+	CharacterName    string
+	RarityID         int
+	RarityName       string
+	Level            int
+	LimitBreak       int
+	HP               int `gorm:"column:HP"`
+}
+
+// localhost:8080/team?team_no=nでユーザのチームとチーム戦力を取得
+// team_noを省略すると全てのチームを返す
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+func (c *Config) GetTeams(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	teamNo := 0
+	if v := r.URL.Query().Get("team_no"); v != "" {
+		teamNo, err = strconv.Atoi(v)
+		if err != nil || teamNo <= 0 || teamNo > maxTeams {
+			RespondWithError(w, http.StatusBadRequest, "team_no is error.")
+			return
+		}
+	}
+	teams, err := c.getTeams(userId, teamNo)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &TeamsResponse{
+		Teams: teams,
+	})
+	//	{"teams":[
+	//		{"teamNo":1,"teamName":"Main","power":9350,"members":[
+	//			{"slot":1,"userCharacterID":"02091c4d-...","characterID":"c115174c-...","name":"Mercury","rarityID":1,"rarityName":"SR","level":5,"limitBreak":0,"hp":2120},
+	//			...
+	//		]},
+	//		...
+	//	]}
+	//	が返る
+}
+
+// localhost:8080/teamでユーザのチームを保存
+// 同じ番号のチームがあれば、名前と枠のキャラクターを全て置き換える
+// ユーザが持っているキャラクターだけを入れられ、同じキャラクター(charactersテーブルのidが同じもの)は1つのチームに1体まで
+// チームに入れたキャラクターは売却や強化、限界突破の素材、重複の変換に使えなくなる
+// -H "x-token:yyy"でトークン情報を受け取り、認証
+// -d {"team_no":1, "team_name":"Main", "members":[{"slot":1, "user_character_id":"02091c4d-..."}, ...]}でチームの情報を受け取る
+func (c *Config) SaveTeam(w http.ResponseWriter, r *http.Request) {
+	userId, err := c.getUserId(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var saving SavingTeam
+	if err := readRequestBody(r, &saving); err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	userCharacterIds, err := saving.validate()
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		// 他のリクエストが同時に売却などで消さないように、入れるキャラクターの行をロックする
+		characters, err := getEnhancingCharacters(tx, userId, userCharacterIds)
+		if err != nil {
+			return err
+		}
+		if len(characters) != len(userCharacterIds) {
+			return newAPIError(http.StatusBadRequest, "user_character_id is error.")
+		}
+		seen := make(map[int]bool, len(characters))
+		for _, v := range characters {
+			if seen[v.CharacterID] {
+				return newAPIError(http.StatusBadRequest, v.CharacterName+" is already in the team.")
+			}
+			seen[v.CharacterID] = true
+		}
+		now := time.Now()
+		team := Team{UserID: userId, TeamNo: saving.TeamNo, TeamName: saving.TeamName, CreatedAt: now, UpdatedAt: now}
+		//	INSERT INTO `teams` (`user_id`,`team_no`,`team_name`,`created_at`,`updated_at`) VALUES ('95daec2b-...',1,'Main','2021-09-10 12:00:00','2021-09-10 12:00:00')
+		//	ON DUPLICATE KEY UPDATE `team_name`=VALUES(`team_name`),`updated_at`=VALUES(`updated_at`)
+		err = tx.Clauses(clause.OnConflict{DoUpdates: clause.AssignmentColumns([]string{"team_name", "updated_at"})}).Create(&team).Error
+		if err != nil {
+			return err
+		}
+		// DELETE FROM `team_members` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND team_no = 1
+		if err := tx.Where("user_id = ? AND team_no = ?", userId, saving.TeamNo).Delete(&TeamMember{}).Error; err != nil {
+			return err
+		}
+		members := make([]TeamMember, 0, len(saving.Members))
+		for _, v := range saving.Members {
+			members = append(members, TeamMember{UserID: userId, TeamNo: saving.TeamNo, Slot: v.Slot, UserCharacterID: v.UserCharacterID})
+		}
+		// INSERT INTO `team_members` (`user_id`,`team_no`,`slot`,`user_character_id`) VALUES ('95daec2b-...',1,1,'02091c4d-...'), ...
+		return tx.Create(&members).Error
+	})
+	if err != nil {
+		respondWithAPIError(w, err)
+		return
+	}
+	teams, err := c.getTeams(userId, saving.TeamNo)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, &TeamsResponse{
+		Teams: teams,
+	})
+	//	{"teams":[{"teamNo":1,"teamName":"Main","power":9350,"members":[...]}]}
+	//	が返る
+}
+
+// チームの番号が1以上maxTeams以下で、キャラクターが1体以上maxTeamMembers以下、枠とキャラクターが重複していないことを確認する
+// 名前を省略したときは"Team n"にする
+// 入れるキャラクターのuser_character_idを返す
+func (saving *SavingTeam) validate() ([]string, error) {
+	if saving.TeamNo <= 0 || saving.TeamNo > maxTeams {
+		return nil, newAPIError(http.StatusBadRequest, "team_no is error.")
+	}
+	if saving.TeamName == "" {
+		saving.TeamName = "Team " + strconv.Itoa(saving.TeamNo)
+	}
+	if len([]rune(saving.TeamName)) > maxTeamNameLength {
+		return nil, newAPIError(http.StatusBadRequest, "team_name is error.")
+	}
+	if len(saving.Members) == 0 || len(saving.Members) > maxTeamMembers {
+		return nil, newAPIError(http.StatusBadRequest, "members is error.")
+	}
+	slots := make(map[int]bool, len(saving.Members))
+	userCharacterIds := make([]string, 0, len(saving.Members))
+	for _, v := range saving.Members {
+		if v.Slot <= 0 || v.Slot > maxTeamMembers || slots[v.Slot] {
+			return nil, newAPIError(http.StatusBadRequest, "slot is error.")
+		}
+		slots[v.Slot] = true
+		userCharacterIds = append(userCharacterIds, v.UserCharacterID)
+	}
+	if len(uniqueStrings(userCharacterIds)) != len(userCharacterIds) {
+		return nil, newAPIError(http.StatusBadRequest, "user_character_id is error.")
+	}
+	return userCharacterIds, nil
+}
+
+// dbからユーザのチームを枠のキャラクターとチーム戦力付きで取得
+// teamNoが0なら全てのチームを返す
+func (c *Config) getTeams(userId string, teamNo int) ([]TeamResponse, error) {
+	var teams []Team
+	query := c.DB.Where("user_id = ?", userId)
+	if teamNo != 0 {
+		query = query.Where("team_no = ?", teamNo)
+	}
+	// SELECT * FROM `teams` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' ORDER BY team_no
+	if err := query.Order("team_no").Find(&teams).Error; err != nil {
+		return nil, err
+	}
+	rows, err := c.getTeamMemberRows(userId, teamNo)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[int][]TeamMemberResponse, len(teams))
+	for _, v := range rows {
+		members[v.TeamNo] = append(members[v.TeamNo], v.response())
+	}
+	responses := make([]TeamResponse, 0, len(teams))
+	for _, v := range teams {
+		teamMembers := members[v.TeamNo]
+		if teamMembers == nil {
+			teamMembers = make([]TeamMemberResponse, 0)
+		}
+		responses = append(responses, TeamResponse{
+			TeamNo:   v.TeamNo,
+			TeamName: v.TeamName,
+			Power:    teamPower(teamMembers),
+			Members:  teamMembers,
+		})
+	}
+	return responses, nil
+}
+
+// dbからユーザのチームの枠に入れたキャラクターを、キャラクターの情報付きでチームと枠の順に取得
+// teamNoが0なら全てのチームのキャラクターを返す
+func (c *Config) getTeamMemberRows(userId string, teamNo int) ([]teamMemberRow, error) {
+	var rows []teamMemberRow
+	//	SELECT team_members.team_no, team_members.slot, team_members.user_character_id, user_characters.gacha_character_id, characters.character_name, gacha_characters.rarity_id, rarities.rarity_name,
+	//	user_characters.level, user_characters.limit_break, gacha_characters.HP + (user_characters.level - 1) * rarities.hp_per_level + user_characters.limit_break * rarities.limit_break_hp AS HP
+	//	FROM `team_members`
+	//	join user_characters
+	//	on team_members.user_character_id = user_characters.user_character_id
+	//	join gacha_characters
+	//	on user_characters.gacha_character_id = gacha_characters.gacha_character_id
+	//	join characters
+	//	on gacha_characters.character_id = characters.id
+	//	join rarities
+	//	on gacha_characters.rarity_id = rarities.id
+	//	WHERE team_members.user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND team_members.team_no = 1
+	//	ORDER BY team_members.team_no, team_members.slot
+	query := c.DB.Table("team_members").
+		Select("team_members.team_no, team_members.slot, team_members.user_character_id, user_characters.gacha_character_id, characters.character_name, gacha_characters.rarity_id, rarities.rarity_name, user_characters.level, user_characters.limit_break, "+userCharacterHP+" AS HP").
+		Joins("join user_characters on team_members.user_character_id = user_characters.user_character_id").
+		Joins("join gacha_characters on user_characters.gacha_character_id = gacha_characters.gacha_character_id").
+		Joins("join characters on gacha_characters.character_id = characters.id").
+		Joins("join rarities on gacha_characters.rarity_id = rarities.id").
+		Where("team_members.user_id = ?", userId)
+	if teamNo != 0 {
+		query = query.Where("team_members.team_no = ?", teamNo)
+	}
+	err := query.Order("team_members.team_no, team_members.slot").Scan(&rows).Error
+	return rows, err
+}
+
+// チーム戦力を計算する
+// キャラクターのHPの合計に、全ての枠が埋まっていればfullTeamBonus、
+// 同じレアリティのキャラクターが2体目から1体増えるごとにrarityTeamBonusの割合を足す
+func teamPower(members []TeamMemberResponse) int {
+	hp := 0
+	rarities := make(map[int]int)
+	for _, v := range members {
+		hp += v.HP
+		rarities[v.RarityID] += 1
+	}
+	bonus := 0
+	if len(members) == maxTeamMembers {
+		bonus += fullTeamBonus
+	}
+	for _, count := range rarities {
+		bonus += (count - 1) * rarityTeamBonus
+	}
+	return hp * (100 + bonus) / 100
+}
+
+// トランザクションtxの中で、引数userCharacterIdsのキャラクターがユーザのどのチームにも入っていないことを確認する
+// 売却や素材などでキャラクターを消す前に呼ぶ
+func checkNotInTeam(tx *gorm.DB, userId string, userCharacterIds []string) error {
+	var members []TeamMember
+	// SELECT * FROM `team_members` WHERE user_id = '95daec2b-287c-4358-ba6f-5c29e1c3cbdf' AND user_character_id IN ('eaaada0c-...','ff1583af-...') LIMIT 1
+	err := tx.Where("user_id = ? AND user_character_id IN ?", userId, userCharacterIds).Limit(1).Find(&members).Error
+	if err != nil {
+		return err
+	}
+	if len(members) != 0 {
+		return newAPIError(http.StatusBadRequest, members[0].UserCharacterID+" is in team "+strconv.Itoa(members[0].TeamNo)+".")
+	}
+	return nil
+}
+
+// チームの枠のキャラクターをレスポンスの形に変換
+func (row teamMemberRow) response() TeamMemberResponse {
+	return TeamMemberResponse{
+		Slot:            row.Slot,
+		UserCharacterID: row.UserCharacterID,
+		CharacterID:     row.GachaCharacterID,
+		Name:            row.CharacterName,
+		RarityID:        row.RarityID,
+		RarityName:      row.RarityName,
+		Level:           row.Level,
+		LimitBreak:      row.LimitBreak,
+		HP:              row.HP,
+	}
+}
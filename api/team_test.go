@@ -0,0 +1,84 @@
+package api
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// HPが100で、レアリティがrarityIdsの順のチームの枠のキャラクター
+func testTeamMembers(rarityIds ...int) []TeamMemberResponse {
+	members := make([]TeamMemberResponse, 0, len(rarityIds))
+	for i, rarityId := range rarityIds {
+		members = append(members, TeamMemberResponse{Slot: i + 1, RarityID: rarityId, HP: 100})
+	}
+	return members
+}
+
+func TestTeamPower(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []TeamMemberResponse
+		want    int
+	}{
+		{"one member", testTeamMembers(1), 100},
+		{"different rarities", testTeamMembers(1, 2), 200},
+		{"same rarity", testTeamMembers(1, 1), 200 * (100 + rarityTeamBonus) / 100},
+		{"full team", testTeamMembers(1, 2, 3, 4, 5), 500 * (100 + fullTeamBonus) / 100},
+		{"full team of one rarity", testTeamMembers(3, 3, 3, 3, 3), 500 * (100 + fullTeamBonus + 4*rarityTeamBonus) / 100},
+		{"full team of two rarities", testTeamMembers(1, 1, 1, 2, 2), 500 * (100 + fullTeamBonus + 3*rarityTeamBonus) / 100},
+	}
+	for _, tt := range tests {
+		if got := teamPower(tt.members); got != tt.want {
+			t.Errorf("%s: teamPower() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSavingTeamValidate(t *testing.T) {
+	members := func(slots ...int) []SavingTeamMember {
+		var saving []SavingTeamMember
+		for _, slot := range slots {
+			saving = append(saving, SavingTeamMember{Slot: slot, UserCharacterID: "c" + strconv.Itoa(slot)})
+		}
+		return saving
+	}
+	tests := []struct {
+		name   string
+		saving SavingTeam
+		ok     bool
+	}{
+		{"valid", SavingTeam{TeamNo: 1, Members: members(1, 2, 3)}, true},
+		{"full team", SavingTeam{TeamNo: maxTeams, Members: members(1, 2, 3, 4, 5)}, true},
+		{"team no zero", SavingTeam{TeamNo: 0, Members: members(1)}, false},
+		{"team no over max", SavingTeam{TeamNo: maxTeams + 1, Members: members(1)}, false},
+		{"long name", SavingTeam{TeamNo: 1, TeamName: strings.Repeat("a", maxTeamNameLength+1), Members: members(1)}, false},
+		{"no members", SavingTeam{TeamNo: 1}, false},
+		{"too many members", SavingTeam{TeamNo: 1, Members: append(members(1, 2, 3, 4, 5), SavingTeamMember{Slot: 6, UserCharacterID: "c6"})}, false},
+		{"slot zero", SavingTeam{TeamNo: 1, Members: members(0, 1)}, false},
+		{"slot over max", SavingTeam{TeamNo: 1, Members: members(1, maxTeamMembers+1)}, false},
+		{"duplicate slot", SavingTeam{TeamNo: 1, Members: []SavingTeamMember{{Slot: 1, UserCharacterID: "c1"}, {Slot: 1, UserCharacterID: "c2"}}}, false},
+		{"duplicate character", SavingTeam{TeamNo: 1, Members: []SavingTeamMember{{Slot: 1, UserCharacterID: "c1"}, {Slot: 2, UserCharacterID: "c1"}}}, false},
+	}
+	for _, tt := range tests {
+		if _, err := tt.saving.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestSavingTeamValidateDefaults(t *testing.T) {
+	saving := SavingTeam{TeamNo: 2, Members: []SavingTeamMember{{Slot: 2, UserCharacterID: "c2"}, {Slot: 1, UserCharacterID: "c1"}}}
+	userCharacterIds, err := saving.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 名前を省略したチームには番号から名前を付ける
+	if saving.TeamName != "Team 2" {
+		t.Errorf("team name = %q, want %q", saving.TeamName, "Team 2")
+	}
+	if want := []string{"c2", "c1"}; !reflect.DeepEqual(userCharacterIds, want) {
+		t.Errorf("user character ids = %v, want %v", userCharacterIds, want)
+	}
+}
@@ -3,16 +3,31 @@ package api
 import (
 	"context"
 	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"strconv"
+	"time"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"golang.org/x/crypto/sha3"
 )
 
+// 送信したトランザクションがブロックに取り込まれるのを待つ時間と、確かめる間隔
+const (
+	gmtokenTxWaitTimeout  = 30 * time.Second
+	gmtokenTxPollInterval = 500 * time.Millisecond
+)
+
+// 送信したトランザクションが、待っている間にブロックに取り込まれなかった
+// 後で取り込まれて成功することがあるので、送信し直してはいけない
+var errGmtokenTxUnconfirmed = errors.New("gmtoken transaction is not confirmed yet")
+
+// 送信したトランザクションがブロックに取り込まれたが失敗した(焼却では残高が足りなかったなど)
+var errGmtokenTxReverted = errors.New("gmtoken transaction was reverted")
+
 // 16進数の秘密鍵文字列をイーサリアムアドレスに変換
 func convertKeyToAddress(hexkey string) (common.Address, error) {
 	// 16進数の秘密鍵文字列を読み込む
@@ -34,43 +49,44 @@ func convertKeyToAddress(hexkey string) (common.Address, error) {
 // コントラクトから、引数valだけゲームトークンを鋳造する
 // 鋳造されたゲームトークンは、引数hexkeyの秘密鍵から生成されるアドレスに付与される
 // トランザクションの送信者は、minter_private_key.txtの秘密鍵から生成されるアドレスである
-func (c *Config) MintGmtoken(val int, hexkey string) error {
+// 送信したトランザクションのハッシュを返す
+func (c *Config) MintGmtoken(val int, hexkey string) (string, error) {
 	// 16進数の秘密鍵文字列をアドレスに変換
 	address, err := convertKeyToAddress(hexkey)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// トランザクションを送るアドレスの秘密鍵を読み込む
 	privateKeyBytes, err := ioutil.ReadFile(c.MinterPrivateKey)
 	if err != nil {
-		return err
+		return "", err
 	}
 	privateKey, err := crypto.HexToECDSA(string(privateKeyBytes))
 	if err != nil {
-		return err
+		return "", err
 	}
 	// 秘密鍵からアドレスを生成
 	fromAddress, err := convertKeyToAddress(string(privateKeyBytes))
 	if err != nil {
-		return err
+		return "", err
 	}
 	// ナンスを生成
 	nonce, err := c.Ethclient.PendingNonceAt(context.Background(), fromAddress)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// 転送するイーサの量を設定(ここでは0)
 	value := big.NewInt(0)
 	// ガス価格を設定（SuggestGasPriceで平均のガス価格を取得）
 	gasPrice, err := c.Ethclient.SuggestGasPrice(context.Background())
 	if err != nil {
-		return err
+		return "", err
 	}
 	// fmt.Println(gasPrice) // 20000000000
 	// GameTokenコントラクトのアドレスを読み込む
 	contractAddressBytes, err := ioutil.ReadFile(c.ContractAddress)
 	if err != nil {
-		return err
+		return "", err
 	}
 	contractAddress := common.HexToAddress(string(contractAddressBytes))
 	// スマートコントラクトのmint関数
@@ -100,7 +116,7 @@ func (c *Config) MintGmtoken(val int, hexkey string) error {
 			Data: data,
 		})
 		if err != nil {
-			return err
+			return "", err
 		}
 	*/
 	var gasLimit uint64 = 10000000
@@ -109,58 +125,59 @@ func (c *Config) MintGmtoken(val int, hexkey string) error {
 	// チェーンID(ネットワークID)を取得
 	chainID, err := c.Ethclient.NetworkID(context.Background())
 	if err != nil {
-		return err
+		return "", err
 	}
 	// fmt.Println(chainID) // 5777
 	// 送信者の秘密鍵を使用してトランザクションに署名
 	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), privateKey)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// fmt.Println(signedTx) // &{0xc00006e5a0 {13858186735851446500 49580235901 0xef4fa0} {<nil>} {<nil>} {<nil>}}
 	// トランザクションを送信
 	err = c.Ethclient.SendTransaction(context.Background(), signedTx)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// fmt.Printf("tx sent: %s", signedTx.Hash().Hex()) // tx sent: 0x8369c729025e98fd73e01c6e99724bb397bc58274b963b6eab75f1bd10dc39a1
-	return nil
+	return signedTx.Hash().Hex(), nil
 }
 
 // コントラクトから、引数valだけゲームトークンを焼却する
 // 引数hexkeyの秘密鍵から生成されるアドレスの持つゲームトークンを焼却する
 // トランザクションの送信者は、引数hexkeyの秘密鍵から生成されるアドレスである
-func (c *Config) BurnGmtoken(val int, hexkey string) error {
+// 送信したトランザクションのハッシュを返す
+func (c *Config) BurnGmtoken(val int, hexkey string) (string, error) {
 	// 16進数の秘密鍵文字列を読み込む
 	privateKey, err := crypto.HexToECDSA(hexkey)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// 16進数の秘密鍵文字列をアドレスに変換
 	address, err := convertKeyToAddress(hexkey)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// トランザクションを送るアドレス
 	fromAddress := address
 	// ナンスを生成
 	nonce, err := c.Ethclient.PendingNonceAt(context.Background(), fromAddress)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// 転送するイーサの量を設定(ここでは0)
 	value := big.NewInt(0)
 	// ガス価格を設定（SuggestGasPriceで平均のガス価格を取得）
 	gasPrice, err := c.Ethclient.SuggestGasPrice(context.Background())
 	if err != nil {
-		return err
+		return "", err
 	}
 	// fmt.Println(gasPrice) // 20000000000
 	// GameTokenコントラクトのアドレスを読み込む
 	contractAddressBytes, err := ioutil.ReadFile(c.ContractAddress)
 	if err != nil {
-		return err
+		return "", err
 	}
 	contractAddress := common.HexToAddress(string(contractAddressBytes))
 	// スマートコントラクトのburn関数
@@ -196,21 +213,44 @@ func (c *Config) BurnGmtoken(val int, hexkey string) error {
 	// チェーンID(ネットワークID)を取得
 	chainID, err := c.Ethclient.NetworkID(context.Background())
 	if err != nil {
-		return err
+		return "", err
 	}
 	// fmt.Println(chainID) // 5777
 	// 送信者の秘密鍵を使用してトランザクションに署名
 	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), privateKey)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// fmt.Println(signedTx) // &{0xc00012bf20 {13858187368593859236 638888717301 0xef4fa0} {<nil>} {<nil>} {<nil>}}
 	// トランザクションを送信
 	err = c.Ethclient.SendTransaction(context.Background(), signedTx)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// fmt.Printf("tx sent: %s", signedTx.Hash().Hex()) // tx sent: 0xf98c12a353eceacafe606397493d0d321628f1a70bb147697d1539a2a9ca9199
-	return nil
+	return signedTx.Hash().Hex(), nil
+}
+
+// ハッシュが引数txHashのトランザクションがブロックに取り込まれるまで待つ
+// 取り込まれて失敗していたら(残高が足りないなど)エラーを返す
+// gmtokenTxWaitTimeoutまでに取り込まれたか分からなければerrGmtokenTxUnconfirmedを返す
+func (c *Config) waitGmtokenTx(txHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gmtokenTxWaitTimeout)
+	defer cancel()
+	for {
+		// まだ取り込まれていなければethereum.NotFoundが返るので、取り込まれるまで繰り返す
+		receipt, err := c.Ethclient.TransactionReceipt(ctx, common.HexToHash(txHash))
+		if err == nil {
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				return fmt.Errorf("%w: %s", errGmtokenTxReverted, txHash)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s", errGmtokenTxUnconfirmed, txHash)
+		case <-time.After(gmtokenTxPollInterval):
+		}
+	}
 }
@@ -1,19 +1,26 @@
 package main
 
 import (
-	crand "crypto/rand"
 	"fmt"
 	"log"
-	"math"
-	"math/big"
-	"math/rand"
 	"net/http"
+	"os"
+	"time"
 	"github.com/gorilla/mux"
 	api "local.packages/api"
 	_ "github.com/go-sql-driver/mysql"
 )
 
 func main() {
+	// gacha-simサブコマンドならガチャのシミュレーションだけ実行して終了
+	// 例: go run . gacha-sim -file gacha_sim/gacha_a.yaml -runs 10000 -pulls 1000 -csv costs.csv
+	if len(os.Args) > 1 && os.Args[1] == "gacha-sim" {
+		if err := api.RunGachaSim(os.Args[2:], os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	// configインスタンスを作成
 	config := api.NewConfig()
 	// DBコネクションを閉じる
@@ -22,9 +29,12 @@ func main() {
 		fmt.Println(err)
 	}
 	defer db_sql.Close()
-	// 乱数のシード値を設定
-	seed, _ := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
-	rand.Seed(seed.Int64())
+	// 非同期ガチャジョブのワーカーを起動
+	config.StartDrawWorkers(4)
+	// コミットした後に送信できなかったゲームトークンの鋳造と焼却をやり直す
+	config.StartGmtokenTransfers()
+	// 毎日UTCの0時に前日分の排出率の監査を実行(起動時にも前日分が済んでいなければ実行)
+	config.StartGachaAudit(24 * time.Hour)
 	// サーバー起動
 	startServer(config)
 }
@@ -40,9 +50,67 @@ func startServer(config *api.Config) {
 	router.HandleFunc("/user/get", config.GetUser).Methods("GET")
 	router.HandleFunc("/user/update", config.UpdateUser).Methods("PUT")
 	// ガチャ関連API
+	router.HandleFunc("/gacha/list", config.GetGachaList).Methods("GET")
 	router.HandleFunc("/gacha/draw", config.DrawGacha).Methods("POST")
+	router.HandleFunc("/gacha/box", config.GetGachaBox).Methods("GET")
+	router.HandleFunc("/gacha/box/reset", config.ResetGachaBox).Methods("POST")
+	router.HandleFunc("/gacha/summary", config.GetGachaSummary).Methods("GET")
+	router.HandleFunc("/gacha/history", config.GetGachaHistory).Methods("GET")
+	router.HandleFunc("/gacha/history/{id}", config.GetGachaHistoryDraw).Methods("GET")
+	router.HandleFunc("/gacha/jobs/{id}", config.GetDrawJob).Methods("GET")
+	router.HandleFunc("/gacha/jobs/{id}/results", config.GetDrawJobResults).Methods("GET")
+	router.HandleFunc("/gacha/seed", config.GetGachaSeed).Methods("GET")
+	router.HandleFunc("/gacha/seed/rotate", config.RotateGachaSeed).Methods("POST")
+	router.HandleFunc("/gacha/verify", config.VerifyGacha).Methods("GET")
+	// ガチャチケット関連API
+	router.HandleFunc("/ticket/list", config.GetTicketList).Methods("GET")
+	router.HandleFunc("/ticket/purchase", config.PurchaseTicket).Methods("POST")
+	// 管理者用API
+	router.HandleFunc("/admin/ticket/grant", config.GrantTicket).Methods("POST")
+	router.HandleFunc("/admin/rarities", config.CreateRarity).Methods("POST")
+	router.HandleFunc("/admin/rarities/{id}", config.UpdateRarity).Methods("PUT")
+	router.HandleFunc("/admin/rarities/{id}", config.RetireRarity).Methods("DELETE")
+	router.HandleFunc("/admin/characters", config.CreateCharacter).Methods("POST")
+	router.HandleFunc("/admin/characters/{id}", config.UpdateCharacter).Methods("PUT")
+	router.HandleFunc("/admin/characters/{id}", config.RetireCharacter).Methods("DELETE")
+	router.HandleFunc("/admin/gachas", config.CreateGacha).Methods("POST")
+	router.HandleFunc("/admin/gachas/{id}", config.UpdateGacha).Methods("PUT")
+	router.HandleFunc("/admin/gachas/{id}", config.RetireGacha).Methods("DELETE")
+	router.HandleFunc("/admin/gacha_characters", config.CreateGachaCharacter).Methods("POST")
+	router.HandleFunc("/admin/gacha_characters/{id}", config.UpdateGachaCharacter).Methods("PUT")
+	router.HandleFunc("/admin/gacha_characters/{id}", config.RetireGachaCharacter).Methods("DELETE")
+	router.HandleFunc("/admin/catalog/versions", config.GetCatalogVersions).Methods("GET")
+	router.HandleFunc("/admin/catalog/rollback", config.RollbackCatalog).Methods("POST")
+	router.HandleFunc("/admin/gacha/audits", config.GetGachaAudits).Methods("GET")
+	router.HandleFunc("/admin/gacha/audits", config.RunGachaAudit).Methods("POST")
+	router.HandleFunc("/admin/arena/seasons", config.CreateArenaSeason).Methods("POST")
+	router.HandleFunc("/admin/arena/seasons/{id}/payout", config.PayArenaSeason).Methods("POST")
 	// キャラクター関連API
 	router.HandleFunc("/character/list", config.GetCharacterList).Methods("GET")
+	router.HandleFunc("/character/convert", config.ConvertCharacters).Methods("POST")
+	router.HandleFunc("/character/shards", config.GetCharacterShards).Methods("GET")
+	router.HandleFunc("/character/conversions", config.GetCharacterConversions).Methods("GET")
+	router.HandleFunc("/character/sell", config.SellCharacters).Methods("POST")
+	router.HandleFunc("/character/lock", config.LockCharacters).Methods("POST")
+	router.HandleFunc("/character/favorite", config.FavoriteCharacters).Methods("POST")
+	router.HandleFunc("/character/{id}", config.GetCharacter).Methods("GET")
+	router.HandleFunc("/character/{id}/enhance", config.EnhanceCharacter).Methods("POST")
+	router.HandleFunc("/character/{id}/limit_break", config.LimitBreakCharacter).Methods("POST")
+	router.HandleFunc("/character/{id}/histories", config.GetCharacterHistories).Methods("GET")
+	// チーム関連API
+	router.HandleFunc("/team", config.GetTeams).Methods("GET")
+	router.HandleFunc("/team", config.SaveTeam).Methods("PUT")
+	// 戦闘関連API
+	router.HandleFunc("/battle/stages", config.GetBattleStages).Methods("GET")
+	router.HandleFunc("/battle/start", config.StartBattle).Methods("POST")
+	router.HandleFunc("/battle/{id}", config.GetBattle).Methods("GET")
+	// アリーナ関連API
+	router.HandleFunc("/arena/defense", config.SetArenaDefense).Methods("PUT")
+	router.HandleFunc("/arena/opponents", config.GetArenaOpponents).Methods("GET")
+	router.HandleFunc("/arena/challenge", config.ChallengeArena).Methods("POST")
+	router.HandleFunc("/arena/matches", config.GetArenaMatches).Methods("GET")
+	// 監査の警告の回数などのメトリクス(管理者のみ)
+	router.HandleFunc("/debug/vars", config.GetDebugVars).Methods("GET")
 	// ポートを8080で指定してRouter起動
 	log.Fatal(http.ListenAndServe(":8080", router))
 }
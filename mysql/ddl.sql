@@ -6,7 +6,8 @@ DROP TABLE IF EXISTS `game_user`.`users`;
 CREATE TABLE IF NOT EXISTS `game_user`.`users`(
   `user_id` CHAR(36) PRIMARY KEY NOT NULL,
   `name` VARCHAR(32) NOT NULL,
-  `private_key` VARCHAR(64) NOT NULL
+  `private_key` VARCHAR(64) NOT NULL,
+  `role` VARCHAR(16) NOT NULL DEFAULT 'user'
 );
 
 DROP TABLE IF EXISTS `game_user`.`rarities`;
@@ -14,18 +15,33 @@ CREATE TABLE IF NOT EXISTS `game_user`.`rarities`(
   `id` INT PRIMARY KEY AUTO_INCREMENT NOT NULL,
   `rarity_name` VARCHAR(32) NOT NULL,
   `weight` INT NOT NULL,
-  `HPup` INT NOT NULL
+  `HPup` INT NOT NULL,
+  `grade` INT NOT NULL,
+  `duplicate_policy` VARCHAR(16) NOT NULL DEFAULT 'keep',
+  `duplicate_auto` BOOLEAN NOT NULL DEFAULT TRUE,
+  `duplicate_shards` INT NOT NULL DEFAULT 0,
+  `duplicate_refund` INT NOT NULL DEFAULT 0,
+  `max_level` INT NOT NULL DEFAULT 50,
+  `hp_per_level` INT NOT NULL DEFAULT 0,
+  `enhance_exp` INT NOT NULL DEFAULT 0,
+  `max_limit_break` INT NOT NULL DEFAULT 0,
+  `limit_break_levels` INT NOT NULL DEFAULT 0,
+  `limit_break_hp` INT NOT NULL DEFAULT 0,
+  `sell_price` INT NOT NULL DEFAULT 0,
+  `sell_price_per_level` INT NOT NULL DEFAULT 0,
+  `retired` BOOLEAN NOT NULL DEFAULT FALSE
 );
 
-INSERT INTO rarities(rarity_name, weight, HPup) VALUES ('SR', 1, 1000);
-INSERT INTO rarities(rarity_name, weight, HPup) VALUES ('R', 5, 500);
-INSERT INTO rarities(rarity_name, weight, HPup) VALUES ('N', 14, 0);
+INSERT INTO rarities(rarity_name, weight, HPup, grade, duplicate_policy, duplicate_shards, max_level, hp_per_level, enhance_exp, max_limit_break, limit_break_levels, limit_break_hp, sell_price, sell_price_per_level) VALUES ('SR', 1, 1000, 3, 'shards', 10, 80, 30, 300, 4, 5, 100, 5, 1);
+INSERT INTO rarities(rarity_name, weight, HPup, grade, duplicate_policy, duplicate_shards, max_level, hp_per_level, enhance_exp, max_limit_break, limit_break_levels, limit_break_hp, sell_price, sell_price_per_level) VALUES ('R', 5, 500, 2, 'shards', 2, 60, 20, 150, 4, 5, 50, 2, 1);
+INSERT INTO rarities(rarity_name, weight, HPup, grade, max_level, hp_per_level, enhance_exp, max_limit_break, limit_break_levels, limit_break_hp, sell_price, sell_price_per_level) VALUES ('N', 14, 0, 1, 40, 10, 100, 4, 5, 20, 1, 0);
 
 DROP TABLE IF EXISTS `game_user`.`characters`;
 CREATE TABLE IF NOT EXISTS `game_user`.`characters`(
   `id` INT PRIMARY KEY AUTO_INCREMENT NOT NULL,
   `character_name` VARCHAR(32) NOT NULL,
-  `HP` INT NOT NULL
+  `HP` INT NOT NULL,
+  `retired` BOOLEAN NOT NULL DEFAULT FALSE
 );
 
 INSERT INTO characters(character_name, HP) VALUES ("Mercury", 1000);
@@ -42,12 +58,51 @@ INSERT INTO characters(character_name, HP) VALUES ("Sun", 1000);
 DROP TABLE IF EXISTS `game_user`.`gachas`;
 CREATE TABLE IF NOT EXISTS `game_user`.`gachas`(
   `id` INT PRIMARY KEY AUTO_INCREMENT NOT NULL,
-  `gacha_name` VARCHAR(32) NOT NULL
+  `gacha_name` VARCHAR(32) NOT NULL,
+  `gacha_type` VARCHAR(16) NOT NULL DEFAULT 'normal',
+  `hard_pity` INT NOT NULL DEFAULT 0,
+  `soft_pity` INT NOT NULL DEFAULT 0,
+  `soft_pity_weight_up` INT NOT NULL DEFAULT 0,
+  `pity_rarity_id` INT NOT NULL DEFAULT 1,
+  `start_at` DATETIME NULL DEFAULT NULL,
+  `end_at` DATETIME NULL DEFAULT NULL,
+  `retired` BOOLEAN NOT NULL DEFAULT FALSE
 );
 
-INSERT INTO gachas(gacha_name) VALUES ("Gacha_A");
-INSERT INTO gachas(gacha_name) VALUES ("Gacha_B");
-INSERT INTO gachas(gacha_name) VALUES ("Gacha_C");
+INSERT INTO gachas(gacha_name, hard_pity, soft_pity, soft_pity_weight_up, pity_rarity_id) VALUES ("Gacha_A", 90, 74, 6, 1);
+INSERT INTO gachas(gacha_name, hard_pity, soft_pity, soft_pity_weight_up, pity_rarity_id) VALUES ("Gacha_B", 90, 74, 6, 1);
+INSERT INTO gachas(gacha_name, hard_pity, soft_pity, soft_pity_weight_up, pity_rarity_id) VALUES ("Gacha_C", 90, 74, 6, 1);
+INSERT INTO gachas(gacha_name, gacha_type) VALUES ("Box_A", "box");
+INSERT INTO gachas(gacha_name, gacha_type) VALUES ("StepUp_A", "stepup");
+
+DROP TABLE IF EXISTS `game_user`.`gacha_steps`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_steps`(
+  `gacha_id` INT NOT NULL,
+  `step` INT NOT NULL,
+  `price` INT NOT NULL,
+  `times` INT NOT NULL,
+  `guaranteed_rarity_id` INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`gacha_id`, `step`)
+);
+
+INSERT INTO gacha_steps(gacha_id, step, price, times) VALUES (5, 1, 5, 10);
+INSERT INTO gacha_steps(gacha_id, step, price, times) VALUES (5, 2, 8, 10);
+INSERT INTO gacha_steps(gacha_id, step, price, times) VALUES (5, 3, 10, 10);
+INSERT INTO gacha_steps(gacha_id, step, price, times) VALUES (5, 4, 10, 10);
+INSERT INTO gacha_steps(gacha_id, step, price, times, guaranteed_rarity_id) VALUES (5, 5, 10, 10, 1);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_guarantees`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_guarantees`(
+  `id` INT PRIMARY KEY AUTO_INCREMENT NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `every` INT NOT NULL,
+  `min_rarity_id` INT NOT NULL
+);
+
+INSERT INTO gacha_guarantees(gacha_id, every, min_rarity_id) VALUES (1, 10, 2);
+INSERT INTO gacha_guarantees(gacha_id, every, min_rarity_id) VALUES (2, 10, 2);
+INSERT INTO gacha_guarantees(gacha_id, every, min_rarity_id) VALUES (3, 10, 2);
+INSERT INTO gacha_guarantees(gacha_id, every, min_rarity_id) VALUES (5, 10, 2);
 
 DROP TABLE IF EXISTS `game_user`.`gacha_characters`;
 CREATE TABLE IF NOT EXISTS `game_user`.`gacha_characters`(
@@ -55,7 +110,11 @@ CREATE TABLE IF NOT EXISTS `game_user`.`gacha_characters`(
   `gacha_id` INT NOT NULL,
   `character_id` INT NOT NULL,
   `rarity_id` INT NOT NULL,
-  `HP` INT NOT NULL
+  `HP` INT NOT NULL,
+  `rate_up` INT NOT NULL DEFAULT 1,
+  `box_count` INT NOT NULL DEFAULT 0,
+  `is_prize` BOOLEAN NOT NULL DEFAULT FALSE,
+  `retired` BOOLEAN NOT NULL DEFAULT FALSE
 );
 
 INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP) VALUES (UUID(), 1, 1, 1, 0);
@@ -91,6 +150,20 @@ INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_
 INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP) VALUES (UUID(), 3, 9, 2, 0);
 INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP) VALUES (UUID(), 3, 10, 2, 0);
 
+INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP, box_count, is_prize) VALUES (UUID(), 4, 1, 1, 0, 1, TRUE);
+INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP, box_count) VALUES (UUID(), 4, 2, 2, 0, 5);
+INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP, box_count) VALUES (UUID(), 4, 3, 2, 0, 5);
+INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP, box_count) VALUES (UUID(), 4, 4, 3, 0, 20);
+INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP, box_count) VALUES (UUID(), 4, 5, 3, 0, 20);
+
+INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP) VALUES (UUID(), 5, 6, 1, 0);
+INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP) VALUES (UUID(), 5, 7, 2, 0);
+INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP) VALUES (UUID(), 5, 8, 2, 0);
+INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP) VALUES (UUID(), 5, 9, 3, 0);
+INSERT INTO gacha_characters(gacha_character_id, gacha_id, character_id, rarity_id, HP) VALUES (UUID(), 5, 10, 3, 0);
+
+UPDATE gacha_characters SET rate_up = 3 WHERE gacha_id = 1 AND character_id = 2;
+
 CREATE VIEW character_HP AS
 SELECT gacha_characters.gacha_character_id, rarities.HPup + characters.HP AS HP
 FROM gacha_characters
@@ -107,5 +180,397 @@ DROP TABLE IF EXISTS `game_user`.`user_characters`;
 CREATE TABLE IF NOT EXISTS `game_user`.`user_characters`(
   `user_character_id` CHAR(36) PRIMARY KEY NOT NULL,
   `user_id` VARCHAR(36) NOT NULL,
-  `gacha_character_id` VARCHAR(36) NOT NULL
-);
\ No newline at end of file
+  `gacha_character_id` VARCHAR(36) NOT NULL,
+  `gacha_draw_id` VARCHAR(36) NOT NULL DEFAULT '',
+  `level` INT NOT NULL DEFAULT 1,
+  `exp` INT NOT NULL DEFAULT 0,
+  `limit_break` INT NOT NULL DEFAULT 0,
+  `locked` BOOLEAN NOT NULL DEFAULT FALSE,
+  `favorite` BOOLEAN NOT NULL DEFAULT FALSE,
+  `sort_grade` INT NOT NULL DEFAULT 0,
+  `sort_hp` INT NOT NULL DEFAULT 0,
+  `sort_name` VARCHAR(32) NOT NULL DEFAULT '',
+  `created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  INDEX (`user_id`, `created_at`),
+  INDEX (`user_id`, `sort_grade`),
+  INDEX (`user_id`, `sort_hp`),
+  INDEX (`user_id`, `sort_name`),
+  INDEX (`gacha_draw_id`),
+  INDEX (`gacha_character_id`),
+  INDEX (`created_at`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_pity_counts`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_pity_counts`(
+  `user_id` VARCHAR(36) NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `count` INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`user_id`, `gacha_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_seeds`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_seeds`(
+  `seed_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `server_seed` CHAR(64) NOT NULL,
+  `server_seed_hash` CHAR(64) NOT NULL,
+  `nonce` INT NOT NULL DEFAULT 0,
+  `created_at` DATETIME NOT NULL,
+  `revealed_at` DATETIME NULL DEFAULT NULL,
+  INDEX (`user_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_draw_proofs`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_draw_proofs`(
+  `proof_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `seed_id` CHAR(36) NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `client_seed` VARCHAR(64) NOT NULL,
+  `nonce` INT NOT NULL,
+  `times` INT NOT NULL,
+  `pity_count` INT NOT NULL,
+  `step` INT NOT NULL DEFAULT 0,
+  `table_hash` CHAR(64) NOT NULL,
+  `result_hash` CHAR(64) NOT NULL,
+  `created_at` DATETIME NOT NULL
+);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_table_snapshots`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_table_snapshots`(
+  `snapshot_hash` CHAR(64) PRIMARY KEY NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `snapshot` MEDIUMTEXT NOT NULL,
+  `created_at` DATETIME NOT NULL
+);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_draws`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_draws`(
+  `draw_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `times` INT NOT NULL,
+  `cost` INT NOT NULL,
+  `payment` VARCHAR(16) NOT NULL DEFAULT 'gmtoken',
+  `status` VARCHAR(16) NOT NULL,
+  `burn_tx_hash` VARCHAR(66) NOT NULL DEFAULT '',
+  `shards` INT NOT NULL DEFAULT 0,
+  `refund` INT NOT NULL DEFAULT 0,
+  `refund_tx_hash` VARCHAR(66) NOT NULL DEFAULT '',
+  `proof_id` VARCHAR(36) NOT NULL DEFAULT '',
+  `job_id` VARCHAR(36) NOT NULL DEFAULT '',
+  `error` TEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `updated_at` DATETIME NOT NULL,
+  INDEX (`user_id`, `created_at`),
+  INDEX (`gacha_id`, `created_at`),
+  INDEX (`job_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_draw_characters`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_draw_characters`(
+  `gacha_draw_id` CHAR(36) NOT NULL,
+  `gacha_character_id` VARCHAR(36) NOT NULL,
+  `rarity_id` INT NOT NULL,
+  `count` INT NOT NULL,
+  `converted` INT NOT NULL DEFAULT 0,
+  `boosted` INT NOT NULL DEFAULT 0,
+  `is_new` BOOLEAN NOT NULL DEFAULT false,
+  PRIMARY KEY (`gacha_draw_id`, `gacha_character_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_draw_jobs`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_draw_jobs`(
+  `job_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `times` INT NOT NULL,
+  `request` TEXT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `phase` VARCHAR(16) NOT NULL DEFAULT '',
+  `done` INT NOT NULL DEFAULT 0,
+  `total` INT NOT NULL DEFAULT 0,
+  `error` TEXT NOT NULL,
+  `draw_id` VARCHAR(36) NOT NULL DEFAULT '',
+  `created_at` DATETIME NOT NULL,
+  `updated_at` DATETIME NOT NULL,
+  `finished_at` DATETIME NULL,
+  INDEX (`status`, `created_at`),
+  INDEX (`finished_at`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_boxes`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_boxes`(
+  `user_id` VARCHAR(36) NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `round` INT NOT NULL DEFAULT 1,
+  PRIMARY KEY (`user_id`, `gacha_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_box_items`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_box_items`(
+  `user_id` VARCHAR(36) NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `gacha_character_id` CHAR(36) NOT NULL,
+  `remaining` INT NOT NULL,
+  PRIMARY KEY (`user_id`, `gacha_id`, `gacha_character_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`user_gacha_steps`;
+CREATE TABLE IF NOT EXISTS `game_user`.`user_gacha_steps`(
+  `user_id` VARCHAR(36) NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `step` INT NOT NULL DEFAULT 1,
+  PRIMARY KEY (`user_id`, `gacha_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`user_tickets`;
+CREATE TABLE IF NOT EXISTS `game_user`.`user_tickets`(
+  `user_id` VARCHAR(36) NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `count` INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`user_id`, `gacha_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`ticket_ledgers`;
+CREATE TABLE IF NOT EXISTS `game_user`.`ticket_ledgers`(
+  `ledger_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `amount` INT NOT NULL,
+  `balance` INT NOT NULL,
+  `reason` VARCHAR(16) NOT NULL,
+  `draw_id` VARCHAR(36) NOT NULL DEFAULT '',
+  `tx_hash` VARCHAR(66) NOT NULL DEFAULT '',
+  `created_at` DATETIME NOT NULL,
+  INDEX (`user_id`, `created_at`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`catalog_versions`;
+CREATE TABLE IF NOT EXISTS `game_user`.`catalog_versions`(
+  `version_id` INT PRIMARY KEY AUTO_INCREMENT NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `description` VARCHAR(255) NOT NULL,
+  `snapshot` LONGTEXT NOT NULL,
+  `created_at` DATETIME NOT NULL
+);
+
+DROP TABLE IF EXISTS `game_user`.`gacha_audit_reports`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gacha_audit_reports`(
+  `report_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `gacha_id` INT NOT NULL,
+  `period_start` DATETIME NOT NULL,
+  `period_end` DATETIME NOT NULL,
+  `pulls` INT NOT NULL,
+  `boosted_pulls` INT NOT NULL,
+  `excluded_pulls` INT NOT NULL,
+  `chi_squared` DOUBLE NOT NULL,
+  `degrees_of_freedom` INT NOT NULL,
+  `p_value` DOUBLE NOT NULL,
+  `alpha` DOUBLE NOT NULL,
+  `alert` BOOLEAN NOT NULL,
+  `details` TEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  INDEX (`gacha_id`, `created_at`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`user_character_shards`;
+CREATE TABLE IF NOT EXISTS `game_user`.`user_character_shards`(
+  `user_id` VARCHAR(36) NOT NULL,
+  `character_id` INT NOT NULL,
+  `count` INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`user_id`, `character_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`duplicate_conversions`;
+CREATE TABLE IF NOT EXISTS `game_user`.`duplicate_conversions`(
+  `conversion_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `gacha_draw_id` VARCHAR(36) NOT NULL DEFAULT '',
+  `gacha_character_id` VARCHAR(36) NOT NULL,
+  `character_id` INT NOT NULL,
+  `policy` VARCHAR(16) NOT NULL,
+  `count` INT NOT NULL,
+  `shards` INT NOT NULL DEFAULT 0,
+  `refund` INT NOT NULL DEFAULT 0,
+  `tx_hash` VARCHAR(66) NOT NULL DEFAULT '',
+  `transfer_id` VARCHAR(36) NOT NULL DEFAULT '',
+  `created_at` DATETIME NOT NULL,
+  INDEX (`user_id`, `created_at`),
+  INDEX (`gacha_draw_id`),
+  INDEX (`transfer_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`character_histories`;
+CREATE TABLE IF NOT EXISTS `game_user`.`character_histories`(
+  `history_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `user_character_id` VARCHAR(36) NOT NULL,
+  `action` VARCHAR(16) NOT NULL,
+  `level_before` INT NOT NULL,
+  `level_after` INT NOT NULL,
+  `limit_break_before` INT NOT NULL,
+  `limit_break_after` INT NOT NULL,
+  `exp_gained` INT NOT NULL DEFAULT 0,
+  `materials` TEXT NOT NULL,
+  `gmtoken` INT NOT NULL DEFAULT 0,
+  `tx_hash` VARCHAR(66) NOT NULL DEFAULT '',
+  `transfer_id` VARCHAR(36) NOT NULL DEFAULT '',
+  `created_at` DATETIME NOT NULL,
+  INDEX (`user_id`, `user_character_id`, `created_at`),
+  INDEX (`transfer_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`gmtoken_transfers`;
+CREATE TABLE IF NOT EXISTS `game_user`.`gmtoken_transfers`(
+  `transfer_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `kind` VARCHAR(8) NOT NULL,
+  `amount` INT NOT NULL,
+  `reason` VARCHAR(16) NOT NULL,
+  `ref_id` VARCHAR(36) NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `tx_hash` VARCHAR(66) NOT NULL DEFAULT '',
+  `attempts` INT NOT NULL DEFAULT 0,
+  `error` TEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `updated_at` DATETIME NOT NULL,
+  INDEX (`status`, `updated_at`),
+  INDEX (`user_id`, `created_at`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`teams`;
+CREATE TABLE IF NOT EXISTS `game_user`.`teams`(
+  `user_id` VARCHAR(36) NOT NULL,
+  `team_no` INT NOT NULL,
+  `team_name` VARCHAR(32) NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `updated_at` DATETIME NOT NULL,
+  PRIMARY KEY (`user_id`, `team_no`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`team_members`;
+CREATE TABLE IF NOT EXISTS `game_user`.`team_members`(
+  `user_id` VARCHAR(36) NOT NULL,
+  `team_no` INT NOT NULL,
+  `slot` INT NOT NULL,
+  `user_character_id` VARCHAR(36) NOT NULL,
+  PRIMARY KEY (`user_id`, `team_no`, `slot`),
+  INDEX (`user_id`, `user_character_id`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`stages`;
+CREATE TABLE IF NOT EXISTS `game_user`.`stages`(
+  `id` INT PRIMARY KEY AUTO_INCREMENT NOT NULL,
+  `stage_name` VARCHAR(32) NOT NULL,
+  `max_turns` INT NOT NULL DEFAULT 20,
+  `reward_exp` INT NOT NULL DEFAULT 0,
+  `reward_tickets` INT NOT NULL DEFAULT 0,
+  `reward_ticket_gacha_id` INT NOT NULL DEFAULT 0,
+  `reward_gmtoken` INT NOT NULL DEFAULT 0,
+  `retired` BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+INSERT INTO stages(stage_name, max_turns, reward_exp, reward_tickets, reward_gmtoken) VALUES ('Moon', 20, 100, 0, 1);
+INSERT INTO stages(stage_name, max_turns, reward_exp, reward_tickets, reward_gmtoken) VALUES ('Asteroid Belt', 20, 300, 1, 2);
+INSERT INTO stages(stage_name, max_turns, reward_exp, reward_tickets, reward_gmtoken) VALUES ('Black Hole', 30, 1000, 3, 5);
+
+DROP TABLE IF EXISTS `game_user`.`stage_enemies`;
+CREATE TABLE IF NOT EXISTS `game_user`.`stage_enemies`(
+  `stage_id` INT NOT NULL,
+  `slot` INT NOT NULL,
+  `enemy_name` VARCHAR(32) NOT NULL,
+  `HP` INT NOT NULL,
+  `attack` INT NOT NULL,
+  PRIMARY KEY (`stage_id`, `slot`)
+);
+
+INSERT INTO stage_enemies(stage_id, slot, enemy_name, HP, attack) VALUES (1, 1, 'Slime', 800, 60);
+INSERT INTO stage_enemies(stage_id, slot, enemy_name, HP, attack) VALUES (1, 2, 'Slime', 800, 60);
+INSERT INTO stage_enemies(stage_id, slot, enemy_name, HP, attack) VALUES (2, 1, 'Goblin', 1500, 120);
+INSERT INTO stage_enemies(stage_id, slot, enemy_name, HP, attack) VALUES (2, 2, 'Goblin', 1500, 120);
+INSERT INTO stage_enemies(stage_id, slot, enemy_name, HP, attack) VALUES (2, 3, 'Rock Golem', 3000, 150);
+INSERT INTO stage_enemies(stage_id, slot, enemy_name, HP, attack) VALUES (3, 1, 'Void Knight', 4000, 300);
+INSERT INTO stage_enemies(stage_id, slot, enemy_name, HP, attack) VALUES (3, 2, 'Void Knight', 4000, 300);
+INSERT INTO stage_enemies(stage_id, slot, enemy_name, HP, attack) VALUES (3, 3, 'Singularity', 9000, 450);
+
+DROP TABLE IF EXISTS `game_user`.`battles`;
+CREATE TABLE IF NOT EXISTS `game_user`.`battles`(
+  `battle_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `stage_id` INT NOT NULL,
+  `team_no` INT NOT NULL,
+  `seed` BIGINT NOT NULL,
+  `power` INT NOT NULL,
+  `result` VARCHAR(16) NOT NULL,
+  `turns` INT NOT NULL,
+  `reward_exp` INT NOT NULL DEFAULT 0,
+  `reward_tickets` INT NOT NULL DEFAULT 0,
+  `reward_gmtoken` INT NOT NULL DEFAULT 0,
+  `mint_tx_hash` VARCHAR(66) NOT NULL DEFAULT '',
+  `units` TEXT NOT NULL,
+  `log` MEDIUMTEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  INDEX (`user_id`, `created_at`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`arena_seasons`;
+CREATE TABLE IF NOT EXISTS `game_user`.`arena_seasons`(
+  `id` INT PRIMARY KEY AUTO_INCREMENT NOT NULL,
+  `season_name` VARCHAR(32) NOT NULL,
+  `start_at` DATETIME NOT NULL,
+  `end_at` DATETIME NOT NULL,
+  `paid_out` BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+INSERT INTO arena_seasons(season_name, start_at, end_at) VALUES ('Season 1', '2021-09-01 00:00:00', '2021-10-01 00:00:00');
+
+DROP TABLE IF EXISTS `game_user`.`arena_season_rewards`;
+CREATE TABLE IF NOT EXISTS `game_user`.`arena_season_rewards`(
+  `season_id` INT NOT NULL,
+  `max_rank` INT NOT NULL,
+  `gmtoken` INT NOT NULL,
+  PRIMARY KEY (`season_id`, `max_rank`)
+);
+
+INSERT INTO arena_season_rewards(season_id, max_rank, gmtoken) VALUES (1, 1, 100);
+INSERT INTO arena_season_rewards(season_id, max_rank, gmtoken) VALUES (1, 10, 30);
+INSERT INTO arena_season_rewards(season_id, max_rank, gmtoken) VALUES (1, 100, 5);
+
+DROP TABLE IF EXISTS `game_user`.`arena_players`;
+CREATE TABLE IF NOT EXISTS `game_user`.`arena_players`(
+  `season_id` INT NOT NULL,
+  `user_id` VARCHAR(36) NOT NULL,
+  `rating` INT NOT NULL DEFAULT 1500,
+  `wins` INT NOT NULL DEFAULT 0,
+  `losses` INT NOT NULL DEFAULT 0,
+  `defense_team_no` INT NOT NULL,
+  `reward_gmtoken` INT NOT NULL DEFAULT 0,
+  `reward_tx_hash` VARCHAR(66) NOT NULL DEFAULT '',
+  `updated_at` DATETIME NOT NULL,
+  PRIMARY KEY (`season_id`, `user_id`),
+  INDEX (`season_id`, `rating`)
+);
+
+DROP TABLE IF EXISTS `game_user`.`arena_matches`;
+CREATE TABLE IF NOT EXISTS `game_user`.`arena_matches`(
+  `match_id` CHAR(36) PRIMARY KEY NOT NULL,
+  `season_id` INT NOT NULL,
+  `attacker_id` VARCHAR(36) NOT NULL,
+  `defender_id` VARCHAR(36) NOT NULL,
+  `attacker_team_no` INT NOT NULL,
+  `defender_team_no` INT NOT NULL,
+  `attacker_power` INT NOT NULL,
+  `defender_power` INT NOT NULL,
+  `attacker_rating` INT NOT NULL,
+  `defender_rating` INT NOT NULL,
+  `rating_change` INT NOT NULL,
+  `seed` BIGINT NOT NULL,
+  `result` VARCHAR(16) NOT NULL,
+  `turns` INT NOT NULL,
+  `units` TEXT NOT NULL,
+  `log` MEDIUMTEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  INDEX (`season_id`, `attacker_id`, `created_at`),
+  INDEX (`season_id`, `defender_id`, `created_at`)
+);